@@ -1,6 +1,6 @@
 import * as React from "react";
 import {useEffect, useState} from "react";
-import {postAPI} from "../../utils/api.ts";
+import {API_BASE_URL, getAPI, postAPI} from "../../utils/api.ts";
 import type {UserAuthRequest} from "../../types";
 import {enqueueSnackbar} from "notistack";
 import {Alert, Box, Button, CircularProgress, Grid, TextField, Typography} from "@mui/material";
@@ -15,7 +15,8 @@ export default function Login() {
     });
     const [error, setError] = useState("");
     const [loading, setLoading] = useState(false);
-    const {setUserID, logout, isAuthenticated} = useAuthContext();
+    const [providers, setProviders] = useState<{ name: string, display_name: string }[]>([]);
+    const {setSession, logout, isAuthenticated} = useAuthContext();
     const navigate = useNavigate();
 
     useEffect(() => {
@@ -24,6 +25,12 @@ export default function Login() {
         }
     }, [isAuthenticated, navigate]);
 
+    useEffect(() => {
+        getAPI("/auth.oidc.providers")
+            .then((resp) => setProviders(resp.providers || []))
+            .catch(() => setProviders([]));
+    }, []);
+
     const handleChange = (e: React.ChangeEvent<HTMLInputElement>) => {
         setFormData({
             ...formData,
@@ -47,12 +54,18 @@ export default function Login() {
         setLoading(true);
         setError("");
 
-        const resp = await postAPI("/user.login", payload);
+        let resp = await postAPI("/user.login", payload);
+        if (resp.mfa_required) {
+            const code = window.prompt("Enter the code from your authenticator app, or a recovery code");
+            resp = code
+                ? await postAPI("/user.login.mfa", {mfa_token: resp.mfa_token, code: code.trim()})
+                : {error: "Two-factor code is required"};
+        }
         if (resp.error && resp.error !== "") {
             logout();
             enqueueSnackbar(resp.error, {variant: "error"});
         } else {
-            setUserID(resp.user.id.toString());
+            setSession(resp.user.id.toString(), resp.token);
             enqueueSnackbar("Login successful", {variant: "success"});
             navigate("/chat");
         }
@@ -114,6 +127,16 @@ export default function Login() {
                 >
                     {loading ? <CircularProgress/> : "Login"}
                 </Button>
+                {providers.map((provider) => (
+                    <Button
+                        key={provider.name}
+                        variant="outlined"
+                        href={`${API_BASE_URL}/auth.oidc.start?provider=${encodeURIComponent(provider.name)}`}
+                        sx={{width: '100%'}}
+                    >
+                        {`Sign in with ${provider.display_name}`}
+                    </Button>
+                ))}
                 <Link to="/register" style={{paddingTop: 2}}>
                     {"New user? Go to Register"}
                 </Link>
@@ -0,0 +1,66 @@
+import {useEffect, useRef} from "react";
+import {enqueueSnackbar} from "notistack";
+import {CircularProgress, Grid} from "@mui/material";
+import {useNavigate} from "react-router-dom";
+import {postAPI} from "../../utils/api.ts";
+import {useAuthContext} from "../../contexts/AuthContext.tsx";
+
+// LoginCallback finishes a single sign-on login or account link. The server
+// redirects here with the outcome in the URL fragment.
+export default function LoginCallback() {
+    const {setSession, logout} = useAuthContext();
+    const navigate = useNavigate();
+    const handled = useRef(false);
+
+    useEffect(() => {
+        if (handled.current) {
+            return;
+        }
+        handled.current = true;
+
+        const params = new URLSearchParams(window.location.hash.slice(1));
+        window.history.replaceState(null, "", window.location.pathname);
+
+        const finish = async () => {
+            // A signed-in user linked a provider account; they stay signed in
+            const linked = params.get("linked");
+            if (linked) {
+                enqueueSnackbar(`Linked sign-in with ${linked}`, {variant: "success"});
+                navigate("/chat", {replace: true});
+                return;
+            }
+
+            let userID = params.get("user_id");
+            let token = params.get("token");
+            let error = params.get("error");
+
+            const mfaToken = params.get("mfa_token");
+            if (mfaToken) {
+                const code = window.prompt("Enter the code from your authenticator app, or a recovery code");
+                const resp = code
+                    ? await postAPI("/user.login.mfa", {mfa_token: mfaToken, code: code.trim()})
+                    : {error: "Two-factor code is required"};
+                error = resp.error || null;
+                userID = resp.user ? resp.user.id.toString() : null;
+                token = resp.token || null;
+            }
+
+            if (error || !userID || !token) {
+                logout();
+                enqueueSnackbar(error || "Sign-in failed", {variant: "error"});
+                navigate("/login", {replace: true});
+                return;
+            }
+            setSession(userID, token);
+            enqueueSnackbar("Login successful", {variant: "success"});
+            navigate("/chat", {replace: true});
+        };
+        finish();
+    }, [setSession, logout, navigate]);
+
+    return (
+        <Grid display="flex" justifyContent="center" sx={{minHeight: '100vh', pt: 8}}>
+            <CircularProgress/>
+        </Grid>
+    );
+}
@@ -15,7 +15,7 @@ export default function Register() {
     });
     const [error, setError] = useState("");
     const [loading, setLoading] = useState(false);
-    const {setUserID, logout, isAuthenticated} = useAuthContext();
+    const {setSession, logout, isAuthenticated} = useAuthContext();
     const navigate = useNavigate();
 
     useEffect(() => {
@@ -47,12 +47,21 @@ export default function Register() {
         setLoading(true);
         setError("");
 
-        const resp = await postAPI("/user.register", payload);
+        let resp = await postAPI("/user.register", payload);
+        if (!resp.error) {
+            // Registering does not open a session, so sign in with the new account
+            resp = await postAPI("/user.login", {username: payload.username, password: payload.password});
+        }
         if (resp.error && resp.error !== "") {
             logout();
+            const fields: Record<string, string> = resp.fields ?? {};
+            const details = Object.entries(fields).map(([field, message]) => `${field} ${message}`);
+            if (details.length > 0) {
+                setError(details.join("; "));
+            }
             enqueueSnackbar(resp.error, {variant: "error"});
         } else {
-            setUserID(resp.user.id.toString());
+            setSession(resp.user.id.toString(), resp.token);
             enqueueSnackbar("User created successfully", {variant: "success"});
             navigate("/chat");
         }
@@ -4,7 +4,7 @@ import React, {useEffect, useState} from 'react';
 import {Avatar, Box, IconButton, Menu, MenuItem, Typography} from '@mui/material';
 import {useNavigate} from 'react-router-dom';
 import {useAuthContext} from '../../contexts/AuthContext';
-import {getAPI} from '../../utils/api';
+import {API_BASE_URL, getAPI} from '../../utils/api';
 import {enqueueSnackbar} from 'notistack';
 import type {User} from '../../types';
 import {getAvatarColor} from '../../utils/utils';
@@ -21,7 +21,7 @@ const UserAvatar: React.FC = () => {
             if (!userID) return;
 
             try {
-                const response = await getAPI(`/user.get.me?user_id=${userID}`);
+                const response = await getAPI('/user.get.me');
                 if (response.error) {
                     enqueueSnackbar(response.error, {variant: "error"});
                 } else {
@@ -53,17 +53,22 @@ const UserAvatar: React.FC = () => {
         return null;
     }
 
+    const displayName = currentUser.display_name || currentUser.username;
+    const avatarSrc = currentUser.avatar_url ? `${API_BASE_URL}${currentUser.avatar_url}` : undefined;
+
     return (
         <>
             <IconButton onClick={handleAvatarClick} size="small">
                 <Avatar
+                    src={avatarSrc}
+                    alt={displayName}
                     sx={{
                         bgcolor: getAvatarColor(currentUser.username),
                         width: 40,
                         height: 40
                     }}
                 >
-                    {currentUser.username.charAt(0).toUpperCase()}
+                    {displayName.charAt(0).toUpperCase()}
                 </Avatar>
             </IconButton>
             <Menu
@@ -83,17 +88,26 @@ const UserAvatar: React.FC = () => {
                 <Box sx={{px: 2, py: 1, borderBottom: 1, borderColor: 'divider'}}>
                     <Box sx={{display: 'flex', alignItems: 'center', gap: 1}}>
                         <Avatar
+                            src={avatarSrc}
+                            alt={displayName}
                             sx={{
                                 bgcolor: getAvatarColor(currentUser.username),
                                 width: 32,
                                 height: 32
                             }}
                         >
-                            {currentUser.username.charAt(0).toUpperCase()}
+                            {displayName.charAt(0).toUpperCase()}
                         </Avatar>
-                        <Typography variant="body1" fontWeight="medium">
-                            {currentUser.username}
-                        </Typography>
+                        <Box>
+                            <Typography variant="body1" fontWeight="medium">
+                                {displayName}
+                            </Typography>
+                            {currentUser.status_text && (
+                                <Typography variant="body2" color="text.secondary">
+                                    {currentUser.status_text}
+                                </Typography>
+                            )}
+                        </Box>
                     </Box>
                 </Box>
                 <MenuItem onClick={handleSignOut}>
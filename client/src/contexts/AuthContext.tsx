@@ -4,7 +4,7 @@ import { useAuth } from '../hooks/useAuth';
 import type { AuthState } from '../hooks/useAuth';
 
 interface AuthContextType extends AuthState {
-    setUserID: (userID: string) => void;
+    setSession: (userID: string, token: string) => void;
     logout: () => void;
 }
 
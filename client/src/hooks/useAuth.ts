@@ -1,8 +1,10 @@
 import { useState, useEffect } from 'react';
-import { getUserID } from '../utils/utils';
+import { getSessionToken, getUserID } from '../utils/utils';
+import { postAPI } from '../utils/api';
 
 export interface AuthState {
     userID: string | null;
+    token: string | null;
     isAuthenticated: boolean;
     isLoading: boolean;
 }
@@ -10,17 +12,20 @@ export interface AuthState {
 export const useAuth = () => {
     const [authState, setAuthState] = useState<AuthState>({
         userID: null,
+        token: null,
         isAuthenticated: false,
         isLoading: true,
     });
 
     useEffect(() => {
-        // Automatically get userID on component mount
+        // Automatically get the stored session on component mount
         const initializeAuth = () => {
             const userID = getUserID();
+            const token = getSessionToken();
             setAuthState({
-                userID,
-                isAuthenticated: !!userID,
+                userID: token ? userID : null,
+                token,
+                isAuthenticated: !!userID && !!token,
                 isLoading: false,
             });
         };
@@ -28,19 +33,27 @@ export const useAuth = () => {
         initializeAuth();
     }, []);
 
-    const setUserID = (userID: string) => {
+    const setSession = (userID: string, token: string) => {
         localStorage.setItem('userID', userID);
+        localStorage.setItem('sessionToken', token);
         setAuthState({
             userID,
+            token,
             isAuthenticated: true,
             isLoading: false,
         });
     };
 
     const logout = () => {
+        if (getSessionToken()) {
+            // Revoke the session server-side; the local copy goes either way
+            postAPI('/user.logout', {}).catch(() => undefined);
+        }
         localStorage.removeItem('userID');
+        localStorage.removeItem('sessionToken');
         setAuthState({
             userID: null,
+            token: null,
             isAuthenticated: false,
             isLoading: false,
         });
@@ -48,7 +61,7 @@ export const useAuth = () => {
 
     return {
         ...authState,
-        setUserID,
+        setSession,
         logout,
     };
 };
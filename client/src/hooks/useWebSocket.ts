@@ -1,18 +1,21 @@
 import {useCallback, useEffect, useRef, useState} from "react";
 import {useAuthContext} from "../contexts/AuthContext";
 import type {WSMessage, ConnectionState} from "../types";
+import {WS_BASE_URL} from "../utils/api";
 
 export const useWebSocket = () => {
-    const {userID} = useAuthContext();
+    const {userID, token} = useAuthContext();
     const [socket, setSocket] = useState<WebSocket | null>(null);
     const [messages, setMessages] = useState<WSMessage[]>([]);
     const [connectionState, setConnectionState] = useState<ConnectionState>("disconnected");
     const [error, setError] = useState<string | null>(null);
     const reconnectTimeoutRef = useRef<NodeJS.Timeout | null>(null);
+    // Set by a server_shutdown frame to the server's suggested delay
+    const reconnectDelayRef = useRef<number | null>(null);
     const socketRef = useRef<WebSocket | null>(null);
 
     const connectWebSocket = useCallback(() => {
-        if (!userID) {
+        if (!userID || !token) {
             return;
         }
 
@@ -30,7 +33,8 @@ export const useWebSocket = () => {
         setConnectionState("connecting");
         setError(null);
 
-        const newSocket = new WebSocket(`ws://localhost:8080/chat/ws?user_id=${userID}`);
+        // Browsers cannot set headers on a WebSocket, so the token goes in the query
+        const newSocket = new WebSocket(`${WS_BASE_URL}/chat/ws?access_token=${encodeURIComponent(token)}`);
         socketRef.current = newSocket;
 
         newSocket.onopen = () => {
@@ -45,6 +49,13 @@ export const useWebSocket = () => {
                 const data = JSON.parse(event.data);
                 console.log("Received message:", data);
 
+                if (data.type === "server_shutdown") {
+                    // Spread reconnects out so a restarted server is not stampeded
+                    const seconds = data.retry_after || 3;
+                    reconnectDelayRef.current = (seconds + Math.random() * seconds) * 1000;
+                    return;
+                }
+
                 if (data.type === "error") {
                     setError(data.error || "Server error occurred");
                     return;
@@ -55,6 +66,7 @@ export const useWebSocket = () => {
                     const historyMessages = data.messages || [];
                     const formattedMessages = historyMessages.map((msg: any) => ({
                         type: "message_history",
+                        id: msg.id,
                         sender_id: msg.sender_id,
                         receiver_id: msg.receiver_id,
                         content: msg.content,
@@ -64,6 +76,9 @@ export const useWebSocket = () => {
                 } else if (data.type === "new_message") {
                     // Handle new real-time message (both received and sent messages)
                     setMessages((prevMessages) => [...prevMessages, data as WSMessage]);
+                } else if (data.type === "message_deleted") {
+                    // Removed by a moderator
+                    setMessages((prevMessages) => prevMessages.filter((msg) => msg.id !== data.id));
                 }
 
                 setError(null);
@@ -81,10 +96,12 @@ export const useWebSocket = () => {
 
             // Only attempt reconnection if it wasn't a normal closure and user is still logged in
             if (event.code !== 1000 && userID) {
-                console.log("Attempting to reconnect in 3 seconds...");
+                const delay = reconnectDelayRef.current ?? 3000;
+                reconnectDelayRef.current = null;
+                console.log(`Attempting to reconnect in ${Math.round(delay / 1000)} seconds...`);
                 reconnectTimeoutRef.current = setTimeout(() => {
                     connectWebSocket();
-                }, 3000);
+                }, delay);
             }
         };
 
@@ -94,7 +111,7 @@ export const useWebSocket = () => {
             setConnectionState("disconnected");
             setSocket(null);
         };
-    }, [userID]);
+    }, [userID, token]);
 
     useEffect(() => {
         connectWebSocket();
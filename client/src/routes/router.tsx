@@ -2,6 +2,7 @@ import type {RouteObject} from "react-router-dom";
 import {Navigate} from "react-router-dom";
 import Register from "../components/Auth/Register.tsx";
 import Login from "../components/Auth/Login.tsx";
+import LoginCallback from "../components/Auth/LoginCallback.tsx";
 import ChatPage from "../components/Chat";
 
 const routes: RouteObject[] = [
@@ -13,6 +14,10 @@ const routes: RouteObject[] = [
         path: "/login",
         element: <Login/>,
     },
+    {
+        path: "/login/callback",
+        element: <LoginCallback/>,
+    },
     {
         path: "/register",
         element: <Register/>,
@@ -14,15 +14,24 @@ export type Message = {
 export type User = {
     id: number;
     username: string;
+    display_name: string;
+    bio: string;
+    status_text: string;
+    status_expires_at: string | null;
+    timezone: string;
+    avatar_url?: string;
     created_at: string;
 }
 
 export type WSMessage = {
     type: string;
+    id?: number;
     sender_id?: number;
     receiver_id?: number;
     content?: string;
     error?: string;
+    code?: string;
+    retry_after?: number;
     created_at?: string;
 }
 
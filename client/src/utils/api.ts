@@ -1,12 +1,27 @@
 import axios from "axios";
+import {getSessionToken} from "./utils";
+
+// VITE_API_BASE_URL points the client at another server, e.g. https://chat.example.com
+export const API_BASE_URL = import.meta.env.VITE_API_BASE_URL ?? 'http://localhost:8080';
+
+// WS_BASE_URL follows the API's scheme, so an HTTPS server is reached over WSS
+export const WS_BASE_URL = API_BASE_URL.replace(/^http/, 'ws');
 
 const api = axios.create({
-    baseURL: 'http://localhost:8080',
+    baseURL: API_BASE_URL,
     headers: {
         'Content-Type': 'application/json',
     },
 });
 
+// Every request carries the session token; the server identifies the caller from it
+api.interceptors.request.use((config) => {
+    const token = getSessionToken();
+    if (token) {
+        config.headers.Authorization = `Bearer ${token}`;
+    }
+    return config;
+});
 
 export const postAPI = async (url: string, payload: any) => {
     try {
@@ -2,6 +2,11 @@ export const getUserID = () => {
     return localStorage.getItem("userID");
 }
 
+// getSessionToken returns the bearer token from the last login
+export const getSessionToken = () => {
+    return localStorage.getItem("sessionToken");
+}
+
 export const getAvatarColor = (username: string) => {
     const colors = [
         '#7C4DFF', // Light Blue
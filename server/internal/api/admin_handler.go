@@ -0,0 +1,253 @@
+package api
+
+import (
+	"chat/internal/rbac"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type AdminUserRequest struct {
+	UserID int    `json:"user_id"`
+	Reason string `json:"reason,omitempty"` // Recorded in the audit trail
+}
+
+type AdminRoleRequest struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// AdminHandler serves account administration. Every action is recorded in
+// the audit trail with the acting administrator.
+type AdminHandler struct {
+	userStore store.UserStore
+	sessions  store.SessionStore
+	audit     store.AuditStore
+	hub       *WebSocketHandler
+	logger    *slog.Logger
+}
+
+func NewAdminHandler(userStore store.UserStore, sessions store.SessionStore, audit store.AuditStore, hub *WebSocketHandler, logger *slog.Logger) *AdminHandler {
+	return &AdminHandler{
+		userStore: userStore,
+		sessions:  sessions,
+		audit:     audit,
+		hub:       hub,
+		logger:    logger,
+	}
+}
+
+// ListUsers pages through every account, including hidden and disabled ones.
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, h.userStore, h.logger, rbac.PermManageUsers); !ok {
+		return
+	}
+
+	limit, err := intQueryParam(r, "limit", defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Limit must be between 1 and 100"})
+		return
+	}
+
+	query := r.URL.Query()
+	list := store.UserList{
+		Query:  query.Get("q"),
+		Role:   query.Get("role"),
+		Cursor: query.Get("cursor"),
+		Limit:  limit,
+	}
+	if list.Role != "" && !rbac.Valid(list.Role) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Role must be user, moderator or admin"})
+		return
+	}
+	if value := query.Get("disabled"); value != "" {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Disabled must be true or false"})
+			return
+		}
+		list.Disabled = &disabled
+	}
+
+	page, err := h.userStore.ListUsers(r.Context(), list)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidCursor) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid cursor"})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "listing users", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to list users"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": page.Users, "next_cursor": page.NextCursor})
+}
+
+// DisableUser blocks an account from signing in. Its sessions are revoked and
+// its live connections dropped at once.
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	actor, target, req, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.userStore.SetDisabled(r.Context(), target.ID, true)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "disabling user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to disable user"})
+		return
+	}
+
+	err = h.sessions.RevokeOtherSessions(r.Context(), target.ID, 0)
+	if err != nil {
+		// Sessions of disabled accounts are rejected anyway, so carry on
+		h.logger.ErrorContext(r.Context(), "revoking sessions", "error", err)
+	}
+	h.hub.DisconnectUser(target.ID, 0, "account disabled")
+
+	h.record(r, store.AuditUserDisabled, actor, target, map[string]any{"reason": req.Reason})
+	h.logger.InfoContext(r.Context(), "user disabled", "actor_id", actor.ID, "target_id", target.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User disabled"})
+}
+
+// EnableUser lets a disabled account sign in again.
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	actor, target, req, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.userStore.SetDisabled(r.Context(), target.ID, false)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "enabling user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to enable user"})
+		return
+	}
+
+	h.record(r, store.AuditUserEnabled, actor, target, map[string]any{"reason": req.Reason})
+	h.logger.InfoContext(r.Context(), "user enabled", "actor_id", actor.ID, "target_id", target.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User enabled"})
+}
+
+// DeleteUser removes an account and its conversations permanently.
+func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	actor, target, req, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.userStore.DeleteUser(r.Context(), target.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete user"})
+		return
+	}
+	h.hub.DisconnectUser(target.ID, 0, "account deleted")
+
+	// The target reference is cleared along with the account, so the
+	// details keep who it was
+	h.record(r, store.AuditUserDeleted, actor, nil, map[string]any{
+		"reason":   req.Reason,
+		"user_id":  target.ID,
+		"username": target.Username,
+	})
+	h.logger.InfoContext(r.Context(), "user deleted", "actor_id", actor.ID, "target_id", target.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User deleted"})
+}
+
+// SetRole grants a role to an account, replacing its current one.
+func (h *AdminHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, h.userStore, h.logger, rbac.PermManageRoles)
+	if !ok {
+		return
+	}
+
+	var req AdminRoleRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.UserID == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID is required"})
+		return
+	}
+	if !rbac.Valid(req.Role) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Role must be user, moderator or admin"})
+		return
+	}
+	if req.UserID == actor.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "You cannot change your own role"})
+		return
+	}
+
+	target, ok := h.getUser(r.Context(), w, req.UserID)
+	if !ok {
+		return
+	}
+
+	err = h.userStore.SetRole(r.Context(), target.ID, req.Role)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "setting role", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to change role"})
+		return
+	}
+
+	h.record(r, store.AuditRoleChanged, actor, target, map[string]any{"from": target.Role, "to": req.Role})
+	h.logger.InfoContext(r.Context(), "role changed", "target_id", target.ID, "actor_id", actor.ID, "from", target.Role, "to", req.Role)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Role changed", "role": req.Role})
+}
+
+// targetUser checks the caller may manage users and loads the account the
+// request names. Administrators cannot act on their own account, so nobody
+// locks themselves out by mistake.
+func (h *AdminHandler) targetUser(w http.ResponseWriter, r *http.Request) (actor, target *store.User, req AdminUserRequest, ok bool) {
+	actor, ok = requirePermission(w, r, h.userStore, h.logger, rbac.PermManageUsers)
+	if !ok {
+		return nil, nil, req, false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.UserID == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID is required"})
+		return nil, nil, req, false
+	}
+	if req.UserID == actor.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "You cannot do this to your own account"})
+		return nil, nil, req, false
+	}
+
+	target, ok = h.getUser(r.Context(), w, req.UserID)
+	return actor, target, req, ok
+}
+
+func (h *AdminHandler) getUser(ctx context.Context, w http.ResponseWriter, userID int) (*store.User, bool) {
+	user, err := h.userStore.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "User not found"})
+			return nil, false
+		}
+		h.logger.ErrorContext(ctx, "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return nil, false
+	}
+	return user, true
+}
+
+func (h *AdminHandler) record(r *http.Request, eventType string, actor, target *store.User, details map[string]any) {
+	event := &store.AuditEvent{
+		Type:      eventType,
+		ActorID:   &actor.ID,
+		IPAddress: clientIP(r),
+		Details:   details,
+	}
+	if target != nil {
+		event.TargetUserID = &target.ID
+	}
+	if err := h.audit.RecordEvent(r.Context(), event); err != nil {
+		h.logger.ErrorContext(r.Context(), "recording audit event", "error", err)
+	}
+}
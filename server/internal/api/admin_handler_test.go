@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"chat/internal/credentials"
+	"chat/internal/rbac"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	adminSession = &store.Session{ID: 7, UserID: 1}
+	testAdmin    = &store.User{ID: 1, Username: "root-admin", Role: rbac.RoleAdmin}
+)
+
+func newTestAdminHandler() (*AdminHandler, *MockUserStore, *MockSessionStore, *MockAuditStore) {
+	userStore := &MockUserStore{}
+	sessions := &MockSessionStore{}
+	audit := &MockAuditStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	hub := NewWebSocketHandler(&MockMessageStore{}, userStore, noRelations(), logger)
+	userStore.On("GetUserByID", 1).Return(testAdmin, nil).Maybe()
+	return NewAdminHandler(userStore, sessions, audit, hub, logger), userStore, sessions, audit
+}
+
+func TestRequirePermission(t *testing.T) {
+	userStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	disabledAt := "2024-01-01T00:00:00Z"
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Role: rbac.RoleAdmin}, nil)
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Role: rbac.RoleModerator}, nil)
+	userStore.On("GetUserByID", 3).Return(&store.User{ID: 3, Role: rbac.RoleAdmin, DisabledAt: &disabledAt}, nil)
+
+	tests := []struct {
+		name       string
+		session    *store.Session
+		perm       rbac.Permission
+		wantStatus int
+	}{
+		{name: "no session", perm: rbac.PermModerate, wantStatus: http.StatusUnauthorized},
+		{name: "admin manages users", session: &store.Session{UserID: 1}, perm: rbac.PermManageUsers, wantStatus: http.StatusOK},
+		{name: "moderator moderates", session: &store.Session{UserID: 2}, perm: rbac.PermModerate, wantStatus: http.StatusOK},
+		{name: "moderator cannot manage users", session: &store.Session{UserID: 2}, perm: rbac.PermManageUsers, wantStatus: http.StatusForbidden},
+		{name: "disabled admin", session: &store.Session{UserID: 3}, perm: rbac.PermModerate, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin.user.list", nil)
+			if tt.session != nil {
+				req = withSession(req, tt.session)
+			}
+			w := httptest.NewRecorder()
+
+			_, ok := requirePermission(w, req, userStore, logger, tt.perm)
+
+			assert.Equal(t, tt.wantStatus == http.StatusOK, ok)
+			if !ok {
+				assert.Equal(t, tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Require(t *testing.T) {
+	userStore := &MockUserStore{}
+	userStore.On("GetUserByID", 1).Return(testAdmin, nil).Once()
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Role: rbac.RoleUser}, nil)
+	auth := NewAuthenticator(&MockSessionStore{}, userStore, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+	handler := auth.Require(rbac.PermManageUsers)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers reuse the user the middleware loaded
+		_, ok := requirePermission(w, r, userStore, slog.New(slog.NewTextHandler(os.Stdout, nil)), rbac.PermManageUsers)
+		assert.True(t, ok)
+		assert.Equal(t, testAdmin, userFromContext(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodGet, "/admin.user.list", nil), adminSession))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodGet, "/admin.user.list", nil), &store.Session{ID: 8, UserID: 2}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	userStore.AssertExpectations(t)
+}
+
+func TestAdminHandler_DisableUser(t *testing.T) {
+	handler, userStore, sessions, audit := newTestAdminHandler()
+
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "mallory", Role: rbac.RoleUser}, nil)
+	userStore.On("SetDisabled", 2, true).Return(nil)
+	sessions.On("RevokeOtherSessions", 2, 0).Return(nil)
+	audit.On("RecordEvent", mock.MatchedBy(func(event *store.AuditEvent) bool {
+		return event.Type == store.AuditUserDisabled && *event.ActorID == 1 && *event.TargetUserID == 2 &&
+			event.Details["reason"] == "spam"
+	})).Return(nil)
+
+	stream := newQueuedClient("sse", 9)
+	handler.hub.register(context.Background(), 2, stream)
+
+	w := httptest.NewRecorder()
+	handler.DisableUser(w, withSession(postJSON("/admin.user.disable", AdminUserRequest{UserID: 2, Reason: "spam"}), adminSession))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	select {
+	case <-stream.done:
+	default:
+		t.Error("disabled user's connections should be dropped")
+	}
+	userStore.AssertExpectations(t)
+	sessions.AssertExpectations(t)
+	audit.AssertExpectations(t)
+}
+
+func TestAdminHandler_RejectsOwnAccountAndUnknownUser(t *testing.T) {
+	handler, userStore, _, _ := newTestAdminHandler()
+	userStore.On("GetUserByID", 404).Return(nil, sql.ErrNoRows)
+
+	w := httptest.NewRecorder()
+	handler.DisableUser(w, withSession(postJSON("/admin.user.disable", AdminUserRequest{UserID: 1}), adminSession))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.DeleteUser(w, withSession(postJSON("/admin.user.delete", AdminUserRequest{UserID: 404}), adminSession))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	userStore.AssertNotCalled(t, "SetDisabled", mock.Anything, mock.Anything)
+	userStore.AssertNotCalled(t, "DeleteUser", mock.Anything)
+}
+
+func TestAdminHandler_DeleteUser(t *testing.T) {
+	handler, userStore, _, audit := newTestAdminHandler()
+
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "mallory"}, nil)
+	userStore.On("DeleteUser", 2).Return(nil)
+	audit.On("RecordEvent", mock.MatchedBy(func(event *store.AuditEvent) bool {
+		return event.Type == store.AuditUserDeleted && event.TargetUserID == nil &&
+			event.Details["username"] == "mallory"
+	})).Return(nil)
+
+	w := httptest.NewRecorder()
+	handler.DeleteUser(w, withSession(postJSON("/admin.user.delete", AdminUserRequest{UserID: 2}), adminSession))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	userStore.AssertExpectations(t)
+	audit.AssertExpectations(t)
+}
+
+func TestAdminHandler_SetRole(t *testing.T) {
+	handler, userStore, _, audit := newTestAdminHandler()
+
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob", Role: rbac.RoleUser}, nil)
+	userStore.On("SetRole", 2, rbac.RoleModerator).Return(nil)
+	audit.On("RecordEvent", mock.MatchedBy(func(event *store.AuditEvent) bool {
+		return event.Type == store.AuditRoleChanged && event.Details["to"] == rbac.RoleModerator
+	})).Return(nil)
+
+	w := httptest.NewRecorder()
+	handler.SetRole(w, withSession(postJSON("/admin.user.role", AdminRoleRequest{UserID: 2, Role: "superuser"}), adminSession))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.SetRole(w, withSession(postJSON("/admin.user.role", AdminRoleRequest{UserID: 1, Role: rbac.RoleUser}), adminSession))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.SetRole(w, withSession(postJSON("/admin.user.role", AdminRoleRequest{UserID: 2, Role: rbac.RoleModerator}), adminSession))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	userStore.AssertExpectations(t)
+	audit.AssertExpectations(t)
+}
+
+func TestAdminHandler_ListUsers(t *testing.T) {
+	handler, userStore, _, _ := newTestAdminHandler()
+
+	disabled := true
+	userStore.On("ListUsers", store.UserList{Role: rbac.RoleUser, Disabled: &disabled, Limit: defaultSearchLimit}).
+		Return(&store.UserPage{Users: []*store.User{{ID: 2, Username: "mallory"}}, NextCursor: "next"}, nil)
+
+	w := httptest.NewRecorder()
+	handler.ListUsers(w, withSession(httptest.NewRequest(http.MethodGet, "/admin.user.list?role=user&disabled=true", nil), adminSession))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username": "mallory"`)
+	assert.Contains(t, w.Body.String(), `"next_cursor": "next"`)
+
+	w = httptest.NewRecorder()
+	handler.ListUsers(w, withSession(httptest.NewRequest(http.MethodGet, "/admin.user.list?disabled=maybe", nil), adminSession))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUserHandler_Login_RefusesDisabledAccount(t *testing.T) {
+	userStore := &MockUserStore{}
+	sessions := &MockSessionStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(userStore, sessions, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	disabledAt := "2024-01-01T00:00:00Z"
+	userStore.On("AuthenticateUser", "mallory", "correct-horse-42").
+		Return(&store.User{ID: 2, Username: "mallory", DisabledAt: &disabledAt}, nil)
+
+	w := httptest.NewRecorder()
+	handler.Login(w, loginRequest("mallory", "correct-horse-42", "203.0.113.7:5555"))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	sessions.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
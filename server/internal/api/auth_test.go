@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSessionStore implements the SessionStore interface for testing
+type MockSessionStore struct {
+	mock.Mock
+}
+
+func (m *MockSessionStore) CreateSession(_ context.Context, userID int, ttl time.Duration) (string, *store.Session, error) {
+	args := m.Called(userID, ttl)
+	if args.Get(1) == nil {
+		return args.String(0), nil, args.Error(2)
+	}
+	return args.String(0), args.Get(1).(*store.Session), args.Error(2)
+}
+
+func (m *MockSessionStore) GetSession(_ context.Context, token string) (*store.Session, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Session), args.Error(1)
+}
+
+func (m *MockSessionStore) RevokeSession(_ context.Context, sessionID int) error {
+	args := m.Called(sessionID)
+	return args.Error(0)
+}
+
+func (m *MockSessionStore) RevokeOtherSessions(_ context.Context, userID, keepSessionID int) error {
+	args := m.Called(userID, keepSessionID)
+	return args.Error(0)
+}
+
+func (m *MockSessionStore) CreatePasswordReset(_ context.Context, userID int, ttl time.Duration) (string, error) {
+	args := m.Called(userID, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockSessionStore) GetPasswordReset(_ context.Context, token string) (int, error) {
+	args := m.Called(token)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockSessionStore) ConsumePasswordReset(_ context.Context, token string) (int, error) {
+	args := m.Called(token)
+	return args.Int(0), args.Error(1)
+}
+
+// withSession returns r as the auth middleware would pass it on for session.
+func withSession(r *http.Request, session *store.Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey, session))
+}
+
+// asUser returns r as it would arrive with a session for userID.
+func asUser(r *http.Request, userID int) *http.Request {
+	return withSession(r, &store.Session{ID: 100 + userID, UserID: userID})
+}
+
+// withTestSessions puts next behind the auth middleware, accepting the
+// tokens "token-1" and "token-2" for users 1 and 2.
+func withTestSessions(next http.Handler) http.Handler {
+	sessions := &MockSessionStore{}
+	sessions.On("GetSession", "token-1").Return(&store.Session{ID: 101, UserID: 1}, nil).Maybe()
+	sessions.On("GetSession", "token-2").Return(&store.Session{ID: 102, UserID: 2}, nil).Maybe()
+	sessions.On("GetSession", mock.Anything).Return(nil, store.ErrInvalidToken).Maybe()
+
+	auth := NewAuthenticator(sessions, &MockUserStore{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	return auth.Middleware(next)
+}
+
+func TestAuthenticator_Middleware(t *testing.T) {
+	sessions := &MockSessionStore{}
+	sessions.On("GetSession", "good").Return(&store.Session{ID: 7, UserID: 1}, nil)
+	sessions.On("GetSession", "bad").Return(nil, store.ErrInvalidToken)
+	sessions.On("GetSession", "broken").Return(nil, errors.New("connection refused"))
+
+	auth := NewAuthenticator(sessions, &MockUserStore{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+	var seen *store.Session
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = sessionFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		header      string
+		query       string
+		cookie      string
+		wantStatus  int
+		wantSession bool
+	}{
+		{name: "no token passes through", wantStatus: http.StatusOK},
+		{name: "bearer header", header: "Bearer good", wantStatus: http.StatusOK, wantSession: true},
+		{name: "access_token parameter", query: "?access_token=good", wantStatus: http.StatusOK, wantSession: true},
+		{name: "session cookie", cookie: "good", wantStatus: http.StatusOK, wantSession: true},
+		{name: "session cookie ignored on POST", method: http.MethodPost, cookie: "good", wantStatus: http.StatusOK},
+		{name: "invalid token", header: "Bearer bad", wantStatus: http.StatusUnauthorized},
+		{name: "store failure", header: "Bearer broken", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = nil
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/user.get.me"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantSession {
+				if assert.NotNil(t, seen) {
+					assert.Equal(t, 1, seen.UserID)
+				}
+			} else {
+				assert.Nil(t, seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ClientError is a failure whose message is safe to show the caller as-is.
+// Status is the HTTP status REST endpoints answer with; WebSocket clients get
+// the message in an error frame. Code, when set, tells clients what kind of
+// failure it was without parsing the message.
+type ClientError struct {
+	Status  int
+	Message string
+	Code    string
+}
+
+func (e *ClientError) Error() string {
+	return e.Message
+}
+
+func clientError(status int, message string) *ClientError {
+	return &ClientError{Status: status, Message: message}
+}
+
+// clientErrorFrom unwraps a ClientError from err, falling back to a 500 with
+// fallback as the message so internal details never reach the caller.
+func clientErrorFrom(err error, fallback string) *ClientError {
+	var ce *ClientError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return clientError(http.StatusInternalServerError, fallback)
+}
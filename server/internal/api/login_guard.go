@@ -0,0 +1,111 @@
+package api
+
+import (
+	"chat/internal/lockout"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// usernameLockout slows down guessing against one account.
+	usernameLockout = lockout.Config{
+		FreeAttempts: 5,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		ResetAfter:   time.Hour,
+	}
+	// ipLockout slows down one address spraying many accounts. It allows
+	// more attempts, since several people can share an address.
+	ipLockout = lockout.Config{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		ResetAfter:   time.Hour,
+	}
+)
+
+// LoginGuard tracks failed logins per username and per client IP, imposing
+// exponential backoff on both and recording lockouts in the audit trail.
+type LoginGuard struct {
+	users  *lockout.Tracker
+	ips    *lockout.Tracker
+	audit  store.AuditStore
+	logger *slog.Logger
+}
+
+func NewLoginGuard(audit store.AuditStore, logger *slog.Logger) *LoginGuard {
+	return &LoginGuard{
+		users:  lockout.New(usernameLockout),
+		ips:    lockout.New(ipLockout),
+		audit:  audit,
+		logger: logger,
+	}
+}
+
+func usernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RetryAfter returns how long a login for username from ip must wait, or 0.
+func (g *LoginGuard) RetryAfter(username, ip string) time.Duration {
+	return max(g.users.RetryAfter(usernameKey(username)), g.ips.RetryAfter(ip))
+}
+
+// Failed records a failed login. Unknown usernames are tracked like real
+// ones, so lockouts do not reveal which accounts exist.
+func (g *LoginGuard) Failed(ctx context.Context, username, ip string) {
+	if delay, lockedOut := g.users.Fail(usernameKey(username)); lockedOut {
+		g.recordLockout(ctx, "username", username, ip, delay)
+	}
+	if delay, lockedOut := g.ips.Fail(ip); lockedOut {
+		g.recordLockout(ctx, "ip", username, ip, delay)
+	}
+}
+
+// Succeeded clears the username's failures. The IP's are kept, otherwise an
+// attacker could reset their counter by logging into an account of their own.
+func (g *LoginGuard) Succeeded(username string) {
+	g.users.Reset(usernameKey(username))
+}
+
+// writeLoginThrottled refuses a login attempt that must wait before retrying.
+func writeLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	seconds := retryAfterSeconds(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{
+		"error":       "Too many failed login attempts, try again later",
+		"retry_after": seconds,
+	})
+}
+
+func (g *LoginGuard) recordLockout(ctx context.Context, scope, username, ip string, duration time.Duration) {
+	g.logger.InfoContext(ctx, "login lockout", "scope", scope, "username", username, "ip", ip, "duration", duration)
+	err := g.audit.RecordEvent(ctx, &store.AuditEvent{
+		Type:      store.AuditLoginLockout,
+		IPAddress: ip,
+		Details: map[string]any{
+			"scope":    scope,
+			"username": username,
+			"duration": duration.String(),
+		},
+	})
+	if err != nil {
+		g.logger.ErrorContext(ctx, "recording audit event", "error", err)
+	}
+}
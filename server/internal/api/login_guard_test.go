@@ -0,0 +1,110 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/credentials"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MockAuditStore implements the AuditStore interface for testing
+type MockAuditStore struct {
+	mock.Mock
+}
+
+func (m *MockAuditStore) RecordEvent(_ context.Context, event *store.AuditEvent) error {
+	args := m.Called(event)
+	return args.Error(0)
+}
+
+func loginRequest(username, password, remoteAddr string) *http.Request {
+	jsonBody, _ := json.Marshal(UserRequest{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/user.login", bytes.NewBuffer(jsonBody))
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestUserHandler_Login_BacksOffAndLocksOut(t *testing.T) {
+	userStore := &MockUserStore{}
+	audit := &MockAuditStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(audit, logger)
+	guard.users.SetClock(func() time.Time { return now })
+	guard.ips.SetClock(func() time.Time { return now })
+	handler := NewUserHandler(userStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), guard, logger)
+
+	userStore.On("AuthenticateUser", "alice", "wrong").Return(nil, bcrypt.ErrMismatchedHashAndPassword)
+	audit.On("RecordEvent", mock.MatchedBy(func(e *store.AuditEvent) bool {
+		return e.Type == store.AuditLoginLockout && e.Details["scope"] == "username" && e.IPAddress == "203.0.113.7"
+	})).Return(nil).Once()
+
+	// Free attempts fail normally; after them every attempt must wait, and
+	// the wait doubles until the lockout cap
+	var waits []time.Duration
+	for attempt := 1; attempt <= 16; attempt++ {
+		w := httptest.NewRecorder()
+		handler.Login(w, loginRequest("alice", "wrong", "203.0.113.7:5555"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "attempt %d", attempt)
+
+		if wait := guard.RetryAfter("alice", "203.0.113.7"); wait > 0 {
+			w = httptest.NewRecorder()
+			handler.Login(w, loginRequest("Alice", "wrong", "198.51.100.1:5555"))
+			assert.Equal(t, http.StatusTooManyRequests, w.Code, "attempt %d", attempt)
+			assert.NotEmpty(t, w.Header().Get("Retry-After"))
+			waits = append(waits, wait)
+			now = now.Add(wait)
+		}
+	}
+
+	if assert.Len(t, waits, 16-usernameLockout.FreeAttempts) {
+		assert.Equal(t, time.Second, waits[0])
+		assert.Equal(t, 2*time.Second, waits[1])
+		assert.Equal(t, usernameLockout.MaxDelay, waits[len(waits)-1])
+	}
+	audit.AssertExpectations(t)
+}
+
+func TestUserHandler_Login_UnknownUsernamesAreThrottledToo(t *testing.T) {
+	userStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	guard := NewLoginGuard(&MockAuditStore{}, logger)
+	handler := NewUserHandler(userStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), guard, logger)
+
+	userStore.On("AuthenticateUser", "ghost", "guess").Return(nil, sql.ErrNoRows)
+
+	for i := 0; i <= usernameLockout.FreeAttempts; i++ {
+		handler.Login(httptest.NewRecorder(), loginRequest("ghost", "guess", "203.0.113.7:5555"))
+	}
+
+	w := httptest.NewRecorder()
+	handler.Login(w, loginRequest("ghost", "guess", "203.0.113.7:5555"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	// The throttled attempt never reached the store
+	userStore.AssertNumberOfCalls(t, "AuthenticateUser", usernameLockout.FreeAttempts+1)
+}
+
+func TestLoginGuard_SuccessKeepsIPFailures(t *testing.T) {
+	guard := NewLoginGuard(&MockAuditStore{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+	for i := 0; i <= ipLockout.FreeAttempts; i++ {
+		guard.Failed(context.Background(), "user"+string(rune('a'+i)), "203.0.113.7")
+	}
+	guard.Succeeded("mallory")
+
+	assert.Positive(t, guard.RetryAfter("mallory", "203.0.113.7"))
+	assert.Zero(t, guard.RetryAfter("mallory", "198.51.100.1"))
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"chat/internal/store"
+	"chat/internal/utils"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+type SendMessageRequest struct {
+	ReceiverID int    `json:"receiver_id"`
+	Content    string `json:"content"`
+}
+
+// MessageHandler exposes message operations over REST for bots, scripts and
+// tests that do not want to speak the WebSocket protocol. Sends go through
+// the WebSocketHandler so connected clients still receive them live.
+type MessageHandler struct {
+	messageStore store.MessageStore
+	userStore    store.UserStore
+	hub          *WebSocketHandler
+	logger       *slog.Logger
+}
+
+func NewMessageHandler(messageStore store.MessageStore, userStore store.UserStore, hub *WebSocketHandler, logger *slog.Logger) *MessageHandler {
+	return &MessageHandler{
+		messageStore: messageStore,
+		userStore:    userStore,
+		hub:          hub,
+		logger:       logger,
+	}
+}
+
+func (h *MessageHandler) Send(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	var req SendMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
+		return
+	}
+
+	message, err := h.hub.SendMessage(r.Context(), userID, req.ReceiverID, req.Content)
+	if err != nil {
+		ce := clientErrorFrom(err, "Failed to send message")
+		envelope := utils.Envelope{"error": ce.Message}
+		if ce.Code != "" {
+			envelope["code"] = ce.Code
+		}
+		utils.WriteJSON(w, ce.Status, envelope)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"message": message})
+}
+
+// History returns one page of the conversation with the `with` user, newest
+// page first. Pass the smallest id of a page as `before` to get the one
+// preceding it.
+func (h *MessageHandler) History(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	otherID, err := intQueryParam(r, "with", 0)
+	if err != nil || otherID == 0 {
+		h.logger.ErrorContext(r.Context(), "invalid with parameter", "with", r.URL.Query().Get("with"))
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "With user ID is required"})
+		return
+	}
+
+	beforeID, err := intQueryParam(r, "before", 0)
+	if err != nil || beforeID < 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid before cursor"})
+		return
+	}
+
+	limit, err := intQueryParam(r, "limit", defaultHistoryLimit)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Limit must be between 1 and 100"})
+		return
+	}
+
+	// Fetch one extra row to learn whether an older page exists
+	messages, err := h.messageStore.GetMessagesPage(r.Context(), userID, otherID, beforeID, limit+1)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting messages", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to get messages"})
+		return
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[1:]
+	}
+
+	var nextBefore any
+	if hasMore {
+		nextBefore = messages[0].ID
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"messages":    messages,
+		"has_more":    hasMore,
+		"next_before": nextBefore,
+	})
+}
+
+func (h *MessageHandler) ListConversations(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	conversations, err := h.messageStore.GetConversations(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting conversations", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to get conversations"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"conversations": conversations})
+}
+
+// MarkRead clears the unread count of the conversation with the `with` user.
+func (h *MessageHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	otherID, err := intQueryParam(r, "with", 0)
+	if err != nil || otherID == 0 {
+		h.logger.ErrorContext(r.Context(), "invalid with parameter", "with", r.URL.Query().Get("with"))
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "With user ID is required"})
+		return
+	}
+
+	updated, err := h.messageStore.MarkConversationRead(r.Context(), userID, otherID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "marking conversation read", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to mark conversation read"})
+		return
+	}
+
+	if updated > 0 {
+		h.hub.PublishConversation(r.Context(), userID, otherID)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"marked_read": updated})
+}
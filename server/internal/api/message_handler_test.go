@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"chat/internal/filter"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMessageHandler() (*MessageHandler, *MockMessageStore, *MockUserStore) {
+	userStore := &MockUserStore{}
+	messageStore := &MockMessageStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob"}, nil).Maybe()
+	userStore.On("GetUserByID", 99).Return(nil, errors.New("not found")).Maybe()
+
+	hub := NewWebSocketHandler(messageStore, userStore, noRelations(), logger)
+	return NewMessageHandler(messageStore, userStore, hub, logger), messageStore, userStore
+}
+
+func TestMessageHandler_Send_Success(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	messageStore.On("CreateMessage", 1, 2, "hello").Return(&store.Message{ID: 10, SenderID: 1, ReceiverID: 2, Content: "hello"}, nil)
+
+	body, _ := json.Marshal(SendMessageRequest{ReceiverID: 2, Content: "hello"})
+	req := asUser(httptest.NewRequest(http.MethodPost, "/message.send", bytes.NewBuffer(body)), 1)
+	w := httptest.NewRecorder()
+
+	handler.Send(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Message store.Message `json:"message"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 10, response.Message.ID)
+	assert.Equal(t, "hello", response.Message.Content)
+
+	messageStore.AssertExpectations(t)
+}
+
+func TestMessageHandler_Send_Filtered(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	keywords, err := filter.Keywords([]string{"darn"}, filter.KeywordMask)
+	require.NoError(t, err)
+	handler.hub.SetFilters(filter.Chain{filter.Normalize(), keywords, filter.Links(nil, []string{"evil.test"})})
+
+	// Rewritten content is what gets stored
+	messageStore.On("CreateMessage", 1, 2, "oh ****").Return(&store.Message{ID: 11, Content: "oh ****"}, nil)
+
+	body, _ := json.Marshal(SendMessageRequest{ReceiverID: 2, Content: " oh darn\u200b"})
+	w := httptest.NewRecorder()
+	handler.Send(w, asUser(httptest.NewRequest(http.MethodPost, "/message.send", bytes.NewBuffer(body)), 1))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	body, _ = json.Marshal(SendMessageRequest{ReceiverID: 2, Content: "log in at https://evil.test"})
+	w = httptest.NewRecorder()
+	handler.Send(w, asUser(httptest.NewRequest(http.MethodPost, "/message.send", bytes.NewBuffer(body)), 1))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, filter.CodeBlockedLink, response["code"])
+	assert.Equal(t, "Links to evil.test are not allowed", response["error"])
+
+	messageStore.AssertExpectations(t)
+	messageStore.AssertNumberOfCalls(t, "CreateMessage", 1)
+}
+
+func TestWebSocketHandler_RejectedMessageErrorFrame(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	handler.hub.SetFilters(filter.MaxLength(5))
+
+	sender := newQueuedClient("sse", 1)
+	handler.hub.register(context.Background(), 1, sender)
+
+	handler.hub.handleMessage(context.Background(), 1, sender, &WSMessage{Type: "send_message", ReceiverID: 2, Content: "far too long"})
+
+	frame := (<-sender.frames).(WSMessage)
+	assert.Equal(t, "error", frame.Type)
+	assert.Equal(t, filter.CodeTooLong, frame.Code)
+	assert.Equal(t, "Message must be at most 5 characters", frame.Error)
+	messageStore.AssertNotCalled(t, "CreateMessage", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestMessageHandler_Send_ValidationErrors(t *testing.T) {
+	handler, _, _ := newTestMessageHandler()
+
+	tests := []struct {
+		name     string
+		request  SendMessageRequest
+		status   int
+		expected string
+	}{
+		{"missing receiver", SendMessageRequest{Content: "hi"}, http.StatusBadRequest, "Receiver ID is required"},
+		{"missing content", SendMessageRequest{ReceiverID: 2}, http.StatusBadRequest, "Content is required"},
+		{"unknown receiver", SendMessageRequest{ReceiverID: 99, Content: "hi"}, http.StatusNotFound, "Receiver user not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := asUser(httptest.NewRequest(http.MethodPost, "/message.send", bytes.NewBuffer(body)), 1)
+			w := httptest.NewRecorder()
+
+			handler.Send(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			var response map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.expected, response["error"])
+		})
+	}
+}
+
+func TestMessageHandler_Send_StoreFailureIsNotLeaked(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	messageStore.On("CreateMessage", 1, 2, "hello").Return(nil, errors.New("pq: connection refused"))
+
+	body, _ := json.Marshal(SendMessageRequest{ReceiverID: 2, Content: "hello"})
+	req := asUser(httptest.NewRequest(http.MethodPost, "/message.send", bytes.NewBuffer(body)), 1)
+	w := httptest.NewRecorder()
+
+	handler.Send(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "pq:")
+}
+
+func TestMessageHandler_History_Pagination(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+
+	// limit=2 asks the store for 3 rows; getting 3 back means an older page exists
+	messageStore.On("GetMessagesPage", 1, 2, 0, 3).Return([]*store.Message{
+		{ID: 4, Content: "a"}, {ID: 5, Content: "b"}, {ID: 6, Content: "c"},
+	}, nil)
+
+	req := asUser(httptest.NewRequest(http.MethodGet, "/message.history?with=2&limit=2", nil), 1)
+	w := httptest.NewRecorder()
+
+	handler.History(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Messages   []store.Message `json:"messages"`
+		HasMore    bool            `json:"has_more"`
+		NextBefore *int            `json:"next_before"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Messages, 2)
+	assert.Equal(t, 5, response.Messages[0].ID)
+	assert.Equal(t, 6, response.Messages[1].ID)
+	assert.True(t, response.HasMore)
+	require.NotNil(t, response.NextBefore)
+	assert.Equal(t, 5, *response.NextBefore)
+}
+
+func TestMessageHandler_History_InvalidParams(t *testing.T) {
+	handler, _, _ := newTestMessageHandler()
+
+	for _, query := range []string{
+		"",
+		"with=2&limit=0",
+		"with=2&limit=1000",
+		"with=2&before=abc",
+	} {
+		req := asUser(httptest.NewRequest(http.MethodGet, "/message.history?"+query, nil), 1)
+		w := httptest.NewRecorder()
+
+		handler.History(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestMessageHandler_ListConversations(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	messageStore.On("GetConversations", 1).Return([]*store.Conversation{
+		{User: &store.User{ID: 2, Username: "bob"}, LastMessageID: 3, Preview: "latest", UnreadCount: 2},
+	}, nil)
+
+	req := asUser(httptest.NewRequest(http.MethodGet, "/conversation.list", nil), 1)
+	w := httptest.NewRecorder()
+
+	handler.ListConversations(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Conversations []store.Conversation `json:"conversations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Conversations, 1)
+	assert.Equal(t, 2, response.Conversations[0].UnreadCount)
+	assert.Equal(t, "latest", response.Conversations[0].Preview)
+	assert.Equal(t, "bob", response.Conversations[0].User.Username)
+}
+
+func TestMessageHandler_MarkRead(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	messageStore.On("MarkConversationRead", 1, 2).Return(3, nil)
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/conversation.read?with=2", nil), 1)
+	w := httptest.NewRecorder()
+
+	handler.MarkRead(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"marked_read": 3`)
+	messageStore.AssertExpectations(t)
+}
+
+func TestMessageHandler_RequiresSession(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/message.send?user_id=1", handler.Send},
+		{"/message.history?user_id=1&with=2", handler.History},
+		{"/conversation.list?user_id=1", handler.ListConversations},
+		{"/conversation.read?user_id=1&with=2", handler.MarkRead},
+	} {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(`{"receiver_id": 2, "content": "hi"}`)))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, tt.path)
+	}
+
+	assert.Empty(t, messageStore.Calls)
+}
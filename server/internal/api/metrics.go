@@ -0,0 +1,65 @@
+package api
+
+import (
+	"chat/internal/metrics"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// unmatchedRoute labels requests no route matched, so probes for random
+// paths do not each create a series.
+const unmatchedRoute = "unmatched"
+
+// HTTPMetrics is chi middleware recording each request's route pattern,
+// method, status and duration. It should run before middleware that can
+// answer on its own, such as RateLimit, so those responses are counted too.
+func HTTPMetrics(m *metrics.Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			m.ObserveHTTP(routePattern(r), r.Method, responseStatus(ww, r), time.Since(start))
+		})
+	}
+}
+
+// routePattern returns the pattern of the route that served r, once it has.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return unmatchedRoute
+}
+
+// responseStatus returns the status code written through ww.
+func responseStatus(ww middleware.WrapResponseWriter, r *http.Request) int {
+	switch {
+	case ww.Status() != 0:
+		return ww.Status()
+	case websocket.IsWebSocketUpgrade(r):
+		// The upgrader writes its response to the hijacked connection
+		return http.StatusSwitchingProtocols
+	default:
+		return http.StatusOK
+	}
+}
+
+// frameTypes are the frames clients may send; anything else is counted as
+// invalid.
+var frameTypes = map[string]bool{
+	"send_message":      true,
+	"get_history":       true,
+	"get_conversations": true,
+}
+
+func frameTypeLabel(frameType string) string {
+	if frameTypes[frameType] {
+		return frameType
+	}
+	return "invalid"
+}
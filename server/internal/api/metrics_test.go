@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"chat/internal/metrics"
+	"chat/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r := chi.NewRouter()
+	r.Use(HTTPMetrics(metrics.New(reg)))
+	r.Get("/user.get", func(w http.ResponseWriter, r *http.Request) {})
+	r.Post("/message.send", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/user.get?user_id=1", nil),
+		httptest.NewRequest(http.MethodGet, "/user.get?user_id=2", nil),
+		httptest.NewRequest(http.MethodPost, "/message.send", nil),
+		httptest.NewRequest(http.MethodGet, "/wp-admin/setup.php", nil),
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := `
+# HELP chat_http_requests_total HTTP requests handled, by route, method and status code.
+# TYPE chat_http_requests_total counter
+chat_http_requests_total{method="GET",route="/user.get",status="200"} 2
+chat_http_requests_total{method="GET",route="unmatched",status="404"} 1
+chat_http_requests_total{method="POST",route="/message.send",status="400"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "chat_http_requests_total"))
+}
+
+func TestWebSocketHandler_Metrics(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	reg := prometheus.NewRegistry()
+	handler.hub.SetMetrics(metrics.New(reg))
+	messageStore.On("CreateMessage", 1, 2, "hello").Return(&store.Message{ID: 1}, nil)
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+
+	recipient := newQueuedClient("sse", 2)
+	handler.hub.register(context.Background(), 2, recipient)
+
+	ctx := context.Background()
+	handler.hub.handleMessage(ctx, 1, &frameRecorder{}, &WSMessage{Type: "send_message", ReceiverID: 2, Content: "hello"})
+	handler.hub.handleMessage(ctx, 1, &frameRecorder{}, &WSMessage{Type: "send_message", ReceiverID: 2})
+	handler.hub.handleMessage(ctx, 1, &frameRecorder{}, &WSMessage{Type: "make_coffee"})
+
+	expected := `
+# HELP chat_frames_received_total Chat frames received from clients, by frame type.
+# TYPE chat_frames_received_total counter
+chat_frames_received_total{type="invalid"} 1
+chat_frames_received_total{type="send_message"} 2
+# HELP chat_messages_delivered_total Messages handed to a recipient's live connection, by transport.
+# TYPE chat_messages_delivered_total counter
+chat_messages_delivered_total{transport="sse"} 1
+# HELP chat_messages_sent_total Messages accepted and stored.
+# TYPE chat_messages_sent_total counter
+chat_messages_sent_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"chat_frames_received_total", "chat_messages_delivered_total", "chat_messages_sent_total"))
+
+	count, err := testutil.GatherAndCount(reg, "chat_message_delivery_latency_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
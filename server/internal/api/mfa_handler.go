@@ -0,0 +1,336 @@
+package api
+
+import (
+	"chat/internal/store"
+	"chat/internal/totp"
+	"chat/internal/utils"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// mfaIssuer is the account issuer shown in authenticator apps.
+	mfaIssuer = "Instant Chat"
+	// mfaChallengeTTL is how long the second step of a login may take.
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type MFACodeRequest struct {
+	Code string `json:"code"` // TOTP code, or a recovery code where accepted
+}
+
+type MFADisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// MFAHandler serves TOTP enrollment and the second step of a two-factor
+// login.
+type MFAHandler struct {
+	userStore store.UserStore
+	sessions  store.SessionStore
+	mfa       store.MFAStore
+	guard     *LoginGuard
+	logger    *slog.Logger
+	now       func() time.Time
+}
+
+func NewMFAHandler(userStore store.UserStore, sessions store.SessionStore, mfa store.MFAStore, guard *LoginGuard, logger *slog.Logger) *MFAHandler {
+	return &MFAHandler{
+		userStore: userStore,
+		sessions:  sessions,
+		mfa:       mfa,
+		guard:     guard,
+		logger:    logger,
+		now:       time.Now,
+	}
+}
+
+// generateRecoveryCodes returns codes of the form xxxxx-xxxxx, 50 random
+// bits each.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// Enroll starts TOTP enrollment, returning the secret and a provisioning URI
+// for the authenticator app. 2FA is not enforced until Verify succeeds.
+func (h *MFAHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	mfa, err := h.mfa.GetMFA(r.Context(), session.UserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if mfa.Enabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generating TOTP secret", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	err = h.mfa.SetPendingMFA(r.Context(), user.ID, secret)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "storing TOTP secret", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to start enrollment"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "MFA enrollment started", "user_id", user.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(mfaIssuer, user.Username, secret),
+	})
+}
+
+// Verify checks a code from the newly enrolled authenticator and turns 2FA
+// on. The recovery codes are returned once and only their hashes are kept.
+func (h *MFAHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Code == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Code is required"})
+		return
+	}
+
+	mfa, err := h.mfa.GetMFA(r.Context(), session.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor enrollment has not been started"})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if mfa.Enabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	step, valid := totp.Validate(mfa.Secret, req.Code, h.now())
+	if !valid {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generating recovery codes", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	err = h.mfa.EnableMFA(r.Context(), session.UserID, step, codes)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "enabling MFA", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "MFA enabled", "user_id", session.UserID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// Disable turns 2FA off. It needs both the password and a second factor, so
+// a stolen session alone cannot remove it.
+func (h *MFAHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFADisableRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Password == "" || req.Code == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Password and code are required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	// Both factors are guessed under the login backoff
+	ip := clientIP(r)
+	if wait := h.guard.RetryAfter(user.Username, ip); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+	if h.userStore.CheckPassword(user.PasswordHash, req.Password) != nil {
+		h.guard.Failed(r.Context(), user.Username, ip)
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "Password is incorrect"})
+		return
+	}
+
+	mfa, err := h.mfa.GetMFA(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if !mfa.Enabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	valid, err := h.checkSecondFactor(r.Context(), mfa, req.Code)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "checking second factor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if !valid {
+		h.guard.Failed(r.Context(), user.Username, ip)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid code"})
+		return
+	}
+	h.guard.Succeeded(user.Username)
+
+	err = h.mfa.DisableMFA(r.Context(), user.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "disabling MFA", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "MFA disabled", "user_id", user.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Two-factor authentication disabled"})
+}
+
+// Login finishes a login started by /user.login for an account with 2FA,
+// exchanging the challenge token and a TOTP or recovery code for a session.
+func (h *MFAHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.MFAToken == "" || req.Code == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "MFA token and code are required"})
+		return
+	}
+
+	challenge, err := h.mfa.GetMFAChallenge(r.Context(), req.MFAToken)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidToken) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid or expired MFA token, log in again"})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "getting MFA challenge", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), challenge.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	// Codes are guessed under the same backoff as passwords, keyed by the
+	// username, so fresh challenges do not buy more attempts
+	ip := clientIP(r)
+	if wait := h.guard.RetryAfter(user.Username, ip); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+
+	mfa, err := h.mfa.GetMFA(r.Context(), challenge.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	valid, err := h.checkSecondFactor(r.Context(), mfa, req.Code)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "checking second factor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if !valid {
+		if err := h.mfa.FailMFAChallenge(r.Context(), challenge.ID); err != nil {
+			h.logger.ErrorContext(r.Context(), "recording MFA failure", "error", err)
+		}
+		h.logger.InfoContext(r.Context(), "invalid second factor", "user_id", challenge.UserID)
+		h.guard.Failed(r.Context(), user.Username, ip)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid code"})
+		return
+	}
+
+	err = h.mfa.ConsumeMFAChallenge(r.Context(), challenge.ID)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidToken) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid or expired MFA token, log in again"})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "consuming MFA challenge", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	h.guard.Succeeded(user.Username)
+	startSession(r.Context(), w, h.sessions, h.logger, user)
+}
+
+// checkSecondFactor accepts a TOTP code that has not been used before, or an
+// unused recovery code, which is then spent.
+func (h *MFAHandler) checkSecondFactor(ctx context.Context, mfa *store.MFA, code string) (bool, error) {
+	if step, valid := totp.Validate(mfa.Secret, code, h.now()); valid {
+		return h.mfa.UseTOTPStep(ctx, mfa.UserID, step)
+	}
+	if len(store.NormalizeRecoveryCode(code)) != 10 {
+		return false, nil
+	}
+	return h.mfa.UseRecoveryCode(ctx, mfa.UserID, code)
+}
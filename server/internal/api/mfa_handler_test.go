@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/credentials"
+	"chat/internal/store"
+	"chat/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockMFAStore implements the MFAStore interface for testing
+type MockMFAStore struct {
+	mock.Mock
+}
+
+func (m *MockMFAStore) GetMFA(_ context.Context, userID int) (*store.MFA, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.MFA), args.Error(1)
+}
+
+func (m *MockMFAStore) SetPendingMFA(_ context.Context, userID int, secret string) error {
+	args := m.Called(userID, secret)
+	return args.Error(0)
+}
+
+func (m *MockMFAStore) EnableMFA(_ context.Context, userID int, step int64, recoveryCodes []string) error {
+	args := m.Called(userID, step, recoveryCodes)
+	return args.Error(0)
+}
+
+func (m *MockMFAStore) DisableMFA(_ context.Context, userID int) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
+func (m *MockMFAStore) UseTOTPStep(_ context.Context, userID int, step int64) (bool, error) {
+	args := m.Called(userID, step)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockMFAStore) UseRecoveryCode(_ context.Context, userID int, code string) (bool, error) {
+	args := m.Called(userID, code)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockMFAStore) CreateMFAChallenge(_ context.Context, userID int, ttl time.Duration) (string, error) {
+	args := m.Called(userID, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockMFAStore) GetMFAChallenge(_ context.Context, token string) (*store.MFAChallenge, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.MFAChallenge), args.Error(1)
+}
+
+func (m *MockMFAStore) FailMFAChallenge(_ context.Context, challengeID int) error {
+	args := m.Called(challengeID)
+	return args.Error(0)
+}
+
+func (m *MockMFAStore) ConsumeMFAChallenge(_ context.Context, challengeID int) error {
+	args := m.Called(challengeID)
+	return args.Error(0)
+}
+
+// noMFA returns an MFA store for users who never enrolled.
+func noMFA() *MockMFAStore {
+	mfaStore := &MockMFAStore{}
+	mfaStore.On("GetMFA", mock.Anything).Return(nil, sql.ErrNoRows).Maybe()
+	return mfaStore
+}
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+var testMFAClock = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestMFAHandler() (*MFAHandler, *MockUserStore, *MockSessionStore, *MockMFAStore) {
+	userStore := &MockUserStore{}
+	sessions := &MockSessionStore{}
+	mfaStore := &MockMFAStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	handler := NewMFAHandler(userStore, sessions, mfaStore, NewLoginGuard(&MockAuditStore{}, logger), logger)
+	handler.now = func() time.Time { return testMFAClock }
+	return handler, userStore, sessions, mfaStore
+}
+
+func enabledMFA() *store.MFA {
+	enabledAt := "2024-04-01T00:00:00Z"
+	return &store.MFA{UserID: 1, Secret: testTOTPSecret, EnabledAt: &enabledAt}
+}
+
+func TestMFAHandler_EnrollAndVerify(t *testing.T) {
+	handler, userStore, _, mfaStore := newTestMFAHandler()
+	session := &store.Session{ID: 7, UserID: 1}
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil)
+	mfaStore.On("GetMFA", 1).Return(nil, sql.ErrNoRows).Once()
+	mfaStore.On("SetPendingMFA", 1, mock.AnythingOfType("string")).Return(nil)
+
+	w := httptest.NewRecorder()
+	handler.Enroll(w, withSession(postJSON("/user.mfa.enroll", nil), session))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var enrollment struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	assert.Contains(t, enrollment.ProvisioningURI, "otpauth://totp/")
+	assert.Contains(t, enrollment.ProvisioningURI, "secret="+enrollment.Secret)
+
+	// The authenticator app now shows the code for the handler's clock
+	mfaStore.On("GetMFA", 1).Return(&store.MFA{UserID: 1, Secret: enrollment.Secret}, nil)
+	code, err := totp.Code(enrollment.Secret, testMFAClock)
+	require.NoError(t, err)
+
+	var recoveryCodes []string
+	mfaStore.On("EnableMFA", 1, totp.Step(testMFAClock), mock.AnythingOfType("[]string")).Return(nil).
+		Run(func(args mock.Arguments) { recoveryCodes = args.Get(2).([]string) })
+
+	w = httptest.NewRecorder()
+	handler.Verify(w, withSession(postJSON("/user.mfa.verify", MFACodeRequest{Code: "000000"}), session))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.Verify(w, withSession(postJSON("/user.mfa.verify", MFACodeRequest{Code: code}), session))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var verified struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verified))
+	assert.Len(t, verified.RecoveryCodes, recoveryCodeCount)
+	assert.Equal(t, recoveryCodes, verified.RecoveryCodes)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, verified.RecoveryCodes[0])
+	mfaStore.AssertExpectations(t)
+}
+
+func TestUserHandler_Login_RequiresSecondFactor(t *testing.T) {
+	userStore := &MockUserStore{}
+	sessions := &MockSessionStore{}
+	mfaStore := &MockMFAStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(userStore, sessions, mfaStore, credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	userStore.On("AuthenticateUser", "alice", "correct-horse-42").Return(&store.User{ID: 1, Username: "alice"}, nil)
+	mfaStore.On("GetMFA", 1).Return(enabledMFA(), nil)
+	mfaStore.On("CreateMFAChallenge", 1, mfaChallengeTTL).Return("challenge-token", nil)
+
+	w := httptest.NewRecorder()
+	handler.Login(w, loginRequest("alice", "correct-horse-42", "203.0.113.7:5555"))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, true, response["mfa_required"])
+	assert.Equal(t, "challenge-token", response["mfa_token"])
+	assert.NotContains(t, response, "token")
+	sessions.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
+
+func TestMFAHandler_Login(t *testing.T) {
+	handler, userStore, sessions, mfaStore := newTestMFAHandler()
+
+	code, err := totp.Code(testTOTPSecret, testMFAClock)
+	require.NoError(t, err)
+
+	mfaStore.On("GetMFAChallenge", "expired").Return(nil, store.ErrInvalidToken)
+	mfaStore.On("GetMFAChallenge", "challenge-token").Return(&store.MFAChallenge{ID: 3, UserID: 1}, nil)
+	mfaStore.On("GetMFA", 1).Return(enabledMFA(), nil)
+	mfaStore.On("UseRecoveryCode", 1, "wrong-codex").Return(false, nil)
+	mfaStore.On("FailMFAChallenge", 3).Return(nil)
+	mfaStore.On("UseTOTPStep", 1, totp.Step(testMFAClock)).Return(true, nil).Once()
+	mfaStore.On("ConsumeMFAChallenge", 3).Return(nil)
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil)
+	sessions.On("CreateSession", 1, sessionTTL).Return("session-token", &store.Session{ID: 9, UserID: 1}, nil)
+
+	w := httptest.NewRecorder()
+	handler.Login(w, postJSON("/user.login.mfa", MFALoginRequest{MFAToken: "expired", Code: code}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.Login(w, postJSON("/user.login.mfa", MFALoginRequest{MFAToken: "challenge-token", Code: "wrong-codex"}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.Login(w, postJSON("/user.login.mfa", MFALoginRequest{MFAToken: "challenge-token", Code: code}))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"token": "session-token"`)
+
+	mfaStore.AssertExpectations(t)
+	sessions.AssertExpectations(t)
+}
+
+func TestMFAHandler_Login_LocksOutRepeatedChallenges(t *testing.T) {
+	handler, userStore, _, mfaStore := newTestMFAHandler()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	userHandler := NewUserHandler(userStore, &MockSessionStore{}, mfaStore, credentials.DefaultPolicy(), handler.guard, logger)
+	handler.guard.users.SetClock(func() time.Time { return testMFAClock })
+	handler.guard.ips.SetClock(func() time.Time { return testMFAClock })
+
+	userStore.On("AuthenticateUser", "alice", "correct-horse-42").Return(&store.User{ID: 1, Username: "alice"}, nil)
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil)
+	mfaStore.On("GetMFA", 1).Return(enabledMFA(), nil)
+	mfaStore.On("CreateMFAChallenge", 1, mfaChallengeTTL).Return("challenge-token", nil)
+	mfaStore.On("GetMFAChallenge", "challenge-token").Return(&store.MFAChallenge{ID: 3, UserID: 1}, nil)
+	mfaStore.On("UseRecoveryCode", 1, "wrong-codex").Return(false, nil)
+	mfaStore.On("FailMFAChallenge", 3).Return(nil)
+
+	// Each round starts a fresh challenge with the right password, which
+	// must not clear the failures of the rounds before it
+	for i := 0; i <= usernameLockout.FreeAttempts; i++ {
+		w := httptest.NewRecorder()
+		userHandler.Login(w, loginRequest("alice", "correct-horse-42", "203.0.113.7:5555"))
+		require.Equal(t, http.StatusOK, w.Code, "round %d", i)
+
+		w = httptest.NewRecorder()
+		handler.Login(w, postJSON("/user.login.mfa", MFALoginRequest{MFAToken: "challenge-token", Code: "wrong-codex"}))
+		require.Equal(t, http.StatusUnauthorized, w.Code, "round %d", i)
+	}
+
+	w := httptest.NewRecorder()
+	handler.Login(w, postJSON("/user.login.mfa", MFALoginRequest{MFAToken: "challenge-token", Code: "wrong-codex"}))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	userHandler.Login(w, loginRequest("alice", "correct-horse-42", "203.0.113.7:5555"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the password step is locked out too")
+}
+
+func TestMFAHandler_RejectsReplayedCode(t *testing.T) {
+	handler, _, _, mfaStore := newTestMFAHandler()
+
+	code, err := totp.Code(testTOTPSecret, testMFAClock)
+	require.NoError(t, err)
+
+	mfaStore.On("UseTOTPStep", 1, totp.Step(testMFAClock)).Return(true, nil).Once()
+	mfaStore.On("UseTOTPStep", 1, totp.Step(testMFAClock)).Return(false, nil).Once()
+
+	valid, err := handler.checkSecondFactor(context.Background(), enabledMFA(), code)
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = handler.checkSecondFactor(context.Background(), enabledMFA(), code)
+	require.NoError(t, err)
+	assert.False(t, valid, "a code may only be used once")
+}
+
+func TestMFAHandler_RecoveryCode(t *testing.T) {
+	handler, _, _, mfaStore := newTestMFAHandler()
+
+	mfaStore.On("UseRecoveryCode", 1, "ABCDE-FGHIJ").Return(true, nil).Once()
+
+	valid, err := handler.checkSecondFactor(context.Background(), enabledMFA(), "ABCDE-FGHIJ")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	mfaStore.AssertExpectations(t)
+}
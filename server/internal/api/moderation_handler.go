@@ -0,0 +1,344 @@
+package api
+
+import (
+	"chat/internal/rbac"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxReportReasonLength = 500
+	defaultReportLimit    = 50
+	maxReportLimit        = 100
+)
+
+type ReportMessageRequest struct {
+	MessageID int    `json:"message_id"`
+	Reason    string `json:"reason"`
+}
+
+type ReportDecisionRequest struct {
+	ReportID int    `json:"report_id"`
+	Action   string `json:"action,omitempty"`
+	Note     string `json:"note,omitempty"` // Shown to warned users and kept in the audit trail
+}
+
+// ModerationHandler takes reports from users and serves the queue moderators
+// work through. Every decision is recorded in the audit trail.
+type ModerationHandler struct {
+	reports      store.ReportStore
+	messageStore store.MessageStore
+	userStore    store.UserStore
+	sessions     store.SessionStore
+	audit        store.AuditStore
+	hub          *WebSocketHandler
+	logger       *slog.Logger
+}
+
+func NewModerationHandler(reports store.ReportStore, messageStore store.MessageStore, userStore store.UserStore, sessions store.SessionStore, audit store.AuditStore, hub *WebSocketHandler, logger *slog.Logger) *ModerationHandler {
+	return &ModerationHandler{
+		reports:      reports,
+		messageStore: messageStore,
+		userStore:    userStore,
+		sessions:     sessions,
+		audit:        audit,
+		hub:          hub,
+		logger:       logger,
+	}
+}
+
+// Report flags a message the caller received. The report keeps a copy of
+// the message, so deleting it does not destroy the evidence.
+func (h *ModerationHandler) Report(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req ReportMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.MessageID == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Message ID is required"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Reason is required"})
+		return
+	}
+	if utf8.RuneCountInString(req.Reason) > maxReportReasonLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Reason must be at most 500 characters"})
+		return
+	}
+
+	report, err := h.reports.CreateReport(r.Context(), req.MessageID, session.UserID, req.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Message not found"})
+		case errors.Is(err, store.ErrAlreadyReported):
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "You have already reported this message"})
+		default:
+			h.logger.ErrorContext(r.Context(), "creating report", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to report message"})
+		}
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "message reported", "message_id", req.MessageID, "reporter_id", session.UserID, "report_id", report.ID)
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"message": "Report submitted", "report_id": report.ID})
+}
+
+// ListReports pages through the queue oldest first, open reports unless
+// `status` says otherwise. Pass the largest id of a page as `after` to get
+// the next one.
+func (h *ModerationHandler) ListReports(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, h.userStore, h.logger, rbac.PermModerate); !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = store.ReportOpen
+	case "all":
+		status = ""
+	case store.ReportOpen, store.ReportActioned, store.ReportDismissed:
+	default:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Status must be open, actioned, dismissed or all"})
+		return
+	}
+
+	afterID, err := intQueryParam(r, "after", 0)
+	if err != nil || afterID < 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid after parameter"})
+		return
+	}
+	limit, err := intQueryParam(r, "limit", defaultReportLimit)
+	if err != nil || limit < 1 || limit > maxReportLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Limit must be between 1 and 100"})
+		return
+	}
+
+	reports, err := h.reports.ListReports(r.Context(), status, afterID, limit)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "listing reports", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to list reports"})
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"reports": reports})
+}
+
+// Action resolves a report by acting on the reported message or its sender.
+// The report is claimed before anything is done, so two moderators acting on
+// it at once cannot both apply their action.
+func (h *ModerationHandler) Action(w http.ResponseWriter, r *http.Request) {
+	moderator, report, req, ok := h.openReport(w, r)
+	if !ok {
+		return
+	}
+
+	switch req.Action {
+	case store.ReportActionDeleteMessage, store.ReportActionWarn, store.ReportActionSuspend:
+	default:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Action must be delete_message, warn or suspend"})
+		return
+	}
+	if req.Action != store.ReportActionDeleteMessage && report.SenderID == nil {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "The sender's account no longer exists"})
+		return
+	}
+	if report.SenderID != nil && *report.SenderID == moderator.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "You cannot act on reports about your own messages"})
+		return
+	}
+
+	var target *store.User
+	if req.Action == store.ReportActionSuspend {
+		var err error
+		target, err = h.userStore.GetUserByID(r.Context(), *report.SenderID)
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "The sender's account no longer exists"})
+			return
+		}
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "getting reported user", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+			return
+		}
+		if rbac.Can(target.Role, rbac.PermModerate) {
+			// Staff accounts are managed by administrators, not the queue
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "Moderators cannot be suspended from the queue"})
+			return
+		}
+	}
+
+	if !h.claim(w, r, moderator, report, store.ReportActioned, req) {
+		return
+	}
+
+	var err error
+	switch req.Action {
+	case store.ReportActionDeleteMessage:
+		err = h.deleteMessage(r.Context(), report)
+	case store.ReportActionWarn:
+		err = h.hub.sendToUser(*report.SenderID, WSMessage{Type: "moderation_warning", Content: req.Note})
+		if err != nil {
+			// Offline users miss the frame; the warning is on record regardless
+			h.logger.ErrorContext(r.Context(), "sending warning", "error", err)
+			err = nil
+		}
+	case store.ReportActionSuspend:
+		err = h.suspend(r.Context(), target.ID)
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "acting on report", "action", req.Action, "report_id", report.ID, "error", err)
+		// Put it back in the queue rather than leave it closed but unactioned
+		if err := h.reports.ReopenReport(r.Context(), report.ID); err != nil {
+			h.logger.ErrorContext(r.Context(), "reopening report", "report_id", report.ID, "error", err)
+		}
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to act on report"})
+		return
+	}
+
+	h.recordDecision(r, moderator, report, store.ReportActioned, req)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Report actioned"})
+}
+
+// Dismiss closes a report without acting on it.
+func (h *ModerationHandler) Dismiss(w http.ResponseWriter, r *http.Request) {
+	moderator, report, req, ok := h.openReport(w, r)
+	if !ok {
+		return
+	}
+	req.Action = ""
+
+	if !h.claim(w, r, moderator, report, store.ReportDismissed, req) {
+		return
+	}
+	h.recordDecision(r, moderator, report, store.ReportDismissed, req)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Report dismissed"})
+}
+
+// deleteMessage removes the reported message and tells both participants.
+// A message that is already gone counts as deleted.
+func (h *ModerationHandler) deleteMessage(ctx context.Context, report *store.Report) error {
+	if report.MessageID == nil {
+		return nil
+	}
+	err := h.messageStore.DeleteMessage(ctx, *report.MessageID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	for _, userID := range []*int{report.SenderID, report.ReporterID} {
+		if userID == nil {
+			continue
+		}
+		_ = h.hub.sendToUser(*userID, WSMessage{Type: "message_deleted", ID: *report.MessageID})
+	}
+	if report.SenderID != nil && report.ReporterID != nil {
+		h.hub.PublishConversation(ctx, *report.SenderID, *report.ReporterID)
+		h.hub.PublishConversation(ctx, *report.ReporterID, *report.SenderID)
+	}
+	return nil
+}
+
+// suspend disables the account and ends its sessions and connections, the
+// same way an administrator disabling it would.
+func (h *ModerationHandler) suspend(ctx context.Context, userID int) error {
+	err := h.userStore.SetDisabled(ctx, userID, true)
+	if err != nil {
+		return err
+	}
+	if err := h.sessions.RevokeOtherSessions(ctx, userID, 0); err != nil {
+		// Sessions of disabled accounts are rejected anyway, so carry on
+		h.logger.ErrorContext(ctx, "revoking sessions", "error", err)
+	}
+	h.hub.DisconnectUser(userID, 0, "account suspended")
+	return nil
+}
+
+// openReport checks the caller may moderate and loads the open report the
+// request names.
+func (h *ModerationHandler) openReport(w http.ResponseWriter, r *http.Request) (moderator *store.User, report *store.Report, req ReportDecisionRequest, ok bool) {
+	moderator, ok = requirePermission(w, r, h.userStore, h.logger, rbac.PermModerate)
+	if !ok {
+		return nil, nil, req, false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ReportID == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Report ID is required"})
+		return nil, nil, req, false
+	}
+
+	report, err = h.reports.GetReport(r.Context(), req.ReportID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Report not found"})
+			return nil, nil, req, false
+		}
+		h.logger.ErrorContext(r.Context(), "getting report", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return nil, nil, req, false
+	}
+	if report.Status != store.ReportOpen {
+		writeReportResolved(w)
+		return nil, nil, req, false
+	}
+	return moderator, report, req, true
+}
+
+// claim closes the report with the moderator's decision, refusing when
+// someone else resolved it first.
+func (h *ModerationHandler) claim(w http.ResponseWriter, r *http.Request, moderator *store.User, report *store.Report, status string, req ReportDecisionRequest) bool {
+	err := h.reports.ResolveReport(r.Context(), report.ID, moderator.ID, status, req.Action)
+	if err != nil {
+		if errors.Is(err, store.ErrReportResolved) {
+			writeReportResolved(w)
+			return false
+		}
+		h.logger.ErrorContext(r.Context(), "resolving report", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to resolve report"})
+		return false
+	}
+	return true
+}
+
+// recordDecision writes the audit event for a report once it is resolved.
+func (h *ModerationHandler) recordDecision(r *http.Request, moderator *store.User, report *store.Report, status string, req ReportDecisionRequest) {
+	eventType := store.AuditReportActioned
+	if status == store.ReportDismissed {
+		eventType = store.AuditReportDismissed
+	}
+	event := &store.AuditEvent{
+		Type:         eventType,
+		ActorID:      &moderator.ID,
+		TargetUserID: report.SenderID,
+		IPAddress:    clientIP(r),
+		Details: map[string]any{
+			"report_id":  report.ID,
+			"message_id": report.MessageID,
+			"action":     req.Action,
+			"note":       req.Note,
+		},
+	}
+	if err := h.audit.RecordEvent(r.Context(), event); err != nil {
+		h.logger.ErrorContext(r.Context(), "recording audit event", "error", err)
+	}
+
+	h.logger.InfoContext(r.Context(), "report resolved", "report_id", report.ID, "status", status, "moderator_id", moderator.ID)
+}
+
+func writeReportResolved(w http.ResponseWriter) {
+	utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Report has already been resolved"})
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"chat/internal/rbac"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockReportStore implements the ReportStore interface for testing
+type MockReportStore struct {
+	mock.Mock
+}
+
+func (m *MockReportStore) CreateReport(_ context.Context, messageID, reporterID int, reason string) (*store.Report, error) {
+	args := m.Called(messageID, reporterID, reason)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) GetReport(_ context.Context, reportID int) (*store.Report, error) {
+	args := m.Called(reportID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) ListReports(_ context.Context, status string, afterID, limit int) ([]*store.Report, error) {
+	args := m.Called(status, afterID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) ResolveReport(_ context.Context, reportID, moderatorID int, status, action string) error {
+	args := m.Called(reportID, moderatorID, status, action)
+	return args.Error(0)
+}
+
+func (m *MockReportStore) ReopenReport(_ context.Context, reportID int) error {
+	args := m.Called(reportID)
+	return args.Error(0)
+}
+
+var moderatorSession = &store.Session{ID: 9, UserID: 5}
+
+type moderationTest struct {
+	handler      *ModerationHandler
+	reports      *MockReportStore
+	messageStore *MockMessageStore
+	userStore    *MockUserStore
+	sessions     *MockSessionStore
+	audit        *MockAuditStore
+}
+
+func newModerationTest() *moderationTest {
+	mt := &moderationTest{
+		reports:      &MockReportStore{},
+		messageStore: &MockMessageStore{},
+		userStore:    &MockUserStore{},
+		sessions:     &MockSessionStore{},
+		audit:        &MockAuditStore{},
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	mt.userStore.On("GetUserByID", 5).Return(&store.User{ID: 5, Username: "mod", Role: rbac.RoleModerator}, nil).Maybe()
+	mt.userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob", Role: rbac.RoleUser}, nil).Maybe()
+	mt.messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+	hub := NewWebSocketHandler(mt.messageStore, mt.userStore, noRelations(), logger)
+	mt.handler = NewModerationHandler(mt.reports, mt.messageStore, mt.userStore, mt.sessions, mt.audit, hub, logger)
+	return mt
+}
+
+// openTestReport is message 11 from mallory (3) reported by bob (2).
+func openTestReport() *store.Report {
+	messageID, senderID, reporterID := 11, 3, 2
+	return &store.Report{ID: 4, MessageID: &messageID, SenderID: &senderID, ReporterID: &reporterID,
+		Content: "buy followers", Reason: "spam", Status: store.ReportOpen}
+}
+
+func TestModerationHandler_Report(t *testing.T) {
+	mt := newModerationTest()
+	session := &store.Session{ID: 1, UserID: 2}
+
+	mt.reports.On("CreateReport", 11, 2, "spam").Return(&store.Report{ID: 4}, nil).Once()
+	mt.reports.On("CreateReport", 11, 2, "spam").Return(nil, store.ErrAlreadyReported).Once()
+	mt.reports.On("CreateReport", 12, 2, "spam").Return(nil, sql.ErrNoRows)
+
+	tests := []struct {
+		name       string
+		body       ReportMessageRequest
+		wantStatus int
+	}{
+		{name: "reported", body: ReportMessageRequest{MessageID: 11, Reason: "  spam "}, wantStatus: http.StatusCreated},
+		{name: "reported twice", body: ReportMessageRequest{MessageID: 11, Reason: "spam"}, wantStatus: http.StatusConflict},
+		{name: "not the recipient", body: ReportMessageRequest{MessageID: 12, Reason: "spam"}, wantStatus: http.StatusNotFound},
+		{name: "missing reason", body: ReportMessageRequest{MessageID: 11, Reason: " "}, wantStatus: http.StatusBadRequest},
+		{name: "missing message", body: ReportMessageRequest{Reason: "spam"}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mt.handler.Report(w, withSession(postJSON("/message.report", tt.body), session))
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	// The legacy user_id parameter would let anyone report as anyone
+	w := httptest.NewRecorder()
+	mt.handler.Report(w, postJSON("/message.report?user_id=2", ReportMessageRequest{MessageID: 11, Reason: "spam"}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	mt.reports.AssertExpectations(t)
+}
+
+func TestModerationHandler_ListReports(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("ListReports", store.ReportOpen, 0, defaultReportLimit).Return([]*store.Report{openTestReport()}, nil)
+	mt.reports.On("ListReports", "", 4, 10).Return([]*store.Report{}, nil)
+
+	w := httptest.NewRecorder()
+	mt.handler.ListReports(w, withSession(httptest.NewRequest(http.MethodGet, "/moderation.report.list", nil), moderatorSession))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"content": "buy followers"`)
+
+	w = httptest.NewRecorder()
+	mt.handler.ListReports(w, withSession(httptest.NewRequest(http.MethodGet, "/moderation.report.list?status=all&after=4&limit=10", nil), moderatorSession))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	mt.handler.ListReports(w, withSession(httptest.NewRequest(http.MethodGet, "/moderation.report.list?status=closed", nil), moderatorSession))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Ordinary users cannot read the queue
+	w = httptest.NewRecorder()
+	mt.handler.ListReports(w, withSession(httptest.NewRequest(http.MethodGet, "/moderation.report.list", nil), &store.Session{ID: 1, UserID: 2}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	mt.reports.AssertExpectations(t)
+}
+
+func TestModerationHandler_DeleteMessage(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.messageStore.On("DeleteMessage", 11).Return(nil)
+	mt.reports.On("ResolveReport", 4, 5, store.ReportActioned, store.ReportActionDeleteMessage).Return(nil)
+	mt.audit.On("RecordEvent", mock.MatchedBy(func(event *store.AuditEvent) bool {
+		return event.Type == store.AuditReportActioned && *event.ActorID == 5 && *event.TargetUserID == 3 &&
+			event.Details["report_id"] == 4 && event.Details["action"] == store.ReportActionDeleteMessage
+	})).Return(nil)
+
+	reporter := newQueuedClient("sse", 1)
+	mt.handler.hub.register(context.Background(), 2, reporter)
+
+	w := httptest.NewRecorder()
+	mt.handler.Action(w, withSession(postJSON("/moderation.report.action",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionDeleteMessage}), moderatorSession))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	frame := (<-reporter.frames).(WSMessage)
+	assert.Equal(t, "message_deleted", frame.Type)
+	assert.Equal(t, 11, frame.ID)
+	mt.messageStore.AssertExpectations(t)
+	mt.reports.AssertExpectations(t)
+	mt.audit.AssertExpectations(t)
+}
+
+func TestModerationHandler_ActionOnClaimedReport(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.reports.On("ResolveReport", 4, 5, store.ReportActioned, store.ReportActionDeleteMessage).Return(store.ErrReportResolved)
+
+	w := httptest.NewRecorder()
+	mt.handler.Action(w, withSession(postJSON("/moderation.report.action",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionDeleteMessage}), moderatorSession))
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	mt.messageStore.AssertNotCalled(t, "DeleteMessage", mock.Anything)
+	mt.audit.AssertNotCalled(t, "RecordEvent", mock.Anything)
+}
+
+func TestModerationHandler_ActionFailureReopensReport(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.reports.On("ResolveReport", 4, 5, store.ReportActioned, store.ReportActionDeleteMessage).Return(nil)
+	mt.messageStore.On("DeleteMessage", 11).Return(errors.New("db down"))
+	mt.reports.On("ReopenReport", 4).Return(nil)
+
+	w := httptest.NewRecorder()
+	mt.handler.Action(w, withSession(postJSON("/moderation.report.action",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionDeleteMessage}), moderatorSession))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	mt.reports.AssertExpectations(t)
+	mt.audit.AssertNotCalled(t, "RecordEvent", mock.Anything)
+}
+
+func TestModerationHandler_Suspend(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.userStore.On("GetUserByID", 3).Return(&store.User{ID: 3, Username: "mallory", Role: rbac.RoleUser}, nil)
+	mt.userStore.On("SetDisabled", 3, true).Return(nil)
+	mt.sessions.On("RevokeOtherSessions", 3, 0).Return(nil)
+	mt.reports.On("ResolveReport", 4, 5, store.ReportActioned, store.ReportActionSuspend).Return(nil)
+	mt.audit.On("RecordEvent", mock.Anything).Return(nil)
+
+	stream := newQueuedClient("sse", 8)
+	mt.handler.hub.register(context.Background(), 3, stream)
+
+	w := httptest.NewRecorder()
+	mt.handler.Action(w, withSession(postJSON("/moderation.report.action",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionSuspend, Note: "spam campaign"}), moderatorSession))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	select {
+	case <-stream.done:
+	default:
+		t.Error("suspended user's connections should be dropped")
+	}
+	mt.userStore.AssertExpectations(t)
+	mt.sessions.AssertExpectations(t)
+}
+
+func TestModerationHandler_CannotSuspendStaff(t *testing.T) {
+	mt := newModerationTest()
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.userStore.On("GetUserByID", 3).Return(&store.User{ID: 3, Role: rbac.RoleAdmin}, nil)
+
+	w := httptest.NewRecorder()
+	mt.handler.Action(w, withSession(postJSON("/moderation.report.action",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionSuspend}), moderatorSession))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	mt.userStore.AssertNotCalled(t, "SetDisabled", mock.Anything, mock.Anything)
+	mt.reports.AssertNotCalled(t, "ResolveReport", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestModerationHandler_Dismiss(t *testing.T) {
+	mt := newModerationTest()
+	resolved := openTestReport()
+	resolved.ID = 6
+	resolved.Status = store.ReportDismissed
+	mt.reports.On("GetReport", 4).Return(openTestReport(), nil)
+	mt.reports.On("GetReport", 6).Return(resolved, nil)
+	mt.reports.On("ResolveReport", 4, 5, store.ReportDismissed, "").Return(nil)
+	mt.audit.On("RecordEvent", mock.MatchedBy(func(event *store.AuditEvent) bool {
+		return event.Type == store.AuditReportDismissed && event.Details["note"] == "banter"
+	})).Return(nil)
+
+	w := httptest.NewRecorder()
+	mt.handler.Dismiss(w, withSession(postJSON("/moderation.report.dismiss",
+		ReportDecisionRequest{ReportID: 4, Action: store.ReportActionSuspend, Note: "banter"}), moderatorSession))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	mt.handler.Dismiss(w, withSession(postJSON("/moderation.report.dismiss", ReportDecisionRequest{ReportID: 6}), moderatorSession))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	mt.reports.AssertExpectations(t)
+	mt.audit.AssertExpectations(t)
+	mt.userStore.AssertNotCalled(t, "SetDisabled", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"chat/internal/credentials"
+	"chat/internal/mail"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long an emailed reset link stays usable.
+const passwordResetTTL = time.Hour
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"` // Username or email address
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordHandler serves password changes and the emailed reset flow. Every
+// password change ends the user's other sessions and drops their live
+// connections.
+type PasswordHandler struct {
+	userStore store.UserStore
+	sessions  store.SessionStore
+	mailer    mail.Mailer
+	policy    *credentials.Policy
+	guard     *LoginGuard
+	hub       *WebSocketHandler
+	logger    *slog.Logger
+	resetURL  string
+}
+
+// NewPasswordHandler builds a PasswordHandler. resetURL is the page the reset
+// email links to; the token is appended as a query parameter.
+func NewPasswordHandler(userStore store.UserStore, sessions store.SessionStore, mailer mail.Mailer, policy *credentials.Policy, guard *LoginGuard, hub *WebSocketHandler, resetURL string, logger *slog.Logger) *PasswordHandler {
+	return &PasswordHandler{
+		userStore: userStore,
+		sessions:  sessions,
+		mailer:    mailer,
+		policy:    policy,
+		guard:     guard,
+		hub:       hub,
+		logger:    logger,
+		resetURL:  resetURL,
+	}
+}
+
+// Change sets a new password for the signed-in user after checking the
+// current one. The session making the request stays signed in.
+func (h *PasswordHandler) Change(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Current and new password are required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	// Guesses at the current password, say from a stolen session, are
+	// throttled and audited like guesses at the login form
+	ip := clientIP(r)
+	if wait := h.guard.RetryAfter(user.Username, ip); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+	if h.userStore.CheckPassword(user.PasswordHash, req.CurrentPassword) != nil {
+		h.logger.InfoContext(r.Context(), "password change with wrong current password", "user_id", user.ID)
+		h.guard.Failed(r.Context(), user.Username, ip)
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "Current password is incorrect"})
+		return
+	}
+	h.guard.Succeeded(user.Username)
+
+	if !h.checkPolicy(w, req.NewPassword, user.Username) {
+		return
+	}
+
+	if !h.setPassword(r.Context(), w, user.ID, req.NewPassword, session.ID) {
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "password changed", "user_id", user.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Password changed"})
+}
+
+// RequestReset emails a reset link to the account matching login. It answers
+// the same way whether or not the account exists, so it cannot be used to
+// find out which usernames or addresses are registered.
+func (h *PasswordHandler) RequestReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Login) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Username or email is required"})
+		return
+	}
+
+	h.sendReset(r.Context(), strings.TrimSpace(req.Login))
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
+		"message": "If an account with an email address matches, a reset link has been sent",
+	})
+}
+
+func (h *PasswordHandler) sendReset(ctx context.Context, login string) {
+	var user *store.User
+	var err error
+	if strings.Contains(login, "@") {
+		user, err = h.userStore.GetUserByEmail(ctx, login)
+	} else {
+		user, err = h.userStore.GetUserByUsername(ctx, login)
+	}
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			h.logger.ErrorContext(ctx, "looking up user for password reset", "error", err)
+		}
+		return
+	}
+	if user.Email == nil {
+		h.logger.InfoContext(ctx, "password reset requested for user without email", "user_id", user.ID)
+		return
+	}
+
+	token, err := h.sessions.CreatePasswordReset(ctx, user.ID, passwordResetTTL)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "creating password reset", "error", err)
+		return
+	}
+
+	err = h.mailer.Send(mail.Message{
+		To:      *user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and works once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+			user.Username, passwordResetTTL, h.resetLink(token)),
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx, "sending password reset email", "error", err)
+		return
+	}
+	h.logger.InfoContext(ctx, "password reset sent", "user_id", user.ID)
+}
+
+func (h *PasswordHandler) resetLink(token string) string {
+	separator := "?"
+	if strings.Contains(h.resetURL, "?") {
+		separator = "&"
+	}
+	return h.resetURL + separator + "token=" + url.QueryEscape(token)
+}
+
+// ConfirmReset redeems a reset token and sets the new password. All of the
+// user's sessions are revoked, since whoever held them may be the reason for
+// the reset.
+func (h *PasswordHandler) ConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetConfirmRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
+		return
+	}
+
+	if req.Token == "" || req.NewPassword == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Token and new password are required"})
+		return
+	}
+
+	// The token is only looked up here and consumed once the new password
+	// has passed the policy, so a weak password does not burn the link.
+	userID, err := h.sessions.GetPasswordReset(r.Context(), req.Token)
+	if err != nil {
+		h.writeResetTokenError(r.Context(), w, err)
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if !h.checkPolicy(w, req.NewPassword, user.Username) {
+		return
+	}
+
+	// Consuming is atomic, so of two concurrent requests only one gets here
+	_, err = h.sessions.ConsumePasswordReset(r.Context(), req.Token)
+	if err != nil {
+		h.writeResetTokenError(r.Context(), w, err)
+		return
+	}
+
+	if !h.setPassword(r.Context(), w, userID, req.NewPassword, 0) {
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "password reset", "user_id", userID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Password has been reset"})
+}
+
+func (h *PasswordHandler) writeResetTokenError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrInvalidToken) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid or expired reset token"})
+		return
+	}
+	h.logger.ErrorContext(ctx, "redeeming password reset", "error", err)
+	utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+}
+
+// checkPolicy writes a 422 response with the policy violation, if any.
+func (h *PasswordHandler) checkPolicy(w http.ResponseWriter, password, username string) bool {
+	if msg := h.policy.ValidatePassword(password, username); msg != "" {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "Invalid password", "fields": map[string]string{"new_password": msg}})
+		return false
+	}
+	return true
+}
+
+// setPassword stores the new password and ends every session other than
+// keepSessionID (0 for none), writing the error response itself on failure.
+func (h *PasswordHandler) setPassword(ctx context.Context, w http.ResponseWriter, userID int, password string, keepSessionID int) bool {
+	passwordHash, err := h.userStore.HashPassword(password)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "hashing password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return false
+	}
+
+	err = h.userStore.UpdatePassword(ctx, userID, passwordHash)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "updating password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update password"})
+		return false
+	}
+
+	err = h.sessions.RevokeOtherSessions(ctx, userID, keepSessionID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "revoking sessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to sign out other sessions"})
+		return false
+	}
+	h.hub.DisconnectUser(userID, keepSessionID, "password changed")
+	return true
+}
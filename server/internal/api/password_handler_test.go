@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"chat/internal/credentials"
+	"chat/internal/mail"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMailer keeps sent messages in memory.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func newTestPasswordHandler() (*PasswordHandler, *MockUserStore, *MockSessionStore, *recordingMailer) {
+	userStore := &MockUserStore{}
+	sessions := &MockSessionStore{}
+	mailer := &recordingMailer{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	hub := NewWebSocketHandler(&MockMessageStore{}, userStore, noRelations(), logger)
+	handler := NewPasswordHandler(userStore, sessions, mailer, credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), hub, "https://chat.example/reset", logger)
+	return handler, userStore, sessions, mailer
+}
+
+func postJSON(target string, body any) *http.Request {
+	jsonBody, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestPasswordHandler_Change_RequiresSession(t *testing.T) {
+	handler, _, _, _ := newTestPasswordHandler()
+
+	req := postJSON("/user.password.change?user_id=1", ChangePasswordRequest{CurrentPassword: "old", NewPassword: "new-passphrase-42"})
+	w := httptest.NewRecorder()
+	handler.Change(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPasswordHandler_Change_WrongCurrentPassword(t *testing.T) {
+	handler, userStore, sessions, _ := newTestPasswordHandler()
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, PasswordHash: "hash"}, nil)
+	userStore.On("CheckPassword", "hash", "wrong").Return(assert.AnError)
+
+	req := withSession(postJSON("/user.password.change", ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new-passphrase-42"}), &store.Session{ID: 7, UserID: 1})
+	w := httptest.NewRecorder()
+	handler.Change(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	userStore.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything)
+	sessions.AssertNotCalled(t, "RevokeOtherSessions", mock.Anything, mock.Anything)
+}
+
+func TestPasswordHandler_Change_ThrottlesWrongCurrentPassword(t *testing.T) {
+	handler, userStore, _, _ := newTestPasswordHandler()
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice", PasswordHash: "hash"}, nil)
+	userStore.On("CheckPassword", "hash", "wrong").Return(assert.AnError)
+
+	change := func() *httptest.ResponseRecorder {
+		req := withSession(postJSON("/user.password.change", ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new-passphrase-42"}), &store.Session{ID: 7, UserID: 1})
+		w := httptest.NewRecorder()
+		handler.Change(w, req)
+		return w
+	}
+	for i := 0; i <= usernameLockout.FreeAttempts; i++ {
+		change()
+	}
+
+	w := change()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	// Guesses on the change form count against the login too
+	assert.Positive(t, handler.guard.RetryAfter("alice", "198.51.100.1"))
+	userStore.AssertNumberOfCalls(t, "CheckPassword", usernameLockout.FreeAttempts+1)
+}
+
+func TestPasswordHandler_Change_RevokesOtherSessions(t *testing.T) {
+	handler, userStore, sessions, _ := newTestPasswordHandler()
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, PasswordHash: "hash"}, nil)
+	userStore.On("CheckPassword", "hash", "old").Return(nil)
+	userStore.On("HashPassword", "new-passphrase-42").Return("new-hash", nil)
+	userStore.On("UpdatePassword", 1, "new-hash").Return(nil)
+	sessions.On("RevokeOtherSessions", 1, 7).Return(nil)
+
+	current := newQueuedClient("sse", 7)
+	other := newQueuedClient("sse", 8)
+	handler.hub.register(context.Background(), 1, current)
+	handler.hub.register(context.Background(), 1, other)
+
+	req := withSession(postJSON("/user.password.change", ChangePasswordRequest{CurrentPassword: "old", NewPassword: "new-passphrase-42"}), &store.Session{ID: 7, UserID: 1})
+	w := httptest.NewRecorder()
+	handler.Change(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	select {
+	case <-other.done:
+	default:
+		t.Error("other session's stream should be closed")
+	}
+	select {
+	case <-current.done:
+		t.Error("current session's stream should stay open")
+	default:
+	}
+	userStore.AssertExpectations(t)
+	sessions.AssertExpectations(t)
+}
+
+func TestPasswordHandler_RequestReset(t *testing.T) {
+	handler, userStore, sessions, mailer := newTestPasswordHandler()
+
+	email := "alice@example.com"
+	userStore.On("GetUserByEmail", email).Return(&store.User{ID: 1, Username: "alice", Email: &email}, nil)
+	userStore.On("GetUserByUsername", "nobody").Return(nil, sql.ErrNoRows)
+	sessions.On("CreatePasswordReset", 1, passwordResetTTL).Return("reset-token", nil)
+
+	for _, login := range []string{email, "nobody"} {
+		w := httptest.NewRecorder()
+		handler.RequestReset(w, postJSON("/user.password.reset.request", PasswordResetRequest{Login: login}))
+		// Known and unknown accounts get the same answer
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	require.Len(t, mailer.sent, 1)
+	assert.Equal(t, email, mailer.sent[0].To)
+	assert.Contains(t, mailer.sent[0].Body, "https://chat.example/reset?token=reset-token")
+	sessions.AssertExpectations(t)
+}
+
+func TestPasswordHandler_ConfirmReset(t *testing.T) {
+	handler, userStore, sessions, _ := newTestPasswordHandler()
+
+	sessions.On("GetPasswordReset", "used").Return(0, store.ErrInvalidToken)
+	sessions.On("GetPasswordReset", "fresh").Return(1, nil)
+	sessions.On("ConsumePasswordReset", "fresh").Return(1, nil)
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil)
+	sessions.On("RevokeOtherSessions", 1, 0).Return(nil)
+	userStore.On("HashPassword", "new-passphrase-42").Return("new-hash", nil)
+	userStore.On("UpdatePassword", 1, "new-hash").Return(nil)
+
+	w := httptest.NewRecorder()
+	handler.ConfirmReset(w, postJSON("/user.password.reset.confirm", PasswordResetConfirmRequest{Token: "used", NewPassword: "new-passphrase-42"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ConfirmReset(w, postJSON("/user.password.reset.confirm", PasswordResetConfirmRequest{Token: "fresh", NewPassword: "new-passphrase-42"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	userStore.AssertExpectations(t)
+	sessions.AssertExpectations(t)
+}
+
+func TestPasswordHandler_RejectsWeakPasswords(t *testing.T) {
+	handler, userStore, sessions, _ := newTestPasswordHandler()
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice", PasswordHash: "hash"}, nil)
+	userStore.On("CheckPassword", "hash", "old").Return(nil)
+
+	req := withSession(postJSON("/user.password.change", ChangePasswordRequest{CurrentPassword: "old", NewPassword: "password1"}), &store.Session{ID: 7, UserID: 1})
+	w := httptest.NewRecorder()
+	handler.Change(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"new_password"`)
+
+	// A weak password must not use up the reset token
+	sessions.On("GetPasswordReset", "fresh").Return(1, nil)
+	for _, password := range []string{"short", "Alice-in-wonderland-42"} {
+		w = httptest.NewRecorder()
+		handler.ConfirmReset(w, postJSON("/user.password.reset.confirm", PasswordResetConfirmRequest{Token: "fresh", NewPassword: password}))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, password)
+	}
+
+	userStore.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything)
+	sessions.AssertNotCalled(t, "ConsumePasswordReset", mock.Anything)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"chat/internal/rbac"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+const userContextKey contextKey = "user"
+
+func userFromContext(ctx context.Context) *store.User {
+	user, _ := ctx.Value(userContextKey).(*store.User)
+	return user
+}
+
+// requirePermission resolves the signed-in user and checks that their role
+// grants perm, writing the error response itself otherwise.
+func requirePermission(w http.ResponseWriter, r *http.Request, userStore store.UserStore, logger *slog.Logger, perm rbac.Permission) (*store.User, bool) {
+	// Already loaded when the route sits behind Authenticator.Require
+	user := userFromContext(r.Context())
+	if user == nil {
+		session, ok := requireSession(w, r)
+		if !ok {
+			return nil, false
+		}
+
+		var err error
+		user, err = userStore.GetUserByID(r.Context(), session.UserID)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "getting user", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+			return nil, false
+		}
+	}
+
+	if user.Disabled() || !rbac.Can(user.Role, perm) {
+		logger.InfoContext(r.Context(), "permission denied", "perm", perm, "user_id", user.ID)
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "Permission denied"})
+		return nil, false
+	}
+	return user, true
+}
+
+// Require guards every route behind it with perm, using the same check as
+// requirePermission. The user is left in the request context for handlers.
+func (a *Authenticator) Require(perm rbac.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := requirePermission(w, r, a.users, a.logger, perm)
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"chat/internal/avatar"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone validation must not depend on the host's zoneinfo
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxStatusTextLength  = 140
+	maxStatusDuration    = 30 * 24 * time.Hour
+)
+
+// UpdateProfileRequest carries the profile fields to change. Omitted fields
+// are left untouched; an empty string clears a field.
+type UpdateProfileRequest struct {
+	DisplayName     *string `json:"display_name"`
+	Bio             *string `json:"bio"`
+	StatusText      *string `json:"status_text"`
+	StatusExpiresIn *int    `json:"status_expires_in"` // seconds from now
+	Timezone        *string `json:"timezone"`
+}
+
+// ProfileHandler serves profile edits and avatars, and tells everyone who
+// shares a conversation with the user when their profile changes.
+type ProfileHandler struct {
+	userStore    store.UserStore
+	messageStore store.MessageStore
+	hub          *WebSocketHandler
+	logger       *slog.Logger
+	now          func() time.Time
+}
+
+func NewProfileHandler(userStore store.UserStore, messageStore store.MessageStore, hub *WebSocketHandler, logger *slog.Logger) *ProfileHandler {
+	return &ProfileHandler{
+		userStore:    userStore,
+		messageStore: messageStore,
+		hub:          hub,
+		logger:       logger,
+		now:          time.Now,
+	}
+}
+
+// validate normalises req in place and returns a message per invalid field.
+func (req *UpdateProfileRequest) validate(now time.Time) (store.ProfileUpdate, map[string]string) {
+	fields := map[string]string{}
+	update := store.ProfileUpdate{Timezone: req.Timezone}
+
+	checkText := func(name string, value *string, maxLength int, multiline bool) *string {
+		if value == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(*value)
+		switch {
+		case !utf8.ValidString(trimmed):
+			fields[name] = "must be valid UTF-8"
+		case utf8.RuneCountInString(trimmed) > maxLength:
+			fields[name] = "must be at most " + strconv.Itoa(maxLength) + " characters"
+		case strings.IndexFunc(trimmed, func(r rune) bool {
+			return unicode.IsControl(r) && !(multiline && r == '\n')
+		}) >= 0:
+			fields[name] = "must not contain control characters"
+		}
+		return &trimmed
+	}
+
+	update.DisplayName = checkText("display_name", req.DisplayName, maxDisplayNameLength, false)
+	update.Bio = checkText("bio", req.Bio, maxBioLength, true)
+	update.StatusText = checkText("status_text", req.StatusText, maxStatusTextLength, false)
+
+	if req.StatusExpiresIn != nil {
+		expiresIn := time.Duration(*req.StatusExpiresIn) * time.Second
+		switch {
+		case req.StatusText == nil:
+			fields["status_expires_in"] = "requires status_text"
+		case expiresIn <= 0 || expiresIn > maxStatusDuration:
+			fields["status_expires_in"] = "must be between 1 second and 30 days"
+		default:
+			expiresAt := now.Add(expiresIn)
+			update.StatusExpiresAt = &expiresAt
+		}
+	}
+
+	if req.Timezone != nil && *req.Timezone != "" {
+		if _, err := time.LoadLocation(*req.Timezone); err != nil || *req.Timezone == "Local" {
+			fields["timezone"] = "must be an IANA time zone such as Europe/Berlin"
+		}
+	}
+
+	return update, fields
+}
+
+func (h *ProfileHandler) Update(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	var req UpdateProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
+		return
+	}
+
+	update, fields := req.validate(h.now())
+	if len(fields) > 0 {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "Invalid profile", "fields": fields})
+		return
+	}
+
+	user, err := h.userStore.UpdateProfile(r.Context(), userID, update)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updating profile", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update profile"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "profile updated", "user_id", userID)
+	h.publishProfile(r.Context(), user)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// UploadAvatar accepts a multipart form with the image in the "avatar" field.
+func (h *ProfileHandler) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	r.Body = http.MaxBytesReader(w, r.Body, avatar.MaxUploadBytes+1<<20)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "reading avatar upload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "An image in the avatar field is required"})
+		return
+	}
+	defer file.Close()
+
+	data, err := avatar.Process(file)
+	if err != nil {
+		if errors.Is(err, avatar.ErrTooLarge) || errors.Is(err, avatar.ErrUnsupportedFormat) {
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "Invalid avatar", "fields": map[string]string{"avatar": err.Error()}})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "processing avatar", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to process avatar"})
+		return
+	}
+
+	user, err := h.userStore.SetAvatar(r.Context(), userID, avatar.ContentType, data)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "storing avatar", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to store avatar"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "avatar updated", "user_id", userID)
+	h.publishProfile(r.Context(), user)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// Avatar serves a user's stored avatar image. It is public so it can be used
+// directly as an <img> source.
+func (h *ProfileHandler) Avatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID"})
+		return
+	}
+
+	contentType, data, err := h.userStore.GetAvatar(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Avatar not found"})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "getting avatar", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to get avatar"})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// Avatar URLs carry a version parameter, so a stale cache is never served
+	if r.URL.Query().Get("v") != "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(data)
+}
+
+// publishProfile sends a profile_updated frame to the user's own connections
+// and to everyone they share a conversation with.
+func (h *ProfileHandler) publishProfile(ctx context.Context, user *store.User) {
+	partnerIDs, err := h.messageStore.GetConversationPartnerIDs(ctx, user.ID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "getting conversation partners", "error", err)
+		partnerIDs = nil
+	}
+
+	frame := map[string]interface{}{
+		"type": "profile_updated",
+		"user": user,
+	}
+	for _, id := range append(partnerIDs, user.ID) {
+		_ = h.hub.sendToUser(id, frame)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProfileHandler() (*ProfileHandler, *MockUserStore, *MockMessageStore) {
+	userStore := &MockUserStore{}
+	messageStore := &MockMessageStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+
+	hub := NewWebSocketHandler(messageStore, userStore, noRelations(), logger)
+	handler := NewProfileHandler(userStore, messageStore, hub, logger)
+	handler.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return handler, userStore, messageStore
+}
+
+func strPtr(s string) *string { return &s }
+func intPtr(i int) *int       { return &i }
+
+func TestUpdateProfileRequest_Validate(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		request UpdateProfileRequest
+		invalid string
+	}{
+		{"valid", UpdateProfileRequest{DisplayName: strPtr("Alice"), Timezone: strPtr("Europe/Berlin")}, ""},
+		{"multiline bio", UpdateProfileRequest{Bio: strPtr("line one\nline two")}, ""},
+		{"long display name", UpdateProfileRequest{DisplayName: strPtr(strings.Repeat("a", 65))}, "display_name"},
+		{"control characters", UpdateProfileRequest{DisplayName: strPtr("bad\x07name")}, "display_name"},
+		{"newline in status", UpdateProfileRequest{StatusText: strPtr("a\nb")}, "status_text"},
+		{"long bio", UpdateProfileRequest{Bio: strPtr(strings.Repeat("b", 501))}, "bio"},
+		{"unknown timezone", UpdateProfileRequest{Timezone: strPtr("Mars/Olympus")}, "timezone"},
+		{"expiry without status", UpdateProfileRequest{StatusExpiresIn: intPtr(60)}, "status_expires_in"},
+		{"negative expiry", UpdateProfileRequest{StatusText: strPtr("busy"), StatusExpiresIn: intPtr(-1)}, "status_expires_in"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fields := tt.request.validate(now)
+			if tt.invalid == "" {
+				assert.Empty(t, fields)
+			} else {
+				assert.Contains(t, fields, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileRequest_ValidateNormalises(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	req := UpdateProfileRequest{StatusText: strPtr("  in a meeting "), StatusExpiresIn: intPtr(3600)}
+
+	update, fields := req.validate(now)
+	require.Empty(t, fields)
+	assert.Equal(t, "in a meeting", *update.StatusText)
+	assert.Equal(t, now.Add(time.Hour), *update.StatusExpiresAt)
+	assert.Nil(t, update.DisplayName)
+}
+
+func TestProfileHandler_Update(t *testing.T) {
+	handler, userStore, messageStore := newTestProfileHandler()
+	updated := &store.User{ID: 1, Username: "alice", DisplayName: "Alice A."}
+	userStore.On("UpdateProfile", 1, mock.MatchedBy(func(u store.ProfileUpdate) bool {
+		return u.DisplayName != nil && *u.DisplayName == "Alice A."
+	})).Return(updated, nil)
+	messageStore.On("GetConversationPartnerIDs", 1).Return([]int{2, 3}, nil)
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/user.update", bytes.NewBufferString(`{"display_name": "Alice A."}`)), 1)
+	w := httptest.NewRecorder()
+
+	handler.Update(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Alice A.")
+	userStore.AssertExpectations(t)
+	messageStore.AssertExpectations(t)
+}
+
+func TestProfileHandler_Update_ReturnsFieldErrors(t *testing.T) {
+	handler, userStore, _ := newTestProfileHandler()
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/user.update", bytes.NewBufferString(`{"timezone": "Nowhere/Land"}`)), 1)
+	w := httptest.NewRecorder()
+
+	handler.Update(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var response struct {
+		Fields map[string]string `json:"fields"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Contains(t, response.Fields, "timezone")
+	userStore.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything)
+}
+
+func TestProfileHandler_RequiresSession(t *testing.T) {
+	handler, userStore, _ := newTestProfileHandler()
+
+	w := httptest.NewRecorder()
+	handler.Update(w, httptest.NewRequest(http.MethodPost, "/user.update?user_id=1", bytes.NewBufferString(`{"display_name": "Mallory"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.UploadAvatar(w, httptest.NewRequest(http.MethodPost, "/user.avatar.upload?user_id=1", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	userStore.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything)
+	userStore.AssertNotCalled(t, "SetAvatar", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestProfileHandler_Avatar(t *testing.T) {
+	handler, userStore, _ := newTestProfileHandler()
+	userStore.On("GetAvatar", 1).Return("image/png", []byte("png-bytes"), nil)
+	userStore.On("GetAvatar", 2).Return("", nil, sql.ErrNoRows)
+
+	req := httptest.NewRequest(http.MethodGet, "/user.avatar?id=1&v=123", nil)
+	w := httptest.NewRecorder()
+	handler.Avatar(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+	assert.Equal(t, "png-bytes", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/user.avatar?id=2", nil)
+	w = httptest.NewRecorder()
+	handler.Avatar(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
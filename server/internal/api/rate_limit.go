@@ -0,0 +1,50 @@
+package api
+
+import (
+	"chat/internal/ratelimit"
+	"chat/internal/utils"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// codeRateLimited marks responses and error frames refused by a rate limit.
+const codeRateLimited = "rate_limited"
+
+// RateLimit is chi middleware applying the limit configured for each route's
+// path, or the default HTTP limit. Signed-in callers are limited per user and
+// everyone else per IP address, so it must run after Authenticator.Middleware.
+func RateLimit(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := r.URL.Path
+			if !limiter.Has(name) {
+				name = ratelimit.HTTPDefault
+			}
+
+			caller := "ip:" + clientIP(r)
+			if session := sessionFromContext(r.Context()); session != nil {
+				caller = "user:" + strconv.Itoa(session.UserID)
+			}
+
+			if allowed, retryAfter := limiter.Allow(r.Context(), name, caller); !allowed {
+				seconds := retryAfterSeconds(retryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{
+					"error":       "Too many requests, try again later",
+					"code":        codeRateLimited,
+					"retry_after": seconds,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, as Retry-After
+// expects.
+func retryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
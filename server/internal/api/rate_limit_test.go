@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/ratelimit"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(limits map[string]ratelimit.Limit) *ratelimit.Limiter {
+	return ratelimit.NewLimiter(ratelimit.NewMemoryStore(), limits, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+}
+
+func TestRateLimit_Middleware(t *testing.T) {
+	limiter := newTestLimiter(map[string]ratelimit.Limit{
+		ratelimit.HTTPDefault: {Requests: 100, Per: time.Minute},
+		"/user.register":      {Requests: 1, Per: time.Hour},
+	})
+	handler := RateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(path, remoteAddr string, session *store.Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = remoteAddr
+		if session != nil {
+			req = withSession(req, session)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, request("/user.register", "203.0.113.7:5555", nil).Code)
+
+	w := request("/user.register", "203.0.113.7:6666", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code": "rate_limited"`)
+
+	// Other addresses, users and routes have their own buckets
+	assert.Equal(t, http.StatusNoContent, request("/user.register", "198.51.100.1:5555", nil).Code)
+	assert.Equal(t, http.StatusNoContent, request("/user.register", "203.0.113.7:5555", &store.Session{ID: 1, UserID: 1}).Code)
+	assert.Equal(t, http.StatusNoContent, request("/user.login", "203.0.113.7:5555", nil).Code)
+}
+
+func TestWebSocketHandler_RateLimitsFrames(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	handler.hub.SetRateLimiter(newTestLimiter(map[string]ratelimit.Limit{
+		"send_message": {Requests: 1, Per: 10 * time.Second},
+	}))
+	messageStore.On("CreateMessage", 1, 2, "one").Return(&store.Message{ID: 1}, nil)
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+
+	sender := newQueuedClient("sse", 1)
+	handler.hub.register(context.Background(), 1, sender)
+
+	handler.hub.handleMessage(context.Background(), 1, sender, &WSMessage{Type: "send_message", ReceiverID: 2, Content: "one"})
+	handler.hub.handleMessage(context.Background(), 1, sender, &WSMessage{Type: "send_message", ReceiverID: 2, Content: "two"})
+
+	var limited *WSMessage
+	for len(sender.frames) > 0 {
+		if frame, ok := (<-sender.frames).(WSMessage); ok && frame.Code == codeRateLimited {
+			limited = &frame
+		}
+	}
+	require.NotNil(t, limited, "the second frame should be refused")
+	assert.Equal(t, "error", limited.Type)
+	assert.Equal(t, 10, limited.RetryAfter)
+	messageStore.AssertNumberOfCalls(t, "CreateMessage", 1)
+}
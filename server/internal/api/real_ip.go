@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RealIP is chi middleware that attributes requests arriving through a
+// trusted reverse proxy to the client named in X-Forwarded-For. The header is
+// read from the right, skipping trusted hops, so a client cannot choose its
+// address by sending the header itself. Requests from anywhere else keep
+// their peer address, and with no trusted proxies the header is ignored.
+//
+// It must run before anything that calls clientIP, such as rate limiting.
+func RealIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(trusted) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, err := netip.ParseAddr(clientIP(r))
+			if err == nil && isTrusted(peer.Unmap()) {
+				if client, ok := forwardedFor(r.Header.Values("X-Forwarded-For"), isTrusted); ok {
+					r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the rightmost address in the X-Forwarded-For values
+// that is not a trusted proxy. If every hop is trusted the leftmost is used.
+func forwardedFor(values []string, isTrusted func(netip.Addr) bool) (netip.Addr, bool) {
+	hops := strings.Split(strings.Join(values, ","), ",")
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Anything left of a malformed entry cannot be trusted either
+			break
+		}
+		client = addr.Unmap()
+		if !isTrusted(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
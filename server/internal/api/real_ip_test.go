@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	var seen string
+	handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = clientIP(r)
+	}))
+
+	request := func(remoteAddr string, forwardedFor ...string) string {
+		req := httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+		req.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return seen
+	}
+
+	// Through a trusted proxy the client it saw is used, past any other
+	// trusted hops but not past addresses the client made up
+	assert.Equal(t, "203.0.113.7", request("10.0.0.1:4000", "203.0.113.7"))
+	assert.Equal(t, "203.0.113.7", request("10.0.0.1:4000", "198.51.100.1, 203.0.113.7, 10.0.0.2"))
+	assert.Equal(t, "203.0.113.7", request("10.0.0.1:4000", "198.51.100.1", "203.0.113.7"))
+	assert.Equal(t, "2001:db8::1", request("10.0.0.1:4000", "2001:db8::1"))
+	assert.Equal(t, "10.0.0.3", request("10.0.0.1:4000", "10.0.0.3"))
+
+	// Without a usable header the proxy itself is the client
+	assert.Equal(t, "10.0.0.1", request("10.0.0.1:4000"))
+	assert.Equal(t, "10.0.0.1", request("10.0.0.1:4000", "unknown"))
+
+	// Anyone else cannot set their address
+	assert.Equal(t, "198.51.100.9", request("198.51.100.9:4000", "203.0.113.7"))
+
+	// With no trusted proxies the header is ignored
+	handler = RealIP(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = clientIP(r)
+	}))
+	assert.Equal(t, "10.0.0.1", request("10.0.0.1:4000", "203.0.113.7"))
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+type RelationRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// RelationHandler manages a user's block and mute lists.
+type RelationHandler struct {
+	relations store.RelationStore
+	userStore store.UserStore
+	hub       *WebSocketHandler
+	logger    *slog.Logger
+}
+
+func NewRelationHandler(relations store.RelationStore, userStore store.UserStore, hub *WebSocketHandler, logger *slog.Logger) *RelationHandler {
+	return &RelationHandler{
+		relations: relations,
+		userStore: userStore,
+		hub:       hub,
+		logger:    logger,
+	}
+}
+
+// Block stops all messages between the caller and user_id, in both
+// directions, and hides each from the other's directory. The blocked user is
+// not told.
+func (h *RelationHandler) Block(w http.ResponseWriter, r *http.Request) {
+	userID, targetID, ok := h.decodeTarget(w, r)
+	if !ok {
+		return
+	}
+	if !h.update(r.Context(), w, h.relations.AddRelation, store.RelationBlock, userID, targetID) {
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user blocked", "user_id", userID, "target_id", targetID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User blocked"})
+}
+
+func (h *RelationHandler) Unblock(w http.ResponseWriter, r *http.Request) {
+	userID, targetID, ok := h.decodeTarget(w, r)
+	if !ok {
+		return
+	}
+	if !h.update(r.Context(), w, h.relations.RemoveRelation, store.RelationBlock, userID, targetID) {
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user unblocked", "user_id", userID, "target_id", targetID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User unblocked"})
+}
+
+// Mute keeps messages from user_id arriving but without notifications.
+func (h *RelationHandler) Mute(w http.ResponseWriter, r *http.Request) {
+	userID, targetID, ok := h.decodeTarget(w, r)
+	if !ok {
+		return
+	}
+	if !h.update(r.Context(), w, h.relations.AddRelation, store.RelationMute, userID, targetID) {
+		return
+	}
+
+	// The conversation's muted flag changed
+	h.hub.PublishConversation(r.Context(), userID, targetID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User muted"})
+}
+
+func (h *RelationHandler) Unmute(w http.ResponseWriter, r *http.Request) {
+	userID, targetID, ok := h.decodeTarget(w, r)
+	if !ok {
+		return
+	}
+	if !h.update(r.Context(), w, h.relations.RemoveRelation, store.RelationMute, userID, targetID) {
+		return
+	}
+
+	h.hub.PublishConversation(r.Context(), userID, targetID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User unmuted"})
+}
+
+// GetBlocked lists the users the caller has blocked.
+func (h *RelationHandler) GetBlocked(w http.ResponseWriter, r *http.Request) {
+	h.list(w, r, store.RelationBlock)
+}
+
+// GetMuted lists the users the caller has muted.
+func (h *RelationHandler) GetMuted(w http.ResponseWriter, r *http.Request) {
+	h.list(w, r, store.RelationMute)
+}
+
+func (h *RelationHandler) list(w http.ResponseWriter, r *http.Request, relation store.Relation) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := h.relations.GetRelations(r.Context(), relation, session.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "listing relations", "relation", relation, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": users})
+}
+
+// decodeTarget resolves the caller and the existing user they name.
+func (h *RelationHandler) decodeTarget(w http.ResponseWriter, r *http.Request) (userID, targetID int, ok bool) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return 0, 0, false
+	}
+	userID = session.UserID
+
+	var req RelationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.UserID == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID is required"})
+		return 0, 0, false
+	}
+	if req.UserID == userID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "You cannot do this to yourself"})
+		return 0, 0, false
+	}
+
+	_, err = h.userStore.GetUserByID(r.Context(), req.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "User not found"})
+			return 0, 0, false
+		}
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return 0, 0, false
+	}
+	return userID, req.UserID, true
+}
+
+func (h *RelationHandler) update(ctx context.Context, w http.ResponseWriter, apply func(context.Context, store.Relation, int, int) error, relation store.Relation, userID, targetID int) bool {
+	if err := apply(ctx, relation, userID, targetID); err != nil {
+		h.logger.ErrorContext(ctx, "updating relation", "relation", relation, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockRelationStore implements the RelationStore interface for testing
+type MockRelationStore struct {
+	mock.Mock
+}
+
+func (m *MockRelationStore) AddRelation(_ context.Context, relation store.Relation, userID, targetID int) error {
+	args := m.Called(relation, userID, targetID)
+	return args.Error(0)
+}
+
+func (m *MockRelationStore) RemoveRelation(_ context.Context, relation store.Relation, userID, targetID int) error {
+	args := m.Called(relation, userID, targetID)
+	return args.Error(0)
+}
+
+func (m *MockRelationStore) GetRelations(_ context.Context, relation store.Relation, userID int) ([]*store.User, error) {
+	args := m.Called(relation, userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.User), args.Error(1)
+}
+
+func (m *MockRelationStore) IsBlockedBetween(_ context.Context, userID, otherUserID int) (bool, error) {
+	args := m.Called(userID, otherUserID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRelationStore) IsMuted(_ context.Context, userID, targetID int) (bool, error) {
+	args := m.Called(userID, targetID)
+	return args.Bool(0), args.Error(1)
+}
+
+// noRelations is a relation store where nobody has blocked or muted anyone.
+func noRelations() *MockRelationStore {
+	relations := &MockRelationStore{}
+	relations.On("IsBlockedBetween", mock.Anything, mock.Anything).Return(false, nil).Maybe()
+	relations.On("IsMuted", mock.Anything, mock.Anything).Return(false, nil).Maybe()
+	return relations
+}
+
+func newTestRelationHub(relations *MockRelationStore) (*WebSocketHandler, *MockMessageStore) {
+	userStore := &MockUserStore{}
+	messageStore := &MockMessageStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob"}, nil).Maybe()
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+	return NewWebSocketHandler(messageStore, userStore, relations, logger), messageStore
+}
+
+func TestSendMessage_RefusesBlockedUsers(t *testing.T) {
+	relations := &MockRelationStore{}
+	relations.On("IsBlockedBetween", 1, 2).Return(true, nil)
+	hub, messageStore := newTestRelationHub(relations)
+
+	_, err := hub.SendMessage(context.Background(), 1, 2, "hello")
+
+	var clientErr *ClientError
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusForbidden, clientErr.Status)
+	assert.Equal(t, "Message could not be delivered", clientErr.Message)
+	messageStore.AssertNotCalled(t, "CreateMessage", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSendMessage_MutedStillDelivers(t *testing.T) {
+	relations := &MockRelationStore{}
+	relations.On("IsBlockedBetween", 1, 2).Return(false, nil)
+	relations.On("IsMuted", 2, 1).Return(true, nil)
+	hub, messageStore := newTestRelationHub(relations)
+	messageStore.On("CreateMessage", 1, 2, "hello").Return(&store.Message{ID: 3}, nil)
+
+	sender := newQueuedClient("sse", 1)
+	recipient := newQueuedClient("sse", 2)
+	hub.register(context.Background(), 1, sender)
+	hub.register(context.Background(), 2, recipient)
+
+	_, err := hub.SendMessage(context.Background(), 1, 2, "hello")
+	require.NoError(t, err)
+
+	received := (<-recipient.frames).(WSMessage)
+	assert.Equal(t, 3, received.ID)
+	assert.True(t, received.Muted)
+
+	echoed := (<-sender.frames).(WSMessage)
+	assert.False(t, echoed.Muted)
+}
+
+func newTestRelationHandler() (*RelationHandler, *MockRelationStore, *MockUserStore) {
+	relations := &MockRelationStore{}
+	userStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+	hub := NewWebSocketHandler(&MockMessageStore{}, userStore, relations, logger)
+	return NewRelationHandler(relations, userStore, hub, logger), relations, userStore
+}
+
+func TestRelationHandler_Block(t *testing.T) {
+	handler, relations, userStore := newTestRelationHandler()
+	session := &store.Session{ID: 5, UserID: 1}
+
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "mallory"}, nil)
+	userStore.On("GetUserByID", 404).Return(nil, sql.ErrNoRows)
+	relations.On("AddRelation", store.RelationBlock, 1, 2).Return(nil)
+
+	w := httptest.NewRecorder()
+	handler.Block(w, withSession(postJSON("/user.block", RelationRequest{UserID: 1}), session))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.Block(w, withSession(postJSON("/user.block", RelationRequest{UserID: 404}), session))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.Block(w, withSession(postJSON("/user.block", RelationRequest{UserID: 2}), session))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	relations.AssertExpectations(t)
+	relations.AssertNumberOfCalls(t, "AddRelation", 1)
+}
+
+func TestRelationHandler_GetMuted(t *testing.T) {
+	handler, relations, _ := newTestRelationHandler()
+	relations.On("GetRelations", store.RelationMute, 1).Return([]*store.User{{ID: 2, Username: "bob"}}, nil)
+
+	w := httptest.NewRecorder()
+	handler.GetMuted(w, withSession(httptest.NewRequest(http.MethodGet, "/user.mutes", nil), &store.Session{ID: 5, UserID: 1}))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username": "bob"`)
+}
+
+// The legacy user_id parameter names anyone, so it must not reach relations
+func TestRelationHandler_RequiresSession(t *testing.T) {
+	handler, relations, _ := newTestRelationHandler()
+
+	w := httptest.NewRecorder()
+	handler.Block(w, postJSON("/user.block?user_id=1", RelationRequest{UserID: 2}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.GetBlocked(w, httptest.NewRequest(http.MethodGet, "/user.blocks?user_id=1", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	relations.AssertNotCalled(t, "AddRelation", mock.Anything, mock.Anything, mock.Anything)
+	relations.AssertNotCalled(t, "GetRelations", mock.Anything, mock.Anything)
+}
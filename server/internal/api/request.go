@@ -0,0 +1,16 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// intQueryParam parses an optional integer query parameter, returning def
+// when it is absent.
+func intQueryParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
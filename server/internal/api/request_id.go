@@ -0,0 +1,29 @@
+package api
+
+import (
+	"chat/internal/logging"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader carries the ID of a request, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID bounds the IDs accepted from callers, so a proxy's ID can be
+// reused without letting clients write arbitrary text into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID is chi middleware giving every request an ID, taken from the
+// X-Request-ID header when a proxy already set one. The ID is echoed in the
+// response and attached to every log line written for the request, so it
+// should run before other middleware.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = logging.NewID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"chat/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	request := func(header string) string {
+		req := httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+		if header != "" {
+			req.Header.Set(RequestIDHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+		return seen
+	}
+
+	// A proxy's ID is kept
+	assert.Equal(t, "edge-1f2e.3", request("edge-1f2e.3"))
+
+	// Missing or unsafe IDs are replaced
+	generated := request("")
+	assert.Len(t, generated, 16)
+	assert.NotEqual(t, generated, request(""))
+	assert.Len(t, request("evil\nlevel=ERROR msg=forged"), 16)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"chat/internal/utils"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// codeShuttingDown marks responses and error frames refused while the server
+// drains for a restart.
+const codeShuttingDown = "server_shutting_down"
+
+var errShuttingDown = &ClientError{Status: http.StatusServiceUnavailable, Message: "Server is shutting down", Code: codeShuttingDown}
+
+// Ready reports whether the handler accepts connections and messages,
+// which it stops doing once Shutdown begins.
+func (h *WebSocketHandler) Ready(context.Context) error {
+	if h.draining.Load() {
+		return errors.New("draining connections")
+	}
+	return nil
+}
+
+// Shutdown drains the handler before the server stops. It refuses new
+// connections and messages, sends every client a server_shutdown frame
+// telling it to reconnect after reconnectAfter, waits for messages already
+// being sent, then closes every connection with going-away status.
+// Connections are closed even if ctx ends first, in which case its error is
+// returned.
+func (h *WebSocketHandler) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	h.sendsMutex.Lock()
+	h.reconnectAfter = reconnectAfter
+	h.draining.Store(true)
+	idle := make(chan struct{})
+	if h.sends == 0 {
+		close(idle)
+	} else {
+		h.sendsIdle = idle
+	}
+	h.sendsMutex.Unlock()
+
+	frame := WSMessage{Type: "server_shutdown", RetryAfter: retryAfterSeconds(reconnectAfter)}
+	for _, c := range h.allClients() {
+		_ = c.send(frame, h.logger)
+	}
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		h.logger.ErrorContext(ctx, "messages still sending at shutdown", "error", err)
+	}
+
+	clients := h.removeAllClients()
+	for _, c := range clients {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	h.logger.InfoContext(ctx, "closed connections for shutdown", "count", len(clients))
+	return err
+}
+
+// beginSend registers a message being sent, or reports false once draining.
+// Every successful call must be paired with endSend.
+func (h *WebSocketHandler) beginSend() bool {
+	h.sendsMutex.Lock()
+	defer h.sendsMutex.Unlock()
+	if h.draining.Load() {
+		return false
+	}
+	h.sends++
+	return true
+}
+
+func (h *WebSocketHandler) endSend() {
+	h.sendsMutex.Lock()
+	defer h.sendsMutex.Unlock()
+	h.sends--
+	if h.sends == 0 && h.sendsIdle != nil {
+		close(h.sendsIdle)
+		h.sendsIdle = nil
+	}
+}
+
+// refuseIfDraining answers 503 with a Retry-After hint once Shutdown has
+// begun, and reports whether it did.
+func (h *WebSocketHandler) refuseIfDraining(w http.ResponseWriter) bool {
+	if !h.draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(h.reconnectAfter)))
+	utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": errShuttingDown.Message, "code": codeShuttingDown})
+	return true
+}
+
+func (h *WebSocketHandler) allClients() []client {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	var clients []client
+	for _, conns := range h.clients {
+		for c := range conns {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// removeAllClients empties the registry and returns what it held.
+func (h *WebSocketHandler) removeAllClients() []client {
+	h.clientsMutex.Lock()
+	var clients []client
+	for _, conns := range h.clients {
+		for c := range conns {
+			clients = append(clients, c)
+		}
+	}
+	h.clients = make(map[int]map[client]struct{})
+	h.clientsMutex.Unlock()
+
+	h.pollersMutex.Lock()
+	for key, poller := range h.pollers {
+		poller.expiry.Stop()
+		delete(h.pollers, key)
+	}
+	h.pollersMutex.Unlock()
+	return clients
+}
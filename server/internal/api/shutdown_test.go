@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newDrainTestHandler returns a handler whose CreateMessage blocks until
+// release is closed, and a connected WebSocket for user 1.
+func newDrainTestHandler(t *testing.T) (*WebSocketHandler, *websocket.Conn, string, chan struct{}) {
+	userStore := &MockUserStore{}
+	messageStore := &MockMessageStore{}
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob"}, nil).Maybe()
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+
+	release := make(chan struct{})
+	messageStore.On("CreateMessage", 1, 2, "in flight").
+		Run(func(mock.Arguments) { <-release }).
+		Return(&store.Message{ID: 7}, nil)
+
+	handler := NewWebSocketHandler(messageStore, userStore, noRelations(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	server := httptest.NewServer(withTestSessions(http.HandlerFunc(handler.HandleWebSocket)))
+	t.Cleanup(server.Close)
+
+	url := "ws" + server.URL[4:] + "/?access_token=token-1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.Eventually(t, func() bool { return len(handler.allClients()) == 1 }, time.Second, 10*time.Millisecond)
+	return handler, conn, url, release
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var frame WSMessage
+	require.NoError(t, conn.ReadJSON(&frame))
+	return frame
+}
+
+func TestShutdown_DrainsConnections(t *testing.T) {
+	handler, conn, url, release := newDrainTestHandler(t)
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := handler.SendMessage(context.Background(), 1, 2, "in flight")
+		sent <- err
+	}()
+	// Let the send reach CreateMessage
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- handler.Shutdown(context.Background(), 5*time.Second)
+	}()
+
+	frame := readFrame(t, conn)
+	assert.Equal(t, "server_shutdown", frame.Type)
+	assert.Equal(t, 5, frame.RetryAfter)
+
+	// New work is refused while the send is still in flight
+	_, err := handler.SendMessage(context.Background(), 1, 2, "too late")
+	var ce *ClientError
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, http.StatusServiceUnavailable, ce.Status)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown returned before the in-flight message was stored")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-sent)
+	require.NoError(t, <-stopped)
+
+	// The message still reaches the sender before the going-away close
+	assert.Equal(t, "new_message", readFrame(t, conn).Type)
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	handler, conn, _, release := newDrainTestHandler(t)
+	defer close(release)
+
+	go func() { _, _ = handler.SendMessage(context.Background(), 1, 2, "in flight") }()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, handler.Shutdown(ctx, time.Second), context.DeadlineExceeded)
+
+	// Connections are closed regardless
+	assert.Empty(t, handler.allClients())
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+}
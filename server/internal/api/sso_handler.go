@@ -0,0 +1,447 @@
+package api
+
+import (
+	"chat/internal/credentials"
+	"chat/internal/oidc"
+	"chat/internal/store"
+	"chat/internal/utils"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// oidcStateTTL is how long the user has to sign in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// maxUsernameAttempts bounds the search for a free username when
+	// provisioning an account.
+	maxUsernameAttempts = 5
+)
+
+// usernameInvalidChars matches what the default username policy rejects.
+var usernameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var (
+	// errSSOAccountNotFound means the provider account matches no user and
+	// the provider does not allow signing up.
+	errSSOAccountNotFound = errors.New("no account is linked to this sign-in")
+	// errSSOEmailUnverified means an account has the provider's email but
+	// has not shown it owns it. Anyone can register with someone else's
+	// address, so linking would hand that account to whoever registered it.
+	errSSOEmailUnverified = errors.New("account with this email has not verified it")
+)
+
+// SSOHandler serves sign-in through external OpenID Connect providers, next
+// to the password login. The callback redirects back to the client with the
+// outcome in the URL fragment, which never reaches a server log.
+type SSOHandler struct {
+	providers     map[string]*oidc.Provider
+	ordered       []*oidc.Provider // As configured, for the login page
+	userStore     store.UserStore
+	sessions      store.SessionStore
+	identities    store.IdentityStore
+	mfa           store.MFAStore
+	policy        *credentials.Policy
+	loginRedirect string
+	logger        *slog.Logger
+}
+
+// NewSSOHandler builds an SSOHandler. loginRedirect is the client page that
+// finishes the login.
+func NewSSOHandler(providers []*oidc.Provider, userStore store.UserStore, sessions store.SessionStore, identities store.IdentityStore, mfa store.MFAStore, policy *credentials.Policy, loginRedirect string, logger *slog.Logger) *SSOHandler {
+	byName := make(map[string]*oidc.Provider, len(providers))
+	for _, p := range providers {
+		byName[p.Config.Name] = p
+	}
+	return &SSOHandler{
+		providers:     byName,
+		ordered:       providers,
+		userStore:     userStore,
+		sessions:      sessions,
+		identities:    identities,
+		mfa:           mfa,
+		policy:        policy,
+		loginRedirect: loginRedirect,
+		logger:        logger,
+	}
+}
+
+// Providers lists the configured providers for the login page.
+func (h *SSOHandler) Providers(w http.ResponseWriter, r *http.Request) {
+	providers := make([]map[string]string, 0, len(h.providers))
+	for _, p := range h.ordered {
+		displayName := p.Config.DisplayName
+		if displayName == "" {
+			displayName = p.Config.Name
+		}
+		providers = append(providers, map[string]string{"name": p.Config.Name, "display_name": displayName})
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"providers": providers})
+}
+
+// Start redirects the browser to the provider's sign-in page.
+func (h *SSOHandler) Start(w http.ResponseWriter, r *http.Request) {
+	authURL, ok := h.authorize(w, r, 0)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Link returns the provider sign-in page that links the provider account to
+// the signed-in user's. It is fetched with the session token, which a
+// browser redirect could not carry, and the client then navigates there.
+func (h *SSOHandler) Link(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	authURL, ok := h.authorize(w, r, session.UserID)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"url": authURL})
+}
+
+// authorize stores a pending sign-in with the provider named in the request
+// and returns the provider's sign-in page, writing the error response itself
+// on failure. linkUserID is the user linking an account, or 0 to sign in.
+func (h *SSOHandler) authorize(w http.ResponseWriter, r *http.Request, linkUserID int) (string, bool) {
+	provider, ok := h.providers[r.URL.Query().Get("provider")]
+	if !ok {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Unknown sign-in provider"})
+		return "", false
+	}
+
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generating PKCE verifier", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return "", false
+	}
+	nonce, err := store.NewOIDCNonce()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generating nonce", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return "", false
+	}
+
+	state, err := h.identities.CreateOIDCState(r.Context(), &store.OIDCState{
+		Provider:     provider.Config.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+	}, oidcStateTTL)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "storing OIDC state", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return "", false
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "building authorization URL for", "provider", provider.Config.Name, "error", err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "Sign-in provider is unavailable"})
+		return "", false
+	}
+	return authURL, true
+}
+
+// Callback finishes a sign-in: it redeems the state, exchanges the code and
+// signs in the linked user, linking or creating one first if allowed. A
+// state started by Link instead links the provider account to its user.
+func (h *SSOHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		h.logger.InfoContext(r.Context(), "sign-in provider returned error", "provider_error", providerErr)
+		h.redirect(w, r, url.Values{"error": {"Sign-in was cancelled or denied"}})
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		h.redirect(w, r, url.Values{"error": {"Invalid sign-in response"}})
+		return
+	}
+
+	state, err := h.identities.ConsumeOIDCState(r.Context(), query.Get("state"))
+	if err != nil {
+		if !errors.Is(err, store.ErrInvalidToken) {
+			h.logger.ErrorContext(r.Context(), "consuming OIDC state", "error", err)
+		}
+		h.redirect(w, r, url.Values{"error": {"Sign-in expired, try again"}})
+		return
+	}
+	provider, ok := h.providers[state.Provider]
+	if !ok {
+		h.redirect(w, r, url.Values{"error": {"Unknown sign-in provider"}})
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "completing sign-in with", "provider", provider.Config.Name, "error", err)
+		h.redirect(w, r, url.Values{"error": {"Sign-in failed"}})
+		return
+	}
+
+	if state.LinkUserID != 0 {
+		h.finishLink(w, r, provider.Config.Name, state.LinkUserID, claims)
+		return
+	}
+
+	user, err := h.resolveUser(r.Context(), provider.Config, claims)
+	if err != nil {
+		if errors.Is(err, errSSOAccountNotFound) {
+			h.logger.InfoContext(r.Context(), "sign-in for unknown account", "provider", provider.Config.Name, "subject", claims.Subject)
+			h.redirect(w, r, url.Values{"error": {"No account is linked to this sign-in"}})
+			return
+		}
+		if errors.Is(err, errSSOEmailUnverified) {
+			h.logger.InfoContext(r.Context(), "sign-in matches account with unverified email", "provider", provider.Config.Name, "subject", claims.Subject)
+			h.redirect(w, r, url.Values{"error": {"An account already uses this email. Sign in with its password, then link this sign-in from your account"}})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "resolving user for sign-in", "provider", provider.Config.Name, "error", err)
+		h.redirect(w, r, url.Values{"error": {"Sign-in failed"}})
+		return
+	}
+
+	if user.Disabled() {
+		h.logger.InfoContext(r.Context(), "login refused for disabled user", "username", user.Username)
+		h.redirect(w, r, url.Values{"error": {"This account has been disabled"}})
+		return
+	}
+
+	// Two-factor accounts still need their second factor, as with a password
+	mfa, err := h.mfa.GetMFA(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		h.redirect(w, r, url.Values{"error": {"Sign-in failed"}})
+		return
+	}
+	if mfa.Enabled() {
+		challenge, err := h.mfa.CreateMFAChallenge(r.Context(), user.ID, mfaChallengeTTL)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "creating MFA challenge", "error", err)
+			h.redirect(w, r, url.Values{"error": {"Sign-in failed"}})
+			return
+		}
+		h.redirect(w, r, url.Values{"mfa_token": {challenge}})
+		return
+	}
+
+	token, session, err := h.sessions.CreateSession(r.Context(), user.ID, sessionTTL)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "creating session", "error", err)
+		h.redirect(w, r, url.Values{"error": {"Sign-in failed"}})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user logged in", "provider", provider.Config.Name, "username", user.Username)
+	h.redirect(w, r, url.Values{
+		"token":      {token},
+		"expires_at": {session.ExpiresAt},
+		"user_id":    {fmt.Sprint(user.ID)},
+		"username":   {user.Username},
+	})
+}
+
+// finishLink links the provider account to the user who started the link,
+// unless it already belongs to someone else.
+func (h *SSOHandler) finishLink(w http.ResponseWriter, r *http.Request, provider string, userID int, claims *oidc.Claims) {
+	linked, err := h.identities.GetUserByIdentity(r.Context(), provider, claims.Subject)
+	switch {
+	case err == nil && linked.ID == userID:
+		h.redirect(w, r, url.Values{"linked": {provider}})
+		return
+	case err == nil:
+		h.logger.InfoContext(r.Context(), "identity already linked to another user", "provider", provider, "user_id", userID)
+		h.redirect(w, r, url.Values{"error": {"This sign-in is already linked to another account"}})
+		return
+	case !errors.Is(err, sql.ErrNoRows):
+		h.logger.ErrorContext(r.Context(), "getting linked user", "error", err)
+		h.redirect(w, r, url.Values{"error": {"Linking failed"}})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getting user", "error", err)
+		h.redirect(w, r, url.Values{"error": {"Linking failed"}})
+		return
+	}
+	if user.Disabled() {
+		h.redirect(w, r, url.Values{"error": {"This account has been disabled"}})
+		return
+	}
+	if err := h.link(r.Context(), user, provider, claims.Subject, verifiedEmail(claims)); err != nil {
+		h.logger.ErrorContext(r.Context(), "linking identity", "error", err)
+		h.redirect(w, r, url.Values{"error": {"Linking failed"}})
+		return
+	}
+	h.logger.InfoContext(r.Context(), "identity linked", "provider", provider, "user_id", userID)
+	h.redirect(w, r, url.Values{"linked": {provider}})
+}
+
+// redirect sends the browser back to the client login page with values in
+// the fragment.
+func (h *SSOHandler) redirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, h.loginRedirect+"#"+values.Encode(), http.StatusFound)
+}
+
+// resolveUser finds the account for a provider identity. An identity already
+// linked wins; then, if the provider allows it, an account with the same
+// email is linked, as long as both sides have verified it; then, if signup is
+// allowed, a new account is created.
+func (h *SSOHandler) resolveUser(ctx context.Context, cfg oidc.Config, claims *oidc.Claims) (*store.User, error) {
+	user, err := h.identities.GetUserByIdentity(ctx, cfg.Name, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	email := verifiedEmail(claims)
+	if cfg.LinkByEmail && email != nil {
+		user, err = h.userStore.GetUserByEmail(ctx, *email)
+		if err == nil {
+			if !user.EmailVerified() {
+				return nil, errSSOEmailUnverified
+			}
+			h.logger.InfoContext(ctx, "linking identity to existing user by email", "provider", cfg.Name, "user_id", user.ID)
+			return user, h.link(ctx, user, cfg.Name, claims.Subject, email)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if !cfg.AllowSignup {
+		return nil, errSSOAccountNotFound
+	}
+
+	user, err = h.provision(ctx, claims, email)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.InfoContext(ctx, "user provisioned", "provider", cfg.Name, "username", user.Username)
+	return user, h.link(ctx, user, cfg.Name, claims.Subject, email)
+}
+
+// verifiedEmail returns the email the provider vouches for, if any.
+func verifiedEmail(claims *oidc.Claims) *string {
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil
+	}
+	return &claims.Email
+}
+
+func (h *SSOHandler) link(ctx context.Context, user *store.User, provider, subject string, email *string) error {
+	return h.identities.LinkIdentity(ctx, &store.Identity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+	})
+}
+
+// provision creates an account for a first-time sign-in. It gets a random
+// password nobody knows, so it can only sign in through the provider until a
+// password reset sets one.
+func (h *SSOHandler) provision(ctx context.Context, claims *oidc.Claims, email *string) (*store.User, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := h.userStore.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	base := h.usernameFor(claims)
+	for attempt := 0; attempt < maxUsernameAttempts; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, err := randomSuffix()
+			if err != nil {
+				return nil, err
+			}
+			keep := h.policy.MaxUsernameLength - credentials.TakenUsernameSuffixLength
+			if keep < 1 {
+				return nil, fmt.Errorf("%q is taken and a maximum username length of %d leaves no room for a suffix", base, h.policy.MaxUsernameLength)
+			}
+			username = truncate(base, keep) + "-" + suffix
+		}
+
+		user := &store.User{Username: username, PasswordHash: passwordHash, Email: email}
+		if email != nil {
+			// The provider vouched for the address
+			verifiedAt := time.Now().UTC().Format(time.RFC3339)
+			user.EmailVerifiedAt = &verifiedAt
+		}
+		err = h.userStore.CreateUser(ctx, user)
+		switch {
+		case err == nil:
+			return user, nil
+		case errors.Is(err, store.ErrEmailTaken):
+			// The address belongs to an account this provider may not link to
+			email = nil
+			attempt--
+		case !errors.Is(err, store.ErrUsernameTaken):
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free username for %q after %d attempts", base, maxUsernameAttempts)
+}
+
+// usernameFor derives a username from the identity that passes the username
+// policy: the preferred username, else the email's local part, else "user".
+func (h *SSOHandler) usernameFor(claims *oidc.Claims) string {
+	candidates := []string{claims.PreferredUsername}
+	if local, _, found := strings.Cut(claims.Email, "@"); found {
+		candidates = append(candidates, local)
+	}
+
+	for _, candidate := range candidates {
+		username := strings.TrimLeft(usernameInvalidChars.ReplaceAllString(candidate, ""), "._-")
+		username = truncate(username, h.policy.MaxUsernameLength)
+		if h.policy.ValidateUsername(username) == "" {
+			return username
+		}
+	}
+	return "user"
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func randomPassword() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// randomSuffix returns the random characters of a taken username's suffix,
+// one fewer than credentials.TakenUsernameSuffixLength.
+func randomSuffix() (string, error) {
+	raw := make([]byte, 3)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return strings.ToLower(recoveryCodeEncoding.EncodeToString(raw)), nil
+}
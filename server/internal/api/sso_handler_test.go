@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"chat/internal/credentials"
+	"chat/internal/oidc"
+	"chat/internal/oidc/oidctest"
+	"chat/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockIdentityStore implements the IdentityStore interface for testing
+type MockIdentityStore struct {
+	mock.Mock
+}
+
+func (m *MockIdentityStore) CreateOIDCState(_ context.Context, state *store.OIDCState, ttl time.Duration) (string, error) {
+	args := m.Called(state, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockIdentityStore) ConsumeOIDCState(_ context.Context, token string) (*store.OIDCState, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.OIDCState), args.Error(1)
+}
+
+func (m *MockIdentityStore) GetUserByIdentity(_ context.Context, provider, subject string) (*store.User, error) {
+	args := m.Called(provider, subject)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockIdentityStore) LinkIdentity(_ context.Context, identity *store.Identity) error {
+	args := m.Called(identity)
+	return args.Error(0)
+}
+
+const testLoginRedirect = "http://chat.example/login/callback"
+
+type ssoTest struct {
+	handler    *SSOHandler
+	issuer     *oidctest.Issuer
+	userStore  *MockUserStore
+	sessions   *MockSessionStore
+	identities *MockIdentityStore
+	mfa        *MockMFAStore
+}
+
+func newSSOTest(t *testing.T, cfg oidc.Config) *ssoTest {
+	issuer := oidctest.NewIssuer("chat-client", "s3cret")
+	t.Cleanup(issuer.Close)
+
+	cfg.Name = "corp"
+	cfg.IssuerURL = issuer.URL()
+	cfg.ClientID = "chat-client"
+	cfg.ClientSecret = "s3cret"
+	cfg.RedirectURL = "http://chat.example/auth.oidc.callback"
+	provider, err := oidc.NewProvider(cfg, nil)
+	require.NoError(t, err)
+
+	st := &ssoTest{
+		issuer:     issuer,
+		userStore:  &MockUserStore{},
+		sessions:   &MockSessionStore{},
+		identities: &MockIdentityStore{},
+		mfa:        noMFA(),
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	st.handler = NewSSOHandler([]*oidc.Provider{provider}, st.userStore, st.sessions, st.identities, st.mfa, credentials.DefaultPolicy(), testLoginRedirect, logger)
+	return st
+}
+
+// signIn runs the whole flow as the browser would and returns the values the
+// callback put in the client redirect's fragment.
+func (st *ssoTest) signIn(t *testing.T, user oidctest.User) url.Values {
+	st.issuer.SetUser(user)
+
+	var pending *store.OIDCState
+	st.identities.On("CreateOIDCState", mock.Anything, oidcStateTTL).Return("state-token", nil).Once().
+		Run(func(args mock.Arguments) { pending = args.Get(0).(*store.OIDCState) })
+
+	w := httptest.NewRecorder()
+	st.handler.Start(w, httptest.NewRequest(http.MethodGet, "/auth.oidc.start?provider=corp", nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	return st.finish(t, w.Header().Get("Location"), &pending)
+}
+
+// link runs the flow that links a provider account to the signed-in user.
+func (st *ssoTest) link(t *testing.T, userID int, user oidctest.User) url.Values {
+	st.issuer.SetUser(user)
+
+	var pending *store.OIDCState
+	st.identities.On("CreateOIDCState", mock.Anything, oidcStateTTL).Return("state-token", nil).Once().
+		Run(func(args mock.Arguments) { pending = args.Get(0).(*store.OIDCState) })
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth.oidc.link?provider=corp", nil)
+	st.handler.Link(w, withSession(r, &store.Session{ID: 7, UserID: userID}))
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		URL string `json:"url"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Equal(t, userID, pending.LinkUserID)
+	return st.finish(t, response.URL, &pending)
+}
+
+// finish signs in at the provider's authURL and follows it back through the
+// callback.
+func (st *ssoTest) finish(t *testing.T, authURL string, pending **store.OIDCState) url.Values {
+	require.True(t, strings.HasPrefix(authURL, st.issuer.URL()+"/authorize?"))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "state-token", callback.Query().Get("state"))
+
+	st.identities.On("ConsumeOIDCState", "state-token").Return(*pending, nil).Once()
+
+	w := httptest.NewRecorder()
+	st.handler.Callback(w, httptest.NewRequest(http.MethodGet, "/auth.oidc.callback?"+callback.RawQuery, nil))
+	require.Equal(t, http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, testLoginRedirect, location.Scheme+"://"+location.Host+location.Path)
+	fragment, err := url.ParseQuery(location.Fragment)
+	require.NoError(t, err)
+	return fragment
+}
+
+func TestSSOHandler_SignsInLinkedIdentity(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+	alice := &store.User{ID: 1, Username: "alice"}
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(alice, nil)
+	st.sessions.On("CreateSession", 1, sessionTTL).Return("session-token", &store.Session{ID: 5, UserID: 1}, nil)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-1"})
+	assert.Equal(t, "session-token", result.Get("token"))
+	assert.Equal(t, "1", result.Get("user_id"))
+	st.identities.AssertNotCalled(t, "LinkIdentity", mock.Anything)
+}
+
+func TestSSOHandler_LinksByVerifiedEmail(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{LinkByEmail: true})
+	email, verifiedAt := "alice@corp.example", "2024-04-01T00:00:00Z"
+	alice := &store.User{ID: 1, Username: "alice", Email: &email, EmailVerifiedAt: &verifiedAt}
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(nil, sql.ErrNoRows)
+	st.userStore.On("GetUserByEmail", "alice@corp.example").Return(alice, nil)
+	st.identities.On("LinkIdentity", mock.MatchedBy(func(identity *store.Identity) bool {
+		return identity.UserID == 1 && identity.Provider == "corp" && identity.Subject == "u-1"
+	})).Return(nil)
+	st.sessions.On("CreateSession", 1, sessionTTL).Return("session-token", &store.Session{ID: 5, UserID: 1}, nil)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-1", Email: "alice@corp.example", EmailVerified: true})
+	assert.Equal(t, "session-token", result.Get("token"))
+	st.identities.AssertExpectations(t)
+}
+
+// Anyone can register with someone else's address and a password of their
+// own; linking would let them sign in as the victim once the victim uses
+// single sign-on.
+func TestSSOHandler_RefusesLinkToPreRegisteredEmail(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{LinkByEmail: true, AllowSignup: true})
+	email := "alice@corp.example"
+	squatter := &store.User{ID: 1, Username: "alice", Email: &email}
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(nil, sql.ErrNoRows)
+	st.userStore.On("GetUserByEmail", "alice@corp.example").Return(squatter, nil)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-1", Email: "alice@corp.example", EmailVerified: true})
+	assert.Contains(t, result.Get("error"), "An account already uses this email")
+	assert.Empty(t, result.Get("token"))
+	st.identities.AssertNotCalled(t, "LinkIdentity", mock.Anything)
+	st.userStore.AssertNotCalled(t, "CreateUser", mock.Anything)
+	st.sessions.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
+
+func TestSSOHandler_LinksSignedInUser(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(nil, sql.ErrNoRows).Once()
+	st.userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil)
+	st.identities.On("LinkIdentity", mock.MatchedBy(func(identity *store.Identity) bool {
+		return identity.UserID == 1 && identity.Provider == "corp" && identity.Subject == "u-1"
+	})).Return(nil).Once()
+
+	result := st.link(t, 1, oidctest.User{Subject: "u-1"})
+	assert.Equal(t, "corp", result.Get("linked"))
+	assert.Empty(t, result.Get("token"), "linking does not start another session")
+
+	// The provider account cannot then be linked to someone else
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(&store.User{ID: 1, Username: "alice"}, nil)
+	result = st.link(t, 2, oidctest.User{Subject: "u-1"})
+	assert.Equal(t, "This sign-in is already linked to another account", result.Get("error"))
+
+	st.identities.AssertExpectations(t)
+	st.sessions.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
+
+func TestSSOHandler_LinkRequiresSession(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+
+	w := httptest.NewRecorder()
+	st.handler.Link(w, httptest.NewRequest(http.MethodGet, "/auth.oidc.link?provider=corp&user_id=1", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	st.identities.AssertNotCalled(t, "CreateOIDCState", mock.Anything, mock.Anything)
+}
+
+func TestSSOHandler_IgnoresUnverifiedEmail(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{LinkByEmail: true})
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(nil, sql.ErrNoRows)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-1", Email: "alice@corp.example"})
+	assert.Equal(t, "No account is linked to this sign-in", result.Get("error"))
+	assert.Empty(t, result.Get("token"))
+	st.userStore.AssertNotCalled(t, "GetUserByEmail", mock.Anything)
+}
+
+func TestSSOHandler_ProvisionsNewUser(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{AllowSignup: true})
+
+	st.identities.On("GetUserByIdentity", "corp", "u-2").Return(nil, sql.ErrNoRows)
+	st.userStore.On("HashPassword", mock.AnythingOfType("string")).Return("hash", nil)
+	st.userStore.On("CreateUser", mock.MatchedBy(func(u *store.User) bool { return u.Username == "bob.smith" })).
+		Return(store.ErrUsernameTaken).Once()
+	st.userStore.On("CreateUser", mock.MatchedBy(func(u *store.User) bool {
+		return strings.HasPrefix(u.Username, "bob.smith-") && *u.Email == "bob@corp.example" && u.EmailVerifiedAt != nil
+	})).Return(nil).Run(func(args mock.Arguments) { args.Get(0).(*store.User).ID = 2 })
+	st.identities.On("LinkIdentity", mock.MatchedBy(func(identity *store.Identity) bool {
+		return identity.UserID == 2 && identity.Subject == "u-2"
+	})).Return(nil)
+	st.sessions.On("CreateSession", 2, sessionTTL).Return("session-token", &store.Session{ID: 6, UserID: 2}, nil)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-2", Email: "bob@corp.example", EmailVerified: true, PreferredUsername: "bob.smith"})
+	assert.Equal(t, "2", result.Get("user_id"))
+	assert.True(t, strings.HasPrefix(result.Get("username"), "bob.smith-"))
+	st.userStore.AssertExpectations(t)
+	st.identities.AssertExpectations(t)
+}
+
+func TestSSOHandler_ProvisionWithoutRoomForSuffix(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{AllowSignup: true})
+	st.handler.policy.MinUsernameLength = 1
+	st.handler.policy.MaxUsernameLength = 5
+
+	st.userStore.On("HashPassword", mock.AnythingOfType("string")).Return("hash", nil)
+	st.userStore.On("CreateUser", mock.Anything).Return(store.ErrUsernameTaken).Once()
+
+	_, err := st.handler.provision(context.Background(), &oidc.Claims{PreferredUsername: "bob"}, nil)
+	assert.ErrorContains(t, err, "no room for a suffix")
+	st.userStore.AssertExpectations(t)
+}
+
+func TestSSOHandler_RequiresSecondFactor(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+	st.mfa = &MockMFAStore{}
+	st.handler.mfa = st.mfa
+
+	st.identities.On("GetUserByIdentity", "corp", "u-1").Return(&store.User{ID: 1, Username: "alice"}, nil)
+	st.mfa.On("GetMFA", 1).Return(enabledMFA(), nil)
+	st.mfa.On("CreateMFAChallenge", 1, mfaChallengeTTL).Return("challenge-token", nil)
+
+	result := st.signIn(t, oidctest.User{Subject: "u-1"})
+	assert.Equal(t, "challenge-token", result.Get("mfa_token"))
+	assert.Empty(t, result.Get("token"))
+	st.sessions.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
+
+func TestSSOHandler_CallbackRejectsUnknownState(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+	st.identities.On("ConsumeOIDCState", "forged").Return(nil, store.ErrInvalidToken)
+
+	w := httptest.NewRecorder()
+	st.handler.Callback(w, httptest.NewRequest(http.MethodGet, "/auth.oidc.callback?code=c&state=forged", nil))
+
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "#error=")
+}
+
+func TestSSOHandler_UsernameFor(t *testing.T) {
+	st := newSSOTest(t, oidc.Config{})
+
+	tests := []struct {
+		claims   oidc.Claims
+		expected string
+	}{
+		{oidc.Claims{PreferredUsername: "alice"}, "alice"},
+		{oidc.Claims{PreferredUsername: "Bob Smith"}, "BobSmith"},
+		{oidc.Claims{PreferredUsername: "__", Email: "carol.j@corp.example"}, "carol.j"},
+		{oidc.Claims{PreferredUsername: "admin"}, "user"},
+		{oidc.Claims{PreferredUsername: strings.Repeat("x", 40)}, strings.Repeat("x", 32)},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, st.handler.usernameFor(&tt.claims))
+	}
+}
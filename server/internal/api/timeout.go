@@ -0,0 +1,24 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Timeout is chi middleware giving each request a deadline of d, after
+// which store calls made with its context fail. Zero leaves requests
+// unbounded. Streaming routes, which stay open as long as the client does,
+// should not use it.
+func Timeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
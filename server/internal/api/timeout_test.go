@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeout(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	})
+
+	before := time.Now()
+	Timeout(time.Minute)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user.get", nil))
+	require.True(t, ok)
+	assert.WithinDuration(t, before.Add(time.Minute), deadline, time.Second)
+
+	Timeout(0)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user.get", nil))
+	assert.False(t, ok)
+}
+
+// blockingMessageStore holds GetConversations and CreateMessage until their
+// context ends, then reports why.
+type blockingMessageStore struct {
+	*MockMessageStore
+	started chan struct{}
+	ended   chan error
+}
+
+func (s *blockingMessageStore) GetConversations(ctx context.Context, _ int) ([]*store.Conversation, error) {
+	return nil, s.block(ctx)
+}
+
+func (s *blockingMessageStore) CreateMessage(ctx context.Context, _, _ int, _ string) (*store.Message, error) {
+	return nil, s.block(ctx)
+}
+
+func (s *blockingMessageStore) block(ctx context.Context) error {
+	close(s.started)
+	<-ctx.Done()
+	s.ended <- ctx.Err()
+	return ctx.Err()
+}
+
+func newBlockingWebSocketServer(t *testing.T, limits ConnectionLimits, frame WSMessage) (*websocket.Conn, *blockingMessageStore) {
+	userStore := &MockUserStore{}
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob"}, nil).Maybe()
+	messageStore := &blockingMessageStore{
+		MockMessageStore: &MockMessageStore{},
+		started:          make(chan struct{}),
+		ended:            make(chan error, 1),
+	}
+
+	handler := NewWebSocketHandler(messageStore, userStore, noRelations(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	handler.SetConnectionLimits(limits)
+	server := httptest.NewServer(withTestSessions(http.HandlerFunc(handler.HandleWebSocket)))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"?access_token=token-1", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.WriteJSON(frame))
+	return conn, messageStore
+}
+
+func TestWebSocket_FrameTimeout(t *testing.T) {
+	conn, messageStore := newBlockingWebSocketServer(t, ConnectionLimits{FrameTimeout: 50 * time.Millisecond}, WSMessage{Type: "get_conversations"})
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	var reply WSMessage
+	require.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "error", reply.Type)
+	assert.ErrorIs(t, <-messageStore.ended, context.DeadlineExceeded)
+}
+
+func TestWebSocket_CloseCancelsFrame(t *testing.T) {
+	conn, messageStore := newBlockingWebSocketServer(t, ConnectionLimits{}, WSMessage{Type: "get_conversations"})
+
+	select {
+	case <-messageStore.started:
+	case <-time.After(time.Second):
+		t.Fatal("frame was not handled")
+	}
+	conn.Close()
+
+	select {
+	case err := <-messageStore.ended:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("closing the connection did not cancel the frame")
+	}
+}
+
+// Storing a message is the one step a disconnect does not abandon; only the
+// frame timeout ends it.
+func TestWebSocket_CloseLetsMessageStoreFinish(t *testing.T) {
+	conn, messageStore := newBlockingWebSocketServer(t, ConnectionLimits{FrameTimeout: 200 * time.Millisecond},
+		WSMessage{Type: "send_message", ReceiverID: 2, Content: "last words"})
+
+	select {
+	case <-messageStore.started:
+	case <-time.After(time.Second):
+		t.Fatal("frame was not handled")
+	}
+	conn.Close()
+
+	select {
+	case err := <-messageStore.ended:
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "the insert ran until the frame timeout, not until the disconnect")
+	case <-time.After(time.Second):
+		t.Fatal("the frame timeout did not end the insert")
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"chat/internal/tracing"
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans handlers record.
+const tracerName = "chat/internal/api"
+
+// Tracing is chi middleware starting a span for each request, continuing the
+// caller's trace when it sends a traceparent header. Store calls made with
+// the request's context become its children. The span is named after the
+// route once routing is done.
+func Tracing(tp trace.TracerProvider) func(http.Handler) http.Handler {
+	tracer := tp.Tracer(tracerName)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+				))
+			defer span.End()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			route := routePattern(r)
+			status := responseStatus(ww, r)
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(
+				attribute.String("http.route", route),
+				attribute.Int("http.response.status_code", status),
+			)
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
+
+// startFrameSpan starts the trace for one frame read from a long-lived
+// connection. Each frame gets a trace of its own, linked to the connection's
+// request, rather than the connection collecting every frame in one trace.
+func (h *WebSocketHandler) startFrameSpan(connCtx context.Context, userID int, frameType string) (context.Context, trace.Span) {
+	return h.tracer.Start(connCtx, "frame "+frameTypeLabel(frameType),
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(connCtx)),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("chat.frame.type", frameTypeLabel(frameType)),
+			attribute.Int("chat.user_id", userID),
+		))
+}
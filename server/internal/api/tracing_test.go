@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"chat/internal/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracerProvider() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	rec := tracetest.NewSpanRecorder()
+	return tracing.NewSDKProvider(1, sdktrace.WithSpanProcessor(rec)), rec
+}
+
+func TestTracing(t *testing.T) {
+	tp, rec := newTestTracerProvider()
+	var handlerSpan trace.SpanContext
+	r := chi.NewRouter()
+	r.Use(Tracing(tp))
+	r.Get("/user.get", func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+	})
+	r.Post("/message.send", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/user.get?user_id=1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/message.send", nil))
+
+	spans := rec.Ended()
+	require.Len(t, spans, 2)
+
+	// The caller's trace is continued and handlers see the request's span
+	get := spans[0]
+	assert.Equal(t, "GET /user.get", get.Name())
+	assert.Equal(t, trace.SpanKindServer, get.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", get.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", get.Parent().SpanID().String())
+	assert.Equal(t, get.SpanContext(), handlerSpan)
+	assert.Contains(t, get.Attributes(), attribute.Int("http.response.status_code", http.StatusOK))
+	assert.Equal(t, codes.Unset, get.Status().Code)
+
+	send := spans[1]
+	assert.Equal(t, "POST /message.send", send.Name())
+	assert.False(t, send.Parent().IsValid())
+	assert.Equal(t, codes.Error, send.Status().Code)
+}
+
+func TestWebSocketHandler_FrameSpans(t *testing.T) {
+	handler, messageStore, _ := newTestMessageHandler()
+	tp, rec := newTestTracerProvider()
+	handler.hub.SetTracerProvider(tp)
+	messageStore.On("GetConversations", 1).Return([]*store.Conversation{}, nil)
+
+	r := chi.NewRouter()
+	r.Use(Tracing(tp))
+	r.With(withTestSessions).Get("/ws", handler.hub.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?access_token=token-1", nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.WriteJSON(WSMessage{Type: "get_conversations"}))
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		var reply WSMessage
+		require.NoError(t, conn.ReadJSON(&reply))
+	}
+	conn.Close()
+
+	// Frames end before the connection's request does
+	var upgrade sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		for _, span := range rec.Ended() {
+			if span.Name() == "GET /ws" {
+				upgrade = span
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	var frames []sdktrace.ReadOnlySpan
+	for _, span := range rec.Ended() {
+		if span.Name() == "frame get_conversations" {
+			frames = append(frames, span)
+		}
+	}
+	require.Len(t, frames, 2)
+	assert.NotEqual(t, frames[0].SpanContext().TraceID(), frames[1].SpanContext().TraceID())
+	for _, frame := range frames {
+		assert.NotEqual(t, upgrade.SpanContext().TraceID(), frame.SpanContext().TraceID())
+		require.Len(t, frame.Links(), 1)
+		assert.Equal(t, upgrade.SpanContext(), frame.Links()[0].SpanContext)
+		assert.Contains(t, frame.Attributes(), attribute.Int("chat.user_id", 1))
+	}
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"chat/internal/logging"
+	"chat/internal/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// queuedClientBuffer is how many undelivered frames an SSE or long-poll
+	// client may hold before it is told to resync.
+	queuedClientBuffer = 256
+	sseHeartbeat       = 25 * time.Second
+	pollTimeout        = 25 * time.Second
+	pollMaxFrames      = 100
+	// pollIdleTimeout is how long a long-poll client stays registered between
+	// requests, so frames sent while it reconnects are not lost.
+	pollIdleTimeout = time.Minute
+)
+
+var errClientBacklogged = errors.New("client frame queue is full")
+
+// resyncFrame replaces the queue of a client that fell too far behind. The
+// frames it missed are gone, so it has to refetch what it shows.
+var resyncFrame = WSMessage{Type: "resync"}
+
+// client is one live delivery channel to a user. WebSocket, SSE and long-poll
+// connections all register in the same WebSocketHandler registry, so the
+// delivery logic in handleMessage does not care which transport a user is on.
+type client interface {
+	send(data any, logger *slog.Logger) error
+	transport() string
+	// sessionID is the session the connection was opened with.
+	sessionID() int
+	// close ends the connection with a WebSocket close code and reason.
+	close(code int, reason string)
+}
+
+// queuedClient buffers frames for transports where the server cannot push
+// directly into a socket: SSE drains the queue on its own goroutine, long-poll
+// drains it once per request.
+type queuedClient struct {
+	name      string
+	session   int
+	frames    chan any
+	done      chan struct{}
+	closeOnce sync.Once
+	expiry    *time.Timer
+	// sendMu serializes senders, so a full queue can be swapped for
+	// resyncFrame without another frame slipping in.
+	sendMu sync.Mutex
+}
+
+func newQueuedClient(name string, session int) *queuedClient {
+	return &queuedClient{
+		name:    name,
+		session: session,
+		frames:  make(chan any, queuedClientBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+// send queues data. A client whose queue is full has stopped reading, or
+// cannot keep up; rather than leave a gap it would never notice, its queue is
+// dropped for a single resync frame.
+func (c *queuedClient) send(data any, logger *slog.Logger) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	select {
+	case c.frames <- data:
+		return nil
+	default:
+	}
+	// Only readers run concurrently, so the resync frame is sure to fit
+	dropped := len(drainFrames(c, queuedClientBuffer))
+	c.frames <- resyncFrame
+	logger.Warn("client fell behind, asking it to resync", "transport", c.name, "dropped", dropped+1)
+	return errClientBacklogged
+}
+
+func (c *queuedClient) transport() string {
+	return c.name
+}
+
+func (c *queuedClient) sessionID() int {
+	return c.session
+}
+
+// close ends a pending event stream or long poll.
+func (c *queuedClient) close(int, string) {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// HandleEventStream serves the chat event stream as Server-Sent Events for
+// clients whose proxies block WebSocket upgrades. Frames are sent with
+// POST /chat/send.
+func (h *WebSocketHandler) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok || !h.allowConnection(w, r, session.UserID) {
+		return
+	}
+	userID := session.UserID
+
+	rc := http.NewResponseController(w)
+	// The server-wide WriteTimeout would otherwise cut the stream.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		h.logger.ErrorContext(r.Context(), "clearing write deadline", "error", err)
+		return
+	}
+
+	// Register before flushing headers so nothing sent after the client sees
+	// the response start is missed.
+	ctx := logging.WithConnID(r.Context(), logging.NewID())
+	c := newQueuedClient("sse", session.ID)
+	h.register(ctx, userID, c)
+	defer h.unregister(userID, c)
+	defer h.metrics.ConnectionOpened(c.transport())()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		h.logger.ErrorContext(r.Context(), "streaming not supported", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.logger.InfoContext(ctx, "client disconnected", "user_id", userID)
+			return
+		case <-c.done:
+			// Deliver what was queued before the close, such as a
+			// server_shutdown frame.
+			for _, frame := range drainFrames(c, queuedClientBuffer) {
+				if !h.writeEvent(w, frame) {
+					break
+				}
+			}
+			_ = rc.Flush()
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case frame := <-c.frames:
+			if !h.writeEvent(w, frame) {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes frame as a Server-Sent Event, reporting whether the
+// stream is still usable.
+func (h *WebSocketHandler) writeEvent(w http.ResponseWriter, frame any) bool {
+	payload, err := utils.JSONEncoder.Marshal(frame)
+	if err != nil {
+		h.logger.Error("encoding message", "error", err)
+		return true
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+		h.logger.Error("writing message", "error", err)
+		return false
+	}
+	return true
+}
+
+// drainFrames takes up to limit frames already queued for c without waiting.
+func drainFrames(c *queuedClient, limit int) []any {
+	frames := make([]any, 0)
+	for len(frames) < limit {
+		select {
+		case frame := <-c.frames:
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+	return frames
+}
+
+// pollerKey identifies a long-poll client. Each session gets its own queue,
+// so devices polling with different sessions do not steal each other's frames.
+type pollerKey struct {
+	userID    int
+	sessionID int
+}
+
+// poller returns the long-poll client registered for userID and sessionID,
+// creating it on the first request. It stays registered until
+// pollIdleTimeout passes without a poll.
+func (h *WebSocketHandler) poller(ctx context.Context, userID, sessionID int) *queuedClient {
+	h.pollersMutex.Lock()
+	defer h.pollersMutex.Unlock()
+
+	key := pollerKey{userID: userID, sessionID: sessionID}
+	if c, exists := h.pollers[key]; exists && c.expiry.Stop() {
+		c.expiry.Reset(pollIdleTimeout)
+		return c
+	}
+
+	c := newQueuedClient("long-poll", sessionID)
+	c.expiry = time.AfterFunc(pollIdleTimeout, func() {
+		h.pollersMutex.Lock()
+		if h.pollers[key] == c {
+			delete(h.pollers, key)
+		}
+		h.pollersMutex.Unlock()
+		h.unregister(userID, c)
+		h.logger.Info("long-poll client expired", "user_id", userID)
+	})
+	h.pollers[key] = c
+	h.register(ctx, userID, c)
+	return c
+}
+
+// HandleLongPoll returns the frames queued for the user, waiting up to
+// pollTimeout for the first one to arrive. An empty list means the client
+// should simply poll again.
+func (h *WebSocketHandler) HandleLongPoll(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok || h.refuseIfDraining(w) {
+		return
+	}
+
+	c := h.poller(r.Context(), session.UserID, session.ID)
+	frames := make([]any, 0)
+
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context().Done():
+		return
+	case <-c.done:
+		if !h.draining.Load() {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Session revoked"})
+			return
+		}
+		// Hand over the server_shutdown frame and anything before it
+		frames = drainFrames(c, pollMaxFrames)
+	case <-timer.C:
+	case frame := <-c.frames:
+		frames = append(frames, frame)
+		frames = append(frames, drainFrames(c, pollMaxFrames-1)...)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"frames": frames})
+}
+
+// frameRecorder collects the replies to a frame sent over REST.
+type frameRecorder struct {
+	frames []any
+}
+
+func (r *frameRecorder) send(data any, _ *slog.Logger) error {
+	r.frames = append(r.frames, data)
+	return nil
+}
+
+// HandleSendFrame accepts the same frames a WebSocket client would send, for
+// transports that cannot send upstream. Replies to the frame, such as an
+// error or the requested history, come back in the response; new messages
+// still reach every connection as usual.
+func (h *WebSocketHandler) HandleSendFrame(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	var msg WSMessage
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
+		return
+	}
+
+	replies := &frameRecorder{frames: make([]any, 0)}
+	h.handleMessage(r.Context(), session.UserID, replies, &msg)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"frames": replies.frames})
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"chat/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockMessageStore implements the MessageStore interface for testing
+type MockMessageStore struct {
+	mock.Mock
+}
+
+func (m *MockMessageStore) CreateMessage(_ context.Context, senderID, receiverID int, content string) (*store.Message, error) {
+	args := m.Called(senderID, receiverID, content)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Message), args.Error(1)
+}
+
+func (m *MockMessageStore) GetMessagesBetweenUsers(_ context.Context, userID1, userID2 int) ([]*store.Message, error) {
+	args := m.Called(userID1, userID2)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Message), args.Error(1)
+}
+
+func (m *MockMessageStore) GetMessagesPage(_ context.Context, userID1, userID2, beforeID, limit int) ([]*store.Message, error) {
+	args := m.Called(userID1, userID2, beforeID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Message), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversations(_ context.Context, userID int) ([]*store.Conversation, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Conversation), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversation(_ context.Context, userID, otherUserID int) (*store.Conversation, error) {
+	args := m.Called(userID, otherUserID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Conversation), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversationPartnerIDs(_ context.Context, userID int) ([]int, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]int), args.Error(1)
+}
+
+func (m *MockMessageStore) MarkConversationRead(_ context.Context, readerID, otherUserID int) (int, error) {
+	args := m.Called(readerID, otherUserID)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockMessageStore) DeleteMessage(_ context.Context, messageID int) error {
+	args := m.Called(messageID)
+	return args.Error(0)
+}
+
+func newTransportTestServer(t *testing.T) (*httptest.Server, *MockMessageStore) {
+	userStore := &MockUserStore{}
+	messageStore := &MockMessageStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+	userStore.On("GetUserByID", 2).Return(&store.User{ID: 2, Username: "bob"}, nil).Maybe()
+
+	handler := NewWebSocketHandler(messageStore, userStore, noRelations(), logger)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat/ws", handler.HandleWebSocket)
+	mux.HandleFunc("/chat/events", handler.HandleEventStream)
+	mux.HandleFunc("/chat/poll", handler.HandleLongPoll)
+	mux.HandleFunc("/chat/send", handler.HandleSendFrame)
+
+	server := httptest.NewServer(withTestSessions(mux))
+	t.Cleanup(server.Close)
+	return server, messageStore
+}
+
+func postFrame(t *testing.T, server *httptest.Server, userID string, frame WSMessage) {
+	body, err := json.Marshal(frame)
+	require.NoError(t, err)
+
+	resp, err := http.Post(server.URL+"/chat/send?access_token=token-"+userID, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestEventStream_ReceivesFramesSentOverREST(t *testing.T) {
+	server, messageStore := newTransportTestServer(t)
+	messageStore.On("CreateMessage", 1, 2, "hello bob").Return(&store.Message{ID: 1}, nil)
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/chat/events?access_token=token-2", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	postFrame(t, server, "1", WSMessage{Type: "send_message", ReceiverID: 2, Content: "hello bob"})
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "data: "), line)
+
+	var msg WSMessage
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg))
+	assert.Equal(t, "new_message", msg.Type)
+	assert.Equal(t, 1, msg.SenderID)
+	assert.Equal(t, "hello bob", msg.Content)
+
+	messageStore.AssertExpectations(t)
+}
+
+func TestLongPoll_DeliversToWebSocketAndPollers(t *testing.T) {
+	server, messageStore := newTransportTestServer(t)
+	messageStore.On("CreateMessage", 2, 1, "hi alice").Return(&store.Message{ID: 2}, nil)
+	messageStore.On("GetConversation", mock.Anything, mock.Anything).Return(&store.Conversation{User: &store.User{}}, nil).Maybe()
+
+	// Alice listens over a WebSocket, Bob over long-polling
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/chat/ws?access_token=token-1", nil)
+	require.NoError(t, err)
+	defer wsConn.Close()
+
+	pollResult := make(chan []WSMessage, 1)
+	go func() {
+		resp, err := http.Get(server.URL + "/chat/poll?access_token=token-2")
+		if err != nil {
+			pollResult <- nil
+			return
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Frames []WSMessage `json:"frames"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		pollResult <- body.Frames
+	}()
+
+	// Give the poll request time to register before sending
+	time.Sleep(100 * time.Millisecond)
+	postFrame(t, server, "2", WSMessage{Type: "send_message", ReceiverID: 1, Content: "hi alice"})
+
+	var wsMsg WSMessage
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, wsConn.ReadJSON(&wsMsg))
+	assert.Equal(t, "new_message", wsMsg.Type)
+	assert.Equal(t, "hi alice", wsMsg.Content)
+
+	select {
+	case frames := <-pollResult:
+		require.NotEmpty(t, frames)
+		assert.Equal(t, "new_message", frames[0].Type)
+		assert.Equal(t, 2, frames[0].SenderID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("long-poll did not return")
+	}
+}
+
+func TestTransports_RequireSession(t *testing.T) {
+	server, _ := newTransportTestServer(t)
+
+	// A bare user_id is not a caller
+	for _, path := range []string{"/chat/events", "/chat/poll", "/chat/ws"} {
+		resp, err := http.Get(server.URL + path + "?user_id=1")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+	}
+
+	resp, err := http.Post(server.URL+"/chat/send?user_id=1", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/chat/send?access_token=token-1", "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSendMessage_PublishesConversationUpdates(t *testing.T) {
+	server, messageStore := newTransportTestServer(t)
+	messageStore.On("CreateMessage", 1, 2, "ping").Return(&store.Message{ID: 7}, nil)
+	messageStore.On("GetConversation", 2, 1).Return(&store.Conversation{
+		User: &store.User{ID: 1, Username: "alice"}, LastMessageID: 7, Preview: "ping", UnreadCount: 1,
+	}, nil)
+
+	// Only Bob is connected, so Alice's view must not be queried
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/chat/ws?access_token=token-2", nil)
+	require.NoError(t, err)
+	defer wsConn.Close()
+
+	postFrame(t, server, "1", WSMessage{Type: "send_message", ReceiverID: 2, Content: "ping"})
+
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	var first WSMessage
+	require.NoError(t, wsConn.ReadJSON(&first))
+	assert.Equal(t, "new_message", first.Type)
+	assert.Equal(t, 7, first.ID)
+
+	var update struct {
+		Type         string             `json:"type"`
+		Conversation store.Conversation `json:"conversation"`
+	}
+	require.NoError(t, wsConn.ReadJSON(&update))
+	assert.Equal(t, "conversation_updated", update.Type)
+	assert.Equal(t, 1, update.Conversation.UnreadCount)
+	assert.Equal(t, "alice", update.Conversation.User.Username)
+
+	messageStore.AssertExpectations(t)
+	messageStore.AssertNotCalled(t, "GetConversation", 1, 2)
+}
+
+func TestWebSocket_OriginsAndConnectionLimits(t *testing.T) {
+	userStore := &MockUserStore{}
+	userStore.On("GetUserByID", 1).Return(&store.User{ID: 1, Username: "alice"}, nil).Maybe()
+	handler := NewWebSocketHandler(&MockMessageStore{}, userStore, noRelations(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	handler.SetAllowedOrigins([]string{"https://chat.example.com"})
+	handler.SetConnectionLimits(ConnectionLimits{MaxMessageBytes: 64, MaxConnections: 1})
+
+	server := httptest.NewServer(withTestSessions(http.HandlerFunc(handler.HandleWebSocket)))
+	t.Cleanup(server.Close)
+	url := "ws" + server.URL[4:] + "/?access_token=token-1"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.test"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://chat.example.com"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A second connection is over the limit
+	require.Eventually(t, func() bool {
+		handler.clientsMutex.RLock()
+		defer handler.clientsMutex.RUnlock()
+		return len(handler.clients[1]) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, resp, err = websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Oversized frames close the connection
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"get_conversations","content":"`+strings.Repeat("x", 100)+`"}`)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "got %v", err)
+}
+
+func TestReplies_GoOnlyToTheRequestingConnection(t *testing.T) {
+	server, _ := newTransportTestServer(t)
+
+	// Alice's other connection must not see the error meant for the REST call
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/chat/ws?access_token=token-1", nil)
+	require.NoError(t, err)
+	defer wsConn.Close()
+
+	body, err := json.Marshal(WSMessage{Type: "make_coffee"})
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+"/chat/send?access_token=token-1", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var reply struct {
+		Frames []WSMessage `json:"frames"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reply))
+	require.Len(t, reply.Frames, 1)
+	assert.Equal(t, "Invalid message type", reply.Frames[0].Error)
+
+	require.NoError(t, wsConn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = wsConn.ReadMessage()
+	assert.Error(t, err, "the WebSocket should have received nothing")
+}
+
+func TestQueuedClient_ResyncsWhenFull(t *testing.T) {
+	c := newQueuedClient("sse", 1)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	for i := 0; i < queuedClientBuffer; i++ {
+		require.NoError(t, c.send(WSMessage{Type: "new_message", ID: i}, logger))
+	}
+	assert.ErrorIs(t, c.send(WSMessage{Type: "new_message"}, logger), errClientBacklogged)
+
+	frames := drainFrames(c, queuedClientBuffer)
+	require.Len(t, frames, 1)
+	assert.Equal(t, resyncFrame, frames[0])
+
+	// Once drained it queues normally again
+	require.NoError(t, c.send(WSMessage{Type: "new_message"}, logger))
+}
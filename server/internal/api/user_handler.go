@@ -1,28 +1,64 @@
 package api
 
 import (
+	"chat/internal/credentials"
 	"chat/internal/store"
 	"chat/internal/utils"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"time"
 )
 
+// sessionTTL is how long a login stays valid.
+const sessionTTL = 30 * 24 * time.Hour
+
 type UserRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional, used for password resets
+}
+
+// validate checks a registration against policy, normalising the email
+// address in place, and returns a message per invalid field.
+func (req *UserRequest) validate(policy *credentials.Policy) map[string]string {
+	fields := map[string]string{}
+
+	if msg := policy.ValidateUsername(req.Username); msg != "" {
+		fields["username"] = msg
+	}
+	if msg := policy.ValidatePassword(req.Password, req.Username); msg != "" {
+		fields["password"] = msg
+	}
+	if req.Email != "" {
+		address, err := mail.ParseAddress(req.Email)
+		if err != nil || address.Name != "" {
+			fields["email"] = "must be a valid email address"
+		} else {
+			req.Email = address.Address
+		}
+	}
+
+	return fields
 }
 
 type UserHandler struct {
-	Store  store.UserStore
-	logger *log.Logger
+	Store    store.UserStore
+	sessions store.SessionStore
+	mfa      store.MFAStore
+	policy   *credentials.Policy
+	guard    *LoginGuard
+	logger   *slog.Logger
 }
 
-func NewUserHandler(store store.UserStore, logger *log.Logger) *UserHandler {
-	return &UserHandler{Store: store, logger: logger}
+func NewUserHandler(store store.UserStore, sessions store.SessionStore, mfa store.MFAStore, policy *credentials.Policy, guard *LoginGuard, logger *slog.Logger) *UserHandler {
+	return &UserHandler{Store: store, sessions: sessions, mfa: mfa, policy: policy, guard: guard, logger: logger}
 }
 
 func (h *UserHandler) GetMeUser(w http.ResponseWriter, r *http.Request) {
@@ -31,28 +67,19 @@ func (h *UserHandler) GetMeUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userIDStr := r.URL.Query().Get("user_id")
-	if userIDStr == "" {
-		h.logger.Printf("ERROR: user_id query parameter is required")
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID query parameter is required"})
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		h.logger.Printf("ERROR: invalid user_id: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID"})
+	session, ok := requireSession(w, r)
+	if !ok {
 		return
 	}
 
-	user, err := h.Store.GetUserByID(userID)
+	user, err := h.Store.GetUserByID(r.Context(), session.UserID)
 	if err != nil {
-		h.logger.Printf("ERROR: user not found: %v", err)
+		h.logger.ErrorContext(r.Context(), "user not found", "error", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "User not found"})
 		return
 	}
 
-	h.logger.Printf("INFO: User: %v retrieved successfully", user.Username)
+	h.logger.InfoContext(r.Context(), "user retrieved successfully", "username", user.Username)
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
 	return
 }
@@ -66,35 +93,58 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req UserRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERROR: decoding request body: %v", err)
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
 		return
 	}
 
 	// Validate input
 	if req.Username == "" || req.Password == "" {
-		h.logger.Printf("ERROR: username or password is empty")
+		h.logger.ErrorContext(r.Context(), "username or password is empty")
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Username and password are required"})
 		return
 	}
 
-	// Check if user already exists
-	existingUser, err := h.Store.GetUserByUsername(req.Username)
+	fields := req.validate(h.policy)
+	if len(fields) > 0 {
+		h.logger.InfoContext(r.Context(), "registration rejected", "fields", fields)
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "Invalid registration", "fields": fields})
+		return
+	}
+
+	var email *string
+	if req.Email != "" {
+		email = &req.Email
+
+		existingUser, err := h.Store.GetUserByEmail(r.Context(), *email)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			h.logger.ErrorContext(r.Context(), "checking existing email", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+			return
+		}
+		if existingUser != nil {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Email already in use", "fields": map[string]string{"email": "is already in use"}})
+			return
+		}
+	}
+
+	// Check if user already exists (case-insensitively)
+	existingUser, err := h.Store.GetUserByUsername(r.Context(), req.Username)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		h.logger.Printf("ERROR: checking existing user: %v", err)
+		h.logger.ErrorContext(r.Context(), "checking existing user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
 		return
 	}
 	if existingUser != nil {
-		h.logger.Printf("ERROR: user already exists: %s", req.Username)
-		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Username already exists"})
+		h.logger.ErrorContext(r.Context(), "user already exists", "username", req.Username)
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Username already exists", "fields": map[string]string{"username": "is already taken"}})
 		return
 	}
 
 	// Hash password
 	passwordHash, err := h.Store.HashPassword(req.Password)
 	if err != nil {
-		h.logger.Printf("ERROR: hashing password: %v", err)
+		h.logger.ErrorContext(r.Context(), "hashing password", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
 		return
 	}
@@ -102,17 +152,26 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	// Create user
 	user := &store.User{
 		Username:     req.Username,
+		Email:        email,
 		PasswordHash: passwordHash,
 	}
 
-	err = h.Store.CreateUser(user)
+	err = h.Store.CreateUser(r.Context(), user)
 	if err != nil {
-		h.logger.Printf("ERROR: creating user: %v", err)
+		switch {
+		case errors.Is(err, store.ErrUsernameTaken):
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Username already exists", "fields": map[string]string{"username": "is already taken"}})
+			return
+		case errors.Is(err, store.ErrEmailTaken):
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Email already in use", "fields": map[string]string{"email": "is already in use"}})
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "creating user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create user"})
 		return
 	}
 
-	h.logger.Printf("INFO: user created successfully: %s", user.Username)
+	h.logger.InfoContext(r.Context(), "user created successfully", "username", user.Username)
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
 		"message": "User created successfully",
 		"user": map[string]interface{}{
@@ -131,7 +190,7 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var req UserRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERROR: decoding request body: %v", err)
+		h.logger.ErrorContext(r.Context(), "decoding request body", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request body"})
 		return
 	}
@@ -142,22 +201,85 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Throttled attempts are refused before bcrypt runs, so they cost the
+	// server nothing and reveal nothing about the account
+	ip := clientIP(r)
+	if wait := h.guard.RetryAfter(req.Username, ip); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+
 	// Authenticate user
-	user, err := h.Store.AuthenticateUser(req.Username, req.Password)
+	user, err := h.Store.AuthenticateUser(r.Context(), req.Username, req.Password)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			h.logger.Printf("INFO: login attempt with invalid username: %s", req.Username)
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			h.logger.InfoContext(r.Context(), "failed login attempt", "username", req.Username)
+			h.guard.Failed(r.Context(), req.Username, ip)
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid username or password"})
 			return
 		}
-		h.logger.Printf("ERROR: authenticating user: %v", err)
+		h.logger.ErrorContext(r.Context(), "authenticating user", "error", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid username or password"})
 		return
 	}
 
-	h.logger.Printf("INFO: user logged in successfully: %s", user.Username)
+	// Checked only once the password is right, so it reveals nothing to
+	// someone guessing
+	if user.Disabled() {
+		writeAccountDisabled(w, h.logger, user)
+		return
+	}
+
+	mfa, err := h.mfa.GetMFA(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		h.logger.ErrorContext(r.Context(), "getting MFA enrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if mfa.Enabled() {
+		// The password was right, but the session is only issued once the
+		// second factor is checked by /user.login.mfa
+		challenge, err := h.mfa.CreateMFAChallenge(r.Context(), user.ID, mfaChallengeTTL)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "creating MFA challenge", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+			return
+		}
+		h.logger.InfoContext(r.Context(), "password accepted, awaiting second factor", "username", user.Username)
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+			"message":      "Two-factor authentication required",
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	// With a second factor enrolled, failures are only cleared once it is
+	// checked, so a stolen password cannot be used to reset the backoff
+	h.guard.Succeeded(req.Username)
+	startSession(r.Context(), w, h.sessions, h.logger, user)
+}
+
+// startSession issues a session for user and writes the login response.
+func startSession(ctx context.Context, w http.ResponseWriter, sessions store.SessionStore, logger *slog.Logger, user *store.User) {
+	if user.Disabled() {
+		writeAccountDisabled(w, logger, user)
+		return
+	}
+
+	token, session, err := sessions.CreateSession(ctx, user.ID, sessionTTL)
+	if err != nil {
+		logger.Error("creating session", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	logger.Info("user logged in successfully", "username", user.Username)
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
-		"message": "Login successful",
+		"message":    "Login successful",
+		"token":      token,
+		"expires_at": session.ExpiresAt,
 		"user": map[string]interface{}{
 			"id":       user.ID,
 			"username": user.Username,
@@ -165,6 +287,29 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func writeAccountDisabled(w http.ResponseWriter, logger *slog.Logger, user *store.User) {
+	logger.Info("login refused for disabled user", "username", user.Username)
+	utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "This account has been disabled"})
+}
+
+// Logout revokes the session the request was made with.
+func (h *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.sessions.RevokeSession(r.Context(), session.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "revoking session", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user logged out", "user_id", session.UserID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Logged out"})
+}
+
 func (h *UserHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		utils.WriteJSON(w, http.StatusMethodNotAllowed, utils.Envelope{"error": "Method not allowed"})
@@ -173,32 +318,114 @@ func (h *UserHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
 
 	userIDStr := r.URL.Query().Get("user_id")
 	if userIDStr == "" {
-		h.logger.Printf("ERROR: user_id query parameter is required")
+		h.logger.ErrorContext(r.Context(), "user_id query parameter is required")
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID query parameter is required"})
 		return
 	}
 
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		h.logger.Printf("ERROR: invalid user_id: %v", err)
+		h.logger.ErrorContext(r.Context(), "invalid user_id", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID"})
 		return
 	}
 
-	_, err = h.Store.GetUserByID(userID)
+	_, err = h.Store.GetUserByID(r.Context(), userID)
 	if err != nil {
-		h.logger.Printf("ERROR: user not found: %v", err)
+		h.logger.ErrorContext(r.Context(), "user not found", "error", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "User not found"})
 		return
 	}
 
-	users, err := h.Store.GetUsersExcept(userID)
+	users, err := h.Store.GetUsersExcept(r.Context(), userID)
 	if err != nil {
-		h.logger.Printf("ERROR: getting users: %v", err)
+		h.logger.ErrorContext(r.Context(), "getting users", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to get users"})
 		return
 	}
 
-	h.logger.Printf("INFO: users retrieved successfully")
+	h.logger.InfoContext(r.Context(), "users retrieved successfully")
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": users})
 }
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Search pages through the user directory. q matches usernames and display
+// names by prefix or fuzzily; users who opted out of the directory and the
+// caller are never returned.
+func (h *UserHandler) Search(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	limit, err := intQueryParam(r, "limit", defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Limit must be between 1 and 100"})
+		return
+	}
+
+	query := r.URL.Query()
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Order must be asc or desc"})
+		return
+	}
+
+	page, err := h.Store.SearchUsers(r.Context(), store.UserSearch{
+		Query:         query.Get("q"),
+		ExcludeUserID: userID,
+		Sort:          query.Get("sort"),
+		Descending:    order == "desc",
+		Cursor:        query.Get("cursor"),
+		Limit:         limit,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidSort):
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Sort must be username, display_name or created_at"})
+		case errors.Is(err, store.ErrInvalidCursor):
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid cursor"})
+		default:
+			h.logger.ErrorContext(r.Context(), "searching users", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to search users"})
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": page.Users, "next_cursor": page.NextCursor})
+}
+
+type DiscoverableRequest struct {
+	Discoverable *bool `json:"discoverable"`
+}
+
+// SetDiscoverable lets a user opt out of (or back into) the user directory.
+func (h *UserHandler) SetDiscoverable(w http.ResponseWriter, r *http.Request) {
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	var req DiscoverableRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Discoverable == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "discoverable must be true or false"})
+		return
+	}
+
+	err = h.Store.SetDiscoverable(r.Context(), userID, *req.Discoverable)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updating discoverability", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update user"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "user set discoverable", "user_id", userID, "discoverable", *req.Discoverable)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"discoverable": *req.Discoverable})
+}
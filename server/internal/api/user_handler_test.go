@@ -2,15 +2,18 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	"chat/internal/credentials"
 	"chat/internal/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -22,12 +25,12 @@ type MockUserStore struct {
 	mock.Mock
 }
 
-func (m *MockUserStore) CreateUser(user *store.User) error {
+func (m *MockUserStore) CreateUser(_ context.Context, user *store.User) error {
 	args := m.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockUserStore) GetUserByID(id int) (*store.User, error) {
+func (m *MockUserStore) GetUserByID(_ context.Context, id int) (*store.User, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -35,7 +38,7 @@ func (m *MockUserStore) GetUserByID(id int) (*store.User, error) {
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
-func (m *MockUserStore) GetUserByUsername(username string) (*store.User, error) {
+func (m *MockUserStore) GetUserByUsername(_ context.Context, username string) (*store.User, error) {
 	args := m.Called(username)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -43,7 +46,20 @@ func (m *MockUserStore) GetUserByUsername(username string) (*store.User, error)
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
-func (m *MockUserStore) GetUsersExcept(excludeUserID int) ([]*store.User, error) {
+func (m *MockUserStore) GetUserByEmail(_ context.Context, email string) (*store.User, error) {
+	args := m.Called(email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) UpdatePassword(_ context.Context, userID int, passwordHash string) error {
+	args := m.Called(userID, passwordHash)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) GetUsersExcept(_ context.Context, excludeUserID int) ([]*store.User, error) {
 	args := m.Called(excludeUserID)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -51,6 +67,43 @@ func (m *MockUserStore) GetUsersExcept(excludeUserID int) ([]*store.User, error)
 	return args.Get(0).([]*store.User), args.Error(1)
 }
 
+func (m *MockUserStore) SearchUsers(_ context.Context, search store.UserSearch) (*store.UserPage, error) {
+	args := m.Called(search)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.UserPage), args.Error(1)
+}
+
+func (m *MockUserStore) SetDiscoverable(_ context.Context, userID int, discoverable bool) error {
+	args := m.Called(userID, discoverable)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) UpdateProfile(_ context.Context, userID int, update store.ProfileUpdate) (*store.User, error) {
+	args := m.Called(userID, update)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) SetAvatar(_ context.Context, userID int, contentType string, data []byte) (*store.User, error) {
+	args := m.Called(userID, contentType, data)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) GetAvatar(_ context.Context, userID int) (string, []byte, error) {
+	args := m.Called(userID)
+	if args.Get(1) == nil {
+		return args.String(0), nil, args.Error(2)
+	}
+	return args.String(0), args.Get(1).([]byte), args.Error(2)
+}
+
 func (m *MockUserStore) HashPassword(password string) (string, error) {
 	args := m.Called(password)
 	return args.String(0), args.Error(1)
@@ -61,7 +114,7 @@ func (m *MockUserStore) CheckPassword(hashedPassword, password string) error {
 	return args.Error(0)
 }
 
-func (m *MockUserStore) AuthenticateUser(username, password string) (*store.User, error) {
+func (m *MockUserStore) AuthenticateUser(_ context.Context, username, password string) (*store.User, error) {
 	args := m.Called(username, password)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -69,11 +122,34 @@ func (m *MockUserStore) AuthenticateUser(username, password string) (*store.User
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
+func (m *MockUserStore) ListUsers(_ context.Context, list store.UserList) (*store.UserPage, error) {
+	args := m.Called(list)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.UserPage), args.Error(1)
+}
+
+func (m *MockUserStore) SetRole(_ context.Context, userID int, role string) error {
+	args := m.Called(userID, role)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) SetDisabled(_ context.Context, userID int, disabled bool) error {
+	args := m.Called(userID, disabled)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) DeleteUser(_ context.Context, userID int) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
 func TestNewUserHandler(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	handler := NewUserHandler(mockStore, logger)
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	assert.NotNil(t, handler)
 	assert.Equal(t, mockStore, handler.Store)
@@ -82,12 +158,12 @@ func TestNewUserHandler(t *testing.T) {
 
 func TestUserHandler_Register_Success(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	// Setup mock expectations
 	mockStore.On("GetUserByUsername", "testuser").Return(nil, sql.ErrNoRows)
-	mockStore.On("HashPassword", "password123").Return("hashed_password", nil)
+	mockStore.On("HashPassword", "correct-horse-42").Return("hashed_password", nil)
 	mockStore.On("CreateUser", mock.AnythingOfType("*store.User")).Return(nil).Run(func(args mock.Arguments) {
 		user := args.Get(0).(*store.User)
 		user.ID = 1
@@ -97,7 +173,7 @@ func TestUserHandler_Register_Success(t *testing.T) {
 	// Create request
 	reqBody := UserRequest{
 		Username: "testuser",
-		Password: "password123",
+		Password: "correct-horse-42",
 	}
 	jsonBody, _ := json.Marshal(reqBody)
 	req := httptest.NewRequest(http.MethodPost, "/user.register", bytes.NewBuffer(jsonBody))
@@ -124,8 +200,8 @@ func TestUserHandler_Register_Success(t *testing.T) {
 
 func TestUserHandler_Register_UserExists(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	// Setup mock expectations - user already exists
 	existingUser := &store.User{ID: 1, Username: "testuser"}
@@ -134,7 +210,7 @@ func TestUserHandler_Register_UserExists(t *testing.T) {
 	// Create request
 	reqBody := UserRequest{
 		Username: "testuser",
-		Password: "password123",
+		Password: "correct-horse-42",
 	}
 	jsonBody, _ := json.Marshal(reqBody)
 	req := httptest.NewRequest(http.MethodPost, "/user.register", bytes.NewBuffer(jsonBody))
@@ -160,8 +236,8 @@ func TestUserHandler_Register_UserExists(t *testing.T) {
 
 func TestUserHandler_Register_InvalidInput(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	tests := []struct {
 		name     string
@@ -205,10 +281,96 @@ func TestUserHandler_Register_InvalidInput(t *testing.T) {
 	}
 }
 
+func TestUserHandler_Register_PolicyViolations(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	tests := []struct {
+		name    string
+		request UserRequest
+		fields  []string
+	}{
+		{
+			name:    "whitespace username and short password",
+			request: UserRequest{Username: "   ", Password: "abc"},
+			fields:  []string{"username", "password"},
+		},
+		{
+			name:    "reserved username",
+			request: UserRequest{Username: "Admin", Password: "correct-horse-42"},
+			fields:  []string{"username"},
+		},
+		{
+			name:    "breached password",
+			request: UserRequest{Username: "testuser", Password: "qwertyuiop"},
+			fields:  []string{"password"},
+		},
+		{
+			name:    "password over bcrypt limit",
+			request: UserRequest{Username: "testuser", Password: strings.Repeat("correct-horse-", 800)},
+			fields:  []string{"password"},
+		},
+		{
+			name:    "invalid email",
+			request: UserRequest{Username: "testuser", Password: "correct-horse-42", Email: "not-an-email"},
+			fields:  []string{"email"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonBody, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/user.register", bytes.NewBuffer(jsonBody))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			handler.Register(w, req)
+
+			assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+			var response struct {
+				Error  string            `json:"error"`
+				Fields map[string]string `json:"fields"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			require.NoError(t, err)
+
+			assert.Equal(t, "Invalid registration", response.Error)
+			assert.Len(t, response.Fields, len(tt.fields))
+			for _, field := range tt.fields {
+				assert.NotEmpty(t, response.Fields[field])
+			}
+		})
+	}
+
+	mockStore.AssertNotCalled(t, "CreateUser", mock.Anything)
+}
+
+func TestUserHandler_Register_ConcurrentDuplicate(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	// The lookup misses, but another registration wins the unique index
+	mockStore.On("GetUserByUsername", "TestUser").Return(nil, sql.ErrNoRows)
+	mockStore.On("HashPassword", "correct-horse-42").Return("hashed_password", nil)
+	mockStore.On("CreateUser", mock.AnythingOfType("*store.User")).Return(store.ErrUsernameTaken)
+
+	jsonBody, _ := json.Marshal(UserRequest{Username: "TestUser", Password: "correct-horse-42"})
+	req := httptest.NewRequest(http.MethodPost, "/user.register", bytes.NewBuffer(jsonBody))
+	w := httptest.NewRecorder()
+	handler.Register(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "Username already exists")
+}
+
 func TestUserHandler_Login_Success(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	sessionStore := &MockSessionStore{}
+	handler := NewUserHandler(mockStore, sessionStore, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	// Setup mock expectations
 	user := &store.User{
@@ -216,6 +378,7 @@ func TestUserHandler_Login_Success(t *testing.T) {
 		Username: "testuser",
 	}
 	mockStore.On("AuthenticateUser", "testuser", "password123").Return(user, nil)
+	sessionStore.On("CreateSession", 1, sessionTTL).Return("session-token", &store.Session{ID: 7, UserID: 1, ExpiresAt: "2030-01-01T00:00:00Z"}, nil)
 
 	// Create request
 	reqBody := UserRequest{
@@ -240,6 +403,7 @@ func TestUserHandler_Login_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "Login successful", response["message"])
+	assert.Equal(t, "session-token", response["token"])
 	assert.NotNil(t, response["user"])
 
 	userMap := response["user"].(map[string]interface{})
@@ -247,12 +411,13 @@ func TestUserHandler_Login_Success(t *testing.T) {
 	assert.Equal(t, "testuser", userMap["username"])
 
 	mockStore.AssertExpectations(t)
+	sessionStore.AssertExpectations(t)
 }
 
 func TestUserHandler_Login_InvalidCredentials(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	// Setup mock expectations - user not found
 	mockStore.On("AuthenticateUser", "testuser", "wrongpassword").Return(nil, sql.ErrNoRows)
@@ -286,8 +451,8 @@ func TestUserHandler_Login_InvalidCredentials(t *testing.T) {
 
 func TestUserHandler_Login_DatabaseError(t *testing.T) {
 	mockStore := &MockUserStore{}
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
-	handler := NewUserHandler(mockStore, logger)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
 
 	// Setup mock expectations - database error
 	mockStore.On("AuthenticateUser", "testuser", "password123").Return(nil, errors.New("database connection failed"))
@@ -318,3 +483,103 @@ func TestUserHandler_Login_DatabaseError(t *testing.T) {
 
 	mockStore.AssertExpectations(t)
 }
+
+func TestUserHandler_Search(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	mockStore.On("SearchUsers", store.UserSearch{
+		Query:         "bo",
+		ExcludeUserID: 1,
+		Sort:          "created_at",
+		Descending:    true,
+		Limit:         2,
+	}).Return(&store.UserPage{
+		Users:      []*store.User{{ID: 2, Username: "bob"}, {ID: 3, Username: "bobby"}},
+		NextCursor: "next",
+	}, nil)
+
+	req := asUser(httptest.NewRequest(http.MethodGet, "/user.search?q=bo&sort=created_at&order=desc&limit=2", nil), 1)
+	w := httptest.NewRecorder()
+
+	handler.Search(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Users      []store.User `json:"users"`
+		NextCursor string       `json:"next_cursor"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Users, 2)
+	assert.Equal(t, "next", response.NextCursor)
+
+	mockStore.AssertExpectations(t)
+}
+
+func TestUserHandler_Search_InvalidInput(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	mockStore.On("SearchUsers", mock.MatchedBy(func(s store.UserSearch) bool { return s.Sort == "password" })).
+		Return(nil, store.ErrInvalidSort)
+	mockStore.On("SearchUsers", mock.MatchedBy(func(s store.UserSearch) bool { return s.Cursor == "garbage" })).
+		Return(nil, store.ErrInvalidCursor)
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=500",
+		"order=sideways",
+		"sort=password",
+		"cursor=garbage",
+	} {
+		req := asUser(httptest.NewRequest(http.MethodGet, "/user.search?"+query, nil), 1)
+		w := httptest.NewRecorder()
+
+		handler.Search(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestUserHandler_SetDiscoverable(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	mockStore.On("SetDiscoverable", 1, false).Return(nil)
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/user.discoverable", bytes.NewBufferString(`{"discoverable": false}`)), 1)
+	w := httptest.NewRecorder()
+
+	handler.SetDiscoverable(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockStore.AssertExpectations(t)
+
+	// A missing flag must not be read as false
+	req = asUser(httptest.NewRequest(http.MethodPost, "/user.discoverable", bytes.NewBufferString(`{}`)), 1)
+	w = httptest.NewRecorder()
+
+	handler.SetDiscoverable(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUserHandler_DirectoryRequiresSession(t *testing.T) {
+	mockStore := &MockUserStore{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := NewUserHandler(mockStore, &MockSessionStore{}, noMFA(), credentials.DefaultPolicy(), NewLoginGuard(&MockAuditStore{}, logger), logger)
+
+	w := httptest.NewRecorder()
+	handler.Search(w, httptest.NewRequest(http.MethodGet, "/user.search?user_id=1&q=bo", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.SetDiscoverable(w, httptest.NewRequest(http.MethodPost, "/user.discoverable?user_id=1", bytes.NewBufferString(`{"discoverable": false}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Empty(t, mockStore.Calls)
+}
@@ -1,295 +1,630 @@
 package api
 
 import (
+	"chat/internal/filter"
+	"chat/internal/logging"
+	"chat/internal/metrics"
+	"chat/internal/ratelimit"
 	"chat/internal/store"
 	"chat/internal/utils"
+	"context"
+	"errors"
 	"github.com/gorilla/websocket"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true // For now, allow all origins
+		return true // Until SetAllowedOrigins narrows it
 	},
+	Subprotocols:      utils.Subprotocols(),
+	EnableCompression: true,
+}
+
+// ConnectionLimits bound what each user's live connections may use. Zero
+// values mean no limit.
+type ConnectionLimits struct {
+	// MaxMessageBytes is the largest frame read from a WebSocket; a larger
+	// one closes the connection.
+	MaxMessageBytes int64
+	// MaxConnections is how many WebSocket and event stream connections a
+	// user may hold open at once.
+	MaxConnections int
+	// FrameTimeout bounds the work done for one frame read from a
+	// WebSocket, such as storing a message.
+	FrameTimeout time.Duration
+}
+
+// wsClient is a connected socket together with the encoding negotiated at
+// upgrade time. gorilla/websocket allows only one concurrent writer, and
+// deliveries for a user can come from any other connection's goroutine.
+type wsClient struct {
+	conn    *websocket.Conn
+	encoder utils.Encoder
+	session int
+	writeMu sync.Mutex
+}
+
+func (c *wsClient) send(data any, logger *slog.Logger) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return utils.WriteWebsocketMessage(c.conn, c.encoder, data, logger)
+}
+
+func (c *wsClient) transport() string {
+	return "websocket/" + c.encoder.Name()
+}
+
+func (c *wsClient) sessionID() int {
+	return c.session
+}
+
+// close ends the connection from the server side. Closing the socket makes
+// the read loop in HandleWebSocket return, which unregisters the client.
+func (c *wsClient) close(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+	_ = c.conn.Close()
 }
 
 type WebSocketHandler struct {
 	messageStore store.MessageStore
 	userStore    store.UserStore
-	logger       *log.Logger
-	clients      map[int]*websocket.Conn
+	relations    store.RelationStore
+	filters      filter.MessageFilter
+	limiter      *ratelimit.Limiter
+	metrics      *metrics.Metrics
+	tracer       trace.Tracer
+	upgrader     websocket.Upgrader
+	limits       ConnectionLimits
+	logger       *slog.Logger
+	clients      map[int]map[client]struct{}
 	clientsMutex sync.RWMutex
+	pollers      map[pollerKey]*queuedClient
+	pollersMutex sync.Mutex
+	// sends counts SendMessage calls in progress, so Shutdown can wait for
+	// messages being stored before it closes connections. sendsIdle is
+	// closed once draining and the count reaches zero.
+	sends          int
+	sendsIdle      chan struct{}
+	sendsMutex     sync.Mutex
+	draining       atomic.Bool
+	reconnectAfter time.Duration
 }
 
-func NewWebSocketHandler(messageStore store.MessageStore, userStore store.UserStore, logger *log.Logger) *WebSocketHandler {
+func NewWebSocketHandler(messageStore store.MessageStore, userStore store.UserStore, relations store.RelationStore, logger *slog.Logger) *WebSocketHandler {
 	return &WebSocketHandler{
 		messageStore: messageStore,
 		userStore:    userStore,
+		relations:    relations,
+		filters:      filter.Default(),
+		metrics:      metrics.New(prometheus.NewRegistry()),
+		tracer:       noop.NewTracerProvider().Tracer(tracerName),
+		upgrader:     upgrader,
 		logger:       logger,
-		clients:      make(map[int]*websocket.Conn),
+		clients:      make(map[int]map[client]struct{}),
+		pollers:      make(map[pollerKey]*queuedClient),
+	}
+}
+
+// SetFilters replaces the filters outgoing messages pass through before they
+// are stored. The default chain only normalizes and limits length.
+func (h *WebSocketHandler) SetFilters(filters filter.MessageFilter) {
+	h.filters = filters
+}
+
+// SetRateLimiter limits the frames clients send, per user by frame type and
+// per connection overall. Without one frames are not limited.
+func (h *WebSocketHandler) SetRateLimiter(limiter *ratelimit.Limiter) {
+	h.limiter = limiter
+}
+
+// SetMetrics records connections, frames and message deliveries in m. By
+// default they are recorded in a registry nothing exposes.
+func (h *WebSocketHandler) SetMetrics(m *metrics.Metrics) {
+	h.metrics = m
+}
+
+// SetTracerProvider records a trace for each frame read from a WebSocket.
+func (h *WebSocketHandler) SetTracerProvider(tp trace.TracerProvider) {
+	h.tracer = tp.Tracer(tracerName)
+}
+
+// SetAllowedOrigins restricts WebSocket upgrades from browsers to the given
+// origins; "*" allows any. Requests without an Origin header, which browsers
+// always send, are let through.
+func (h *WebSocketHandler) SetAllowedOrigins(origins []string) {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.ToLower(origin)] = true
+	}
+	h.upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed["*"] || allowed[strings.ToLower(origin)]
+	}
+}
+
+// SetConnectionLimits bounds frame sizes and how many connections each user
+// may hold open.
+func (h *WebSocketHandler) SetConnectionLimits(limits ConnectionLimits) {
+	h.limits = limits
+}
+
+// allowConnection refuses a new connection for userID while draining, or once
+// they hold the maximum, answering with 503 or 429.
+func (h *WebSocketHandler) allowConnection(w http.ResponseWriter, r *http.Request, userID int) bool {
+	if h.refuseIfDraining(w) {
+		return false
 	}
+	if h.limits.MaxConnections == 0 {
+		return true
+	}
+	h.clientsMutex.RLock()
+	open := len(h.clients[userID])
+	h.clientsMutex.RUnlock()
+	if open < h.limits.MaxConnections {
+		return true
+	}
+	h.logger.InfoContext(r.Context(), "connection limit reached", "user_id", userID)
+	utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "Too many open connections"})
+	return false
 }
 
 type WSMessage struct {
 	Type       string `json:"type"`
+	ID         int    `json:"id,omitempty"`
 	SenderID   int    `json:"sender_id,omitempty"`
 	ReceiverID int    `json:"receiver_id,omitempty"`
 	Content    string `json:"content,omitempty"`
 	Error      string `json:"error,omitempty"`
+	// Code classifies an error frame, e.g. why a message was rejected
+	Code string `json:"code,omitempty"`
+	// RetryAfter is how many seconds a rate limited client should wait, or
+	// a client told of a shutdown should wait before reconnecting
+	RetryAfter int    `json:"retry_after,omitempty"`
 	CreatedAt  string `json:"created_at,omitempty"`
+	// Muted is set on a recipient's copy of a message from someone they
+	// muted; clients deliver it without notifying.
+	Muted bool `json:"muted,omitempty"`
 }
 
 func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("user_id")
-	if userIDStr == "" {
-		h.logger.Printf("ERROR: user_id is required")
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "User ID is required"})
+	session, ok := requireSession(w, r)
+	if !ok {
 		return
 	}
+	userID := session.UserID
 
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		h.logger.Printf("ERROR: invalid user_id: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID"})
+	if !h.allowConnection(w, r, userID) {
 		return
 	}
 
-	_, err = h.userStore.GetUserByID(userID)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		h.logger.Printf("ERROR: user not found: %v", err)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "User not found"})
+		h.logger.ErrorContext(r.Context(), "upgrading connection", "error", err)
 		return
 	}
+	defer conn.Close()
+	if h.limits.MaxMessageBytes > 0 {
+		conn.SetReadLimit(h.limits.MaxMessageBytes)
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		h.logger.Printf("ERROR: upgrading connection: %v", err)
-		return
+	// Every log line written for this connection carries its ID. The
+	// request's context outlives the hijacked connection, so work is
+	// cancelled once reading from it fails instead.
+	ctx, cancel := context.WithCancel(logging.WithConnID(r.Context(), logging.NewID()))
+	defer cancel()
+	client := &wsClient{
+		conn:    conn,
+		encoder: utils.EncoderForSubprotocol(conn.Subprotocol()),
+		session: session.ID,
 	}
-	defer conn.Close()
 
+	h.register(ctx, userID, client)
+	defer h.unregister(userID, client)
+	defer h.metrics.ConnectionOpened(client.transport())()
+
+	var bucket *ratelimit.Bucket
+	if h.limiter != nil {
+		bucket = h.limiter.NewBucket(ratelimit.Connection)
+	}
+
+	for msg := range h.readFrames(ctx, cancel, userID, client) {
+		if bucket != nil {
+			if allowed, retryAfter := bucket.Take(); !allowed {
+				_ = client.send(rateLimitedFrame(retryAfter), h.logger)
+				continue
+			}
+		}
+		h.handleFrame(ctx, userID, client, msg)
+	}
+}
+
+// readFrames reads from c until the connection fails or closes, then calls
+// cancel so the frame being handled is abandoned. Frames are handed over one
+// at a time, keeping their order; the channel closes once reading stops.
+func (h *WebSocketHandler) readFrames(ctx context.Context, cancel context.CancelFunc, userID int, c *wsClient) <-chan *WSMessage {
+	frames := make(chan *WSMessage)
+	go func() {
+		defer close(frames)
+		defer cancel()
+		for {
+			var msg WSMessage
+			err := utils.ReadWebsocketMessage(c.conn, c.encoder, &msg)
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) || errors.Is(err, net.ErrClosed) {
+					h.logger.InfoContext(ctx, "client disconnected", "user_id", userID)
+				} else {
+					h.logger.ErrorContext(ctx, "reading message", "error", err)
+				}
+				return
+			}
+			select {
+			case frames <- &msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return frames
+}
+
+// handleFrame handles one frame read from a WebSocket within the frame
+// timeout, tracing it separately from the connection.
+func (h *WebSocketHandler) handleFrame(connCtx context.Context, userID int, c *wsClient, msg *WSMessage) {
+	ctx, span := h.startFrameSpan(connCtx, userID, msg.Type)
+	defer span.End()
+	if h.limits.FrameTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.limits.FrameTimeout)
+		defer cancel()
+	}
+	h.handleMessage(ctx, userID, c, msg)
+}
+
+func (h *WebSocketHandler) register(ctx context.Context, userID int, c client) {
 	h.clientsMutex.Lock()
-	h.clients[userID] = conn
+	if h.clients[userID] == nil {
+		h.clients[userID] = make(map[client]struct{})
+	}
+	h.clients[userID][c] = struct{}{}
 	h.clientsMutex.Unlock()
-	defer func() {
-		h.clientsMutex.Lock()
+	h.logger.InfoContext(ctx, "client connected", "user_id", userID, "transport", c.transport())
+}
+
+func (h *WebSocketHandler) unregister(userID int, c client) {
+	h.clientsMutex.Lock()
+	delete(h.clients[userID], c)
+	if len(h.clients[userID]) == 0 {
 		delete(h.clients, userID)
-		h.clientsMutex.Unlock()
-	}()
-	h.logger.Printf("INFO: client connected: %d", userID)
-
-	for {
-		var msg WSMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				h.logger.Printf("INFO: client disconnected: %d", userID)
-			} else {
-				h.logger.Printf("ERROR: reading message: %v", err)
-			}
-			return
+	}
+	h.clientsMutex.Unlock()
+}
+
+// DisconnectUser closes every live connection of userID that does not belong
+// to exceptSessionID, for when sessions are revoked. Pass 0 to drop them all.
+func (h *WebSocketHandler) DisconnectUser(userID, exceptSessionID int, reason string) {
+	h.clientsMutex.Lock()
+	var dropped []client
+	for c := range h.clients[userID] {
+		if exceptSessionID == 0 || c.sessionID() != exceptSessionID {
+			dropped = append(dropped, c)
+			delete(h.clients[userID], c)
 		}
+	}
+	if len(h.clients[userID]) == 0 {
+		delete(h.clients, userID)
+	}
+	h.clientsMutex.Unlock()
 
-		h.handleMessage(userID, &msg)
+	h.pollersMutex.Lock()
+	for _, c := range dropped {
+		key := pollerKey{userID: userID, sessionID: c.sessionID()}
+		if poller, ok := c.(*queuedClient); ok && h.pollers[key] == poller {
+			poller.expiry.Stop()
+			delete(h.pollers, key)
+		}
 	}
+	h.pollersMutex.Unlock()
+
+	for _, c := range dropped {
+		c.close(websocket.ClosePolicyViolation, reason)
+	}
+	if len(dropped) > 0 {
+		h.logger.Info("disconnected clients", "count", len(dropped), "user_id", userID, "reason", reason)
+	}
+}
+
+// sendToUser delivers a frame to every connection userID currently has open,
+// whatever transport it uses. Users with no connections are skipped.
+func (h *WebSocketHandler) sendToUser(userID int, data any) error {
+	var errs []error
+	for _, c := range h.userClients(userID) {
+		if err := c.send(data, h.logger); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver sends a new message to its recipient like sendToUser, recording
+// each delivery and how long it took since the message was received.
+func (h *WebSocketHandler) deliver(userID int, message WSMessage, received time.Time) error {
+	var errs []error
+	for _, c := range h.userClients(userID) {
+		if err := c.send(message, h.logger); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		h.metrics.MessageDelivered(c.transport(), time.Since(received))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *WebSocketHandler) userClients(userID int) []client {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	conns := make([]client, 0, len(h.clients[userID]))
+	for c := range h.clients[userID] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// replier receives the replies to the frames one connection sends. Replies
+// go only to that connection; other connections of the same user never see
+// another one's errors or history.
+type replier interface {
+	send(data any, logger *slog.Logger) error
+}
+
+func (h *WebSocketHandler) sendError(reply replier, message string) {
+	_ = reply.send(WSMessage{
+		Type:  "error",
+		Error: message,
+	}, h.logger)
+}
+
+func (h *WebSocketHandler) sendClientError(reply replier, ce *ClientError) {
+	_ = reply.send(WSMessage{
+		Type:  "error",
+		Error: ce.Message,
+		Code:  ce.Code,
+	}, h.logger)
 }
 
-func (h *WebSocketHandler) handleMessage(senderID int, msg *WSMessage) {
+func (h *WebSocketHandler) handleMessage(ctx context.Context, senderID int, reply replier, msg *WSMessage) {
+	h.metrics.FrameReceived(frameTypeLabel(msg.Type))
+	if !h.allowFrame(ctx, senderID, reply, msg.Type) {
+		return
+	}
+
 	switch msg.Type {
 	case "send_message":
-		h.handleSendMessage(senderID, msg)
+		h.handleSendMessage(ctx, senderID, reply, msg)
 	case "get_history":
-		h.handleGetMessages(senderID, msg)
+		h.handleGetMessages(ctx, senderID, reply, msg)
+	case "get_conversations":
+		h.handleGetConversations(ctx, senderID, reply)
 	default:
-		h.handleInvalidMessage(senderID)
+		h.handleInvalidMessage(reply)
 	}
 }
 
-func (h *WebSocketHandler) handleSendMessage(senderID int, msg *WSMessage) {
-	if msg.ReceiverID == 0 {
-		h.logger.Printf("ERROR: receiver_id is required")
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Receiver ID is required",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
-		}
-		return
+// allowFrame applies the user's limit for frameType, telling the sending
+// connection when it has to slow down.
+func (h *WebSocketHandler) allowFrame(ctx context.Context, userID int, reply replier, frameType string) bool {
+	if h.limiter == nil {
+		return true
 	}
 
-	if msg.Content == "" {
-		h.logger.Printf("ERROR: content is required")
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Content is required",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
-		}
-		return
+	name := frameType
+	if !h.limiter.Has(name) {
+		name = ratelimit.FrameDefault
 	}
+	allowed, retryAfter := h.limiter.Allow(ctx, name, "user:"+strconv.Itoa(userID))
+	if !allowed {
+		h.logger.InfoContext(ctx, "frames rate limited", "frame_type", frameType, "user_id", userID)
+		_ = reply.send(rateLimitedFrame(retryAfter), h.logger)
+	}
+	return allowed
+}
+
+func rateLimitedFrame(retryAfter time.Duration) WSMessage {
+	return WSMessage{
+		Type:       "error",
+		Error:      "Too many requests, slow down",
+		Code:       codeRateLimited,
+		RetryAfter: retryAfterSeconds(retryAfter),
+	}
+}
 
-	_, err := h.userStore.GetUserByID(msg.ReceiverID)
+func (h *WebSocketHandler) handleSendMessage(ctx context.Context, senderID int, reply replier, msg *WSMessage) {
+	_, err := h.SendMessage(ctx, senderID, msg.ReceiverID, msg.Content)
 	if err != nil {
-		h.logger.Printf("ERROR: receiver user not found: %v", err)
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Receiver user not found",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
-		}
-		return
+		h.sendClientError(reply, clientErrorFrom(err, "Failed to send message"))
 	}
+}
 
-	_, err = h.messageStore.CreateMessage(senderID, msg.ReceiverID, msg.Content)
+// SendMessage stores a message and fans it out to every live connection of
+// both participants. It is the single send path for WebSocket frames and the
+// REST API; validation failures come back as *ClientError.
+func (h *WebSocketHandler) SendMessage(ctx context.Context, senderID, receiverID int, content string) (*store.Message, error) {
+	received := time.Now()
+	if !h.beginSend() {
+		return nil, errShuttingDown
+	}
+	defer h.endSend()
+
+	if receiverID == 0 {
+		h.logger.ErrorContext(ctx, "receiver_id is required")
+		return nil, clientError(http.StatusBadRequest, "Receiver ID is required")
+	}
+
+	if content == "" {
+		h.logger.ErrorContext(ctx, "content is required")
+		return nil, clientError(http.StatusBadRequest, "Content is required")
+	}
+
+	content, err := h.filters.Filter(content)
 	if err != nil {
-		h.logger.Printf("ERROR: creating message: %v", err)
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Failed to send message",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
+		var rejection *filter.Rejection
+		if errors.As(err, &rejection) {
+			h.logger.InfoContext(ctx, "message rejected", "sender_id", senderID, "code", rejection.Code)
+			return nil, &ClientError{Status: http.StatusUnprocessableEntity, Message: rejection.Reason, Code: rejection.Code}
 		}
-		return
+		h.logger.ErrorContext(ctx, "filtering message", "error", err)
+		return nil, err
+	}
+
+	_, err = h.userStore.GetUserByID(ctx, receiverID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "receiver user not found", "error", err)
+		return nil, clientError(http.StatusNotFound, "Receiver user not found")
+	}
+
+	blocked, err := h.relations.IsBlockedBetween(ctx, senderID, receiverID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "checking blocks", "error", err)
+		return nil, err
+	}
+	if blocked {
+		// Deliberately vague, so the sender cannot tell they were blocked
+		h.logger.InfoContext(ctx, "message between blocked users refused", "sender_id", senderID, "receiver_id", receiverID)
+		return nil, clientError(http.StatusForbidden, "Message could not be delivered")
+	}
+
+	// A sender who disconnects mid-send must not leave it unknown whether
+	// the message was stored, so only the deadline bounds the insert.
+	storeCtx, cancel := withoutCancelKeepDeadline(ctx)
+	defer cancel()
+	message, err := h.messageStore.CreateMessage(storeCtx, senderID, receiverID, content)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "creating message", "error", err)
+		return nil, err
+	}
+	h.metrics.MessageSent()
+
+	muted, err := h.relations.IsMuted(ctx, receiverID, senderID)
+	if err != nil {
+		// The message is stored; at worst it notifies when it should not
+		h.logger.ErrorContext(ctx, "checking mutes", "error", err)
+	}
+
+	response := WSMessage{
+		Type:       "new_message",
+		ID:         message.ID,
+		SenderID:   senderID,
+		ReceiverID: receiverID,
+		Content:    content,
+		CreatedAt:  time.Now().Format(time.RFC3339),
 	}
 
 	// Send new_message to recipient
+	recipientCopy := response
+	recipientCopy.Muted = muted
+	err = h.deliver(receiverID, recipientCopy, received)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "failed to send message to recipient", "error", err)
+	}
+
+	// Send new_message to sender as well so they see their own message
+	err = h.sendToUser(senderID, response)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "failed to send message to sender", "error", err)
+	}
+
+	h.PublishConversation(ctx, receiverID, senderID)
+	h.PublishConversation(ctx, senderID, receiverID)
+
+	return message, nil
+}
+
+// withoutCancelKeepDeadline returns a context that ignores ctx being
+// cancelled but still ends at its deadline, if it has one.
+func withoutCancelKeepDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return detached, func() {}
+}
+
+// PublishConversation pushes userID's current view of the conversation with
+// otherUserID as a conversation_updated frame, so conversation lists stay live
+// without refetching.
+func (h *WebSocketHandler) PublishConversation(ctx context.Context, userID, otherUserID int) {
 	h.clientsMutex.RLock()
-	recipientConn, recipientExists := h.clients[msg.ReceiverID]
-	senderConn, senderExists := h.clients[senderID]
+	_, connected := h.clients[userID]
 	h.clientsMutex.RUnlock()
+	if !connected {
+		return
+	}
 
-	// Get current timestamp
-	currentTime := time.Now().Format(time.RFC3339)
-
-	if recipientExists {
-		response := WSMessage{
-			Type:       "new_message",
-			SenderID:   senderID,
-			ReceiverID: msg.ReceiverID,
-			Content:    msg.Content,
-			CreatedAt:  currentTime,
-		}
-		err := utils.WriteWebsocketMessage(recipientConn, response, h.logger)
-		if err != nil {
-			h.logger.Printf("ERROR: failed to send message to recipient: %v", err)
-		}
+	conversation, err := h.messageStore.GetConversation(ctx, userID, otherUserID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "getting conversation", "error", err)
+		return
 	}
 
-	// Send new_message to sender as well so they see their own message
-	if senderExists {
-		response := WSMessage{
-			Type:       "new_message",
-			SenderID:   senderID,
-			ReceiverID: msg.ReceiverID,
-			Content:    msg.Content,
-			CreatedAt:  currentTime,
-		}
-		err = utils.WriteWebsocketMessage(senderConn, response, h.logger)
-		if err != nil {
-			h.logger.Printf("ERROR: failed to send message to sender: %v", err)
-		}
+	response := map[string]interface{}{
+		"type":         "conversation_updated",
+		"conversation": conversation,
 	}
+	_ = h.sendToUser(userID, response)
 }
 
-func (h *WebSocketHandler) handleGetMessages(senderID int, msg *WSMessage) {
+func (h *WebSocketHandler) handleGetMessages(ctx context.Context, senderID int, reply replier, msg *WSMessage) {
 	if msg.ReceiverID == 0 {
-		h.logger.Printf("ERROR: receiver_id is required")
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Receiver ID is required",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
-		}
+		h.logger.ErrorContext(ctx, "receiver_id is required")
+		h.sendError(reply, "Receiver ID is required")
 		return
 	}
 
-	messages, err := h.messageStore.GetMessagesBetweenUsers(senderID, msg.ReceiverID)
+	messages, err := h.messageStore.GetMessagesBetweenUsers(ctx, senderID, msg.ReceiverID)
 	if err != nil {
-		h.logger.Printf("ERROR: getting messages: %v", err)
-		h.clientsMutex.RLock()
-		senderConn, exists := h.clients[senderID]
-		h.clientsMutex.RUnlock()
-		if exists {
-			response := WSMessage{
-				Type:  "error",
-				Error: "Failed to get messages",
-			}
-			err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-			if err != nil {
-				return
-			}
-		}
+		h.logger.ErrorContext(ctx, "getting messages", "error", err)
+		h.sendError(reply, "Failed to get messages")
 		return
 	}
 
-	h.clientsMutex.RLock()
-	senderConn, exists := h.clients[senderID]
-	h.clientsMutex.RUnlock()
-	if exists {
-		response := map[string]interface{}{
-			"type":        "messages_history",
-			"sender_id":   senderID,
-			"receiver_id": msg.ReceiverID,
-			"messages":    messages,
-		}
-		err = utils.WriteWebsocketMessage(senderConn, response, h.logger)
-		if err != nil {
-			return
-		}
+	response := map[string]interface{}{
+		"type":        "messages_history",
+		"sender_id":   senderID,
+		"receiver_id": msg.ReceiverID,
+		"messages":    messages,
 	}
+	_ = reply.send(response, h.logger)
 }
 
-func (h *WebSocketHandler) handleInvalidMessage(senderID int) {
-	h.clientsMutex.RLock()
-	senderConn, exists := h.clients[senderID]
-	h.clientsMutex.RUnlock()
-	if exists {
-		response := WSMessage{
-			Type:  "error",
-			Error: "Invalid message type",
-		}
-		err := utils.WriteWebsocketMessage(senderConn, response, h.logger)
-		if err != nil {
-			return
-		}
+func (h *WebSocketHandler) handleGetConversations(ctx context.Context, userID int, reply replier) {
+	conversations, err := h.messageStore.GetConversations(ctx, userID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "getting conversations", "error", err)
+		h.sendError(reply, "Failed to get conversations")
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":          "conversations",
+		"conversations": conversations,
 	}
+	_ = reply.send(response, h.logger)
+}
+
+func (h *WebSocketHandler) handleInvalidMessage(reply replier) {
+	h.sendError(reply, "Invalid message type")
 }
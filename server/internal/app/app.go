@@ -2,52 +2,408 @@ package app
 
 import (
 	"chat/internal/api"
+	"chat/internal/config"
+	"chat/internal/credentials"
+	"chat/internal/crypto"
+	"chat/internal/filter"
+	"chat/internal/health"
+	"chat/internal/logging"
+	"chat/internal/mail"
+	"chat/internal/metrics"
 	"chat/internal/migrations"
+	"chat/internal/oidc"
+	"chat/internal/ratelimit"
+	"chat/internal/rbac"
 	"chat/internal/store"
+	"chat/internal/tracing"
 	"chat/internal/utils"
+	"context"
 	"database/sql"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Application struct {
-	Logger           *log.Logger
-	DB               *sql.DB
-	UserHandler      *api.UserHandler
-	WebSocketHandler *api.WebSocketHandler
+	Config *config.Config
+	Logger *slog.Logger
+	DB     *sql.DB
+	// Registry holds the metrics served at /metrics.
+	Registry *prometheus.Registry
+	Metrics  *metrics.Metrics
+	// TracerProvider records request, frame and store spans; a no-op unless
+	// an exporter is configured.
+	TracerProvider trace.TracerProvider
+	// Health answers liveness and readiness probes.
+	Health            *health.Checker
+	UserHandler       *api.UserHandler
+	WebSocketHandler  *api.WebSocketHandler
+	MessageHandler    *api.MessageHandler
+	ProfileHandler    *api.ProfileHandler
+	PasswordHandler   *api.PasswordHandler
+	MFAHandler        *api.MFAHandler
+	SSOHandler        *api.SSOHandler
+	AdminHandler      *api.AdminHandler
+	RelationHandler   *api.RelationHandler
+	ModerationHandler *api.ModerationHandler
+	Authenticator     *api.Authenticator
+	RateLimiter       *ratelimit.Limiter
+	// TrustedProxies may name the client in X-Forwarded-For.
+	TrustedProxies []netip.Prefix
+}
+
+// loadOIDCProviders reads a JSON array of provider configs.
+func loadOIDCProviders(path string) ([]*oidc.Provider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []oidc.Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	providers := make([]*oidc.Provider, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("%s: duplicate provider %q", path, cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		provider, err := oidc.NewProvider(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// loadPolicy builds the username and password policy from cfg, extending
+// the embedded breached-password list with the configured file.
+func loadPolicy(cfg config.AuthConfig) (*credentials.Policy, error) {
+	pattern, err := regexp.Compile(cfg.UsernamePattern)
+	if err != nil {
+		return nil, err
+	}
+	policy := credentials.DefaultPolicy()
+	policy.MinUsernameLength = cfg.UsernameMinLength
+	policy.MaxUsernameLength = cfg.UsernameMaxLength
+	policy.UsernamePattern = pattern
+	policy.UsernameHint = cfg.UsernameHint
+	policy.SetReservedUsernames(cfg.ReservedUsernames)
+	policy.MinPasswordLength = cfg.PasswordMinLength
+	policy.MinUniqueRunes = cfg.PasswordMinUniqueChars
+
+	if cfg.BreachedPasswordsFile != "" {
+		f, err := os.Open(cfg.BreachedPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		err = policy.AddBreached(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// loadMessageFilters builds the outgoing message filters: normalization and
+// the length limit always, then blocked words and link lists when set.
+func loadMessageFilters(cfg config.MessagesConfig) (filter.Chain, error) {
+	chain := filter.Chain{filter.Normalize(), filter.MaxLength(cfg.MaxLength)}
+
+	if cfg.BlockedWordsFile != "" {
+		f, err := os.Open(cfg.BlockedWordsFile)
+		if err != nil {
+			return nil, err
+		}
+		words, err := filter.ReadWords(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		keywords, err := filter.Keywords(words, cfg.BlockedWordsAction)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, keywords)
+	}
+
+	if len(cfg.LinkAllowlist) > 0 || len(cfg.LinkDenylist) > 0 {
+		chain = append(chain, filter.Links(cfg.LinkAllowlist, cfg.LinkDenylist))
+	}
+	return chain, nil
+}
+
+// newRateLimiter builds the limiter. The postgres store shares buckets
+// between servers through the database instead of keeping them in memory.
+func newRateLimiter(db *sql.DB, cfg *config.Config, logger *slog.Logger) (*ratelimit.Limiter, error) {
+	limits, err := cfg.RateLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	var limitStore ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "memory":
+		limitStore = ratelimit.NewMemoryStore()
+	case "postgres":
+		limitStore = store.NewPostgresRateLimitStore(db)
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %q", cfg.RateLimit.Store)
+	}
+	return ratelimit.NewLimiter(limitStore, limits, logger), nil
+}
+
+// grantAdmins gives the admin role to each username, so the first
+// administrator can be set up without touching the database.
+func grantAdmins(ctx context.Context, userStore store.UserStore, usernames []string, logger *slog.Logger) error {
+	for _, username := range usernames {
+		user, err := userStore.GetUserByUsername(ctx, username)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				logger.Error("admin user not found", "username", username)
+				continue
+			}
+			return err
+		}
+		if user.Role == rbac.RoleAdmin {
+			continue
+		}
+		if err := userStore.SetRole(ctx, user.ID, rbac.RoleAdmin); err != nil {
+			return err
+		}
+		logger.Info("granted admin role", "username", user.Username)
+	}
+	return nil
 }
 
-func NewApplication() (*Application, error) {
-	pgDB, err := store.Open()
+// readinessTimeout bounds the checks run for each readiness probe.
+const readinessTimeout = 2 * time.Second
+
+// migrationsApplied checks that db is migrated at least to the latest
+// version this build embeds.
+func migrationsApplied(db *sql.DB, logger *slog.Logger) health.Check {
+	var reported atomic.Int64
+	return func(ctx context.Context) error {
+		current, latest, err := store.MigrationVersions(ctx, db, migrations.FS, ".")
+		if err != nil {
+			return err
+		}
+		if current < latest {
+			return fmt.Errorf("database is at version %d, want %d", current, latest)
+		}
+		// A newer server has migrated further, as during a rolling deploy.
+		// Failing readiness would take every older server out of rotation at
+		// once, so it is only reported.
+		if current > latest && reported.Swap(current) != current {
+			logger.WarnContext(ctx, "database schema is newer than this server", "version", current, "latest_known", latest)
+		}
+		return nil
+	}
+}
+
+func NewApplication(cfg *config.Config) (_ *Application, err error) {
+	pgDB, err := store.Open(cfg.Database.DSN)
 	if err != nil {
 		return nil, err
 	}
+	// Until the application owns the pool, every failure below must close it
+	defer func() {
+		if err != nil {
+			pgDB.Close()
+		}
+	}()
+	pgDB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	pgDB.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	pgDB.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+
+	if cfg.Database.AutoMigrate {
+		err = store.MigrateFS(context.Background(), pgDB, migrations.FS, ".", store.MigrateUp)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err = store.MigrateFS(pgDB, migrations.FS, ".")
+	logger, err := logging.New(os.Stdout, cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if err := crypto.LoadKey(os.Getenv("ENCRYPTION_KEY")); err != nil {
+		logger.Error("loading encryption key", "error", err)
+		return nil, err
 	}
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	registry := metrics.NewRegistry()
+	registry.MustRegister(collectors.NewDBStatsCollector(pgDB, "chat"))
+	appMetrics := metrics.New(registry)
+
+	tracerProvider, err := tracing.NewProvider(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	userStore := store.NewPostgresUserStore(pgDB)
+	userStore.SetObserver(appMetrics)
+	userStore.SetTracerProvider(tracerProvider)
 	messageStore := store.NewPostgresMessageStore(pgDB)
+	messageStore.SetObserver(appMetrics)
+	messageStore.SetTracerProvider(tracerProvider)
+	sessionStore := store.NewPostgresSessionStore(pgDB)
+	auditStore := store.NewPostgresAuditStore(pgDB)
+	mfaStore := store.NewPostgresMFAStore(pgDB)
+	identityStore := store.NewPostgresIdentityStore(pgDB)
+	relationStore := store.NewPostgresRelationStore(pgDB)
+	reportStore := store.NewPostgresReportStore(pgDB)
+
+	var mailer mail.Mailer = mail.NewLogMailer(logger)
+	if cfg.Mail.Dir != "" {
+		mailer, err = mail.NewFileMailer(cfg.Mail.Dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	policy, err := loadPolicy(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []*oidc.Provider
+	if path := cfg.Auth.OIDCProvidersFile; path != "" {
+		providers, err = loadOIDCProviders(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filters, err := loadMessageFilters(cfg.Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := newRateLimiter(pgDB, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := grantAdmins(context.Background(), userStore, cfg.Auth.AdminUsernames, logger); err != nil {
+		return nil, err
+	}
+
+	loginGuard := api.NewLoginGuard(auditStore, logger)
+	userHandler := api.NewUserHandler(userStore, sessionStore, mfaStore, policy, loginGuard, logger)
+	webSocketHandler := api.NewWebSocketHandler(messageStore, userStore, relationStore, logger)
+	webSocketHandler.SetFilters(filters)
+	webSocketHandler.SetRateLimiter(limiter)
+	webSocketHandler.SetMetrics(appMetrics)
+	webSocketHandler.SetTracerProvider(tracerProvider)
+	webSocketHandler.SetAllowedOrigins(cfg.CORS.AllowedOrigins)
+	webSocketHandler.SetConnectionLimits(api.ConnectionLimits{
+		MaxMessageBytes: cfg.WebSocket.MaxMessageBytes,
+		MaxConnections:  cfg.WebSocket.MaxConnectionsPerUser,
+		FrameTimeout:    cfg.WebSocket.FrameTimeout,
+	})
 
-	userHandler := api.NewUserHandler(userStore, logger)
-	webSocketHandler := api.NewWebSocketHandler(messageStore, userStore, logger)
+	checker := health.NewChecker(readinessTimeout, logger)
+	checker.Add("database", pgDB.PingContext)
+	checker.Add("migrations", migrationsApplied(pgDB, logger))
+	// Chat messages are relayed in process by the WebSocket hub; there is
+	// no external broker to check
+	checker.Add("websocket_hub", webSocketHandler.Ready)
+	checker.Add("key_provider", func(context.Context) error { return crypto.Check() })
+
+	messageHandler := api.NewMessageHandler(messageStore, userStore, webSocketHandler, logger)
+	profileHandler := api.NewProfileHandler(userStore, messageStore, webSocketHandler, logger)
+	passwordHandler := api.NewPasswordHandler(userStore, sessionStore, mailer, policy, loginGuard, webSocketHandler, cfg.Auth.PasswordResetURL, logger)
 
 	app := &Application{
-		Logger:           logger,
-		DB:               pgDB,
-		UserHandler:      userHandler,
-		WebSocketHandler: webSocketHandler,
+		Config:            cfg,
+		Logger:            logger,
+		DB:                pgDB,
+		Registry:          registry,
+		Metrics:           appMetrics,
+		TracerProvider:    tracerProvider,
+		Health:            checker,
+		UserHandler:       userHandler,
+		WebSocketHandler:  webSocketHandler,
+		MessageHandler:    messageHandler,
+		ProfileHandler:    profileHandler,
+		PasswordHandler:   passwordHandler,
+		MFAHandler:        api.NewMFAHandler(userStore, sessionStore, mfaStore, loginGuard, logger),
+		RelationHandler:   api.NewRelationHandler(relationStore, userStore, webSocketHandler, logger),
+		AdminHandler:      api.NewAdminHandler(userStore, sessionStore, auditStore, webSocketHandler, logger),
+		ModerationHandler: api.NewModerationHandler(reportStore, messageStore, userStore, sessionStore, auditStore, webSocketHandler, logger),
+		SSOHandler:        api.NewSSOHandler(providers, userStore, sessionStore, identityStore, mfaStore, policy, cfg.Auth.OIDCLoginRedirect, logger),
+		Authenticator:     api.NewAuthenticator(sessionStore, userStore, logger),
+		RateLimiter:       limiter,
+		TrustedProxies:    trustedProxies,
 	}
 
 	return app, nil
 }
 
+// Shutdown stops server and the application within ctx's deadline.
+// Readiness probes fail from the start, and the server keeps serving for the
+// drain delay so load balancers can take it out of rotation. It then stops
+// accepting connections while chat clients, which it does not track once
+// upgraded, are drained; buffered spans are flushed and the database closes
+// last.
+func (a *Application) Shutdown(ctx context.Context, server *http.Server) error {
+	a.Health.SetShuttingDown()
+	if delay := a.Config.Shutdown.DrainDelay; delay > 0 {
+		a.Logger.InfoContext(ctx, "waiting for load balancers to stop sending traffic", "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Shutdown(ctx)
+	}()
+
+	err := a.WebSocketHandler.Shutdown(ctx, a.Config.Shutdown.ReconnectAfter)
+	if serverErr := <-serverDone; serverErr != nil {
+		// Cut off requests that outlived the deadline
+		_ = server.Close()
+		err = errors.Join(err, serverErr)
+	}
+	return errors.Join(err, tracing.Shutdown(ctx, a.TracerProvider), a.DB.Close())
+}
+
+// HealthCheck reports only that the server is running. It predates /livez
+// and /readyz and is kept for existing monitors.
 func (a *Application) HealthCheck(w http.ResponseWriter, _r *http.Request) {
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"status": "OK"})
-	a.Logger.Println("INFO: Health check")
 }
@@ -0,0 +1,73 @@
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// Size is the width and height every stored avatar is resized to.
+	Size = 256
+	// MaxUploadBytes caps the size of an uploaded image before decoding.
+	MaxUploadBytes = 5 << 20
+	// maxPixels guards against decompression bombs: small files that declare
+	// enormous dimensions.
+	maxPixels = 40_000_000
+
+	ContentType = "image/png"
+)
+
+var (
+	ErrTooLarge          = errors.New("avatar image is too large")
+	ErrUnsupportedFormat = errors.New("avatar must be a PNG, JPEG or GIF image")
+)
+
+// Process decodes an uploaded image, crops it to a centred square and scales
+// it to Size x Size, returning the PNG-encoded result.
+func Process(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxUploadBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading avatar: %w", err)
+	}
+	if len(data) > MaxUploadBytes {
+		return nil, ErrTooLarge
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, Size, Size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, centerSquare(src.Bounds()), draw.Src, nil)
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, dst); err != nil {
+		return nil, fmt.Errorf("encoding avatar: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// centerSquare returns the largest square inside b, centred on it.
+func centerSquare(b image.Rectangle) image.Rectangle {
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
@@ -0,0 +1,72 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestProcess_ResizesToSquare(t *testing.T) {
+	// A wide image: left third red, middle green, right third blue
+	src := image.NewRGBA(image.Rect(0, 0, 900, 300))
+	for x := 0; x < 900; x++ {
+		c := color.RGBA{R: 255, A: 255}
+		if x >= 300 && x < 600 {
+			c = color.RGBA{G: 255, A: 255}
+		} else if x >= 600 {
+			c = color.RGBA{B: 255, A: 255}
+		}
+		for y := 0; y < 300; y++ {
+			src.Set(x, y, c)
+		}
+	}
+
+	out, err := Process(bytes.NewReader(encodePNG(t, src)))
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, Size, img.Bounds().Dx())
+	assert.Equal(t, Size, img.Bounds().Dy())
+
+	// The crop is centred, so only the green middle third survives
+	r, g, b, _ := img.At(Size/2, Size/2).RGBA()
+	assert.Zero(t, r)
+	assert.NotZero(t, g)
+	assert.Zero(t, b)
+}
+
+func TestProcess_RejectsNonImages(t *testing.T) {
+	_, err := Process(bytes.NewReader([]byte("definitely not an image")))
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestProcess_RejectsOversizedUploads(t *testing.T) {
+	_, err := Process(bytes.NewReader(make([]byte, MaxUploadBytes+1)))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestProcess_RejectsDecompressionBombs(t *testing.T) {
+	data := encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+
+	// Rewrite the IHDR chunk to claim 50000x50000 pixels and fix its CRC
+	binary.BigEndian.PutUint32(data[16:20], 50000)
+	binary.BigEndian.PutUint32(data[20:24], 50000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+
+	_, err := Process(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
@@ -0,0 +1,662 @@
+// Package config loads server settings. Each setting has a default and can
+// be overridden, in increasing order of precedence, by a YAML or TOML file,
+// an environment variable and a command-line flag.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat/internal/credentials"
+	"chat/internal/filter"
+	"chat/internal/logging"
+	"chat/internal/ratelimit"
+	"chat/internal/tlsutil"
+	"chat/internal/tracing"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Addr is the address the server listens on, such as ":8080".
+	Addr string `yaml:"addr" toml:"addr"`
+	// MetricsAddr serves /metrics on its own listener, kept off the public
+	// address; empty disables it.
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr"`
+	// LogLevel is the least severe level logged: debug, info, warn or error.
+	LogLevel string `yaml:"log_level" toml:"log_level"`
+	// LogFormat is "json" or "text".
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+	// RequestTimeout bounds the work done for each API request, 0 for no
+	// bound. Streaming connections are not subject to it.
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed. Requests from anywhere else
+	// are attributed to their peer address.
+	TrustedProxies []string        `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	Database       DatabaseConfig  `yaml:"database" toml:"database"`
+	TLS            TLSConfig       `yaml:"tls" toml:"tls"`
+	CORS           CORSConfig      `yaml:"cors" toml:"cors"`
+	WebSocket      WebSocketConfig `yaml:"websocket" toml:"websocket"`
+	Shutdown       ShutdownConfig  `yaml:"shutdown" toml:"shutdown"`
+	Auth           AuthConfig      `yaml:"auth" toml:"auth"`
+	Mail           MailConfig      `yaml:"mail" toml:"mail"`
+	Messages       MessagesConfig  `yaml:"messages" toml:"messages"`
+	RateLimit      RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+	Tracing        TracingConfig   `yaml:"tracing" toml:"tracing"`
+}
+
+type DatabaseConfig struct {
+	DSN             string        `yaml:"dsn" toml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	// AutoMigrate applies pending migrations at startup. Turn it off to
+	// migrate as a separate deploy step with the migrate command.
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate"`
+}
+
+// TLSConfig serves HTTPS when both files are set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// ReloadInterval is how often the files are checked for a renewed
+	// certificate.
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+	// ClientCAFile verifies client certificates, as ClientAuth requires:
+	// "none", "verify" when presented or "require".
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth" toml:"client_auth"`
+	// RedirectAddr, when set, serves plain HTTP there that redirects to
+	// HTTPS.
+	RedirectAddr string `yaml:"redirect_addr" toml:"redirect_addr"`
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// CORSConfig lists the browser origins allowed to call the API and open
+// WebSockets. "*" allows any origin but cannot be combined with credentials.
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	AllowCredentials bool     `yaml:"allow_credentials" toml:"allow_credentials"`
+}
+
+type WebSocketConfig struct {
+	// MaxMessageBytes is the largest frame a client may send.
+	MaxMessageBytes int64 `yaml:"max_message_bytes" toml:"max_message_bytes"`
+	// MaxConnectionsPerUser caps live connections per user, 0 for no cap.
+	MaxConnectionsPerUser int `yaml:"max_connections_per_user" toml:"max_connections_per_user"`
+	// FrameTimeout bounds the work done for each frame, 0 for no bound.
+	FrameTimeout time.Duration `yaml:"frame_timeout" toml:"frame_timeout"`
+}
+
+type ShutdownConfig struct {
+	// Timeout bounds how long draining connections and requests may take
+	// before the database is closed regardless.
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// ReconnectAfter is how long clients are told to wait before
+	// reconnecting, giving the replacement server time to start.
+	ReconnectAfter time.Duration `yaml:"reconnect_after" toml:"reconnect_after"`
+	// DrainDelay is how long the server keeps serving after readiness
+	// starts failing, so load balancers stop sending it traffic before it
+	// stops accepting connections. It counts towards Timeout.
+	DrainDelay time.Duration `yaml:"drain_delay" toml:"drain_delay"`
+}
+
+type AuthConfig struct {
+	// PasswordResetURL is the client page reset emails link to.
+	PasswordResetURL string `yaml:"password_reset_url" toml:"password_reset_url"`
+	// BreachedPasswordsFile extends the built-in breached-password list.
+	BreachedPasswordsFile string `yaml:"breached_passwords_file" toml:"breached_passwords_file"`
+	// OIDCProvidersFile enables single sign-on with the providers it lists.
+	OIDCProvidersFile string `yaml:"oidc_providers_file" toml:"oidc_providers_file"`
+	// OIDCLoginRedirect is the client page single sign-on returns to.
+	OIDCLoginRedirect string `yaml:"oidc_login_redirect" toml:"oidc_login_redirect"`
+	// AdminUsernames are promoted to administrators at startup.
+	AdminUsernames []string `yaml:"admin_usernames" toml:"admin_usernames"`
+
+	// Usernames must be between UsernameMinLength and UsernameMaxLength
+	// characters and match UsernamePattern, which UsernameHint describes to
+	// users who do not.
+	UsernameMinLength int    `yaml:"username_min_length" toml:"username_min_length"`
+	UsernameMaxLength int    `yaml:"username_max_length" toml:"username_max_length"`
+	UsernamePattern   string `yaml:"username_pattern" toml:"username_pattern"`
+	UsernameHint      string `yaml:"username_hint" toml:"username_hint"`
+	// ReservedUsernames may not be registered, whatever their case.
+	ReservedUsernames []string `yaml:"reserved_usernames" toml:"reserved_usernames"`
+	// PasswordMinLength is in characters. PasswordMinUniqueChars rejects
+	// long but repetitive passwords.
+	PasswordMinLength      int `yaml:"password_min_length" toml:"password_min_length"`
+	PasswordMinUniqueChars int `yaml:"password_min_unique_chars" toml:"password_min_unique_chars"`
+}
+
+type MailConfig struct {
+	// Dir writes outgoing mail to files; otherwise it is only logged.
+	Dir string `yaml:"dir" toml:"dir"`
+}
+
+type MessagesConfig struct {
+	MaxLength          int                  `yaml:"max_length" toml:"max_length"`
+	BlockedWordsFile   string               `yaml:"blocked_words_file" toml:"blocked_words_file"`
+	BlockedWordsAction filter.KeywordAction `yaml:"blocked_words_action" toml:"blocked_words_action"`
+	LinkAllowlist      []string             `yaml:"link_allowlist" toml:"link_allowlist"`
+	LinkDenylist       []string             `yaml:"link_denylist" toml:"link_denylist"`
+}
+
+type RateLimitConfig struct {
+	// Store is "memory", or "postgres" to share buckets between servers.
+	Store string `yaml:"store" toml:"store"`
+	// Limits overrides individual limits by name, such as
+	// "/user.register": "3/1h".
+	Limits map[string]string `yaml:"limits" toml:"limits"`
+}
+
+// TracingConfig exports OpenTelemetry traces when Exporter is "otlp".
+type TracingConfig struct {
+	// Exporter is "none" or "otlp".
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// Endpoint is the collector's host:port.
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	Insecure bool   `yaml:"insecure" toml:"insecure"`
+	// SampleRatio is the share of new traces recorded, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// Default returns the settings used when nothing overrides them, suited to
+// local development.
+func Default() *Config {
+	return &Config{
+		Addr:           ":8080",
+		MetricsAddr:    "127.0.0.1:9090",
+		LogLevel:       "info",
+		LogFormat:      logging.FormatJSON,
+		RequestTimeout: 15 * time.Second,
+		Database: DatabaseConfig{
+			DSN:             "host=localhost port=5432 user=postgres password=root dbname=postgres sslmode=disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			AutoMigrate:     true,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: time.Minute,
+			ClientAuth:     tlsutil.ClientAuthNone,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   []string{"http://localhost:5173"},
+			AllowCredentials: true,
+		},
+		WebSocket: WebSocketConfig{
+			MaxMessageBytes:       64 << 10,
+			MaxConnectionsPerUser: 10,
+			FrameTimeout:          10 * time.Second,
+		},
+		Shutdown: ShutdownConfig{
+			Timeout:        30 * time.Second,
+			ReconnectAfter: 5 * time.Second,
+		},
+		Auth: AuthConfig{
+			PasswordResetURL:       "http://localhost:5173/reset-password",
+			OIDCLoginRedirect:      "http://localhost:5173/login/callback",
+			UsernameMinLength:      credentials.DefaultMinUsernameLength,
+			UsernameMaxLength:      credentials.DefaultMaxUsernameLength,
+			UsernamePattern:        credentials.DefaultUsernamePattern,
+			UsernameHint:           credentials.DefaultUsernameHint,
+			ReservedUsernames:      credentials.DefaultReservedUsernames(),
+			PasswordMinLength:      credentials.DefaultMinPasswordLength,
+			PasswordMinUniqueChars: credentials.DefaultMinUniqueRunes,
+		},
+		Messages: MessagesConfig{
+			MaxLength:          filter.DefaultMaxLength,
+			BlockedWordsAction: filter.KeywordMask,
+		},
+		RateLimit: RateLimitConfig{Store: "memory"},
+		Tracing: TracingConfig{
+			Exporter:    tracing.ExporterNone,
+			SampleRatio: 1,
+		},
+	}
+}
+
+// setting is one value that can be set from the environment or a flag.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"addr", "LISTEN_ADDR", "address to listen on", stringValue(func(c *Config) *string { return &c.Addr })},
+	{"port", "PORT", "port to listen on on all interfaces, instead of -addr", func(c *Config, value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		c.Addr = ":" + value
+		return nil
+	}},
+	{"metrics-addr", "METRICS_ADDR", "address serving /metrics, empty to disable", stringValue(func(c *Config) *string { return &c.MetricsAddr })},
+	{"log-level", "LOG_LEVEL", "least severe level logged: debug, info, warn or error", stringValue(func(c *Config) *string { return &c.LogLevel })},
+	{"log-format", "LOG_FORMAT", "log output format: json or text", stringValue(func(c *Config) *string { return &c.LogFormat })},
+	{"request-timeout", "REQUEST_TIMEOUT", "longest an API request may take, 0 for no limit", durationValue(func(c *Config) *time.Duration { return &c.RequestTimeout })},
+	{"trusted-proxies", "TRUSTED_PROXIES", "comma-separated proxy addresses or CIDRs whose X-Forwarded-For is believed", listValue(func(c *Config) *[]string { return &c.TrustedProxies })},
+
+	{"db-dsn", "DATABASE_URL", "PostgreSQL connection string", stringValue(func(c *Config) *string { return &c.Database.DSN })},
+	{"db-max-open-conns", "DB_MAX_OPEN_CONNS", "most open database connections", intValue(func(c *Config) *int { return &c.Database.MaxOpenConns })},
+	{"db-max-idle-conns", "DB_MAX_IDLE_CONNS", "most idle database connections kept", intValue(func(c *Config) *int { return &c.Database.MaxIdleConns })},
+	{"db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "longest a database connection is reused", durationValue(func(c *Config) *time.Duration { return &c.Database.ConnMaxLifetime })},
+	{"db-auto-migrate", "DB_AUTO_MIGRATE", "apply pending migrations at startup", boolValue(func(c *Config) *bool { return &c.Database.AutoMigrate })},
+
+	{"tls-cert", "TLS_CERT_FILE", "TLS certificate file; serves HTTPS with -tls-key", stringValue(func(c *Config) *string { return &c.TLS.CertFile })},
+	{"tls-key", "TLS_KEY_FILE", "TLS private key file", stringValue(func(c *Config) *string { return &c.TLS.KeyFile })},
+	{"tls-reload-interval", "TLS_RELOAD_INTERVAL", "how often certificate files are checked for changes", durationValue(func(c *Config) *time.Duration { return &c.TLS.ReloadInterval })},
+	{"tls-client-ca", "TLS_CLIENT_CA_FILE", "CA certificates that sign client certificates", stringValue(func(c *Config) *string { return &c.TLS.ClientCAFile })},
+	{"tls-client-auth", "TLS_CLIENT_AUTH", "client certificates: none, verify or require", stringValue(func(c *Config) *string { return &c.TLS.ClientAuth })},
+	{"tls-redirect-addr", "TLS_REDIRECT_ADDR", "address serving HTTP redirects to HTTPS", stringValue(func(c *Config) *string { return &c.TLS.RedirectAddr })},
+
+	{"cors-origins", "CORS_ALLOWED_ORIGINS", "comma-separated browser origins allowed to use the API", listValue(func(c *Config) *[]string { return &c.CORS.AllowedOrigins })},
+	{"cors-credentials", "CORS_ALLOW_CREDENTIALS", "allow cross-origin requests with credentials", boolValue(func(c *Config) *bool { return &c.CORS.AllowCredentials })},
+
+	{"ws-max-message-bytes", "WS_MAX_MESSAGE_BYTES", "largest WebSocket frame accepted", func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		c.WebSocket.MaxMessageBytes = n
+		return nil
+	}},
+	{"ws-max-connections", "WS_MAX_CONNECTIONS_PER_USER", "most live connections per user, 0 for no limit", intValue(func(c *Config) *int { return &c.WebSocket.MaxConnectionsPerUser })},
+	{"ws-frame-timeout", "WS_FRAME_TIMEOUT", "longest handling a WebSocket frame may take, 0 for no limit", durationValue(func(c *Config) *time.Duration { return &c.WebSocket.FrameTimeout })},
+
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "longest a graceful shutdown may take", durationValue(func(c *Config) *time.Duration { return &c.Shutdown.Timeout })},
+	{"shutdown-reconnect-after", "SHUTDOWN_RECONNECT_AFTER", "how long clients wait to reconnect after a shutdown", durationValue(func(c *Config) *time.Duration { return &c.Shutdown.ReconnectAfter })},
+	{"shutdown-drain-delay", "SHUTDOWN_DRAIN_DELAY", "how long to keep serving after readiness fails on shutdown", durationValue(func(c *Config) *time.Duration { return &c.Shutdown.DrainDelay })},
+
+	{"password-reset-url", "PASSWORD_RESET_URL", "client page password reset emails link to", stringValue(func(c *Config) *string { return &c.Auth.PasswordResetURL })},
+	{"breached-passwords-file", "BREACHED_PASSWORDS_FILE", "extra breached passwords, one per line", stringValue(func(c *Config) *string { return &c.Auth.BreachedPasswordsFile })},
+	{"oidc-providers-file", "OIDC_PROVIDERS_FILE", "JSON list of single sign-on providers", stringValue(func(c *Config) *string { return &c.Auth.OIDCProvidersFile })},
+	{"oidc-login-redirect", "OIDC_LOGIN_REDIRECT", "client page single sign-on returns to", stringValue(func(c *Config) *string { return &c.Auth.OIDCLoginRedirect })},
+	{"admin-usernames", "ADMIN_USERNAMES", "comma-separated users promoted to administrators", listValue(func(c *Config) *[]string { return &c.Auth.AdminUsernames })},
+	{"username-min-length", "USERNAME_MIN_LENGTH", "shortest username in characters", intValue(func(c *Config) *int { return &c.Auth.UsernameMinLength })},
+	{"username-max-length", "USERNAME_MAX_LENGTH", "longest username in characters", intValue(func(c *Config) *int { return &c.Auth.UsernameMaxLength })},
+	{"username-pattern", "USERNAME_PATTERN", "regular expression usernames must match", stringValue(func(c *Config) *string { return &c.Auth.UsernamePattern })},
+	{"username-hint", "USERNAME_HINT", "description of -username-pattern shown to users", stringValue(func(c *Config) *string { return &c.Auth.UsernameHint })},
+	{"reserved-usernames", "RESERVED_USERNAMES", "comma-separated usernames nobody may register", listValue(func(c *Config) *[]string { return &c.Auth.ReservedUsernames })},
+	{"password-min-length", "PASSWORD_MIN_LENGTH", "shortest password in characters", intValue(func(c *Config) *int { return &c.Auth.PasswordMinLength })},
+	{"password-min-unique-chars", "PASSWORD_MIN_UNIQUE_CHARS", "fewest distinct characters in a password", intValue(func(c *Config) *int { return &c.Auth.PasswordMinUniqueChars })},
+
+	{"mail-dir", "MAIL_DIR", "directory outgoing mail is written to", stringValue(func(c *Config) *string { return &c.Mail.Dir })},
+
+	{"message-max-length", "MESSAGE_MAX_LENGTH", "longest message in characters", intValue(func(c *Config) *int { return &c.Messages.MaxLength })},
+	{"blocked-words-file", "BLOCKED_WORDS_FILE", "blocked words, one per line", stringValue(func(c *Config) *string { return &c.Messages.BlockedWordsFile })},
+	{"blocked-words-action", "BLOCKED_WORDS_ACTION", "mask or reject messages with blocked words", func(c *Config, value string) error {
+		c.Messages.BlockedWordsAction = filter.KeywordAction(value)
+		return nil
+	}},
+	{"link-allowlist", "LINK_ALLOWLIST", "comma-separated domains links may point to", listValue(func(c *Config) *[]string { return &c.Messages.LinkAllowlist })},
+	{"link-denylist", "LINK_DENYLIST", "comma-separated domains links may not point to", listValue(func(c *Config) *[]string { return &c.Messages.LinkDenylist })},
+
+	{"rate-limit-store", "RATE_LIMIT_STORE", "memory, or postgres to share limits between servers", stringValue(func(c *Config) *string { return &c.RateLimit.Store })},
+	{"rate-limits", "RATE_LIMITS", "comma-separated name=requests/duration overrides", func(c *Config, value string) error {
+		if c.RateLimit.Limits == nil {
+			c.RateLimit.Limits = make(map[string]string)
+		}
+		for _, pair := range SplitList(value) {
+			name, limit, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not name=limit", pair)
+			}
+			c.RateLimit.Limits[strings.TrimSpace(name)] = strings.TrimSpace(limit)
+		}
+		return nil
+	}},
+
+	{"tracing-exporter", "TRACING_EXPORTER", "where traces go: none or otlp", stringValue(func(c *Config) *string { return &c.Tracing.Exporter })},
+	{"tracing-endpoint", "TRACING_ENDPOINT", "OTLP/HTTP collector host:port", stringValue(func(c *Config) *string { return &c.Tracing.Endpoint })},
+	{"tracing-insecure", "TRACING_INSECURE", "send traces over plain HTTP", boolValue(func(c *Config) *bool { return &c.Tracing.Insecure })},
+	{"tracing-sample-ratio", "TRACING_SAMPLE_RATIO", "share of new traces recorded, from 0 to 1", func(c *Config, value string) error {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		c.Tracing.SampleRatio = ratio
+		return nil
+	}},
+}
+
+func stringValue(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intValue(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolValue(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationValue(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func listValue(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = SplitList(value)
+		return nil
+	}
+}
+
+// Load builds the configuration from the defaults, then the file named by
+// -config or CONFIG_FILE, then the environment, then the flags in args, and
+// validates the result. getenv is usually os.Getenv.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML or TOML configuration file (env CONFIG_FILE)")
+	for _, s := range settings {
+		fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	path := *configFile
+	if path == "" {
+		path = getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("config: %s: %w", s.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(cfg, f.Value.String()); setErr != nil {
+					err = fmt.Errorf("config: -%s: %w", s.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings in a YAML or TOML file, chosen by
+// extension. Unknown keys are errors so typos do not pass silently.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config: parsing %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.NewDecoder(f).Decode(c)
+		if err != nil {
+			return fmt.Errorf("config: parsing %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: parsing %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported file type %q, want .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// maxUsernameColumn is the width of users.username.
+const maxUsernameColumn = 255
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("config: "+format, args...))
+	}
+
+	if c.Addr == "" {
+		fail("addr is required")
+	}
+	if c.MetricsAddr != "" && (c.MetricsAddr == c.Addr || c.MetricsAddr == c.TLS.RedirectAddr) {
+		fail("metrics_addr must differ from addr and tls.redirect_addr")
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		fail("log_level must be debug, info, warn or error: %q", c.LogLevel)
+	}
+	if c.LogFormat != logging.FormatJSON && c.LogFormat != logging.FormatText {
+		fail("log_format must be json or text: %q", c.LogFormat)
+	}
+	if c.RequestTimeout < 0 {
+		fail("request_timeout must not be negative")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			fail("trusted_proxies: %v", err)
+		}
+	}
+
+	if c.Database.DSN == "" {
+		fail("database.dsn is required")
+	}
+	if c.Database.MaxOpenConns < 0 {
+		fail("database.max_open_conns must not be negative")
+	}
+	if c.Database.MaxIdleConns < 0 {
+		fail("database.max_idle_conns must not be negative")
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		fail("database.max_idle_conns must not exceed max_open_conns")
+	}
+	if c.Database.ConnMaxLifetime < 0 {
+		fail("database.conn_max_lifetime must not be negative")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		fail("tls.reload_interval must be positive")
+	}
+	switch c.TLS.ClientAuth {
+	case tlsutil.ClientAuthNone:
+	case tlsutil.ClientAuthVerify, tlsutil.ClientAuthRequire:
+		if c.TLS.ClientCAFile == "" {
+			fail("tls.client_auth %q needs tls.client_ca_file", c.TLS.ClientAuth)
+		}
+	default:
+		fail("tls.client_auth must be none, verify or require: %q", c.TLS.ClientAuth)
+	}
+	if !c.TLS.Enabled() && (c.TLS.RedirectAddr != "" || c.TLS.ClientAuth != tlsutil.ClientAuthNone) {
+		fail("tls.redirect_addr and tls.client_auth need tls.cert_file and tls.key_file")
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" && c.CORS.AllowCredentials {
+			fail(`cors.allowed_origins cannot be "*" when credentials are allowed`)
+		}
+	}
+
+	if c.WebSocket.MaxMessageBytes < 1 {
+		fail("websocket.max_message_bytes must be positive")
+	}
+	if c.WebSocket.MaxConnectionsPerUser < 0 {
+		fail("websocket.max_connections_per_user must not be negative")
+	}
+	if c.WebSocket.FrameTimeout < 0 {
+		fail("websocket.frame_timeout must not be negative")
+	}
+
+	if c.Shutdown.Timeout <= 0 {
+		fail("shutdown.timeout must be positive")
+	}
+	if c.Shutdown.ReconnectAfter < 0 {
+		fail("shutdown.reconnect_after must not be negative")
+	}
+	if c.Shutdown.DrainDelay < 0 || (c.Shutdown.Timeout > 0 && c.Shutdown.DrainDelay >= c.Shutdown.Timeout) {
+		fail("shutdown.drain_delay must not be negative and must be shorter than shutdown.timeout")
+	}
+
+	if c.Auth.UsernameMinLength < 1 {
+		fail("auth.username_min_length must be positive")
+	}
+	if c.Auth.UsernameMaxLength < c.Auth.UsernameMinLength || c.Auth.UsernameMaxLength > maxUsernameColumn {
+		fail("auth.username_max_length must be between username_min_length and %d", maxUsernameColumn)
+	}
+	if c.Auth.UsernameMaxLength <= credentials.TakenUsernameSuffixLength {
+		fail("auth.username_max_length must be more than %d, to leave room for the suffix added to taken single sign-on usernames", credentials.TakenUsernameSuffixLength)
+	}
+	if _, err := regexp.Compile(c.Auth.UsernamePattern); err != nil {
+		fail("auth.username_pattern: %v", err)
+	}
+	if c.Auth.UsernameHint == "" {
+		fail("auth.username_hint is required")
+	}
+	if c.Auth.PasswordMinLength < 1 || c.Auth.PasswordMinLength > credentials.MaxPasswordBytes {
+		fail("auth.password_min_length must be between 1 and %d", credentials.MaxPasswordBytes)
+	}
+	if c.Auth.PasswordMinUniqueChars < 0 || c.Auth.PasswordMinUniqueChars > c.Auth.PasswordMinLength {
+		fail("auth.password_min_unique_chars must be between 0 and password_min_length")
+	}
+
+	if c.Messages.MaxLength < 1 {
+		fail("messages.max_length must be positive")
+	}
+	if c.Messages.BlockedWordsAction != filter.KeywordMask && c.Messages.BlockedWordsAction != filter.KeywordReject {
+		fail("messages.blocked_words_action must be mask or reject: %q", c.Messages.BlockedWordsAction)
+	}
+
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "postgres" {
+		fail("rate_limit.store must be memory or postgres: %q", c.RateLimit.Store)
+	}
+	for name, limit := range c.RateLimit.Limits {
+		if _, err := ratelimit.ParseLimit(limit); err != nil {
+			fail("rate_limit.limits[%s]: %v", name, err)
+		}
+	}
+
+	if c.Tracing.Exporter != tracing.ExporterNone && c.Tracing.Exporter != tracing.ExporterOTLP {
+		fail("tracing.exporter must be none or otlp: %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	return errors.Join(errs...)
+}
+
+// TrustedProxyPrefixes returns the trusted proxies as address ranges, a bare
+// address being a range of one.
+func (c *Config) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		prefix, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", proxy)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", proxy)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// RateLimits returns the default rate limits with the configured overrides
+// applied.
+func (c *Config) RateLimits() (map[string]ratelimit.Limit, error) {
+	limits := ratelimit.DefaultLimits()
+	for name, value := range c.RateLimit.Limits {
+		limit, err := ratelimit.ParseLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// SplitList splits a comma-separated setting, dropping empty entries.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
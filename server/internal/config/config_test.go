@@ -0,0 +1,227 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chat/internal/credentials"
+	"chat/internal/filter"
+	"chat/internal/ratelimit"
+	"chat/internal/tlsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+	assert.False(t, cfg.TLS.Enabled())
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, "chat.yaml", `
+addr: ":9000"
+log_level: warn
+database:
+  dsn: postgres://file
+  max_open_conns: 50
+  conn_max_lifetime: 5m
+cors:
+  allowed_origins: [https://chat.example.com]
+messages:
+  link_denylist: [evil.test]
+rate_limit:
+  limits:
+    /user.register: 3/1h
+`)
+
+	cfg, err := Load(
+		[]string{"-config", path, "-addr", ":9100"},
+		env(map[string]string{
+			"LISTEN_ADDR":   ":9050",
+			"DATABASE_URL":  "postgres://env",
+			"LINK_DENYLIST": "bad.test, worse.test",
+		}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9100", cfg.Addr, "flags beat the environment")
+	assert.Equal(t, "postgres://env", cfg.Database.DSN, "the environment beats the file")
+	assert.Equal(t, "warn", cfg.LogLevel)
+	assert.Equal(t, 50, cfg.Database.MaxOpenConns)
+	assert.Equal(t, 25, cfg.Database.MaxIdleConns, "unset keys keep their default")
+	assert.Equal(t, 5*time.Minute, cfg.Database.ConnMaxLifetime)
+	assert.Equal(t, []string{"https://chat.example.com"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, []string{"bad.test", "worse.test"}, cfg.Messages.LinkDenylist)
+
+	limits, err := cfg.RateLimits()
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Limit{Requests: 3, Per: time.Hour}, limits["/user.register"])
+	assert.Equal(t, ratelimit.DefaultLimits()["/user.login"], limits["/user.login"])
+}
+
+func TestLoad_TOML(t *testing.T) {
+	path := writeFile(t, "chat.toml", `
+log_level = "debug"
+log_format = "text"
+
+[tls]
+cert_file = "cert.pem"
+key_file = "key.pem"
+
+[websocket]
+max_connections_per_user = 3
+
+[shutdown]
+timeout = "1m"
+drain_delay = "10s"
+`)
+
+	cfg, err := Load(nil, env(map[string]string{"CONFIG_FILE": path, "RATE_LIMITS": "send_message=10/10s"}))
+	require.NoError(t, err)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, "text", cfg.LogFormat)
+	assert.True(t, cfg.TLS.Enabled())
+	assert.Equal(t, 3, cfg.WebSocket.MaxConnectionsPerUser)
+	assert.Equal(t, time.Minute, cfg.Shutdown.Timeout)
+	assert.Equal(t, 10*time.Second, cfg.Shutdown.DrainDelay)
+	assert.Equal(t, map[string]string{"send_message": "10/10s"}, cfg.RateLimit.Limits)
+}
+
+func TestLoad_Port(t *testing.T) {
+	cfg, err := Load([]string{"-port", "9090"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", cfg.Addr)
+
+	_, err = Load([]string{"-port", "http"}, env(nil))
+	assert.Error(t, err)
+}
+
+func TestLoad_Tracing(t *testing.T) {
+	cfg, err := Load([]string{"-tracing-sample-ratio", "0.25"}, env(map[string]string{
+		"TRACING_EXPORTER": "otlp",
+		"TRACING_ENDPOINT": "collector:4318",
+		"TRACING_INSECURE": "true",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, TracingConfig{Exporter: "otlp", Endpoint: "collector:4318", Insecure: true, SampleRatio: 0.25}, cfg.Tracing)
+}
+
+func TestLoad_AutoMigrate(t *testing.T) {
+	cfg, err := Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.True(t, cfg.Database.AutoMigrate)
+
+	cfg, err = Load([]string{"-db-auto-migrate=false"}, env(nil))
+	require.NoError(t, err)
+	assert.False(t, cfg.Database.AutoMigrate)
+}
+
+func TestLoad_CredentialPolicy(t *testing.T) {
+	cfg, err := Load([]string{"-password-min-length", "12"}, env(map[string]string{
+		"USERNAME_PATTERN":   "^[a-z]+$",
+		"RESERVED_USERNAMES": "ops, billing",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 12, cfg.Auth.PasswordMinLength)
+	assert.Equal(t, "^[a-z]+$", cfg.Auth.UsernamePattern)
+	assert.Equal(t, []string{"ops", "billing"}, cfg.Auth.ReservedUsernames)
+	assert.Equal(t, 3, cfg.Auth.UsernameMinLength, "unset keys keep their default")
+}
+
+func TestConfig_TrustedProxyPrefixes(t *testing.T) {
+	cfg, err := Load(nil, env(map[string]string{"TRUSTED_PROXIES": "10.1.2.3/8, 192.0.2.7, ::ffff:198.51.100.1"}))
+	require.NoError(t, err)
+
+	prefixes, err := cfg.TrustedProxyPrefixes()
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.7/32"),
+		netip.MustParsePrefix("198.51.100.1/32"),
+	}, prefixes)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "unknown flag", args: []string{"-nope"}},
+		{name: "bad number", env: map[string]string{"DB_MAX_OPEN_CONNS": "many"}},
+		{name: "bad ratio", args: []string{"-tracing-sample-ratio", "half"}},
+		{name: "bad duration", args: []string{"-db-conn-max-lifetime", "forever"}},
+		{name: "missing file", args: []string{"-config", "/does/not/exist.yaml"}},
+		{name: "unsupported file", args: []string{"-config", writeFile(t, "chat.json", "{}")}},
+		{name: "unknown yaml key", args: []string{"-config", writeFile(t, "typo.yaml", "adr: \":1\"\n")}},
+		{name: "unknown toml key", args: []string{"-config", writeFile(t, "typo.toml", "adr = \":1\"\n")}},
+		{name: "invalid value", env: map[string]string{"LOG_LEVEL": "loud"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.args, env(tt.env))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+
+	cfg := Default()
+	cfg.CORS.AllowedOrigins = []string{"*"}
+	cfg.TLS.CertFile = "cert.pem"
+	cfg.Database.MaxIdleConns = 100
+	cfg.Messages.BlockedWordsAction = filter.KeywordAction("shout")
+	cfg.RateLimit.Store = "redis"
+	cfg.RateLimit.Limits = map[string]string{"send_message": "lots"}
+	cfg.Shutdown.Timeout = 0
+	cfg.Shutdown.DrainDelay = -time.Second
+	cfg.TLS.ClientAuth = tlsutil.ClientAuthRequire
+	cfg.TLS.RedirectAddr = ":80"
+	cfg.LogFormat = "xml"
+	cfg.Tracing.Exporter = "jaeger"
+	cfg.Tracing.SampleRatio = 2
+	cfg.RequestTimeout = -time.Second
+	cfg.WebSocket.FrameTimeout = -time.Second
+	cfg.Auth.UsernameMaxLength = 1000
+	cfg.Auth.UsernamePattern = "[a-z"
+	cfg.Auth.PasswordMinLength = 100
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "load-balancer"}
+	cfg.MetricsAddr = cfg.Addr
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, problem := range []string{"cors.allowed_origins", "tls.cert_file", "max_idle_conns", "blocked_words_action", "rate_limit.store", "rate_limit.limits[send_message]", "shutdown.timeout", "shutdown.drain_delay", "tls.client_ca_file", "tls.redirect_addr", "log_format", "tracing.exporter", "tracing.sample_ratio", "request_timeout", "websocket.frame_timeout", "auth.username_max_length", "auth.username_pattern", "auth.password_min_length", "trusted_proxies", "metrics_addr"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	// Taken single sign-on usernames need room for a suffix
+	cfg = Default()
+	cfg.Auth.UsernameMinLength = 1
+	cfg.Auth.UsernameMaxLength = credentials.TakenUsernameSuffixLength
+	require.Error(t, cfg.Validate())
+	assert.Contains(t, cfg.Validate().Error(), "auth.username_max_length")
+
+	// Any origin is fine without credentials
+	cfg = Default()
+	cfg.CORS.AllowedOrigins = []string{"*"}
+	cfg.CORS.AllowCredentials = false
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,156 @@
+package credentials
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxPasswordBytes is bcrypt's input limit. Longer passwords are rejected
+// rather than silently truncated.
+const MaxPasswordBytes = 72
+
+//go:embed breached.txt
+var breachedList string
+
+// Policy decides which usernames and passwords are acceptable at
+// registration and on every password change.
+type Policy struct {
+	MinUsernameLength int
+	MaxUsernameLength int
+	// UsernamePattern is the allowed character set; UsernameHint describes it
+	// in error messages.
+	UsernamePattern *regexp.Regexp
+	UsernameHint    string
+	// ReservedUsernames are lowercase names nobody may register.
+	ReservedUsernames map[string]struct{}
+
+	MinPasswordLength int
+	// MinUniqueRunes rejects passwords like "aaaaaaaaaa" that meet the length
+	// requirement but carry almost no entropy.
+	MinUniqueRunes int
+	// Breached holds lowercase passwords known from breaches.
+	Breached map[string]struct{}
+}
+
+// TakenUsernameSuffixLength is the length of the "-" and random characters
+// appended to a username derived for single sign-on that is already taken.
+// The maximum username length must leave room for it and at least one
+// character of the derived name.
+const TakenUsernameSuffixLength = 6
+
+// Defaults of DefaultPolicy, which configuration starts from.
+const (
+	DefaultMinUsernameLength = 3
+	DefaultMaxUsernameLength = 32
+	DefaultUsernamePattern   = `^[A-Za-z0-9][A-Za-z0-9._-]*$`
+	DefaultUsernameHint      = "may only contain letters, digits, dots, hyphens and underscores, and must start with a letter or digit"
+	DefaultMinPasswordLength = 8
+	DefaultMinUniqueRunes    = 5
+)
+
+// DefaultReservedUsernames returns the names nobody may register unless
+// configured otherwise.
+func DefaultReservedUsernames() []string {
+	return []string{
+		"admin", "administrator", "root", "system", "support", "help",
+		"moderator", "mod", "staff", "security", "official", "api",
+		"me", "everyone", "null", "undefined", "anonymous", "deleted",
+	}
+}
+
+// DefaultPolicy returns the policy used unless configured otherwise:
+// usernames of 3-32 letters, digits, dots, hyphens and underscores that start
+// with a letter or digit, and passwords of at least 8 characters that are
+// not on the embedded breached-password list.
+func DefaultPolicy() *Policy {
+	p := &Policy{
+		MinUsernameLength: DefaultMinUsernameLength,
+		MaxUsernameLength: DefaultMaxUsernameLength,
+		UsernamePattern:   regexp.MustCompile(DefaultUsernamePattern),
+		UsernameHint:      DefaultUsernameHint,
+		MinPasswordLength: DefaultMinPasswordLength,
+		MinUniqueRunes:    DefaultMinUniqueRunes,
+		Breached:          map[string]struct{}{},
+	}
+	p.SetReservedUsernames(DefaultReservedUsernames())
+	// The embedded list is known to be well formed
+	_ = p.AddBreached(strings.NewReader(breachedList))
+	return p
+}
+
+// SetReservedUsernames replaces the reserved names, which match regardless
+// of case.
+func (p *Policy) SetReservedUsernames(names []string) {
+	p.ReservedUsernames = make(map[string]struct{}, len(names))
+	for _, name := range names {
+		p.ReservedUsernames[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
+	}
+}
+
+// AddBreached adds one password per line from r to the breached list. Blank
+// lines and lines starting with # are skipped.
+func (p *Policy) AddBreached(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.Breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("credentials: reading breached list: %w", err)
+	}
+	return nil
+}
+
+// ValidateUsername returns why username is not acceptable, or "" if it is.
+func (p *Policy) ValidateUsername(username string) string {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case length < p.MinUsernameLength || length > p.MaxUsernameLength:
+		return "must be between " + strconv.Itoa(p.MinUsernameLength) + " and " + strconv.Itoa(p.MaxUsernameLength) + " characters"
+	case !p.UsernamePattern.MatchString(username):
+		return p.UsernameHint
+	}
+	if _, reserved := p.ReservedUsernames[strings.ToLower(username)]; reserved {
+		return "is reserved"
+	}
+	return ""
+}
+
+// ValidatePassword returns why password is not acceptable for the account
+// named username, or "" if it is.
+func (p *Policy) ValidatePassword(password, username string) string {
+	lower := strings.ToLower(password)
+	switch {
+	case !utf8.ValidString(password):
+		return "must be valid UTF-8"
+	case len(password) > MaxPasswordBytes:
+		return "must be at most " + strconv.Itoa(MaxPasswordBytes) + " bytes"
+	case utf8.RuneCountInString(password) < p.MinPasswordLength:
+		return "must be at least " + strconv.Itoa(p.MinPasswordLength) + " characters"
+	case uniqueRunes(password) < p.MinUniqueRunes:
+		return "is too repetitive"
+	case username != "" && strings.Contains(lower, strings.ToLower(username)):
+		return "must not contain the username"
+	}
+	if _, breached := p.Breached[lower]; breached {
+		return "is too common and has appeared in data breaches"
+	}
+	return ""
+}
+
+func uniqueRunes(s string) int {
+	seen := map[rune]struct{}{}
+	for _, r := range s {
+		seen[r] = struct{}{}
+	}
+	return len(seen)
+}
@@ -0,0 +1,74 @@
+package credentials
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_ValidateUsername(t *testing.T) {
+	policy := DefaultPolicy()
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"bob.smith-2_x", true},
+		{"ab", false},
+		{strings.Repeat("a", 33), false},
+		{"   ", false},
+		{"_alice", false},
+		{"ali ce", false},
+		{"alice<script>", false},
+		{"Admin", false},
+		{"ROOT", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			msg := policy.ValidateUsername(tt.username)
+			if tt.valid {
+				assert.Empty(t, msg)
+			} else {
+				assert.NotEmpty(t, msg)
+			}
+		})
+	}
+}
+
+func TestPolicy_ValidatePassword(t *testing.T) {
+	policy := DefaultPolicy()
+
+	tests := []struct {
+		name     string
+		password string
+		wantMsg  string
+	}{
+		{"strong", "correct horse battery", ""},
+		{"too short", "a1b2c3", "must be at least 8 characters"},
+		{"repetitive", "aaaaaaaaaaaa", "is too repetitive"},
+		{"contains username", "xxALICExx99", "must not contain the username"},
+		{"breached", "Password123", "is too common and has appeared in data breaches"},
+		{"over bcrypt limit", strings.Repeat("ab", 37), "must be at most 72 bytes"},
+		{"multibyte within limit", strings.Repeat("é", 36), "is too repetitive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantMsg, policy.ValidatePassword(tt.password, "alice"))
+		})
+	}
+}
+
+func TestPolicy_AddBreached(t *testing.T) {
+	policy := DefaultPolicy()
+	require.Empty(t, policy.ValidatePassword("our-company-2024", "alice"))
+
+	err := policy.AddBreached(strings.NewReader("# local additions\n\nOur-Company-2024\n"))
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, policy.ValidatePassword("our-company-2024", "alice"))
+}
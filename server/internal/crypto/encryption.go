@@ -4,35 +4,39 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/joho/godotenv"
 	"golang.org/x/crypto/nacl/secretbox"
-	"log"
-	"os"
 )
 
-var encryptionKey [32]byte
+var errNoKey = errors.New("crypto: no encryption key loaded")
 
-func init() {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found, using default key")
-	}
+var (
+	encryptionKey [32]byte
+	keyLoaded     bool
+)
 
-	keyHex := os.Getenv("ENCRYPTION_KEY")
+// LoadKey sets the key messages and secrets are sealed with, given as a
+// 64-character hex string (32 bytes). It must be called once at startup,
+// before anything is encrypted or decrypted.
+func LoadKey(keyHex string) error {
 	if keyHex == "" {
-		log.Fatal("ENCRYPTION_KEY environment variable is required")
+		return errors.New("crypto: ENCRYPTION_KEY is required")
 	}
-
 	keyBytes, err := hex.DecodeString(keyHex)
-	if err != nil || len(keyBytes) != 32 {
-		log.Fatal("ENCRYPTION_KEY must be a 64-character hex string (32 bytes)")
+	if err != nil || len(keyBytes) != len(encryptionKey) {
+		return errors.New("crypto: ENCRYPTION_KEY must be a 64-character hex string (32 bytes)")
 	}
 
 	copy(encryptionKey[:], keyBytes)
+	keyLoaded = true
+	return nil
 }
 
 func Encrypt(plaintext string) (string, error) {
+	if !keyLoaded {
+		return "", errNoKey
+	}
 	var nonce [24]byte
 	if _, err := rand.Read(nonce[:]); err != nil {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
@@ -45,6 +49,9 @@ func Encrypt(plaintext string) (string, error) {
 }
 
 func Decrypt(ciphertext string) (string, error) {
+	if !keyLoaded {
+		return "", errNoKey
+	}
 	data, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
@@ -63,3 +70,21 @@ func Decrypt(ciphertext string) (string, error) {
 
 	return string(decrypted), nil
 }
+
+// Check confirms the encryption key is loaded by sealing and opening a probe
+// message.
+func Check() error {
+	const probe = "health check"
+	sealed, err := Encrypt(probe)
+	if err != nil {
+		return err
+	}
+	opened, err := Decrypt(sealed)
+	if err != nil {
+		return err
+	}
+	if opened != probe {
+		return fmt.Errorf("encryption round trip changed the message")
+	}
+	return nil
+}
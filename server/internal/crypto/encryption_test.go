@@ -8,9 +8,21 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func init() {
-	// Set environment variable for the main package
-	os.Setenv("ENCRYPTION_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+const testKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	if err := LoadKey(testKey); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestLoadKey_Invalid(t *testing.T) {
+	for _, key := range []string{"", "not hex", testKey[:32]} {
+		assert.Error(t, LoadKey(key), "key %q", key)
+	}
+	// A rejected key leaves the loaded one in place
+	assert.NoError(t, Check())
 }
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -129,6 +141,14 @@ func TestEncryptEmptyString(t *testing.T) {
 	assert.Equal(t, "", decrypted)
 }
 
+func TestCheck(t *testing.T) {
+	assert.NoError(t, Check())
+
+	defer func() { keyLoaded = true }()
+	keyLoaded = false
+	assert.Error(t, Check())
+}
+
 func BenchmarkEncrypt(b *testing.B) {
 	plaintext := "This is a test message for benchmarking encryption performance"
 
@@ -0,0 +1,167 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// zeroWidthJoiner is a format character that emoji sequences depend on, so
+// Normalize keeps it.
+const zeroWidthJoiner = '\u200d'
+
+// Normalize composes content to NFC, drops control and invisible format
+// characters (zero-width spaces, bidi overrides) other than newlines and
+// tabs, and trims surrounding whitespace. Content left empty is rejected.
+func Normalize() MessageFilter {
+	return Func(func(content string) (string, error) {
+		content = strings.Map(func(r rune) rune {
+			switch {
+			case r == '\n' || r == '\t' || r == zeroWidthJoiner:
+				return r
+			case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+				return -1
+			}
+			return r
+		}, norm.NFC.String(content))
+
+		content = strings.TrimSpace(content)
+		if content == "" {
+			return "", reject(CodeEmpty, "Message is empty")
+		}
+		return content, nil
+	})
+}
+
+// MaxLength rejects content longer than limit characters.
+func MaxLength(limit int) MessageFilter {
+	return Func(func(content string) (string, error) {
+		if utf8.RuneCountInString(content) > limit {
+			return "", reject(CodeTooLong, fmt.Sprintf("Message must be at most %d characters", limit))
+		}
+		return content, nil
+	})
+}
+
+// KeywordAction is what a keyword filter does with a match.
+type KeywordAction string
+
+const (
+	// KeywordMask replaces each match with asterisks and sends the message.
+	KeywordMask KeywordAction = "mask"
+	// KeywordReject refuses the whole message.
+	KeywordReject KeywordAction = "reject"
+)
+
+// Keywords matches whole words from a list, ignoring case.
+func Keywords(words []string, action KeywordAction) (MessageFilter, error) {
+	if action != KeywordMask && action != KeywordReject {
+		return nil, fmt.Errorf("filter: unknown keyword action %q", action)
+	}
+
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return Func(func(content string) (string, error) { return content, nil }), nil
+	}
+	pattern, err := regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	if err != nil {
+		return nil, fmt.Errorf("filter: compiling keyword list: %w", err)
+	}
+
+	return Func(func(content string) (string, error) {
+		if !pattern.MatchString(content) {
+			return content, nil
+		}
+		if action == KeywordReject {
+			return "", reject(CodeBlockedWord, "Message contains a blocked word")
+		}
+		return pattern.ReplaceAllStringFunc(content, func(match string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		}), nil
+	}), nil
+}
+
+// ReadWords reads one keyword per line from r. Blank lines and lines
+// starting with # are skipped.
+func ReadWords(r io.Reader) ([]string, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("filter: reading keyword list: %w", err)
+	}
+	return words, nil
+}
+
+// linkPattern finds http(s) URLs and www. hosts. Bare domains without either
+// are not treated as links.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// Links checks every link's host against domain lists. A domain covers its
+// subdomains. Denied hosts are always rejected; when allow is not empty,
+// only hosts on it may be linked.
+func Links(allow, deny []string) MessageFilter {
+	allow, deny = normalizeDomains(allow), normalizeDomains(deny)
+
+	return Func(func(content string) (string, error) {
+		for _, link := range linkPattern.FindAllString(content, -1) {
+			host := linkHost(link)
+			if host == "" {
+				return "", reject(CodeBlockedLink, "Message contains an invalid link")
+			}
+			if matchesDomain(host, deny) || (len(allow) > 0 && !matchesDomain(host, allow)) {
+				return "", reject(CodeBlockedLink, "Links to "+host+" are not allowed")
+			}
+		}
+		return content, nil
+	})
+}
+
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
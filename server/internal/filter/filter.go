@@ -0,0 +1,66 @@
+// Package filter checks outgoing messages before they are stored. A filter
+// lets content through unchanged, rewrites it, or rejects it with a reason
+// the sender is shown.
+package filter
+
+// Rejection codes sent to clients alongside the reason.
+const (
+	CodeEmpty       = "empty_message"
+	CodeTooLong     = "message_too_long"
+	CodeBlockedWord = "blocked_word"
+	CodeBlockedLink = "blocked_link"
+)
+
+// MessageFilter inspects the content of one outgoing message. It returns the
+// content to send, which may be rewritten, or a *Rejection to refuse it.
+// Other errors are treated as internal failures.
+type MessageFilter interface {
+	Filter(content string) (string, error)
+}
+
+// Func adapts an ordinary function to a MessageFilter.
+type Func func(content string) (string, error)
+
+func (f Func) Filter(content string) (string, error) {
+	return f(content)
+}
+
+// Rejection is a filter refusing a message. Code is stable for clients to
+// branch on; Reason is shown to the sender.
+type Rejection struct {
+	Code   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+func reject(code, reason string) *Rejection {
+	return &Rejection{Code: code, Reason: reason}
+}
+
+// Chain runs filters in order, each seeing the previous one's output, and
+// stops at the first rejection.
+type Chain []MessageFilter
+
+func (c Chain) Filter(content string) (string, error) {
+	var err error
+	for _, f := range c {
+		content, err = f.Filter(content)
+		if err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+// DefaultMaxLength is how many characters a message may have unless
+// configured otherwise.
+const DefaultMaxLength = 4000
+
+// Default is the chain used when nothing else is configured: normalization
+// followed by the default length limit.
+func Default() Chain {
+	return Chain{Normalize(), MaxLength(DefaultMaxLength)}
+}
@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rejectionCode(t *testing.T, err error) string {
+	t.Helper()
+	var rejection *Rejection
+	require.True(t, errors.As(err, &rejection), "expected a rejection, got %v", err)
+	return rejection.Code
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{name: "plain", content: "hello", expected: "hello"},
+		{name: "composes", content: "cafe\u0301", expected: "caf\u00e9"},
+		{name: "drops controls and zero-width", content: "he\x00l\u200blo\u202e", expected: "hello"},
+		{name: "keeps newlines and tabs", content: "a\n\tb", expected: "a\n\tb"},
+		{name: "keeps emoji joiners", content: "\U0001F469\u200d\U0001F4BB", expected: "\U0001F469\u200d\U0001F4BB"},
+		{name: "trims", content: "  hi \n", expected: "hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize().Filter(tt.content)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+
+	_, err := Normalize().Filter("\u200b \x07")
+	assert.Equal(t, CodeEmpty, rejectionCode(t, err))
+}
+
+func TestMaxLength(t *testing.T) {
+	_, err := MaxLength(3).Filter("héé")
+	assert.NoError(t, err)
+
+	_, err = MaxLength(3).Filter("héél")
+	assert.Equal(t, CodeTooLong, rejectionCode(t, err))
+}
+
+func TestKeywords(t *testing.T) {
+	mask, err := Keywords([]string{"darn", " heck "}, KeywordMask)
+	require.NoError(t, err)
+
+	got, err := mask.Filter("Darn it, what the HECK")
+	require.NoError(t, err)
+	assert.Equal(t, "**** it, what the ****", got)
+
+	// Only whole words match
+	got, err = mask.Filter("checking in")
+	require.NoError(t, err)
+	assert.Equal(t, "checking in", got)
+
+	block, err := Keywords([]string{"darn"}, KeywordReject)
+	require.NoError(t, err)
+	_, err = block.Filter("oh darn")
+	assert.Equal(t, CodeBlockedWord, rejectionCode(t, err))
+
+	_, err = Keywords([]string{"darn"}, "shout")
+	assert.Error(t, err)
+}
+
+func TestReadWords(t *testing.T) {
+	words, err := ReadWords(strings.NewReader("# comment\ndarn\n\n  heck  \n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"darn", "heck"}, words)
+}
+
+func TestLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		content string
+		allowed bool
+	}{
+		{name: "no lists", content: "see https://example.com/x", allowed: true},
+		{name: "denied", deny: []string{"evil.test"}, content: "go to https://EVIL.test/login", allowed: false},
+		{name: "denied subdomain", deny: []string{"evil.test"}, content: "www.login.evil.test", allowed: false},
+		{name: "lookalike not denied", deny: []string{"evil.test"}, content: "https://notevil.test", allowed: true},
+		{name: "allowed", allow: []string{"example.com"}, content: "https://docs.example.com and http://example.com", allowed: true},
+		{name: "not on allow list", allow: []string{"example.com"}, content: "https://example.org", allowed: false},
+		{name: "text without links", allow: []string{"example.com"}, content: "just words", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Links(tt.allow, tt.deny).Filter(tt.content)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, CodeBlockedLink, rejectionCode(t, err))
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	mask, err := Keywords([]string{"darn"}, KeywordMask)
+	require.NoError(t, err)
+	chain := Chain{Normalize(), mask, MaxLength(10)}
+
+	got, err := chain.Filter("  darn\u200b ")
+	require.NoError(t, err)
+	assert.Equal(t, "****", got)
+
+	_, err = chain.Filter("darn darn darn")
+	assert.Equal(t, CodeTooLong, rejectionCode(t, err))
+
+	internal := errors.New("boom")
+	_, err = Chain{Func(func(string) (string, error) { return "", internal })}.Filter("x")
+	assert.ErrorIs(t, err, internal)
+}
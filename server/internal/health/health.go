@@ -0,0 +1,144 @@
+// Package health answers liveness and readiness probes. The server is live
+// while it can serve requests at all, and ready while every registered
+// check passes and it is not shutting down.
+package health
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chat/internal/utils"
+)
+
+// Readiness states.
+const (
+	StatusReady        = "ready"
+	StatusUnready      = "unready"
+	StatusShuttingDown = "shutting_down"
+)
+
+// Check reports why a dependency cannot serve traffic, or nil when it can.
+// It should give up once ctx ends.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// DurationMS is how long the check took, in milliseconds.
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the readiness of the server and each of its checks.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the checks that decide readiness.
+type Checker struct {
+	timeout      time.Duration
+	logger       *slog.Logger
+	checksMutex  sync.RWMutex
+	checks       []namedCheck
+	shuttingDown atomic.Bool
+	// ready is the last status reported, so only changes are logged.
+	ready atomic.Value
+}
+
+// NewChecker returns a Checker giving each check up to timeout.
+func NewChecker(timeout time.Duration, logger *slog.Logger) *Checker {
+	return &Checker{timeout: timeout, logger: logger}
+}
+
+// Add registers check under name. Checks run concurrently on each probe.
+func (c *Checker) Add(name string, check Check) {
+	c.checksMutex.Lock()
+	defer c.checksMutex.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// SetShuttingDown reports the server unready from now on, so load balancers
+// stop sending it traffic while it drains.
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Ready runs every check.
+func (c *Checker) Ready(ctx context.Context) Report {
+	c.checksMutex.RLock()
+	checks := c.checks
+	c.checksMutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := nc.check(ctx)
+			results[i] = Result{OK: err == nil, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusReady, Checks: make(map[string]Result, len(checks))}
+	for i, nc := range checks {
+		report.Checks[nc.name] = results[i]
+		if !results[i].OK {
+			report.Status = StatusUnready
+		}
+	}
+	if c.shuttingDown.Load() {
+		report.Status = StatusShuttingDown
+	}
+	return report
+}
+
+// Livez answers liveness probes. It checks no dependencies: restarting the
+// server would not bring a database back.
+func (c *Checker) Livez(w http.ResponseWriter, _ *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"status": "alive"})
+}
+
+// Readyz answers readiness probes with every check's result, and 503 unless
+// all of them pass.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Ready(r.Context())
+	if previous, _ := c.ready.Swap(report.Status).(string); previous != report.Status {
+		c.logger.InfoContext(r.Context(), "readiness changed", "status", report.Status, "checks", failed(report))
+	}
+
+	status := http.StatusOK
+	if report.Status != StatusReady {
+		status = http.StatusServiceUnavailable
+	}
+	utils.WriteJSON(w, status, utils.Envelope{"status": report.Status, "checks": report.Checks})
+}
+
+// failed lists the checks that did not pass, for logging.
+func failed(report Report) map[string]string {
+	errs := make(map[string]string)
+	for name, result := range report.Checks {
+		if !result.OK {
+			errs[name] = result.Error
+		}
+	}
+	return errs
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readyz(t *testing.T, c *Checker) (int, Report) {
+	w := httptest.NewRecorder()
+	c.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	return w.Code, report
+}
+
+func TestChecker_Readyz(t *testing.T) {
+	c := NewChecker(50*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// No checks means nothing can be wrong
+	code, report := readyz(t, c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusReady, report.Status)
+
+	dbErr := errors.New("connection refused")
+	c.Add("database", func(context.Context) error { return dbErr })
+	c.Add("key_provider", func(context.Context) error { return nil })
+	c.Add("websocket_hub", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, report = readyz(t, c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusUnready, report.Status)
+	assert.Equal(t, Result{Error: "connection refused"}, zeroDuration(report.Checks["database"]))
+	assert.True(t, report.Checks["key_provider"].OK)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["websocket_hub"].Error, "checks are bounded by the timeout")
+
+	dbErr = nil
+	c.SetShuttingDown()
+	code, report = readyz(t, c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusShuttingDown, report.Status)
+	assert.True(t, report.Checks["database"].OK)
+}
+
+func TestChecker_Livez(t *testing.T) {
+	c := NewChecker(time.Second, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.Add("database", func(context.Context) error { return errors.New("down") })
+	c.SetShuttingDown()
+
+	w := httptest.NewRecorder()
+	c.Livez(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "alive"}`, w.Body.String())
+}
+
+func zeroDuration(r Result) Result {
+	r.DurationMS = 0
+	return r
+}
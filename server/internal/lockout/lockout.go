@@ -0,0 +1,124 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// Config controls how quickly a key is slowed down after failures.
+type Config struct {
+	// FreeAttempts failures are allowed before any delay applies.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past FreeAttempts. It
+	// doubles with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. Reaching it counts as a lockout.
+	MaxDelay time.Duration
+	// ResetAfter forgets a key's failures once it has been quiet this long.
+	ResetAfter time.Duration
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Tracker counts failed attempts per key, such as a username or an IP
+// address, and tells callers how long a key must wait before trying again.
+// It is safe for concurrent use.
+type Tracker struct {
+	cfg       Config
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func New(cfg Config) *Tracker {
+	return &Tracker{
+		cfg:     cfg,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// SetClock replaces the tracker's time source, for tests.
+func (t *Tracker) SetClock(now func() time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.now = now
+}
+
+// RetryAfter returns how long the caller must wait before keys may be tried
+// again: the longest remaining block among them, or 0.
+func (t *Tracker) RetryAfter(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var wait time.Duration
+	for _, key := range keys {
+		if e, ok := t.entries[key]; ok {
+			wait = max(wait, e.blockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt for key and returns the delay now imposed on
+// it. lockedOut is true only for the failure that first reaches MaxDelay, so
+// callers can report each lockout once.
+func (t *Tracker) Fail(key string) (delay time.Duration, lockedOut bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	e, ok := t.entries[key]
+	if !ok || now.Sub(e.lastFailure) > t.cfg.ResetAfter {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	previous := t.delay(e.failures)
+	e.failures++
+	e.lastFailure = now
+
+	delay = t.delay(e.failures)
+	e.blockedUntil = now.Add(delay)
+	return delay, delay == t.cfg.MaxDelay && previous < t.cfg.MaxDelay
+}
+
+// Reset forgets the failures recorded for key.
+func (t *Tracker) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+func (t *Tracker) delay(failures int) time.Duration {
+	over := failures - t.cfg.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	delay := t.cfg.BaseDelay
+	for i := 1; i < over && delay < t.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, t.cfg.MaxDelay)
+}
+
+// sweep drops quiet entries so keys from one-off attempts do not accumulate.
+// Callers must hold t.mu.
+func (t *Tracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.cfg.ResetAfter {
+		return
+	}
+	t.lastSweep = now
+	for key, e := range t.entries {
+		if now.Sub(e.lastFailure) > t.cfg.ResetAfter && !now.Before(e.blockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
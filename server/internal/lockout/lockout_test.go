@@ -0,0 +1,54 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTracker() (*Tracker, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tracker := New(Config{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 8 * time.Second, ResetAfter: time.Hour})
+	tracker.SetClock(func() time.Time { return now })
+	return tracker, &now
+}
+
+func TestTracker_ExponentialBackoff(t *testing.T) {
+	tracker, _ := newTestTracker()
+
+	var delays []time.Duration
+	var lockouts int
+	for i := 0; i < 8; i++ {
+		delay, lockedOut := tracker.Fail("user:alice")
+		delays = append(delays, delay)
+		if lockedOut {
+			lockouts++
+		}
+	}
+
+	assert.Equal(t, []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}, delays)
+	assert.Equal(t, 1, lockouts, "a lockout is reported once")
+	assert.Equal(t, 8*time.Second, tracker.RetryAfter("user:alice", "ip:10.0.0.1"))
+	assert.Zero(t, tracker.RetryAfter("user:bob"))
+}
+
+func TestTracker_BlockExpiresAndResets(t *testing.T) {
+	tracker, now := newTestTracker()
+
+	for i := 0; i < 4; i++ {
+		tracker.Fail("user:alice")
+	}
+	assert.Equal(t, time.Second, tracker.RetryAfter("user:alice"))
+
+	*now = now.Add(time.Second)
+	assert.Zero(t, tracker.RetryAfter("user:alice"))
+
+	// Failures are forgotten after a quiet period
+	*now = now.Add(2 * time.Hour)
+	delay, _ := tracker.Fail("user:alice")
+	assert.Zero(t, delay)
+
+	tracker.Reset("user:alice")
+	assert.Empty(t, tracker.entries)
+}
@@ -0,0 +1,145 @@
+// Package logging builds the structured logger the server writes with. Log
+// records carry the ID of the request or connection they were written for,
+// taken from the context, and attributes that could hold secrets or message
+// plaintext are redacted before they are written.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Output formats.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("logging: unknown level %q", level)
+	}
+	return l, nil
+}
+
+// New returns a logger writing records at level or above to w, as JSON or
+// text.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l, ReplaceAttr: redact}
+
+	var handler slog.Handler
+	switch format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// Redacted replaces the value of sensitive attributes.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute names whose values are never written.
+var sensitiveKeys = map[string]bool{
+	"password":         true,
+	"current_password": true,
+	"new_password":     true,
+	"token":            true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"id_token":         true,
+	"secret":           true,
+	"authorization":    true,
+	"cookie":           true,
+	"content":          true,
+	"body":             true,
+	"mfa_code":         true,
+}
+
+// IsSensitive reports whether values logged under key are redacted.
+func IsSensitive(key string) bool {
+	return sensitiveKeys[strings.ToLower(key)]
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) && a.Value.Kind() != slog.KindGroup {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	connIDKey
+)
+
+// WithRequestID returns a context whose log records carry request_id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID set by WithRequestID, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithConnID returns a context whose log records carry conn_id, for
+// everything done on behalf of one long-lived connection.
+func WithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey, id)
+}
+
+// ConnID returns the ID set by WithConnID, or "".
+func ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey).(string)
+	return id
+}
+
+// NewID returns a random 16 character hex ID.
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the request and connection IDs in a record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := RequestID(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id := ConnID(ctx); id != "" {
+			r.AddAttrs(slog.String("conn_id", id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// records decodes every JSON line written to out.
+func records(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestNew_Levels(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "warn", FormatJSON)
+	require.NoError(t, err)
+
+	logger.Debug("hidden")
+	logger.Info("hidden")
+	logger.Warn("shown", "user_id", 7)
+	logger.Error("shown too")
+
+	recs := records(t, &out)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "WARN", recs[0]["level"])
+	assert.Equal(t, "shown", recs[0]["msg"])
+	assert.Equal(t, float64(7), recs[0]["user_id"])
+	assert.Equal(t, "ERROR", recs[1]["level"])
+
+	_, err = New(&out, "loud", FormatJSON)
+	assert.Error(t, err)
+	_, err = New(&out, "info", "xml")
+	assert.Error(t, err)
+}
+
+func TestNew_Redaction(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "info", FormatJSON)
+	require.NoError(t, err)
+
+	logger.Info("message sent", "content", "meet me at noon", "user_id", 1)
+	logger.Info("login", "Password", "hunter2", "token", "abc123")
+	logger.With("body", "reset link").Info("mail not sent")
+
+	assert.NotContains(t, out.String(), "meet me at noon")
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.NotContains(t, out.String(), "abc123")
+	assert.NotContains(t, out.String(), "reset link")
+
+	recs := records(t, &out)
+	require.Len(t, recs, 3)
+	assert.Equal(t, Redacted, recs[0]["content"])
+	assert.Equal(t, float64(1), recs[0]["user_id"])
+	assert.Equal(t, Redacted, recs[1]["Password"])
+	assert.Equal(t, Redacted, recs[2]["body"])
+}
+
+func TestNew_ContextIDs(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "info", FormatText)
+	require.NoError(t, err)
+
+	ctx := WithConnID(WithRequestID(context.Background(), "req-1"), "conn-1")
+	logger.InfoContext(ctx, "client connected")
+	logger.With("user_id", 3).InfoContext(WithRequestID(context.Background(), "req-2"), "logged in")
+	logger.Info("no context")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], "request_id=req-1")
+	assert.Contains(t, lines[0], "conn_id=conn-1")
+	assert.Contains(t, lines[1], "user_id=3")
+	assert.Contains(t, lines[1], "request_id=req-2")
+	assert.NotContains(t, lines[1], "conn_id")
+	assert.NotContains(t, lines[2], "request_id")
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	assert.Len(t, id, 16)
+	assert.NotEqual(t, id, NewID())
+}
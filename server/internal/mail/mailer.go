@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// LogMailer records messages in the log instead of sending them. Bodies carry
+// password reset tokens, so loggers built by the logging package redact them;
+// set MAIL_DIR to read the links during local development.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func NewLogMailer(logger *slog.Logger) *LogMailer {
+	return &LogMailer{logger: logger}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.logger.Info("mail not sent", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileMailer writes each message as an .eml file in a directory, so local
+// mail can be opened in a mail client or inspected by tests.
+type FileMailer struct {
+	dir string
+	seq atomic.Uint64
+	now func() time.Time
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mail: create dir: %w", err)
+	}
+	return &FileMailer{dir: dir, now: time.Now}, nil
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	now := m.now()
+	name := fmt.Sprintf("%s-%04d.eml", now.UTC().Format("20060102T150405"), m.seq.Add(1))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	if err := os.WriteFile(filepath.Join(m.dir, name), []byte(b.String()), 0o600); err != nil {
+		return fmt.Errorf("mail: write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer, err := NewFileMailer(dir)
+	require.NoError(t, err)
+	mailer.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	for i := 0; i < 2; i++ {
+		err = mailer.Send(Message{To: "alice@example.com", Subject: "Reset your password", Body: "link"})
+		require.NoError(t, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	// Messages sent within the same second must not overwrite each other
+	require.Len(t, entries, 2)
+
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	require.NoError(t, err)
+	content := string(data)
+	assert.True(t, strings.HasPrefix(content, "To: alice@example.com\r\n"))
+	assert.Contains(t, content, "Subject: Reset your password\r\n")
+	assert.True(t, strings.HasSuffix(content, "\r\n\r\nlink"))
+}
@@ -0,0 +1,156 @@
+// Package metrics records what the server is doing as Prometheus metrics.
+// Collectors register with the registry they are given rather than the
+// global one, so the application decides what /metrics exposes and tests
+// can inspect a registry of their own.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+// Metrics holds the server's collectors. It is safe for concurrent use.
+type Metrics struct {
+	httpRequests      *prometheus.CounterVec
+	httpDuration      *prometheus.HistogramVec
+	connections       *prometheus.GaugeVec
+	messagesSent      prometheus.Counter
+	messagesDelivered *prometheus.CounterVec
+	deliveryLatency   prometheus.Histogram
+	framesReceived    *prometheus.CounterVec
+	queryDuration     *prometheus.HistogramVec
+	cryptoDuration    *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route and method. Upgraded and streaming connections count until they close.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_active",
+			Help:      "Open WebSocket and event stream connections, by transport.",
+		}, []string{"transport"}),
+		messagesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages accepted and stored.",
+		}),
+		messagesDelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_delivered_total",
+			Help:      "Messages handed to a recipient's live connection, by transport.",
+		}, []string{"transport"}),
+		deliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_delivery_latency_seconds",
+			Help:      "Time from a message reaching the server to it being handed to a recipient's connection.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}),
+		framesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frames_received_total",
+			Help:      "Chat frames received from clients, by frame type.",
+		}, []string{"type"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Time taken by database operations, by store and operation.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"store", "operation"}),
+		cryptoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "crypto_duration_seconds",
+			Help:      "Time taken to encrypt and decrypt message content.",
+			Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005},
+		}, []string{"operation"}),
+	}
+
+	reg.MustRegister(
+		m.httpRequests,
+		m.httpDuration,
+		m.connections,
+		m.messagesSent,
+		m.messagesDelivered,
+		m.deliveryLatency,
+		m.framesReceived,
+		m.queryDuration,
+		m.cryptoDuration,
+	)
+	return m
+}
+
+// NewRegistry returns a registry with the Go runtime and process collectors
+// already registered.
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// Handler serves the metrics in g in the Prometheus exposition format.
+func Handler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// ObserveHTTP records a handled request. route is the pattern that matched,
+// not the request path, so IDs in paths do not create new series.
+func (m *Metrics) ObserveHTTP(route, method string, status int, d time.Duration) {
+	m.httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.httpDuration.WithLabelValues(route, method).Observe(d.Seconds())
+}
+
+// ConnectionOpened counts a connection as open until the returned function
+// is called.
+func (m *Metrics) ConnectionOpened(transport string) (closed func()) {
+	gauge := m.connections.WithLabelValues(transport)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// MessageSent counts a stored message.
+func (m *Metrics) MessageSent() {
+	m.messagesSent.Inc()
+}
+
+// MessageDelivered counts a message handed to one of the recipient's
+// connections, latency after it reached the server.
+func (m *Metrics) MessageDelivered(transport string, latency time.Duration) {
+	m.messagesDelivered.WithLabelValues(transport).Inc()
+	m.deliveryLatency.Observe(latency.Seconds())
+}
+
+// FrameReceived counts a frame a client sent.
+func (m *Metrics) FrameReceived(frameType string) {
+	m.framesReceived.WithLabelValues(frameType).Inc()
+}
+
+// ObserveQuery records how long a store operation took.
+func (m *Metrics) ObserveQuery(store, operation string, d time.Duration) {
+	m.queryDuration.WithLabelValues(store, operation).Observe(d.Seconds())
+}
+
+// ObserveCrypto records how long encrypting or decrypting took.
+func (m *Metrics) ObserveCrypto(operation string, d time.Duration) {
+	m.cryptoDuration.WithLabelValues(operation).Observe(d.Seconds())
+}
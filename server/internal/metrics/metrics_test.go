@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionOpened(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	closeFirst := m.ConnectionOpened("websocket/json")
+	m.ConnectionOpened("websocket/json")
+	m.ConnectionOpened("sse")
+	closeFirst()
+
+	expected := `
+# HELP chat_connections_active Open WebSocket and event stream connections, by transport.
+# TYPE chat_connections_active gauge
+chat_connections_active{transport="sse"} 1
+chat_connections_active{transport="websocket/json"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "chat_connections_active"))
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	m := New(reg)
+	m.ObserveQuery("message", "CreateMessage", 3*time.Millisecond)
+	m.ObserveCrypto("encrypt", 20*time.Microsecond)
+
+	w := httptest.NewRecorder()
+	Handler(reg).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	assert.Contains(t, body, `chat_db_query_duration_seconds_count{operation="CreateMessage",store="message"} 1`)
+	assert.Contains(t, body, `chat_crypto_duration_seconds_count{operation="encrypt"} 1`)
+	assert.Contains(t, body, "go_goroutines")
+
+	// Registering twice with one registry is a programming error
+	assert.Panics(t, func() { New(reg) })
+}
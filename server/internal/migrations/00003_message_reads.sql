@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ADD COLUMN read_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX messages_sender_receiver_id_idx ON messages (sender_id, receiver_id, id);
+CREATE INDEX messages_receiver_unread_idx ON messages (receiver_id, sender_id) WHERE read_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX messages_receiver_unread_idx;
+DROP INDEX messages_sender_receiver_id_idx;
+ALTER TABLE messages DROP COLUMN read_at;
+-- +goose StatementEnd
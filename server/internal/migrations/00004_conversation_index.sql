@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX messages_receiver_sender_id_idx ON messages (receiver_id, sender_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX messages_receiver_sender_id_idx;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+ALTER TABLE users ADD COLUMN display_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN discoverable BOOLEAN NOT NULL DEFAULT TRUE;
+CREATE INDEX users_username_trgm_idx ON users USING gin (lower(username) gin_trgm_ops);
+CREATE INDEX users_display_name_trgm_idx ON users USING gin (lower(display_name) gin_trgm_ops);
+CREATE INDEX users_username_lower_idx ON users (lower(username), id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX users_username_lower_idx;
+DROP INDEX users_display_name_trgm_idx;
+DROP INDEX users_username_trgm_idx;
+ALTER TABLE users DROP COLUMN discoverable;
+ALTER TABLE users DROP COLUMN display_name;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status_text VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_updated_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE user_avatars (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    content_type VARCHAR(64) NOT NULL,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_avatars;
+ALTER TABLE users DROP COLUMN avatar_updated_at;
+ALTER TABLE users DROP COLUMN timezone;
+ALTER TABLE users DROP COLUMN status_expires_at;
+ALTER TABLE users DROP COLUMN status_text;
+ALTER TABLE users DROP COLUMN bio;
+-- +goose StatementEnd
@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Accounts whose usernames differ only in case predate this rule. Which one
+-- keeps the name is for an operator to decide, so stop with the list rather
+-- than rename anyone.
+DO $$
+DECLARE
+    conflicts TEXT;
+BEGIN
+    SELECT string_agg(names, '; ') INTO conflicts
+    FROM (
+        SELECT string_agg(username || ' (id ' || id || ')', ', ' ORDER BY id) AS names
+        FROM users
+        GROUP BY lower(username)
+        HAVING count(*) > 1
+    ) duplicates;
+
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'usernames that differ only in case must be renamed first: %', conflicts
+            USING HINT = 'Rename all but one account in each group, e.g. UPDATE users SET username = username || ''-'' || id WHERE id = <id>; then restart or run "migrate up".';
+    END IF;
+END
+$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Usernames are unique regardless of case, so "Alice" cannot register next
+-- to "alice". The unique index also serves the lookups and directory sort
+-- the plain index from 00005 was added for.
+CREATE UNIQUE INDEX users_username_lower_unique_idx ON users (lower(username));
+DROP INDEX users_username_lower_idx;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE INDEX users_username_lower_idx ON users (lower(username), id);
+DROP INDEX users_username_lower_unique_idx;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A report keeps its own copy of the message, so moderators can still read
+-- it once the message itself is deleted
+CREATE TABLE message_reports (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+    reporter_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    sender_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    encrypted_content TEXT NOT NULL,
+    message_created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    reason TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'open'
+        CHECK (status IN ('open', 'actioned', 'dismissed')),
+    action VARCHAR(32),
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (message_id, reporter_id)
+);
+CREATE INDEX message_reports_status_id_idx ON message_reports (status, id DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE message_reports;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Set once the account has shown it receives mail at its address, by
+-- redeeming a password reset or by signing up through a provider that
+-- vouches for the address. Only then may single sign-on link to the account
+-- by email.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
+
+-- A sign-in started by a signed-in user to link a provider account to
+-- theirs, rather than to sign in
+ALTER TABLE oidc_states ADD COLUMN link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE oidc_states DROP COLUMN link_user_id;
+ALTER TABLE users DROP COLUMN email_verified_at;
+-- +goose StatementEnd
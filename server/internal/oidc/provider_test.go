@@ -0,0 +1,130 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"chat/internal/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authorize follows the provider redirect and returns the code and state
+// the issuer sends back.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	issuer := oidctest.NewIssuer("chat-client", "s3cret")
+	t.Cleanup(issuer.Close)
+
+	provider, err := NewProvider(Config{
+		Name:         "corp",
+		IssuerURL:    issuer.URL(),
+		ClientID:     "chat-client",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://chat.example/auth.oidc.callback",
+	}, nil)
+	require.NoError(t, err)
+	return provider, issuer
+}
+
+func TestProvider_AuthorizationCodeFlowWithPKCE(t *testing.T) {
+	provider, issuer := newTestProvider(t)
+	issuer.SetUser(oidctest.User{Subject: "u-123", Email: "alice@corp.example", EmailVerified: true, PreferredUsername: "alice"})
+	ctx := context.Background()
+
+	verifier, err := NewVerifier()
+	require.NoError(t, err)
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	require.NoError(t, err)
+	code, state := authorize(t, authURL)
+	assert.Equal(t, "state-1", state)
+
+	claims, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, "u-123", claims.Subject)
+	assert.Equal(t, "alice@corp.example", claims.Email)
+	assert.True(t, claims.EmailVerified)
+}
+
+func TestProvider_ExchangeRejectsWrongVerifierAndNonce(t *testing.T) {
+	provider, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "right-verifier")
+	require.NoError(t, err)
+	code, _ := authorize(t, authURL)
+	_, err = provider.Exchange(ctx, code, "wrong-verifier", "nonce")
+	assert.Error(t, err)
+
+	authURL, err = provider.AuthCodeURL(ctx, "state", "nonce", "right-verifier")
+	require.NoError(t, err)
+	code, _ = authorize(t, authURL)
+	_, err = provider.Exchange(ctx, code, "right-verifier", "other-nonce")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken))
+}
+
+func TestProvider_VerifyRejectsBadTokens(t *testing.T) {
+	provider, issuer := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	valid := map[string]any{
+		"iss": issuer.URL(), "sub": "u-1", "aud": "chat-client",
+		"exp": now.Add(time.Minute).Unix(), "iat": now.Unix(), "nonce": "n",
+	}
+	with := func(key string, value any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+
+	_, err := provider.verify(ctx, issuer.Sign(valid), "n")
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"wrong issuer":   issuer.Sign(with("iss", "https://evil.example")),
+		"wrong audience": issuer.Sign(with("aud", []string{"someone-else"})),
+		"expired":        issuer.Sign(with("exp", now.Add(-time.Hour).Unix())),
+		"alg none":       withHeader(issuer.Sign(valid), `{"alg":"none"}`),
+		"malformed":      "not-a-jwt",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := provider.verify(ctx, token, "n")
+			assert.True(t, errors.Is(err, ErrInvalidIDToken), "got %v", err)
+		})
+	}
+}
+
+// withHeader swaps the JOSE header of a signed token, keeping its payload and
+// signature.
+func withHeader(token, header string) string {
+	parts := strings.SplitN(token, ".", 2)
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1]
+}
+
+func TestS256Challenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", S256Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
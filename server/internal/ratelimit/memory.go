@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a single token bucket. It is not safe for concurrent use.
+type Bucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+	now     func() time.Time
+}
+
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{limit: limit, tokens: float64(limit.Requests), now: time.Now}
+}
+
+// Take takes a token, or returns how long until one is available.
+func (b *Bucket) Take() (bool, time.Duration) {
+	return b.take(b.now())
+}
+
+func (b *Bucket) take(now time.Time) (bool, time.Duration) {
+	var elapsed time.Duration
+	if !b.updated.IsZero() {
+		elapsed = now.Sub(b.updated)
+	}
+	var allowed bool
+	var retryAfter time.Duration
+	b.tokens, allowed, retryAfter = b.limit.Take(b.tokens, elapsed)
+	b.updated = now
+	return allowed, retryAfter
+}
+
+// full reports whether the bucket has refilled completely by now, at which
+// point it is no different from a new one.
+func (b *Bucket) full(now time.Time) bool {
+	return now.Sub(b.updated) >= b.limit.Per
+}
+
+// sweepInterval is how often a MemoryStore drops refilled buckets.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps buckets in process memory. Limits are per server. It is
+// safe for concurrent use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*Bucket), now: time.Now}
+}
+
+// SetClock replaces the store's time source, for tests.
+func (s *MemoryStore) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = NewBucket(limit)
+		s.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(now)
+	return allowed, retryAfter, nil
+}
+
+// sweep drops buckets that have refilled, so one-off callers do not
+// accumulate. Callers must hold s.mu.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if b.full(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
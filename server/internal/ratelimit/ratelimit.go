@@ -0,0 +1,153 @@
+// Package ratelimit throttles requests with token buckets. Each bucket holds
+// up to Limit.Requests tokens and refills evenly over Limit.Per; a request
+// takes one token or is refused until the next one is due.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests requests per Per, in bursts of up to Requests.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) String() string {
+	return strconv.Itoa(l.Requests) + "/" + l.Per.String()
+}
+
+// Take refills a bucket that held tokens elapsed ago and takes one token
+// from it. It returns the tokens left and, when no token was available, how
+// long until one is. New buckets start with Requests tokens.
+func (l Limit) Take(tokens float64, elapsed time.Duration) (remaining float64, allowed bool, retryAfter time.Duration) {
+	rate := float64(l.Requests) / l.Per.Seconds()
+	tokens = math.Min(float64(l.Requests), tokens+max(elapsed, 0).Seconds()*rate)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return tokens, false, max(wait, time.Millisecond)
+}
+
+// ParseLimit parses a limit written as "30/10s": 30 requests per 10 seconds.
+func ParseLimit(value string) (Limit, error) {
+	requests, per, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("ratelimit: limit %q is not requests/duration", value)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("ratelimit: limit %q needs a positive request count", value)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: limit %q needs a positive duration", value)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+// ParseLimits parses comma-separated name=limit pairs, such as
+// "/user.register=5/1h,send_message=30/10s", into limits.
+func ParseLimits(value string, limits map[string]Limit) error {
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("ratelimit: %q is not name=limit", pair)
+		}
+		parsed, err := ParseLimit(limit)
+		if err != nil {
+			return err
+		}
+		limits[strings.TrimSpace(name)] = parsed
+	}
+	return nil
+}
+
+// Limit names that are not a route or frame type.
+const (
+	// HTTPDefault applies to routes without a limit of their own.
+	HTTPDefault = "http"
+	// FrameDefault applies to frame types without a limit of their own.
+	FrameDefault = "frame"
+	// Connection caps every frame read from a single WebSocket connection,
+	// whatever its type.
+	Connection = "connection"
+)
+
+// DefaultLimits returns the limits used unless configured otherwise. Routes
+// are keyed by path and WebSocket frames by type.
+func DefaultLimits() map[string]Limit {
+	return map[string]Limit{
+		HTTPDefault:                    {Requests: 600, Per: time.Minute},
+		"/user.register":               {Requests: 5, Per: time.Hour},
+		"/user.login":                  {Requests: 30, Per: time.Minute},
+		"/user.login.mfa":              {Requests: 30, Per: time.Minute},
+		"/user.password.reset.request": {Requests: 5, Per: time.Hour},
+		"/message.send":                {Requests: 30, Per: 10 * time.Second},
+		"/message.report":              {Requests: 20, Per: time.Hour},
+		FrameDefault:                   {Requests: 60, Per: 10 * time.Second},
+		"send_message":                 {Requests: 30, Per: 10 * time.Second},
+		Connection:                     {Requests: 20, Per: time.Second},
+	}
+}
+
+// Store keeps buckets by key. Stores shared between servers make limits
+// hold across all of them.
+type Store interface {
+	// Take takes a token from key's bucket under limit.
+	Take(ctx context.Context, key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// Limiter applies named limits to callers.
+type Limiter struct {
+	store  Store
+	limits map[string]Limit
+	logger *slog.Logger
+}
+
+func NewLimiter(store Store, limits map[string]Limit, logger *slog.Logger) *Limiter {
+	return &Limiter{store: store, limits: limits, logger: logger}
+}
+
+// Has reports whether name has a limit configured.
+func (l *Limiter) Has(name string) bool {
+	_, ok := l.limits[name]
+	return ok
+}
+
+// Allow takes a token from caller's bucket for name. Names without a limit
+// are not limited, and store failures let the request through rather than
+// take the service down with the store.
+func (l *Limiter) Allow(ctx context.Context, name, caller string) (bool, time.Duration) {
+	limit, ok := l.limits[name]
+	if !ok {
+		return true, 0
+	}
+	allowed, retryAfter, err := l.store.Take(ctx, name+"|"+caller, limit)
+	if err != nil {
+		l.logger.ErrorContext(ctx, "rate limit store", "error", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// NewBucket returns a standalone bucket for name, or nil when name has no
+// limit. It suits limits that only make sense locally, such as per
+// connection.
+func (l *Limiter) NewBucket(name string) *Bucket {
+	limit, ok := l.limits[name]
+	if !ok {
+		return nil
+	}
+	return NewBucket(limit)
+}
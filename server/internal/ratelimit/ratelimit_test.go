@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimit_Take(t *testing.T) {
+	limit := Limit{Requests: 2, Per: 10 * time.Second}
+
+	tokens, allowed, _ := limit.Take(2, 0)
+	assert.True(t, allowed)
+	tokens, allowed, _ = limit.Take(tokens, 0)
+	assert.True(t, allowed)
+
+	tokens, allowed, retryAfter := limit.Take(tokens, 0)
+	assert.False(t, allowed)
+	assert.Equal(t, 5*time.Second, retryAfter, "one token refills every 5s")
+
+	_, allowed, _ = limit.Take(tokens, 5*time.Second)
+	assert.True(t, allowed)
+
+	// Refills never exceed the burst
+	tokens, _, _ = limit.Take(0, time.Hour)
+	assert.Equal(t, 1.0, tokens)
+}
+
+func TestParseLimits(t *testing.T) {
+	limit, err := ParseLimit(" 30/10s ")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 30, Per: 10 * time.Second}, limit)
+
+	for _, bad := range []string{"30", "0/1s", "x/1s", "5/soon", "5/-1s"} {
+		_, err := ParseLimit(bad)
+		assert.Error(t, err, bad)
+	}
+
+	limits := DefaultLimits()
+	require.NoError(t, ParseLimits("/user.register=3/1h, send_message=10/10s,", limits))
+	assert.Equal(t, Limit{Requests: 3, Per: time.Hour}, limits["/user.register"])
+	assert.Equal(t, Limit{Requests: 10, Per: 10 * time.Second}, limits["send_message"])
+	assert.Error(t, ParseLimits("send_message", limits))
+}
+
+func newTestStore() (*MemoryStore, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryStore()
+	s.SetClock(func() time.Time { return now })
+	return s, &now
+}
+
+func TestMemoryStore(t *testing.T) {
+	s, now := newTestStore()
+	ctx := context.Background()
+	limit := Limit{Requests: 3, Per: 3 * time.Second}
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := s.Take(ctx, "user:1", limit)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter, _ := s.Take(ctx, "user:1", limit)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Other keys have their own buckets
+	allowed, _, _ = s.Take(ctx, "user:2", limit)
+	assert.True(t, allowed)
+
+	*now = now.Add(time.Second)
+	allowed, _, _ = s.Take(ctx, "user:1", limit)
+	assert.True(t, allowed)
+
+	// Refilled buckets are swept
+	*now = now.Add(time.Hour)
+	_, _, _ = s.Take(ctx, "user:3", limit)
+	assert.Len(t, s.buckets, 1)
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, Limit) (bool, time.Duration, error) {
+	return false, 0, errors.New("connection refused")
+}
+
+func TestLimiter(t *testing.T) {
+	limits := map[string]Limit{"send_message": {Requests: 1, Per: time.Minute}}
+	limiter := NewLimiter(NewMemoryStore(), limits, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+
+	allowed, _ := limiter.Allow(ctx, "send_message", "user:1")
+	assert.True(t, allowed)
+	allowed, retryAfter := limiter.Allow(ctx, "send_message", "user:1")
+	assert.False(t, allowed)
+	assert.Greater(t, retryAfter, time.Duration(0))
+
+	allowed, _ = limiter.Allow(ctx, "get_history", "user:1")
+	assert.True(t, allowed, "names without a limit are not limited")
+	assert.Nil(t, limiter.NewBucket(Connection))
+
+	// A broken store must not take the service down
+	limiter = NewLimiter(failingStore{}, limits, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	allowed, _ = limiter.Allow(ctx, "send_message", "user:1")
+	assert.True(t, allowed)
+}
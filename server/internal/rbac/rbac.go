@@ -0,0 +1,42 @@
+// Package rbac defines user roles and the permissions each one grants. It is
+// the single place that decides who may do what; handlers and middleware ask
+// it through Can rather than comparing role names.
+package rbac
+
+// Roles, from least to most privileged.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+type Permission string
+
+const (
+	// PermModerate covers reviewing reports and acting on messages.
+	PermModerate Permission = "moderate"
+	// PermManageUsers covers listing, disabling, enabling and deleting
+	// accounts.
+	PermManageUsers Permission = "manage_users"
+	// PermManageRoles covers granting and revoking roles.
+	PermManageRoles Permission = "manage_roles"
+)
+
+// grants lists what each role may do. Roles do not inherit from each other
+// implicitly, so every grant is spelled out.
+var grants = map[string]map[Permission]bool{
+	RoleUser:      {},
+	RoleModerator: {PermModerate: true},
+	RoleAdmin:     {PermModerate: true, PermManageUsers: true, PermManageRoles: true},
+}
+
+// Valid reports whether role is a known role.
+func Valid(role string) bool {
+	_, ok := grants[role]
+	return ok
+}
+
+// Can reports whether role grants perm. Unknown roles grant nothing.
+func Can(role string, perm Permission) bool {
+	return grants[role][perm]
+}
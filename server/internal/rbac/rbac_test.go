@@ -0,0 +1,38 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		role     string
+		perm     Permission
+		expected bool
+	}{
+		{RoleUser, PermModerate, false},
+		{RoleUser, PermManageUsers, false},
+		{RoleModerator, PermModerate, true},
+		{RoleModerator, PermManageUsers, false},
+		{RoleModerator, PermManageRoles, false},
+		{RoleAdmin, PermModerate, true},
+		{RoleAdmin, PermManageUsers, true},
+		{RoleAdmin, PermManageRoles, true},
+		{"", PermModerate, false},
+		{"superuser", PermManageUsers, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Can(tt.role, tt.perm), "%s %s", tt.role, tt.perm)
+	}
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid(RoleUser))
+	assert.True(t, Valid(RoleModerator))
+	assert.True(t, Valid(RoleAdmin))
+	assert.False(t, Valid("Admin"))
+	assert.False(t, Valid(""))
+}
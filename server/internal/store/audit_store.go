@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// Audit event types.
+const (
+	AuditLoginLockout = "login_lockout"
+	AuditUserDisabled = "user_disabled"
+	AuditUserEnabled  = "user_enabled"
+	AuditUserDeleted  = "user_deleted"
+	AuditRoleChanged  = "role_changed"
+	// Moderator decisions on reported messages
+	AuditReportActioned  = "report_actioned"
+	AuditReportDismissed = "report_dismissed"
+)
+
+// AuditEvent is an append-only record of a security-relevant action. ActorID
+// is who did it and TargetUserID who it affected; either may be unknown.
+type AuditEvent struct {
+	ID           int64          `json:"id"`
+	Type         string         `json:"type"`
+	ActorID      *int           `json:"actor_id,omitempty"`
+	TargetUserID *int           `json:"target_user_id,omitempty"`
+	IPAddress    string         `json:"ip_address,omitempty"`
+	Details      map[string]any `json:"details,omitempty"`
+	CreatedAt    string         `json:"created_at"`
+}
+
+type PostgresAuditStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAuditStore(db *sql.DB) *PostgresAuditStore {
+	return &PostgresAuditStore{db: db}
+}
+
+type AuditStore interface {
+	RecordEvent(ctx context.Context, event *AuditEvent) error
+}
+
+func (s *PostgresAuditStore) RecordEvent(ctx context.Context, event *AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_events (event_type, actor_id, target_user_id, ip_address, details)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING id, created_at
+	`
+	return s.db.QueryRowContext(ctx, query, event.Type, event.ActorID, event.TargetUserID, event.IPAddress, details).
+		Scan(&event.ID, &event.CreatedAt)
+}
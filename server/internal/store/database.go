@@ -1,41 +1,119 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/pressly/goose/v3"
 	"io/fs"
+	"strconv"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
-func Open() (*sql.DB, error) {
-	db, err := sql.Open("pgx", "host=localhost port=5432 user=postgres password=root dbname=postgres sslmode=disable")
+func Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("DB: open %w", err)
 	}
-	fmt.Println("DB: connected")
-
 	return db, nil
 }
 
-func MigrateFS(db *sql.DB, migrationsFS fs.FS, dir string) error {
+// Migration commands.
+const (
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+	MigrateStatus = "status"
+	MigrateRedo   = "redo"
+	MigrateTo     = "to"
+)
+
+// MigrateFS runs command against db with the migrations in dir of
+// migrationsFS:
+//
+//	up          applies every pending migration
+//	down        rolls back the latest migration
+//	status      logs which migrations are applied
+//	redo        rolls back the latest migration and applies it again
+//	to VERSION  migrates up or down to VERSION
+func MigrateFS(ctx context.Context, db *sql.DB, migrationsFS fs.FS, dir, command string, args ...string) error {
 	goose.SetBaseFS(migrationsFS)
 	defer func() {
 		goose.SetBaseFS(nil)
 	}()
-	return Migrate(db, dir)
+	return migrate(ctx, db, dir, command, args)
 }
 
+// Migrate applies every pending migration in dir on disk.
 func Migrate(db *sql.DB, dir string) error {
+	return migrate(context.Background(), db, dir, MigrateUp, nil)
+}
+
+func migrate(ctx context.Context, db *sql.DB, dir, command string, args []string) error {
+	wantArgs := 0
+	if command == MigrateTo {
+		wantArgs = 1
+	}
+	if len(args) != wantArgs {
+		return fmt.Errorf("migrate %s: want %d arguments, got %d", command, wantArgs, len(args))
+	}
+
 	err := goose.SetDialect("postgres")
 	if err != nil {
 		return fmt.Errorf("migrate: %w", err)
 	}
 
-	err = goose.Up(db, dir)
+	switch command {
+	case MigrateUp:
+		err = goose.UpContext(ctx, db, dir)
+	case MigrateDown:
+		err = goose.DownContext(ctx, db, dir)
+	case MigrateStatus:
+		err = goose.StatusContext(ctx, db, dir)
+	case MigrateRedo:
+		err = goose.RedoContext(ctx, db, dir)
+	case MigrateTo:
+		err = migrateTo(ctx, db, dir, args[0])
+	default:
+		return fmt.Errorf("migrate: unknown command %q", command)
+	}
 	if err != nil {
-		return fmt.Errorf("goose up: %w", err)
+		return fmt.Errorf("goose %s: %w", command, err)
 	}
 	return nil
 }
+
+// migrateTo applies or rolls back migrations until db is at version.
+func migrateTo(ctx context.Context, db *sql.DB, dir, version string) error {
+	target, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || target < 0 {
+		return fmt.Errorf("invalid version %q", version)
+	}
+	current, err := goose.GetDBVersionContext(ctx, db)
+	if err != nil {
+		return err
+	}
+	if target < current {
+		return goose.DownToContext(ctx, db, dir, target)
+	}
+	return goose.UpToContext(ctx, db, dir, target)
+}
+
+// MigrationVersions reports the version db is migrated to and the latest
+// version in migrationsFS.
+func MigrationVersions(ctx context.Context, db *sql.DB, migrationsFS fs.FS, dir string) (current, latest int64, err error) {
+	sub, err := fs.Sub(migrationsFS, dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("migrate: %w", err)
+	}
+	// The provider is not closed, as that would close db
+	provider, err := goose.NewProvider(goose.DialectPostgres, db, sub)
+	if err != nil {
+		return 0, 0, fmt.Errorf("migrate: %w", err)
+	}
+	current, latest, err = provider.GetVersions(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("migrate: %w", err)
+	}
+	return current, latest, nil
+}
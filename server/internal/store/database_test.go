@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"chat/internal/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// Stores seal messages and secrets; any valid key will do
+	if err := crypto.LoadKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// Arguments are checked before the database is touched, so none is needed
+func TestMigrateFS_InvalidCommands(t *testing.T) {
+	migrationsFS := fstest.MapFS{"00001_users.sql": {Data: []byte("-- +goose Up\n")}}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+	}{
+		{name: "unknown command", command: "sideways"},
+		{name: "to without version", command: MigrateTo},
+		{name: "to with bad version", command: MigrateTo, args: []string{"latest"}},
+		{name: "to with negative version", command: MigrateTo, args: []string{"-3"}},
+		{name: "up with version", command: MigrateUp, args: []string{"3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, MigrateFS(ctx, nil, migrationsFS, ".", tt.command, tt.args...))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// Identity links a user to an account at an external OpenID Connect
+// provider, keyed by the provider's subject identifier.
+type Identity struct {
+	ID        int     `json:"id"`
+	UserID    int     `json:"user_id"`
+	Provider  string  `json:"provider"`
+	Subject   string  `json:"subject"`
+	Email     *string `json:"email,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// OIDCState is a pending single sign-on login: what the callback needs to
+// finish it. Only a hash of the state parameter is stored.
+type OIDCState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	// LinkUserID is the signed-in user linking the provider account to
+	// theirs, or 0 for a sign-in.
+	LinkUserID int
+}
+
+type PostgresIdentityStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdentityStore(db *sql.DB) *PostgresIdentityStore {
+	return &PostgresIdentityStore{db: db}
+}
+
+type IdentityStore interface {
+	CreateOIDCState(ctx context.Context, state *OIDCState, ttl time.Duration) (token string, err error)
+	ConsumeOIDCState(ctx context.Context, token string) (*OIDCState, error)
+	GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	LinkIdentity(ctx context.Context, identity *Identity) error
+}
+
+// NewOIDCNonce returns a random value for the ID token nonce.
+func NewOIDCNonce() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// CreateOIDCState stores a pending login and returns the state parameter to
+// send to the provider.
+func (s *PostgresIdentityStore) CreateOIDCState(ctx context.Context, state *OIDCState, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6)
+	`
+	_, err = s.db.ExecContext(ctx, query, hash, state.Provider, state.Nonce, state.CodeVerifier, state.LinkUserID, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeOIDCState redeems a state parameter. Like reset tokens, it works
+// exactly once, so a callback URL cannot be replayed.
+func (s *PostgresIdentityStore) ConsumeOIDCState(ctx context.Context, token string) (*OIDCState, error) {
+	query := `
+		UPDATE oidc_states SET used_at = CURRENT_TIMESTAMP
+		WHERE state_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING provider, nonce, code_verifier, COALESCE(link_user_id, 0)
+	`
+	state := &OIDCState{}
+	err := s.db.QueryRowContext(ctx, query, hashToken(token)).Scan(&state.Provider, &state.Nonce, &state.CodeVerifier, &state.LinkUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// GetUserByIdentity returns the user linked to a provider account and notes
+// the login. It returns sql.ErrNoRows if the account is not linked.
+func (s *PostgresIdentityStore) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	query := `
+		WITH identity AS (
+			UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP
+			WHERE provider = $1 AND subject = $2
+			RETURNING user_id
+		)
+		SELECT ` + userColumns + ` FROM users WHERE id = (SELECT user_id FROM identity)
+	`
+	return scanUser(s.db.QueryRowContext(ctx, query, provider, subject))
+}
+
+// LinkIdentity attaches a provider account to a user. Linking the same
+// account again is a no-op.
+func (s *PostgresIdentityStore) LinkIdentity(ctx context.Context, identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subject) DO UPDATE SET email = EXCLUDED.email
+		RETURNING id, user_id, created_at
+	`
+	return s.db.QueryRowContext(ctx, query, identity.UserID, identity.Provider, identity.Subject, identity.Email).
+		Scan(&identity.ID, &identity.UserID, &identity.CreatedAt)
+}
@@ -1,7 +1,7 @@
 package store
 
 import (
-	"chat/internal/crypto"
+	"context"
 	"database/sql"
 )
 
@@ -14,21 +14,47 @@ type Message struct {
 	CreatedAt        string `json:"created_at"`
 }
 
+// previewLength is how many characters of the last message a conversation
+// list entry carries.
+const previewLength = 100
+
+// Conversation summarises a 1-to-1 thread from one participant's point of view.
+type Conversation struct {
+	User           *User  `json:"user"`
+	LastMessageID  int    `json:"last_message_id"`
+	LastSenderID   int    `json:"last_sender_id"`
+	Preview        string `json:"preview"`
+	LastActivityAt string `json:"last_activity_at"`
+	UnreadCount    int    `json:"unread_count"`
+	Muted          bool   `json:"muted"`
+}
+
 type PostgresMessageStore struct {
 	db *sql.DB
+	instruments
 }
 
 func NewPostgresMessageStore(db *sql.DB) *PostgresMessageStore {
-	return &PostgresMessageStore{db: db}
+	return &PostgresMessageStore{db: db, instruments: newInstruments("message")}
 }
 
 type MessageStore interface {
-	CreateMessage(senderID, receiverID int, content string) (*Message, error)
-	GetMessagesBetweenUsers(userID1, userID2 int) ([]*Message, error)
+	CreateMessage(ctx context.Context, senderID, receiverID int, content string) (*Message, error)
+	GetMessagesBetweenUsers(ctx context.Context, userID1, userID2 int) ([]*Message, error)
+	GetMessagesPage(ctx context.Context, userID1, userID2, beforeID, limit int) ([]*Message, error)
+	GetConversations(ctx context.Context, userID int) ([]*Conversation, error)
+	GetConversation(ctx context.Context, userID, otherUserID int) (*Conversation, error)
+	GetConversationPartnerIDs(ctx context.Context, userID int) ([]int, error)
+	MarkConversationRead(ctx context.Context, readerID, otherUserID int) (int, error)
+	// DeleteMessage removes a message for both participants. It returns
+	// sql.ErrNoRows if there is no such message.
+	DeleteMessage(ctx context.Context, messageID int) error
 }
 
-func (s *PostgresMessageStore) CreateMessage(senderID, receiverID int, content string) (*Message, error) {
-	encryptedContent, err := crypto.Encrypt(content)
+func (s *PostgresMessageStore) CreateMessage(ctx context.Context, senderID, receiverID int, content string) (*Message, error) {
+	ctx, end := s.begin(ctx, "CreateMessage")
+	defer end()
+	encryptedContent, err := s.encrypt(ctx, content)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +65,7 @@ func (s *PostgresMessageStore) CreateMessage(senderID, receiverID int, content s
 		RETURNING id, created_at
 	`
 	message := &Message{}
-	err = s.db.QueryRow(query, senderID, receiverID, encryptedContent).Scan(&message.ID, &message.CreatedAt)
+	err = s.db.QueryRowContext(ctx, query, senderID, receiverID, encryptedContent).Scan(&message.ID, &message.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -50,14 +76,16 @@ func (s *PostgresMessageStore) CreateMessage(senderID, receiverID int, content s
 	return message, nil
 }
 
-func (s *PostgresMessageStore) GetMessagesBetweenUsers(userID1, userID2 int) ([]*Message, error) {
+func (s *PostgresMessageStore) GetMessagesBetweenUsers(ctx context.Context, userID1, userID2 int) ([]*Message, error) {
+	ctx, end := s.begin(ctx, "GetMessagesBetweenUsers")
+	defer end()
 	query := `
 		SELECT id, sender_id, receiver_id, encrypted_content, created_at 
 		FROM messages 
 		WHERE (sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1)
 		ORDER BY created_at
 	`
-	rows, err := s.db.Query(query, userID1, userID2)
+	rows, err := s.db.QueryContext(ctx, query, userID1, userID2)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +103,7 @@ func (s *PostgresMessageStore) GetMessagesBetweenUsers(userID1, userID2 int) ([]
 		if err != nil {
 			return nil, err
 		}
-		message.Content, err = crypto.Decrypt(message.EncryptedContent)
+		message.Content, err = s.decrypt(ctx, message.EncryptedContent)
 		if err != nil {
 			return nil, err
 		}
@@ -83,3 +111,194 @@ func (s *PostgresMessageStore) GetMessagesBetweenUsers(userID1, userID2 int) ([]
 	}
 	return messages, nil
 }
+
+// GetMessagesPage returns up to limit messages between two users older than
+// beforeID (or the newest ones when beforeID is 0), in chronological order.
+func (s *PostgresMessageStore) GetMessagesPage(ctx context.Context, userID1, userID2, beforeID, limit int) ([]*Message, error) {
+	ctx, end := s.begin(ctx, "GetMessagesPage")
+	defer end()
+	query := `
+		SELECT id, sender_id, receiver_id, encrypted_content, created_at
+		FROM (
+			SELECT id, sender_id, receiver_id, encrypted_content, created_at
+			FROM messages
+			WHERE ((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))
+			  AND ($3 = 0 OR id < $3)
+			ORDER BY id DESC
+			LIMIT $4
+		) page
+		ORDER BY id
+	`
+	rows, err := s.db.QueryContext(ctx, query, userID1, userID2, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		message := &Message{}
+		err := rows.Scan(&message.ID, &message.SenderID, &message.ReceiverID, &message.EncryptedContent, &message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		message.Content, err = s.decrypt(ctx, message.EncryptedContent)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// conversationsQuery finds each counterpart through the (sender, receiver, id)
+// indexes, then picks the newest message per counterpart as the larger of two
+// index-only max() lookups rather than sorting the whole history. $2 narrows
+// the result to a single counterpart; 0 returns them all.
+const conversationsQuery = `
+	WITH partners AS (
+		SELECT DISTINCT receiver_id AS other_id FROM messages WHERE sender_id = $1
+		UNION
+		SELECT DISTINCT sender_id FROM messages WHERE receiver_id = $1
+	)
+	SELECT u.*,
+		m.id, m.sender_id, m.encrypted_content, m.created_at,
+		(SELECT COUNT(*) FROM messages c
+		 WHERE c.receiver_id = $1 AND c.sender_id = p.other_id AND c.read_at IS NULL),
+		EXISTS (SELECT 1 FROM user_mutes mu WHERE mu.user_id = $1 AND mu.target_id = p.other_id)
+	FROM partners p
+	JOIN (SELECT ` + profileColumns + ` FROM users) u ON u.id = p.other_id
+	CROSS JOIN LATERAL (
+		SELECT GREATEST(
+			(SELECT MAX(id) FROM messages WHERE sender_id = $1 AND receiver_id = p.other_id),
+			(SELECT MAX(id) FROM messages WHERE sender_id = p.other_id AND receiver_id = $1)
+		) AS id
+	) latest
+	JOIN messages m ON m.id = latest.id
+	WHERE $2 = 0 OR p.other_id = $2
+	ORDER BY m.id DESC
+`
+
+func (s *PostgresMessageStore) queryConversations(ctx context.Context, userID, otherUserID int) ([]*Conversation, error) {
+	rows, err := s.db.QueryContext(ctx, conversationsQuery, userID, otherUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []*Conversation{}
+	for rows.Next() {
+		conversation := &Conversation{User: &User{}}
+		var encryptedContent string
+		dest, finish := profileDest(conversation.User)
+		err := rows.Scan(append(dest, &conversation.LastMessageID, &conversation.LastSenderID, &encryptedContent,
+			&conversation.LastActivityAt, &conversation.UnreadCount, &conversation.Muted)...)
+		if err != nil {
+			return nil, err
+		}
+		finish()
+		content, err := s.decrypt(ctx, encryptedContent)
+		if err != nil {
+			return nil, err
+		}
+		conversation.Preview = Preview(content)
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// GetConversations lists every user userID has exchanged messages with,
+// most recently active first.
+func (s *PostgresMessageStore) GetConversations(ctx context.Context, userID int) ([]*Conversation, error) {
+	ctx, end := s.begin(ctx, "GetConversations")
+	defer end()
+	return s.queryConversations(ctx, userID, 0)
+}
+
+// GetConversation returns userID's view of the conversation with otherUserID,
+// or sql.ErrNoRows if they have never exchanged messages.
+func (s *PostgresMessageStore) GetConversation(ctx context.Context, userID, otherUserID int) (*Conversation, error) {
+	ctx, end := s.begin(ctx, "GetConversation")
+	defer end()
+	conversations, err := s.queryConversations(ctx, userID, otherUserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return conversations[0], nil
+}
+
+// GetConversationPartnerIDs returns everyone userID has exchanged messages
+// with, for fanning out events like profile changes.
+func (s *PostgresMessageStore) GetConversationPartnerIDs(ctx context.Context, userID int) ([]int, error) {
+	ctx, end := s.begin(ctx, "GetConversationPartnerIDs")
+	defer end()
+	query := `
+		SELECT receiver_id FROM messages WHERE sender_id = $1
+		UNION
+		SELECT sender_id FROM messages WHERE receiver_id = $1
+	`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Preview shortens message content for conversation lists and notifications.
+func Preview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= previewLength {
+		return content
+	}
+	return string(runes[:previewLength]) + "…"
+}
+
+// MarkConversationRead marks every message otherUserID sent to readerID as
+// read and returns how many were updated.
+func (s *PostgresMessageStore) MarkConversationRead(ctx context.Context, readerID, otherUserID int) (int, error) {
+	ctx, end := s.begin(ctx, "MarkConversationRead")
+	defer end()
+	query := `
+		UPDATE messages SET read_at = CURRENT_TIMESTAMP
+		WHERE receiver_id = $1 AND sender_id = $2 AND read_at IS NULL
+	`
+	result, err := s.db.ExecContext(ctx, query, readerID, otherUserID)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(updated), nil
+}
+
+func (s *PostgresMessageStore) DeleteMessage(ctx context.Context, messageID int) error {
+	ctx, end := s.begin(ctx, "DeleteMessage")
+	defer end()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM messages WHERE id = $1`, messageID)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package store
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -207,6 +209,32 @@ func TestMessageContentTypes(t *testing.T) {
 	}
 }
 
+func TestPreview(t *testing.T) {
+	assert.Equal(t, "short", Preview("short"))
+
+	long := strings.Repeat("é", previewLength+10)
+	preview := Preview(long)
+	assert.Equal(t, previewLength+1, utf8.RuneCountInString(preview))
+	assert.True(t, strings.HasSuffix(preview, "…"))
+}
+
+func TestConversationJSONMarshaling(t *testing.T) {
+	conversation := &Conversation{
+		User:          &User{ID: 2, Username: "bob", PasswordHash: "secret_hash"},
+		LastMessageID: 9,
+		Preview:       "see you",
+		UnreadCount:   3,
+	}
+
+	jsonData, err := json.Marshal(conversation)
+	require.NoError(t, err)
+
+	jsonStr := string(jsonData)
+	assert.Contains(t, jsonStr, `"unread_count":3`)
+	assert.Contains(t, jsonStr, `"preview":"see you"`)
+	assert.NotContains(t, jsonStr, "secret_hash")
+}
+
 func BenchmarkMessageJSONMarshaling(b *testing.B) {
 	message := &Message{
 		ID:         1,
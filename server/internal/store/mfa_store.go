@@ -0,0 +1,238 @@
+package store
+
+import (
+	"chat/internal/crypto"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxMFAAttempts is how many wrong codes one login challenge tolerates before
+// the password has to be entered again.
+const MaxMFAAttempts = 5
+
+// MFA is a user's TOTP enrollment. It is pending until EnabledAt is set by a
+// successful verification.
+type MFA struct {
+	UserID       int
+	Secret       string
+	EnabledAt    *string
+	LastUsedStep int64
+}
+
+func (m *MFA) Enabled() bool {
+	return m != nil && m.EnabledAt != nil
+}
+
+// MFAChallenge is the half-finished login between the password and the
+// second factor.
+type MFAChallenge struct {
+	ID     int
+	UserID int
+}
+
+type PostgresMFAStore struct {
+	db *sql.DB
+}
+
+func NewPostgresMFAStore(db *sql.DB) *PostgresMFAStore {
+	return &PostgresMFAStore{db: db}
+}
+
+type MFAStore interface {
+	// GetMFA returns sql.ErrNoRows when the user has never enrolled.
+	GetMFA(ctx context.Context, userID int) (*MFA, error)
+	// SetPendingMFA starts or restarts enrollment with a new secret. It does
+	// nothing to an enrollment that is already enabled.
+	SetPendingMFA(ctx context.Context, userID int, secret string) error
+	// EnableMFA finishes enrollment, replacing any recovery codes.
+	EnableMFA(ctx context.Context, userID int, step int64, recoveryCodes []string) error
+	DisableMFA(ctx context.Context, userID int) error
+	// UseTOTPStep records that the code for step was used. It returns false if
+	// that step or a later one was used already, so codes cannot be replayed.
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	// UseRecoveryCode redeems one recovery code, returning false if it is
+	// unknown or already used.
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+	CreateMFAChallenge(ctx context.Context, userID int, ttl time.Duration) (token string, err error)
+	// GetMFAChallenge returns ErrInvalidToken for challenges that are unknown,
+	// expired, used or out of attempts.
+	GetMFAChallenge(ctx context.Context, token string) (*MFAChallenge, error)
+	FailMFAChallenge(ctx context.Context, challengeID int) error
+	// ConsumeMFAChallenge marks a challenge used, returning ErrInvalidToken if
+	// another request got there first.
+	ConsumeMFAChallenge(ctx context.Context, challengeID int) error
+}
+
+// NormalizeRecoveryCode strips the formatting users may type along with a
+// recovery code.
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+func (s *PostgresMFAStore) GetMFA(ctx context.Context, userID int) (*MFA, error) {
+	query := `SELECT user_id, encrypted_secret, enabled_at, last_used_step FROM user_mfa WHERE user_id = $1`
+
+	mfa := &MFA{}
+	var encryptedSecret string
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&mfa.UserID, &encryptedSecret, &mfa.EnabledAt, &mfa.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+
+	mfa.Secret, err = crypto.Decrypt(encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return mfa, nil
+}
+
+func (s *PostgresMFAStore) SetPendingMFA(ctx context.Context, userID int, secret string) error {
+	encryptedSecret, err := crypto.Encrypt(secret)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO user_mfa (user_id, encrypted_secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET encrypted_secret = EXCLUDED.encrypted_secret, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE user_mfa.enabled_at IS NULL
+	`
+	_, err = s.db.ExecContext(ctx, query, userID, encryptedSecret)
+	return err
+}
+
+func (s *PostgresMFAStore) EnableMFA(ctx context.Context, userID int, step int64, recoveryCodes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE user_mfa SET enabled_at = CURRENT_TIMESTAMP, last_used_step = $2
+		WHERE user_id = $1 AND enabled_at IS NULL
+	`, userID, step)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashToken(NormalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresMFAStore) DisableMFA(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresMFAStore) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	query := `UPDATE user_mfa SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`
+	result, err := s.db.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+func (s *PostgresMFAStore) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	query := `
+		UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM mfa_recovery_codes
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+			LIMIT 1
+		) AND used_at IS NULL
+	`
+	result, err := s.db.ExecContext(ctx, query, userID, hashToken(NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+func (s *PostgresMFAStore) CreateMFAChallenge(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	query := `INSERT INTO mfa_challenges (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`
+	_, err = s.db.ExecContext(ctx, query, userID, hash, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *PostgresMFAStore) GetMFAChallenge(ctx context.Context, token string) (*MFAChallenge, error) {
+	query := `
+		SELECT id, user_id FROM mfa_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND attempts < $2 AND expires_at > CURRENT_TIMESTAMP
+	`
+	challenge := &MFAChallenge{}
+	err := s.db.QueryRowContext(ctx, query, hashToken(token), MaxMFAAttempts).Scan(&challenge.ID, &challenge.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (s *PostgresMFAStore) FailMFAChallenge(ctx context.Context, challengeID int) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = $1`, challengeID)
+	return err
+}
+
+func (s *PostgresMFAStore) ConsumeMFAChallenge(ctx context.Context, challengeID int) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE mfa_challenges SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL AND attempts < $2
+	`, challengeID, MaxMFAAttempts)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
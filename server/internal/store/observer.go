@@ -0,0 +1,95 @@
+package store
+
+import (
+	"chat/internal/crypto"
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies the spans stores record.
+const tracerName = "chat/internal/store"
+
+// Observer is told how long store operations take, such as for metrics.
+// Stores without one observe nothing.
+type Observer interface {
+	// ObserveQuery reports a database operation, named after the store
+	// method, including the time spent scanning its rows.
+	ObserveQuery(store, operation string, d time.Duration)
+	// ObserveCrypto reports encrypting or decrypting message content.
+	ObserveCrypto(operation string, d time.Duration)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveQuery(string, string, time.Duration) {}
+func (nopObserver) ObserveCrypto(string, time.Duration)        {}
+
+// instruments times and traces the operations of a store. Stores embed it,
+// so SetObserver and SetTracerProvider are available on each.
+type instruments struct {
+	name     string
+	observer Observer
+	tracer   trace.Tracer
+}
+
+func newInstruments(name string) instruments {
+	return instruments{
+		name:     name,
+		observer: nopObserver{},
+		tracer:   noop.NewTracerProvider().Tracer(tracerName),
+	}
+}
+
+// SetObserver reports query and encryption timings to o.
+func (i *instruments) SetObserver(o Observer) {
+	i.observer = o
+}
+
+// SetTracerProvider records a span for each query and each encryption or
+// decryption with tracers from tp.
+func (i *instruments) SetTracerProvider(tp trace.TracerProvider) {
+	i.tracer = tp.Tracer(tracerName)
+}
+
+// begin starts a span for operation. Call end once it is done to end the
+// span and report how long it took.
+func (i *instruments) begin(ctx context.Context, operation string) (_ context.Context, end func()) {
+	start := time.Now()
+	ctx, span := i.tracer.Start(ctx, i.name+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation.name", operation),
+		))
+	return ctx, func() {
+		span.End()
+		i.observer.ObserveQuery(i.name, operation, time.Since(start))
+	}
+}
+
+func (i *instruments) encrypt(ctx context.Context, plaintext string) (string, error) {
+	return i.crypt(ctx, "encrypt", crypto.Encrypt, plaintext)
+}
+
+func (i *instruments) decrypt(ctx context.Context, ciphertext string) (string, error) {
+	return i.crypt(ctx, "decrypt", crypto.Decrypt, ciphertext)
+}
+
+func (i *instruments) crypt(ctx context.Context, operation string, fn func(string) (string, error), in string) (string, error) {
+	start := time.Now()
+	_, span := i.tracer.Start(ctx, "crypto."+operation)
+	defer span.End()
+
+	out, err := fn(in)
+	i.observer.ObserveCrypto(operation, time.Since(start))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, operation+" failed")
+	}
+	return out, err
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"chat/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstruments_Spans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	s := NewPostgresMessageStore(nil)
+	s.SetTracerProvider(tracing.NewSDKProvider(1, sdktrace.WithSpanProcessor(rec)))
+
+	ctx, end := s.begin(context.Background(), "CreateMessage")
+	ciphertext, err := s.encrypt(ctx, "hello")
+	require.NoError(t, err)
+	_, err = s.decrypt(ctx, "not ciphertext")
+	require.Error(t, err)
+	end()
+
+	spans := rec.Ended()
+	require.Len(t, spans, 3)
+	encrypt, decrypt, query := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "message.CreateMessage", query.Name())
+	assert.Equal(t, "crypto.encrypt", encrypt.Name())
+	assert.Equal(t, query.SpanContext().SpanID(), encrypt.Parent().SpanID())
+	assert.Equal(t, codes.Unset, encrypt.Status().Code)
+	assert.NotEqual(t, "hello", ciphertext)
+
+	assert.Equal(t, "crypto.decrypt", decrypt.Name())
+	assert.Equal(t, codes.Error, decrypt.Status().Code)
+	assert.Len(t, decrypt.Events(), 1)
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"chat/internal/ratelimit"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often idle buckets are deleted.
+const rateLimitPruneInterval = 10 * time.Minute
+
+// PostgresRateLimitStore keeps rate limit buckets in the database, so every
+// server enforces the same limits. Times come from the database clock, so
+// servers need not agree on theirs.
+type PostgresRateLimitStore struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewPostgresRateLimitStore(db *sql.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db: db}
+}
+
+// Take locks key's bucket row for the refill-and-take, so concurrent
+// requests on any server each see the previous one's result.
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, limit ratelimit.Limit) (bool, time.Duration, error) {
+	s.prune(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO rate_limits (key, tokens) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`,
+		key, float64(limit.Requests))
+	if err != nil {
+		return false, 0, err
+	}
+
+	// The refill is measured with clock_timestamp(), read once the row is
+	// locked. CURRENT_TIMESTAMP is when the transaction began, which for a
+	// request that waited on the lock is before the previous holder's
+	// update, so writing it back would rewind the bucket and refill it twice.
+	var tokens, elapsed float64
+	var now time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT tokens, GREATEST(EXTRACT(EPOCH FROM (clock_timestamp() - updated_at)), 0), clock_timestamp()
+		FROM rate_limits WHERE key = $1 FOR UPDATE
+	`, key).Scan(&tokens, &elapsed, &now)
+	if err != nil {
+		return false, 0, err
+	}
+
+	remaining, allowed, retryAfter := limit.Take(tokens, time.Duration(elapsed*float64(time.Second)))
+	_, err = tx.ExecContext(ctx, `UPDATE rate_limits SET tokens = $2, updated_at = $3 WHERE key = $1`, key, remaining, now)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, tx.Commit()
+}
+
+// prune deletes buckets idle for a day, at most once per interval. Any limit
+// up to a day long has refilled them by then.
+func (s *PostgresRateLimitStore) prune(ctx context.Context) {
+	s.mu.Lock()
+	due := time.Since(s.lastPrune) >= rateLimitPruneInterval
+	if due {
+		s.lastPrune = time.Now()
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+
+	_, _ = s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE updated_at < CURRENT_TIMESTAMP - INTERVAL '1 day'`)
+}
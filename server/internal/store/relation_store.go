@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Relation lists. A block cuts off messages in both directions and hides
+// the two users from each other's directory; a mute only silences
+// notifications for the muted user's messages.
+type Relation string
+
+const (
+	RelationBlock Relation = "user_blocks"
+	RelationMute  Relation = "user_mutes"
+)
+
+// blockedBetween matches when $1 and the users.id in scope have blocked each
+// other in either direction. Shared by the directory queries.
+const blockedBetween = `EXISTS (
+	SELECT 1 FROM user_blocks b
+	WHERE (b.user_id = $1 AND b.target_id = users.id) OR (b.user_id = users.id AND b.target_id = $1)
+)`
+
+type PostgresRelationStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRelationStore(db *sql.DB) *PostgresRelationStore {
+	return &PostgresRelationStore{db: db}
+}
+
+type RelationStore interface {
+	// AddRelation puts targetID on one of userID's lists. Adding someone
+	// twice is not an error.
+	AddRelation(ctx context.Context, relation Relation, userID, targetID int) error
+	RemoveRelation(ctx context.Context, relation Relation, userID, targetID int) error
+	GetRelations(ctx context.Context, relation Relation, userID int) ([]*User, error)
+	// IsBlockedBetween reports whether either user has blocked the other.
+	IsBlockedBetween(ctx context.Context, userID, otherUserID int) (bool, error)
+	IsMuted(ctx context.Context, userID, targetID int) (bool, error)
+}
+
+// relationTable guards the table name interpolated into queries.
+func relationTable(relation Relation) string {
+	switch relation {
+	case RelationBlock, RelationMute:
+		return string(relation)
+	}
+	panic("store: unknown relation " + string(relation))
+}
+
+func (s *PostgresRelationStore) AddRelation(ctx context.Context, relation Relation, userID, targetID int) error {
+	query := `INSERT INTO ` + relationTable(relation) + ` (user_id, target_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := s.db.ExecContext(ctx, query, userID, targetID)
+	return err
+}
+
+func (s *PostgresRelationStore) RemoveRelation(ctx context.Context, relation Relation, userID, targetID int) error {
+	query := `DELETE FROM ` + relationTable(relation) + ` WHERE user_id = $1 AND target_id = $2`
+	_, err := s.db.ExecContext(ctx, query, userID, targetID)
+	return err
+}
+
+// GetRelations lists the users on one of userID's lists, most recently added
+// first.
+func (s *PostgresRelationStore) GetRelations(ctx context.Context, relation Relation, userID int) ([]*User, error) {
+	query := `
+		SELECT u.* FROM (SELECT ` + profileColumns + ` FROM users) u
+		JOIN ` + relationTable(relation) + ` r ON r.target_id = u.id
+		WHERE r.user_id = $1
+		ORDER BY r.created_at DESC, u.id
+	`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresRelationStore) IsBlockedBetween(ctx context.Context, userID, otherUserID int) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (user_id = $1 AND target_id = $2) OR (user_id = $2 AND target_id = $1)
+		)
+	`
+	var blocked bool
+	err := s.db.QueryRowContext(ctx, query, userID, otherUserID).Scan(&blocked)
+	return blocked, err
+}
+
+func (s *PostgresRelationStore) IsMuted(ctx context.Context, userID, targetID int) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM user_mutes WHERE user_id = $1 AND target_id = $2)`
+	var muted bool
+	err := s.db.QueryRowContext(ctx, query, userID, targetID).Scan(&muted)
+	return muted, err
+}
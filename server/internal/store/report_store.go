@@ -0,0 +1,167 @@
+package store
+
+import (
+	"chat/internal/crypto"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrAlreadyReported = errors.New("message already reported")
+	ErrReportResolved  = errors.New("report already resolved")
+)
+
+// Report states. Every report starts open and is resolved exactly once.
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// Actions a moderator can take on a report.
+const (
+	ReportActionDeleteMessage = "delete_message"
+	ReportActionWarn          = "warn"
+	ReportActionSuspend       = "suspend"
+)
+
+// Report is a flagged message in the moderation queue. It carries its own
+// copy of the message, so MessageID and SenderID may be nil once the message
+// or its sender are deleted while the content stays reviewable.
+type Report struct {
+	ID               int     `json:"id"`
+	MessageID        *int    `json:"message_id"`
+	ReporterID       *int    `json:"reporter_id"`
+	SenderID         *int    `json:"sender_id"`
+	EncryptedContent string  `json:"-"`
+	Content          string  `json:"content"`
+	MessageCreatedAt string  `json:"message_created_at"`
+	Reason           string  `json:"reason"`
+	Status           string  `json:"status"`
+	Action           *string `json:"action,omitempty"`
+	ResolvedBy       *int    `json:"resolved_by,omitempty"`
+	ResolvedAt       *string `json:"resolved_at,omitempty"`
+	CreatedAt        string  `json:"created_at"`
+}
+
+const reportColumns = `id, message_id, reporter_id, sender_id, encrypted_content, message_created_at,
+	reason, status, action, resolved_by, resolved_at, created_at`
+
+type PostgresReportStore struct {
+	db *sql.DB
+}
+
+func NewPostgresReportStore(db *sql.DB) *PostgresReportStore {
+	return &PostgresReportStore{db: db}
+}
+
+type ReportStore interface {
+	// CreateReport flags a message on behalf of its recipient. It returns
+	// sql.ErrNoRows if the message does not exist or was not sent to
+	// reporterID.
+	CreateReport(ctx context.Context, messageID, reporterID int, reason string) (*Report, error)
+	GetReport(ctx context.Context, reportID int) (*Report, error)
+	// ListReports returns up to limit reports in status (all of them when
+	// status is empty) with ids above afterID, oldest first.
+	ListReports(ctx context.Context, status string, afterID, limit int) ([]*Report, error)
+	// ResolveReport closes an open report. It returns ErrReportResolved if
+	// the report was resolved in the meantime.
+	ResolveReport(ctx context.Context, reportID, moderatorID int, status, action string) error
+	// ReopenReport puts a resolved report back in the queue, for when the
+	// action it was resolved with could not be carried out.
+	ReopenReport(ctx context.Context, reportID int) error
+}
+
+func scanReport(row rowScanner) (*Report, error) {
+	report := &Report{}
+	err := row.Scan(&report.ID, &report.MessageID, &report.ReporterID, &report.SenderID, &report.EncryptedContent,
+		&report.MessageCreatedAt, &report.Reason, &report.Status, &report.Action, &report.ResolvedBy,
+		&report.ResolvedAt, &report.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	report.Content, err = crypto.Decrypt(report.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *PostgresReportStore) CreateReport(ctx context.Context, messageID, reporterID int, reason string) (*Report, error) {
+	query := `
+		INSERT INTO message_reports (message_id, reporter_id, sender_id, encrypted_content, message_created_at, reason)
+		SELECT id, receiver_id, sender_id, encrypted_content, created_at, $3
+		FROM messages WHERE id = $1 AND receiver_id = $2
+		RETURNING ` + reportColumns
+	report, err := scanReport(s.db.QueryRowContext(ctx, query, messageID, reporterID, reason))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return nil, ErrAlreadyReported
+		}
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *PostgresReportStore) GetReport(ctx context.Context, reportID int) (*Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM message_reports WHERE id = $1`
+	return scanReport(s.db.QueryRowContext(ctx, query, reportID))
+}
+
+func (s *PostgresReportStore) ListReports(ctx context.Context, status string, afterID, limit int) ([]*Report, error) {
+	query := `
+		SELECT ` + reportColumns + ` FROM message_reports
+		WHERE ($1 = '' OR status = $1) AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+	rows, err := s.db.QueryContext(ctx, query, status, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *PostgresReportStore) ResolveReport(ctx context.Context, reportID, moderatorID int, status, action string) error {
+	query := `
+		UPDATE message_reports
+		SET status = $3, action = NULLIF($4, ''), resolved_by = $2, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'open'
+	`
+	result, err := s.db.ExecContext(ctx, query, reportID, moderatorID, status, action)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrReportResolved
+	}
+	return nil
+}
+
+func (s *PostgresReportStore) ReopenReport(ctx context.Context, reportID int) error {
+	query := `
+		UPDATE message_reports
+		SET status = 'open', action = NULL, resolved_by = NULL, resolved_at = NULL
+		WHERE id = $1
+	`
+	_, err := s.db.ExecContext(ctx, query, reportID)
+	return err
+}
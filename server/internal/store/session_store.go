@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// ErrInvalidToken is returned for session and reset tokens that are unknown,
+// expired, revoked or already used. Callers cannot tell which, on purpose.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Session is a login. Only a SHA-256 hash of its bearer token is stored, so a
+// database leak does not hand out working tokens.
+type Session struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type PostgresSessionStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSessionStore(db *sql.DB) *PostgresSessionStore {
+	return &PostgresSessionStore{db: db}
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, userID int, ttl time.Duration) (token string, session *Session, err error)
+	GetSession(ctx context.Context, token string) (*Session, error)
+	RevokeSession(ctx context.Context, sessionID int) error
+	RevokeOtherSessions(ctx context.Context, userID, keepSessionID int) error
+	CreatePasswordReset(ctx context.Context, userID int, ttl time.Duration) (token string, err error)
+	GetPasswordReset(ctx context.Context, token string) (userID int, err error)
+	ConsumePasswordReset(ctx context.Context, token string) (userID int, err error)
+}
+
+// newToken returns a random URL-safe token and the hash to store for it.
+func newToken() (string, []byte, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func (s *PostgresSessionStore) CreateSession(ctx context.Context, userID int, ttl time.Duration) (string, *Session, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	query := `
+		INSERT INTO sessions (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, expires_at
+	`
+	session := &Session{UserID: userID}
+	err = s.db.QueryRowContext(ctx, query, userID, hash, time.Now().Add(ttl)).Scan(&session.ID, &session.CreatedAt, &session.ExpiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// GetSession resolves a bearer token to its live session. Sessions of
+// disabled accounts are treated as revoked. It runs on every authenticated
+// request, so it takes the request's context and deadline.
+func (s *PostgresSessionStore) GetSession(ctx context.Context, token string) (*Session, error) {
+	query := `
+		SELECT s.id, s.user_id, s.created_at, s.expires_at FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+			AND u.disabled_at IS NULL
+	`
+	session := &Session{}
+	err := s.db.QueryRowContext(ctx, query, hashToken(token)).Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *PostgresSessionStore) RevokeSession(ctx context.Context, sessionID int) error {
+	query := `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`
+	_, err := s.db.ExecContext(ctx, query, sessionID)
+	return err
+}
+
+// RevokeOtherSessions ends every session of userID except keepSessionID. Pass
+// 0 to revoke them all.
+func (s *PostgresSessionStore) RevokeOtherSessions(ctx context.Context, userID, keepSessionID int) error {
+	query := `
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND id != $2 AND revoked_at IS NULL
+	`
+	_, err := s.db.ExecContext(ctx, query, userID, keepSessionID)
+	return err
+}
+
+// CreatePasswordReset issues a single-use reset token. Earlier unused tokens
+// for the user are invalidated so only the latest email works.
+func (s *PostgresSessionStore) CreatePasswordReset(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, hash, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// GetPasswordReset returns the user a reset token belongs to without using
+// it up, or ErrInvalidToken if it is unknown, used or expired.
+func (s *PostgresSessionStore) GetPasswordReset(ctx context.Context, token string) (int, error) {
+	query := `
+		SELECT user_id FROM password_resets
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`
+	var userID int
+	err := s.db.QueryRowContext(ctx, query, hashToken(token)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// ConsumePasswordReset marks a reset token used and returns its user. The
+// conditional update makes redemption atomic, so a token works exactly once.
+// The token was sent to the user's email, so redeeming it also verifies the
+// address.
+func (s *PostgresSessionStore) ConsumePasswordReset(ctx context.Context, token string) (int, error) {
+	query := `
+		WITH reset AS (
+			UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			RETURNING user_id
+		)
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		FROM reset WHERE users.id = reset.user_id
+		RETURNING users.id
+	`
+	var userID int
+	err := s.db.QueryRowContext(ctx, query, hashToken(token)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
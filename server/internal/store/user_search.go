@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+const defaultUserSort = "username"
+
+// userSortKeys maps the sort names accepted by SearchUsers to the expression
+// rows are ordered and paginated by, and the type the cursor value is cast to.
+var userSortKeys = map[string]struct {
+	expr string
+	cast string
+}{
+	"username":     {expr: "lower(username)", cast: "text"},
+	"display_name": {expr: "lower(display_name)", cast: "text"},
+	"created_at":   {expr: "created_at", cast: "timestamptz"},
+}
+
+// UserSearch describes one page of a directory search. Query matches username
+// and display name by prefix or, through pg_trgm word similarity, fuzzily; an
+// empty Query lists the whole directory.
+type UserSearch struct {
+	Query         string
+	ExcludeUserID int
+	Sort          string
+	Descending    bool
+	Cursor        string
+	Limit         int
+}
+
+type UserPage struct {
+	Users      []*User `json:"users"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// userCursor is the keyset position after the last row of a page. It records
+// the sort it was issued for so it cannot be replayed against another one.
+type userCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int    `json:"i"`
+}
+
+func (c userCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeUserCursor(cursor string) (*userCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &userCursor{}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if key, ok := userSortKeys[c.Sort]; ok && !validCursorValue(key.cast, c.Value) {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// timestamptzLayouts are the forms Postgres prints timestamptz values in,
+// depending on the session time zone's offset.
+var timestamptzLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+}
+
+// validCursorValue reports whether value can be cast to the sort key's type,
+// so a tampered cursor is refused rather than failing the query.
+func validCursorValue(cast, value string) bool {
+	switch cast {
+	case "timestamptz":
+		for _, layout := range timestamptzLayouts {
+			if _, err := time.Parse(layout, value); err == nil {
+				return true
+			}
+		}
+		return false
+	default:
+		// Postgres text cannot hold NUL; JSON decoding already replaced
+		// invalid UTF-8
+		return !strings.ContainsRune(value, 0)
+	}
+}
+
+// escapeLike escapes the LIKE wildcards in s so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// buildUserSearchQuery returns the SQL and arguments for search. Split out of
+// SearchUsers so the query shape can be tested without a database.
+func buildUserSearchQuery(search UserSearch) (string, []any, error) {
+	if search.Sort == "" {
+		search.Sort = defaultUserSort
+	}
+	key, ok := userSortKeys[search.Sort]
+	if !ok {
+		return "", nil, ErrInvalidSort
+	}
+
+	args := []any{search.ExcludeUserID}
+	where := []string{"id != $1", "discoverable", "disabled_at IS NULL", "NOT " + blockedBetween}
+
+	if q := strings.ToLower(strings.TrimSpace(search.Query)); q != "" {
+		args = append(args, escapeLike(q)+"%", q)
+		where = append(where, fmt.Sprintf(
+			"(lower(username) LIKE $%[1]d OR lower(display_name) LIKE $%[1]d OR $%[2]d <%% lower(username) OR $%[2]d <%% lower(display_name))",
+			len(args)-1, len(args)))
+	}
+
+	direction, comparison := "ASC", ">"
+	if search.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if search.Cursor != "" {
+		cursor, err := decodeUserCursor(search.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		if cursor.Sort != search.Sort || cursor.Desc != search.Descending {
+			return "", nil, ErrInvalidCursor
+		}
+		args = append(args, cursor.Value, cursor.ID)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)",
+			key.expr, comparison, len(args)-1, key.cast, len(args)))
+	}
+
+	args = append(args, search.Limit+1)
+	query := fmt.Sprintf(`
+		SELECT `+profileColumns+`, %[1]s::text
+		FROM users
+		WHERE %[2]s
+		ORDER BY %[1]s %[3]s, id %[3]s
+		LIMIT $%[4]d
+	`, key.expr, strings.Join(where, " AND "), direction, len(args))
+
+	return query, args, nil
+}
+
+// SearchUsers returns one page of discoverable users matching search, with a
+// cursor for the next page when there is one.
+func (s *PostgresUserStore) SearchUsers(ctx context.Context, search UserSearch) (*UserPage, error) {
+	ctx, end := s.begin(ctx, "SearchUsers")
+	defer end()
+	if search.Sort == "" {
+		search.Sort = defaultUserSort
+	}
+	query, args, err := buildUserSearchQuery(search)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	page := &UserPage{Users: []*User{}}
+	var lastKey string
+	for rows.Next() {
+		user := &User{}
+		var sortKey string
+		dest, finish := profileDest(user)
+		err := rows.Scan(append(dest, &sortKey)...)
+		if err != nil {
+			return nil, err
+		}
+		finish()
+		if len(page.Users) == search.Limit {
+			// The extra row only signals that another page exists
+			last := page.Users[len(page.Users)-1]
+			page.NextCursor = userCursor{Sort: search.Sort, Desc: search.Descending, Value: lastKey, ID: last.ID}.encode()
+			break
+		}
+		page.Users = append(page.Users, user)
+		lastKey = sortKey
+	}
+	return page, rows.Err()
+}
+
+// UserList describes one page of the administrators' account list. Unlike
+// UserSearch it includes hidden and disabled accounts and their private
+// fields. Rows are ordered by id.
+type UserList struct {
+	Query    string // Username or email prefix
+	Role     string
+	Disabled *bool
+	Cursor   string
+	Limit    int
+}
+
+// userListSort tags cursors issued by ListUsers, so SearchUsers cursors are
+// not accepted and vice versa.
+const userListSort = "admin"
+
+func buildUserListQuery(list UserList) (string, []any, error) {
+	var args []any
+	where := []string{"TRUE"}
+
+	if q := strings.ToLower(strings.TrimSpace(list.Query)); q != "" {
+		args = append(args, escapeLike(q)+"%")
+		where = append(where, fmt.Sprintf("(lower(username) LIKE $%[1]d OR lower(email) LIKE $%[1]d)", len(args)))
+	}
+	if list.Role != "" {
+		args = append(args, list.Role)
+		where = append(where, fmt.Sprintf("role = $%d", len(args)))
+	}
+	if list.Disabled != nil {
+		if *list.Disabled {
+			where = append(where, "disabled_at IS NOT NULL")
+		} else {
+			where = append(where, "disabled_at IS NULL")
+		}
+	}
+	if list.Cursor != "" {
+		cursor, err := decodeUserCursor(list.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		if cursor.Sort != userListSort {
+			return "", nil, ErrInvalidCursor
+		}
+		args = append(args, cursor.ID)
+		where = append(where, fmt.Sprintf("id > $%d", len(args)))
+	}
+
+	args = append(args, list.Limit+1)
+	query := fmt.Sprintf(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE %s
+		ORDER BY id
+		LIMIT $%d
+	`, strings.Join(where, " AND "), len(args))
+
+	return query, args, nil
+}
+
+// ListUsers returns one page of accounts for administrators.
+func (s *PostgresUserStore) ListUsers(ctx context.Context, list UserList) (*UserPage, error) {
+	ctx, end := s.begin(ctx, "ListUsers")
+	defer end()
+	query, args, err := buildUserListQuery(list)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	page := &UserPage{Users: []*User{}}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Users) == list.Limit {
+			last := page.Users[len(page.Users)-1]
+			page.NextCursor = userCursor{Sort: userListSort, ID: last.ID}.encode()
+			break
+		}
+		page.Users = append(page.Users, user)
+	}
+	return page, rows.Err()
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildUserSearchQuery_Defaults(t *testing.T) {
+	query, args, err := buildUserSearchQuery(UserSearch{ExcludeUserID: 7, Limit: 20})
+	require.NoError(t, err)
+
+	assert.Contains(t, query, "ORDER BY lower(username) ASC, id ASC")
+	assert.Contains(t, query, "discoverable")
+	assert.Contains(t, query, "NOT EXISTS")
+	assert.Contains(t, query, "b.user_id = $1 AND b.target_id = users.id")
+	assert.NotContains(t, query, "LIKE")
+	// Limit is bumped by one so the store can tell whether another page exists
+	assert.Equal(t, []any{7, 21}, args)
+}
+
+func TestBuildUserSearchQuery_QueryIsEscaped(t *testing.T) {
+	query, args, err := buildUserSearchQuery(UserSearch{Query: "  Al_%ice ", Limit: 10})
+	require.NoError(t, err)
+
+	assert.Contains(t, query, "lower(username) LIKE $2")
+	assert.Contains(t, query, "$3 <% lower(display_name)")
+	assert.Equal(t, `al\_\%ice%`, args[1])
+	assert.Equal(t, "al_%ice", args[2])
+}
+
+func TestBuildUserSearchQuery_Cursor(t *testing.T) {
+	cursor := userCursor{Sort: "created_at", Desc: true, Value: "2024-01-01 00:00:00+00", ID: 42}.encode()
+
+	query, args, err := buildUserSearchQuery(UserSearch{Sort: "created_at", Descending: true, Cursor: cursor, Limit: 5})
+	require.NoError(t, err)
+
+	assert.Contains(t, query, "(created_at, id) < ($2::timestamptz, $3)")
+	assert.Contains(t, query, "ORDER BY created_at DESC, id DESC")
+	assert.Equal(t, []any{0, "2024-01-01 00:00:00+00", 42, 6}, args)
+}
+
+func TestBuildUserSearchQuery_Errors(t *testing.T) {
+	_, _, err := buildUserSearchQuery(UserSearch{Sort: "password_hash", Limit: 5})
+	assert.ErrorIs(t, err, ErrInvalidSort)
+
+	_, _, err = buildUserSearchQuery(UserSearch{Cursor: "not base64!", Limit: 5})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	// A cursor issued for one sort must not be replayed against another
+	cursor := userCursor{Sort: "username", Value: "bob", ID: 3}.encode()
+	_, _, err = buildUserSearchQuery(UserSearch{Sort: "display_name", Cursor: cursor, Limit: 5})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestDecodeUserCursor_Values(t *testing.T) {
+	for _, value := range []string{
+		"2024-01-01 00:00:00+00",
+		"2024-06-30 12:34:56.789012+00",
+		"2024-06-30 12:34:56.789012+05:30",
+	} {
+		_, err := decodeUserCursor(userCursor{Sort: "created_at", Value: value, ID: 1}.encode())
+		assert.NoError(t, err, value)
+	}
+
+	// Tampered values fail here instead of in Postgres
+	for _, c := range []userCursor{
+		{Sort: "created_at", Value: "yesterday", ID: 1},
+		{Sort: "created_at", Value: "2024-13-01 00:00:00+00", ID: 1},
+		{Sort: "username", Value: "bob\x00", ID: 1},
+	} {
+		_, err := decodeUserCursor(c.encode())
+		assert.ErrorIs(t, err, ErrInvalidCursor, c.Value)
+	}
+}
+
+func TestBuildUserListQuery(t *testing.T) {
+	disabled := true
+	query, args, err := buildUserListQuery(UserList{Query: "Ad", Role: "admin", Disabled: &disabled, Limit: 50})
+	require.NoError(t, err)
+
+	assert.Contains(t, query, "(lower(username) LIKE $1 OR lower(email) LIKE $1)")
+	assert.Contains(t, query, "role = $2")
+	assert.Contains(t, query, "disabled_at IS NOT NULL")
+	assert.Contains(t, query, "password_hash, role, disabled_at")
+	assert.Contains(t, query, "ORDER BY id")
+	assert.Equal(t, []any{"ad%", "admin", 51}, args)
+}
+
+func TestBuildUserListQuery_Cursor(t *testing.T) {
+	cursor := userCursor{Sort: userListSort, ID: 40}.encode()
+	query, args, err := buildUserListQuery(UserList{Cursor: cursor, Limit: 10})
+	require.NoError(t, err)
+	assert.Contains(t, query, "id > $1")
+	assert.Equal(t, []any{40, 11}, args)
+
+	// Directory cursors cannot page through the admin list
+	cursor = userCursor{Sort: "username", Value: "bob", ID: 3}.encode()
+	_, _, err = buildUserListQuery(UserList{Cursor: cursor, Limit: 10})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestUserCursorRoundTrip(t *testing.T) {
+	original := userCursor{Sort: "username", Value: "zoë", ID: 99}
+	encoded := original.encode()
+	assert.False(t, strings.ContainsAny(encoded, "+/="), "cursor must be URL safe")
+
+	decoded, err := decodeUserCursor(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, original, *decoded)
+}
@@ -1,68 +1,212 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"time"
 )
 
+var (
+	ErrUsernameTaken = errors.New("username already exists")
+	ErrEmailTaken    = errors.New("email already in use")
+)
+
+// uniqueViolation is the Postgres error code for a unique index conflict.
+const uniqueViolation = "23505"
+
 type User struct {
-	ID           int    `json:"id"`
-	Username     string `json:"username"`
-	PasswordHash string `json:"-"` // Don't include in JSON responses
-	CreatedAt    string `json:"created_at"`
+	ID              int     `json:"id"`
+	Username        string  `json:"username"`
+	DisplayName     string  `json:"display_name"`
+	Bio             string  `json:"bio"`
+	StatusText      string  `json:"status_text"`
+	StatusExpiresAt *string `json:"status_expires_at"`
+	Timezone        string  `json:"timezone"`
+	AvatarURL       string  `json:"avatar_url,omitempty"`
+	Email           *string `json:"email,omitempty"` // Only loaded by scanUser, never for other users
+	EmailVerifiedAt *string `json:"email_verified_at,omitempty"`
+	PasswordHash    string  `json:"-"`              // Don't include in JSON responses
+	Role            string  `json:"role,omitempty"` // Only loaded by scanUser
+	DisabledAt      *string `json:"disabled_at,omitempty"`
+	Discoverable    bool    `json:"discoverable"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// EmailVerified reports whether the user has shown they receive mail at
+// their email address.
+func (u *User) EmailVerified() bool {
+	return u.Email != nil && u.EmailVerifiedAt != nil
+}
+
+// Disabled reports whether an administrator has disabled the account.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// profileColumns selects everything about a user that is safe to show other
+// users, in the order scanProfile expects. An expired status reads as empty.
+const profileColumns = `id, username, display_name, bio,
+	CASE WHEN status_expires_at IS NULL OR status_expires_at > CURRENT_TIMESTAMP THEN status_text ELSE '' END AS status_text,
+	CASE WHEN status_expires_at > CURRENT_TIMESTAMP THEN status_expires_at END AS status_expires_at,
+	timezone, avatar_updated_at, discoverable, created_at`
+
+// userColumns adds the private account fields to profileColumns, for scanUser.
+const userColumns = profileColumns + `, email, email_verified_at, password_hash, role, disabled_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// profileDest returns scan destinations matching profileColumns. The caller
+// must run finish once the row has been scanned.
+func profileDest(user *User) (dest []any, finish func()) {
+	var avatarUpdatedAt sql.NullTime
+	dest = []any{&user.ID, &user.Username, &user.DisplayName, &user.Bio, &user.StatusText,
+		&user.StatusExpiresAt, &user.Timezone, &avatarUpdatedAt, &user.Discoverable, &user.CreatedAt}
+	finish = func() {
+		if avatarUpdatedAt.Valid {
+			// The timestamp busts client caches whenever the image changes
+			user.AvatarURL = fmt.Sprintf("/user.avatar?id=%d&v=%d", user.ID, avatarUpdatedAt.Time.Unix())
+		}
+	}
+	return dest, finish
+}
+
+func scanProfile(row rowScanner) (*User, error) {
+	user := &User{}
+	dest, finish := profileDest(user)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	finish()
+	return user, nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	dest, finish := profileDest(user)
+	if err := row.Scan(append(dest, &user.Email, &user.EmailVerifiedAt, &user.PasswordHash, &user.Role, &user.DisabledAt)...); err != nil {
+		return nil, err
+	}
+	finish()
+	return user, nil
+}
+
+// ProfileUpdate holds the profile fields to change; nil fields are left as
+// they are. Setting StatusText also replaces StatusExpiresAt, so a new status
+// without an expiry never inherits the old one's.
+type ProfileUpdate struct {
+	DisplayName     *string
+	Bio             *string
+	StatusText      *string
+	StatusExpiresAt *time.Time
+	Timezone        *string
 }
 
 type PostgresUserStore struct {
 	db *sql.DB
+	instruments
 }
 
 func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
-	return &PostgresUserStore{db: db}
+	return &PostgresUserStore{db: db, instruments: newInstruments("user")}
 }
 
 type UserStore interface {
-	CreateUser(user *User) error
-	GetUserByID(id int) (*User, error)
-	GetUserByUsername(username string) (*User, error)
-	GetUsersExcept(excludeUserID int) ([]*User, error)
+	CreateUser(ctx context.Context, user *User) error
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	UpdatePassword(ctx context.Context, userID int, passwordHash string) error
+	GetUsersExcept(ctx context.Context, excludeUserID int) ([]*User, error)
+	SearchUsers(ctx context.Context, search UserSearch) (*UserPage, error)
+	SetDiscoverable(ctx context.Context, userID int, discoverable bool) error
+	UpdateProfile(ctx context.Context, userID int, update ProfileUpdate) (*User, error)
+	SetAvatar(ctx context.Context, userID int, contentType string, data []byte) (*User, error)
+	GetAvatar(ctx context.Context, userID int) (contentType string, data []byte, err error)
 	HashPassword(password string) (string, error)
 	CheckPassword(hashedPassword, password string) error
-	AuthenticateUser(username, password string) (*User, error)
+	AuthenticateUser(ctx context.Context, username, password string) (*User, error)
+	ListUsers(ctx context.Context, list UserList) (*UserPage, error)
+	SetRole(ctx context.Context, userID int, role string) error
+	SetDisabled(ctx context.Context, userID int, disabled bool) error
+	DeleteUser(ctx context.Context, userID int) error
 }
 
-func (s *PostgresUserStore) CreateUser(user *User) error {
-	query := `INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id, created_at`
+// CreateUser inserts user. EmailVerifiedAt is stored as given, so only set it
+// when something other than the user vouches for the address.
+func (s *PostgresUserStore) CreateUser(ctx context.Context, user *User) error {
+	ctx, end := s.begin(ctx, "CreateUser")
+	defer end()
+	query := `INSERT INTO users (username, password_hash, email, email_verified_at) VALUES ($1, $2, $3, $4) RETURNING id, created_at`
 
-	err := s.db.QueryRow(query, user.Username, user.PasswordHash).Scan(&user.ID, &user.CreatedAt)
+	err := s.db.QueryRowContext(ctx, query, user.Username, user.PasswordHash, user.Email, user.EmailVerifiedAt).Scan(&user.ID, &user.CreatedAt)
 	if err != nil {
+		// Lookups before the insert can race with a concurrent registration,
+		// so the unique indexes have the final word
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			if pgErr.ConstraintName == "users_email_lower_idx" {
+				return ErrEmailTaken
+			}
+			return ErrUsernameTaken
+		}
 		return err
 	}
 	return nil
 }
 
-func (s *PostgresUserStore) GetUserByID(id int) (*User, error) {
-	query := `SELECT id, username, password_hash, created_at FROM users WHERE id = $1`
-	user := &User{}
-	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return user, nil
+func (s *PostgresUserStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	ctx, end := s.begin(ctx, "GetUserByID")
+	defer end()
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(s.db.QueryRowContext(ctx, query, id))
 }
 
-func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
-	query := `SELECT id, username, password_hash, created_at FROM users WHERE username = $1`
-	user := &User{}
-	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+func (s *PostgresUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, end := s.begin(ctx, "GetUserByUsername")
+	defer end()
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(username) = lower($1)`
+	return scanUser(s.db.QueryRowContext(ctx, query, username))
+}
+
+func (s *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, end := s.begin(ctx, "GetUserByEmail")
+	defer end()
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(email) = lower($1)`
+	return scanUser(s.db.QueryRowContext(ctx, query, email))
+}
+
+func (s *PostgresUserStore) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	ctx, end := s.begin(ctx, "UpdatePassword")
+	defer end()
+	query := `UPDATE users SET password_hash = $2 WHERE id = $1`
+	result, err := s.db.ExecContext(ctx, query, userID, passwordHash)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return user, nil
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-func (s *PostgresUserStore) GetUsersExcept(excludeUserID int) ([]*User, error) {
-	query := `SELECT id, username, created_at FROM users WHERE id != $1`
-	rows, err := s.db.Query(query, excludeUserID)
+// GetUsersExcept lists every discoverable, enabled user other than
+// excludeUserID, leaving out anyone either side has blocked.
+func (s *PostgresUserStore) GetUsersExcept(ctx context.Context, excludeUserID int) ([]*User, error) {
+	ctx, end := s.begin(ctx, "GetUsersExcept")
+	defer end()
+	query := `SELECT ` + profileColumns + ` FROM users WHERE id != $1 AND discoverable AND disabled_at IS NULL AND NOT ` + blockedBetween
+	rows, err := s.db.QueryContext(ctx, query, excludeUserID)
 	if err != nil {
 		return nil, err
 	}
@@ -75,8 +219,7 @@ func (s *PostgresUserStore) GetUsersExcept(excludeUserID int) ([]*User, error) {
 
 	var users []*User
 	for rows.Next() {
-		user := &User{}
-		err := rows.Scan(&user.ID, &user.Username, &user.CreatedAt)
+		user, err := scanProfile(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -85,6 +228,82 @@ func (s *PostgresUserStore) GetUsersExcept(excludeUserID int) ([]*User, error) {
 	return users, nil
 }
 
+func (s *PostgresUserStore) SetDiscoverable(ctx context.Context, userID int, discoverable bool) error {
+	ctx, end := s.begin(ctx, "SetDiscoverable")
+	defer end()
+	query := `UPDATE users SET discoverable = $2 WHERE id = $1`
+	result, err := s.db.ExecContext(ctx, query, userID, discoverable)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresUserStore) UpdateProfile(ctx context.Context, userID int, update ProfileUpdate) (*User, error) {
+	ctx, end := s.begin(ctx, "UpdateProfile")
+	defer end()
+	query := `
+		UPDATE users SET
+			display_name = COALESCE($2, display_name),
+			bio = COALESCE($3, bio),
+			status_text = COALESCE($4, status_text),
+			status_expires_at = CASE WHEN $4::text IS NULL THEN status_expires_at ELSE $5::timestamptz END,
+			timezone = COALESCE($6, timezone)
+		WHERE id = $1
+		RETURNING ` + profileColumns
+	return scanProfile(s.db.QueryRowContext(ctx, query, userID, update.DisplayName, update.Bio,
+		update.StatusText, update.StatusExpiresAt, update.Timezone))
+}
+
+// SetAvatar stores an already processed avatar image and returns the updated
+// profile, whose AvatarURL now points at it.
+func (s *PostgresUserStore) SetAvatar(ctx context.Context, userID int, contentType string, data []byte) (*User, error) {
+	ctx, end := s.begin(ctx, "SetAvatar")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_avatars (user_id, content_type, data, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE
+		SET content_type = EXCLUDED.content_type, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at
+	`, userID, contentType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE users SET avatar_updated_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING ` + profileColumns
+	user, err := scanProfile(tx.QueryRowContext(ctx, query, userID))
+	if err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *PostgresUserStore) GetAvatar(ctx context.Context, userID int) (string, []byte, error) {
+	ctx, end := s.begin(ctx, "GetAvatar")
+	defer end()
+	query := `SELECT content_type, data FROM user_avatars WHERE user_id = $1`
+	var contentType string
+	var data []byte
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&contentType, &data)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
+
 // HashPassword hashes a plain text password using bcrypt
 func (s *PostgresUserStore) HashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -99,10 +318,27 @@ func (s *PostgresUserStore) CheckPassword(hashedPassword, password string) error
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
 
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// burnPasswordCheck runs a bcrypt comparison that always fails, so a login
+// for an unknown username takes as long as one with a wrong password.
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password for timing"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
 // AuthenticateUser verifies username and password, returns user if valid
-func (s *PostgresUserStore) AuthenticateUser(username, password string) (*User, error) {
-	user, err := s.GetUserByUsername(username)
+func (s *PostgresUserStore) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.GetUserByUsername(ctx, username)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			burnPasswordCheck(password)
+		}
 		return nil, err // User not found or database error
 	}
 
@@ -113,3 +349,43 @@ func (s *PostgresUserStore) AuthenticateUser(username, password string) (*User,
 
 	return user, nil
 }
+
+// SetRole changes a user's role. The database rejects unknown roles.
+func (s *PostgresUserStore) SetRole(ctx context.Context, userID int, role string) error {
+	ctx, end := s.begin(ctx, "SetRole")
+	defer end()
+	return s.updateOne(ctx, `UPDATE users SET role = $2 WHERE id = $1`, userID, role)
+}
+
+// SetDisabled disables or re-enables an account. Disabling an account that
+// is already disabled keeps the original time.
+func (s *PostgresUserStore) SetDisabled(ctx context.Context, userID int, disabled bool) error {
+	ctx, end := s.begin(ctx, "SetDisabled")
+	defer end()
+	query := `UPDATE users SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, CURRENT_TIMESTAMP) END WHERE id = $1`
+	return s.updateOne(ctx, query, userID, disabled)
+}
+
+// DeleteUser removes an account along with everything that references it.
+func (s *PostgresUserStore) DeleteUser(ctx context.Context, userID int) error {
+	ctx, end := s.begin(ctx, "DeleteUser")
+	defer end()
+	return s.updateOne(ctx, `DELETE FROM users WHERE id = $1`, userID)
+}
+
+// updateOne runs a statement affecting the user with the given id, returning
+// sql.ErrNoRows if there is none.
+func (s *PostgresUserStore) updateOne(ctx context.Context, query string, userID int, args ...any) error {
+	result, err := s.db.ExecContext(ctx, query, append([]any{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -245,3 +245,19 @@ func TestUserJSONMarshaling(t *testing.T) {
 	assert.NotContains(t, jsonStr, "secret_hash")
 	assert.NotContains(t, jsonStr, "password_hash")
 }
+
+func TestBurnPasswordCheckMatchesRealCost(t *testing.T) {
+	burnPasswordCheck("whatever")
+
+	// Unknown usernames must pay the same bcrypt cost as real accounts
+	cost, err := bcrypt.Cost(dummyHash)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	assert.Equal(t, "abcdefghij", NormalizeRecoveryCode(" ABCDE-FGHIJ "))
+	assert.Equal(t, "abcdefghij", NormalizeRecoveryCode("abcde fghij"))
+	// Hashes must match however the user typed the code
+	assert.Equal(t, hashToken(NormalizeRecoveryCode("abcde-fghij")), hashToken(NormalizeRecoveryCode("ABCDEFGHIJ")))
+}
@@ -0,0 +1,170 @@
+// Package tlsutil serves HTTPS from certificate files that can be replaced
+// on disk without a restart, optionally verifying client certificates.
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client authentication modes.
+const (
+	// ClientAuthNone does not ask for client certificates.
+	ClientAuthNone = "none"
+	// ClientAuthVerify verifies client certificates when presented, so
+	// services can authenticate with one while browsers connect without.
+	ClientAuthVerify = "verify"
+	// ClientAuthRequire refuses connections without a valid client
+	// certificate.
+	ClientAuthRequire = "require"
+)
+
+// Reloader serves a certificate and key pair from disk, picking up new files
+// when they change. It is safe for concurrent use.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// NewReloader loads the key pair, failing if it cannot.
+func NewReloader(certFile, keyFile string, logger *slog.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the key pair again if either file changed since the last
+// load, reporting whether it did. On failure the previous certificate stays
+// in use, so a half-written renewal does not take the server down.
+func (r *Reloader) Reload() (bool, error) {
+	modified, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls: %w", err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modified.Equal(r.modified)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls: loading key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modified = modified
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the files every interval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.logger.ErrorContext(ctx, "reloading certificate", "error", err)
+			} else if reloaded {
+				r.logger.InfoContext(ctx, "reloaded certificate", "cert_file", r.certFile)
+			}
+		}
+	}
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ServerConfig returns the TLS settings for serving certificates from r.
+// With a client CA file, client certificates it signed are verified as
+// clientAuth requires.
+func ServerConfig(r *Reloader, clientCAFile, clientAuth string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	switch clientAuth {
+	case "", ClientAuthNone:
+		return cfg, nil
+	case ClientAuthVerify:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls: unknown client auth mode %q", clientAuth)
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	return cfg, nil
+}
+
+// RedirectHandler sends plain HTTP requests to the same host and path over
+// HTTPS on httpsPort. Port 443 is left out of the URL.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,227 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs certificates generated at test time.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for 127.0.0.1 with the given
+// serial number, usable by servers and clients alike.
+func (ca *testCA) issue(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "chat test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeKeyPair writes a key pair and moves its modification time to at, so
+// changes are seen however coarse the filesystem's timestamps are.
+func writeKeyPair(t *testing.T, dir string, certPEM, keyPEM []byte, at time.Time) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(certFile, at, at))
+	require.NoError(t, os.Chtimes(keyFile, at, at))
+	return certFile, keyFile
+}
+
+// serveTLS serves a 204 handler with cfg and returns its URL.
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }),
+		TLSConfig: cfg,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go func() { _ = server.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func client(ca *testCA, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: ca.pool, Certificates: certs},
+	}}
+}
+
+func TestReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+
+	certPEM, keyPEM := ca.issue(t, 100)
+	certFile, keyFile := writeKeyPair(t, dir, certPEM, keyPEM, start)
+	reloader, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	cfg, err := ServerConfig(reloader, "", ClientAuthNone)
+	require.NoError(t, err)
+	url := serveTLS(t, cfg)
+
+	servedSerial := func() int64 {
+		resp, err := client(ca).Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(100), servedSerial())
+
+	reloaded, err := reloader.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files are not reloaded")
+
+	// A renewed certificate is served without restarting
+	certPEM, keyPEM = ca.issue(t, 200)
+	writeKeyPair(t, dir, certPEM, keyPEM, start.Add(time.Second))
+	reloaded, err = reloader.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, int64(200), servedSerial())
+
+	// A broken renewal keeps the last good certificate
+	writeKeyPair(t, dir, []byte("not a certificate"), keyPEM, start.Add(2*time.Second))
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, int64(200), servedSerial())
+
+	_, err = NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.Error(t, err)
+}
+
+func TestServerConfig_ClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, 1)
+	certFile, keyFile := writeKeyPair(t, dir, certPEM, keyPEM, time.Now())
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	reloader, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	clientCertPEM, clientKeyPEM := ca.issue(t, 2)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	require.NoError(t, err)
+
+	// A certificate from another CA is not trusted
+	otherCertPEM, otherKeyPEM := newTestCA(t).issue(t, 3)
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	require.NoError(t, err)
+
+	tests := []struct {
+		mode    string
+		certs   []tls.Certificate
+		allowed bool
+	}{
+		{mode: ClientAuthRequire, certs: []tls.Certificate{clientCert}, allowed: true},
+		{mode: ClientAuthRequire, allowed: false},
+		{mode: ClientAuthRequire, certs: []tls.Certificate{otherCert}, allowed: false},
+		{mode: ClientAuthVerify, allowed: true},
+		{mode: ClientAuthVerify, certs: []tls.Certificate{clientCert}, allowed: true},
+		{mode: ClientAuthVerify, certs: []tls.Certificate{otherCert}, allowed: false},
+	}
+	for _, tt := range tests {
+		cfg, err := ServerConfig(reloader, caFile, tt.mode)
+		require.NoError(t, err)
+		url := serveTLS(t, cfg)
+
+		resp, err := client(ca, tt.certs...).Get(url)
+		if tt.allowed {
+			require.NoError(t, err, tt.mode)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		} else {
+			assert.Error(t, err, tt.mode)
+		}
+	}
+
+	_, err = ServerConfig(reloader, caFile, "sometimes")
+	assert.Error(t, err)
+	_, err = ServerConfig(reloader, certFile+".missing", ClientAuthRequire)
+	assert.Error(t, err)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port     string
+		target   string
+		location string
+	}{
+		{port: "8443", target: "http://chat.example.com:8080/user.login?next=%2F", location: "https://chat.example.com:8443/user.login?next=%2F"},
+		{port: "443", target: "http://chat.example.com/", location: "https://chat.example.com/"},
+		{port: "443", target: "http://[::1]:80/healthcheck", location: "https://[::1]/healthcheck"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		RedirectHandler(tt.port).ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		assert.Equal(t, tt.location, w.Header().Get("Location"))
+	}
+}
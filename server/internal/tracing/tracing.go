@@ -0,0 +1,90 @@
+// Package tracing sets up OpenTelemetry tracing. Unless an exporter is
+// configured the provider is a no-op, so instrumented code costs next to
+// nothing by default.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Exporters.
+const (
+	// ExporterNone records nothing.
+	ExporterNone = "none"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+)
+
+// ServiceName identifies the server in exported traces.
+const ServiceName = "chat-server"
+
+// Propagator reads and writes the W3C traceparent headers that join a
+// request to its caller's trace.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Options select where spans go.
+type Options struct {
+	Exporter string
+	// Endpoint is the collector's host:port. When empty the exporter uses
+	// OTEL_EXPORTER_OTLP_ENDPOINT, or localhost:4318.
+	Endpoint string
+	// Insecure sends spans over plain HTTP.
+	Insecure bool
+	// SampleRatio is the share of new traces recorded, from 0 to 1. Traces
+	// started by a caller follow the caller's decision.
+	SampleRatio float64
+}
+
+// NewProvider returns the tracer provider opts describe. Providers that
+// export spans implement Shutdown(ctx) error, which flushes what is buffered.
+func NewProvider(ctx context.Context, opts Options) (trace.TracerProvider, error) {
+	switch opts.Exporter {
+	case "", ExporterNone:
+		return noop.NewTracerProvider(), nil
+	case ExporterOTLP:
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", opts.Exporter)
+	}
+
+	var clientOpts []otlptracehttp.Option
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	return NewSDKProvider(opts.SampleRatio, sdktrace.WithBatcher(exporter)), nil
+}
+
+// NewSDKProvider returns a recording provider sampling sampleRatio of new
+// traces. The options say where spans go, such as a tracetest.SpanRecorder
+// registered with sdktrace.WithSpanProcessor in tests.
+func NewSDKProvider(sampleRatio float64, extra ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts := append([]sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	}, extra...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Shutdown flushes and stops tp if it exports spans.
+func Shutdown(ctx context.Context, tp trace.TracerProvider) error {
+	if p, ok := tp.(interface{ Shutdown(context.Context) error }); ok {
+		return p.Shutdown(ctx)
+	}
+	return nil
+}
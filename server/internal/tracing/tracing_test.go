@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestNewProvider(t *testing.T) {
+	ctx := context.Background()
+
+	for _, exporter := range []string{"", ExporterNone} {
+		tp, err := NewProvider(ctx, Options{Exporter: exporter})
+		require.NoError(t, err)
+		assert.IsType(t, noop.TracerProvider{}, tp)
+		assert.NoError(t, Shutdown(ctx, tp))
+	}
+
+	// The exporter connects lazily, so no collector is needed here
+	tp, err := NewProvider(ctx, Options{Exporter: ExporterOTLP, Endpoint: "localhost:4318", Insecure: true, SampleRatio: 1})
+	require.NoError(t, err)
+	assert.IsType(t, &sdktrace.TracerProvider{}, tp)
+	assert.NoError(t, Shutdown(ctx, tp))
+
+	_, err = NewProvider(ctx, Options{Exporter: "jaeger"})
+	assert.Error(t, err)
+}
+
+func TestNewSDKProvider_Sampling(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := NewSDKProvider(0, sdktrace.WithSpanProcessor(rec))
+
+	// New traces are dropped at a ratio of 0
+	_, span := tp.Tracer("test").Start(context.Background(), "dropped")
+	span.End()
+	assert.Empty(t, rec.Ended())
+
+	// A caller's sampled trace is followed regardless
+	header := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	ctx := Propagator.Extract(context.Background(), propagation.HeaderCarrier(header))
+	_, span = tp.Tracer("test").Start(ctx, "kept")
+	span.End()
+	require.Len(t, rec.Ended(), 1)
+	kept := rec.Ended()[0]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", kept.SpanContext().TraceID().String())
+	assert.Contains(t, kept.Resource().Attributes(), attribute.String("service.name", ServiceName))
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"reflect"
+)
+
+// Subprotocols offered during the websocket upgrade. Clients pick an encoding
+// through Sec-WebSocket-Protocol; connections that do not ask for one get JSON.
+const (
+	JSONSubprotocol = "chat.v1.json"
+	CBORSubprotocol = "chat.v1.cbor"
+)
+
+// compressionThreshold is the smallest frame worth running through
+// permessage-deflate; tiny frames get bigger once the deflate trailer is added.
+const compressionThreshold = 512
+
+// Encoder serializes frames for a single websocket connection.
+type Encoder interface {
+	Name() string
+	FrameType() int
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Name() string                       { return JSONSubprotocol }
+func (jsonEncoder) FrameType() int                     { return websocket.TextMessage }
+func (jsonEncoder) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonEncoder) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// cborEncoder reuses the json struct tags, so WSMessage and store types need no
+// extra annotations.
+type cborEncoder struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBOREncoder() cborEncoder {
+	enc, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{DefaultMapType: mapStringAnyType}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborEncoder{enc: enc, dec: dec}
+}
+
+func (cborEncoder) Name() string                         { return CBORSubprotocol }
+func (cborEncoder) FrameType() int                       { return websocket.BinaryMessage }
+func (e cborEncoder) Marshal(v any) ([]byte, error)      { return e.enc.Marshal(v) }
+func (e cborEncoder) Unmarshal(data []byte, v any) error { return e.dec.Unmarshal(data, v) }
+
+var mapStringAnyType = reflect.TypeOf(map[string]any(nil))
+
+var (
+	JSONEncoder Encoder = jsonEncoder{}
+	CBOREncoder Encoder = newCBOREncoder()
+)
+
+// Subprotocols lists the encodings the server accepts, in order of preference.
+func Subprotocols() []string {
+	return []string{CBORSubprotocol, JSONSubprotocol}
+}
+
+// EncoderForSubprotocol returns the encoder negotiated for a connection,
+// falling back to JSON when the client did not request a subprotocol.
+func EncoderForSubprotocol(subprotocol string) Encoder {
+	switch subprotocol {
+	case CBORSubprotocol:
+		return CBOREncoder
+	default:
+		return JSONEncoder
+	}
+}
+
+func WriteWebsocketMessage(conn *websocket.Conn, enc Encoder, data any, logger *slog.Logger) error {
+	payload, err := enc.Marshal(data)
+	if err != nil {
+		logger.Error("encoding message", "error", err)
+		return err
+	}
+
+	conn.EnableWriteCompression(len(payload) >= compressionThreshold)
+	err = conn.WriteMessage(enc.FrameType(), payload)
+	if err != nil {
+		logger.Error("writing message", "error", err)
+		return err
+	}
+	return nil
+}
+
+func ReadWebsocketMessage(conn *websocket.Conn, enc Encoder, v any) error {
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return enc.Unmarshal(payload, v)
+}
@@ -2,8 +2,6 @@ package utils
 
 import (
 	"encoding/json"
-	"github.com/gorilla/websocket"
-	"log"
 	"net/http"
 )
 
@@ -24,12 +22,3 @@ func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 	}
 	return nil
 }
-
-func WriteWebsocketMessage(conn *websocket.Conn, data any, logger *log.Logger) error {
-	err := conn.WriteJSON(data)
-	if err != nil {
-		logger.Printf("ERROR: writing message: %v", err)
-		return err
-	}
-	return nil
-}
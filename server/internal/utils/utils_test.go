@@ -2,7 +2,7 @@ package utils
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -97,7 +97,7 @@ func TestWriteWebsocketMessage(t *testing.T) {
 	// We'll test the function with a mock connection
 
 	// Create a test logger
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	// Test data to send
 	testData := map[string]interface{}{
@@ -122,7 +122,7 @@ func TestWriteWebsocketMessage(t *testing.T) {
 		defer conn.Close()
 
 		// Write message using our function
-		err = WriteWebsocketMessage(conn, testData, logger)
+		err = WriteWebsocketMessage(conn, JSONEncoder, testData, logger)
 		if err != nil {
 			t.Errorf("WriteWebsocketMessage failed: %v", err)
 		}
@@ -143,7 +143,7 @@ func TestWriteWebsocketMessage(t *testing.T) {
 
 func TestWriteWebsocketMessageError(t *testing.T) {
 	// Create a test logger
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	// Create a test server for websocket
 	done := make(chan bool)
@@ -164,7 +164,7 @@ func TestWriteWebsocketMessageError(t *testing.T) {
 
 		// Try to write to closed connection
 		testData := map[string]interface{}{"test": "data"}
-		err = WriteWebsocketMessage(conn, testData, logger)
+		err = WriteWebsocketMessage(conn, JSONEncoder, testData, logger)
 		if err == nil {
 			t.Error("Expected error when writing to closed connection")
 		}
@@ -183,6 +183,99 @@ func TestWriteWebsocketMessageError(t *testing.T) {
 	<-done
 }
 
+func TestEncoderForSubprotocol(t *testing.T) {
+	assert.Equal(t, JSONEncoder, EncoderForSubprotocol(""))
+	assert.Equal(t, JSONEncoder, EncoderForSubprotocol(JSONSubprotocol))
+	assert.Equal(t, CBOREncoder, EncoderForSubprotocol(CBORSubprotocol))
+	assert.Equal(t, JSONEncoder, EncoderForSubprotocol("unknown"))
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	type frame struct {
+		Type       string `json:"type"`
+		ReceiverID int    `json:"receiver_id,omitempty"`
+		Content    string `json:"content,omitempty"`
+	}
+
+	for _, enc := range []Encoder{JSONEncoder, CBOREncoder} {
+		t.Run(enc.Name(), func(t *testing.T) {
+			in := frame{Type: "send_message", ReceiverID: 7, Content: "héllo 👋"}
+
+			payload, err := enc.Marshal(in)
+			require.NoError(t, err)
+
+			var out frame
+			require.NoError(t, enc.Unmarshal(payload, &out))
+			assert.Equal(t, in, out)
+
+			// Untyped decoding must produce string-keyed maps for both encodings
+			var generic map[string]any
+			require.NoError(t, enc.Unmarshal(payload, &generic))
+			assert.Equal(t, "send_message", generic["type"])
+		})
+	}
+}
+
+func TestCBOREncoderIsSmallerThanJSON(t *testing.T) {
+	history := make([]map[string]any, 50)
+	for i := range history {
+		history[i] = map[string]any{"id": i, "sender_id": 1, "receiver_id": 2, "content": "hello there"}
+	}
+
+	jsonPayload, err := JSONEncoder.Marshal(history)
+	require.NoError(t, err)
+	cborPayload, err := CBOREncoder.Marshal(history)
+	require.NoError(t, err)
+
+	assert.Less(t, len(cborPayload), len(jsonPayload))
+}
+
+func TestWebsocketSubprotocolNegotiation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{
+			CheckOrigin:       func(r *http.Request) bool { return true },
+			Subprotocols:      Subprotocols(),
+			EnableCompression: true,
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		enc := EncoderForSubprotocol(conn.Subprotocol())
+		var msg map[string]any
+		if err := ReadWebsocketMessage(conn, enc, &msg); err != nil {
+			return
+		}
+		_ = WriteWebsocketMessage(conn, enc, msg, logger)
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{
+		Subprotocols:      []string{CBORSubprotocol},
+		EnableCompression: true,
+	}
+	conn, _, err := dialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, CBORSubprotocol, conn.Subprotocol())
+
+	require.NoError(t, WriteWebsocketMessage(conn, CBOREncoder, map[string]any{"type": "ping"}, logger))
+
+	frameType, payload, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+
+	var echoed map[string]any
+	require.NoError(t, CBOREncoder.Unmarshal(payload, &echoed))
+	assert.Equal(t, "ping", echoed["type"])
+}
+
 func BenchmarkWriteJSON(b *testing.B) {
 	data := Envelope{
 		"message": "test message",
@@ -2,37 +2,142 @@ package main
 
 import (
 	"chat/internal/app"
+	"chat/internal/config"
+	"chat/internal/tlsutil"
 	"chat/routes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/joho/godotenv"
 )
 
 func main() {
-	var port int
-	flag.IntVar(&port, "port", 8080, "go server port")
-	flag.Parse()
+	// A .env file in the working directory, mostly used in development,
+	// adds to the environment without overriding it
+	envErr := godotenv.Load()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	application, err := app.NewApplication()
+	application, err := app.NewApplication(cfg)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	slog.SetDefault(application.Logger)
+	if envErr != nil && !errors.Is(envErr, fs.ErrNotExist) {
+		application.Logger.Warn("reading .env file", "error", envErr)
 	}
-	defer application.DB.Close()
 
 	r := routes.SetupRoutes(application)
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         cfg.Addr,
 		Handler:      r,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	application.Logger.Printf("Starting server on port %d", port)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = server.ListenAndServe()
-	if err != nil {
-		application.Logger.Fatalf("ERROR: Server error %v", err)
+	if cfg.TLS.Enabled() {
+		reloader, err := tlsutil.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, application.Logger)
+		if err != nil {
+			fatal(application.Logger, "configuring TLS", err)
+		}
+		server.TLSConfig, err = tlsutil.ServerConfig(reloader, cfg.TLS.ClientCAFile, cfg.TLS.ClientAuth)
+		if err != nil {
+			fatal(application.Logger, "configuring TLS", err)
+		}
+		go reloader.Watch(ctx, cfg.TLS.ReloadInterval)
+	}
+
+	serveErr := make(chan error, 3)
+	go func() {
+		application.Logger.Info("starting server", "addr", cfg.Addr)
+		if cfg.TLS.Enabled() {
+			// Certificates come from server.TLSConfig
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	var redirect *http.Server
+	if cfg.TLS.RedirectAddr != "" {
+		_, httpsPort, _ := net.SplitHostPort(cfg.Addr)
+		redirect = &http.Server{
+			Addr:              cfg.TLS.RedirectAddr,
+			Handler:           tlsutil.RedirectHandler(httpsPort),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			application.Logger.Info("redirecting HTTP to HTTPS", "addr", cfg.TLS.RedirectAddr)
+			serveErr <- redirect.ListenAndServe()
+		}()
+	}
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsServer = &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           routes.SetupMetricsRoutes(application),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			application.Logger.Info("serving metrics", "addr", cfg.MetricsAddr)
+			serveErr <- metricsServer.ListenAndServe()
+		}()
 	}
+
+	select {
+	case err := <-serveErr:
+		fatal(application.Logger, "server error", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process instead of waiting
+	stop()
+
+	application.Logger.Info("shutting down", "timeout", cfg.Shutdown.Timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+	if redirect != nil {
+		_ = redirect.Shutdown(shutdownCtx)
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Shutdown(shutdownCtx)
+	}
+	if err := application.Shutdown(shutdownCtx, server); err != nil {
+		application.Logger.Error("shutting down", "error", err)
+		cancel()
+		os.Exit(1)
+	}
+	application.Logger.Info("server stopped")
+}
+
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"chat/internal/config"
+	"chat/internal/migrations"
+	"chat/internal/store"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const migrateUsage = `usage: chat migrate up|down|status|redo [flags]
+       chat migrate to VERSION [flags]
+
+Flags are those of the server, such as -db-dsn and -config.`
+
+// runMigrate runs the migrate subcommand with the arguments following
+// "migrate" and returns the exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	command, args := args[0], args[1:]
+	var commandArgs []string
+	switch command {
+	case store.MigrateUp, store.MigrateDown, store.MigrateStatus, store.MigrateRedo:
+	case store.MigrateTo:
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			return 2
+		}
+		commandArgs, args = args[:1], args[1:]
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	cfg, err := config.Load(args, os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	db, err := store.Open(cfg.Database.DSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := store.MigrateFS(ctx, db, migrations.FS, ".", command, commandArgs...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
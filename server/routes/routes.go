@@ -1,7 +1,10 @@
 package routes
 
 import (
+	"chat/internal/api"
 	"chat/internal/app"
+	"chat/internal/metrics"
+	"chat/internal/rbac"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 )
@@ -9,21 +12,101 @@ import (
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
 
+	r.Use(api.RealIP(app.TrustedProxies))
+	r.Use(api.RequestID)
+	r.Use(api.Tracing(app.TracerProvider))
+	r.Use(api.HTTPMetrics(app.Metrics))
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowedOrigins:   app.Config.CORS.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		ExposedHeaders:   []string{"*"},
-		AllowCredentials: true,
+		AllowCredentials: app.Config.CORS.AllowCredentials,
 		MaxAge:           300,
 	}))
 
-	r.Get("/healthcheck", app.HealthCheck)
-	r.Post("/user.register", app.UserHandler.Register)
-	r.Post("/user.login", app.UserHandler.Login)
-	r.Get("/user.get", app.UserHandler.GetUsers)
-	r.Get("/user.get.me", app.UserHandler.GetMeUser)
-	r.Get("/chat/ws", app.WebSocketHandler.HandleWebSocket)
+	// Probes come from the orchestrator, which has no session, and must
+	// answer however busy the server is
+	r.Get("/livez", app.Health.Livez)
+	r.Get("/readyz", app.Health.Readyz)
 
+	// Streaming connections stay open for as long as the client wants
+	r.Group(func(r chi.Router) {
+		r.Use(app.Authenticator.Middleware)
+		r.Use(api.RateLimit(app.RateLimiter))
+		r.Get("/chat/ws", app.WebSocketHandler.HandleWebSocket)
+		r.Get("/chat/events", app.WebSocketHandler.HandleEventStream)
+		r.Get("/chat/poll", app.WebSocketHandler.HandleLongPoll)
+	})
+
+	// The deadline also covers the session lookup and rate limit store
+	r.Group(func(r chi.Router) {
+		r.Use(api.Timeout(app.Config.RequestTimeout))
+		r.Use(app.Authenticator.Middleware)
+		r.Use(api.RateLimit(app.RateLimiter))
+		r.Get("/healthcheck", app.HealthCheck)
+		r.Post("/user.register", app.UserHandler.Register)
+		r.Post("/user.login", app.UserHandler.Login)
+		r.Post("/user.login.mfa", app.MFAHandler.Login)
+		r.Post("/user.logout", app.UserHandler.Logout)
+		r.Post("/user.mfa.enroll", app.MFAHandler.Enroll)
+		r.Post("/user.mfa.verify", app.MFAHandler.Verify)
+		r.Post("/user.mfa.disable", app.MFAHandler.Disable)
+		r.Post("/user.password.change", app.PasswordHandler.Change)
+		r.Post("/user.password.reset.request", app.PasswordHandler.RequestReset)
+		r.Post("/user.password.reset.confirm", app.PasswordHandler.ConfirmReset)
+		r.Get("/auth.oidc.providers", app.SSOHandler.Providers)
+		r.Get("/auth.oidc.start", app.SSOHandler.Start)
+		r.Get("/auth.oidc.callback", app.SSOHandler.Callback)
+		r.Get("/auth.oidc.link", app.SSOHandler.Link)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.Authenticator.Require(rbac.PermManageUsers))
+			r.Get("/admin.user.list", app.AdminHandler.ListUsers)
+			r.Post("/admin.user.disable", app.AdminHandler.DisableUser)
+			r.Post("/admin.user.enable", app.AdminHandler.EnableUser)
+			r.Post("/admin.user.delete", app.AdminHandler.DeleteUser)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(app.Authenticator.Require(rbac.PermManageRoles))
+			r.Post("/admin.user.role", app.AdminHandler.SetRole)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(app.Authenticator.Require(rbac.PermModerate))
+			r.Get("/moderation.report.list", app.ModerationHandler.ListReports)
+			r.Post("/moderation.report.action", app.ModerationHandler.Action)
+			r.Post("/moderation.report.dismiss", app.ModerationHandler.Dismiss)
+		})
+
+		r.Get("/user.get", app.UserHandler.GetUsers)
+		r.Get("/user.get.me", app.UserHandler.GetMeUser)
+		r.Get("/user.search", app.UserHandler.Search)
+		r.Post("/user.discoverable", app.UserHandler.SetDiscoverable)
+		r.Post("/user.block", app.RelationHandler.Block)
+		r.Post("/user.unblock", app.RelationHandler.Unblock)
+		r.Get("/user.blocks", app.RelationHandler.GetBlocked)
+		r.Post("/user.mute", app.RelationHandler.Mute)
+		r.Post("/user.unmute", app.RelationHandler.Unmute)
+		r.Get("/user.mutes", app.RelationHandler.GetMuted)
+		r.Post("/user.update", app.ProfileHandler.Update)
+		r.Post("/user.avatar.upload", app.ProfileHandler.UploadAvatar)
+		r.Get("/user.avatar", app.ProfileHandler.Avatar)
+		r.Post("/message.send", app.MessageHandler.Send)
+		r.Get("/message.history", app.MessageHandler.History)
+		r.Post("/message.report", app.ModerationHandler.Report)
+		r.Get("/conversation.list", app.MessageHandler.ListConversations)
+		r.Post("/conversation.read", app.MessageHandler.MarkRead)
+		r.Post("/chat/send", app.WebSocketHandler.HandleSendFrame)
+	})
+
+	return r
+}
+
+// SetupMetricsRoutes serves /metrics, for the separate metrics listener.
+// Metrics name routes and internals that the public address should not
+// expose.
+func SetupMetricsRoutes(app *app.Application) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/metrics", metrics.Handler(app.Registry).ServeHTTP)
 	return r
 }
@@ -1,18 +1,29 @@
 package routes
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"chat/internal/api"
 	"chat/internal/app"
+	"chat/internal/config"
+	"chat/internal/credentials"
+	"chat/internal/health"
+	"chat/internal/mail"
+	"chat/internal/metrics"
+	"chat/internal/ratelimit"
 	"chat/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 var ErrUserNotFound = errors.New("user not found")
@@ -22,12 +33,12 @@ type MockUserStore struct {
 	mock.Mock
 }
 
-func (m *MockUserStore) CreateUser(user *store.User) error {
+func (m *MockUserStore) CreateUser(_ context.Context, user *store.User) error {
 	args := m.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockUserStore) GetUserByID(id int) (*store.User, error) {
+func (m *MockUserStore) GetUserByID(_ context.Context, id int) (*store.User, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -35,7 +46,7 @@ func (m *MockUserStore) GetUserByID(id int) (*store.User, error) {
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
-func (m *MockUserStore) GetUserByUsername(username string) (*store.User, error) {
+func (m *MockUserStore) GetUserByUsername(_ context.Context, username string) (*store.User, error) {
 	args := m.Called(username)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -43,7 +54,20 @@ func (m *MockUserStore) GetUserByUsername(username string) (*store.User, error)
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
-func (m *MockUserStore) GetUsersExcept(excludeUserID int) ([]*store.User, error) {
+func (m *MockUserStore) GetUserByEmail(_ context.Context, email string) (*store.User, error) {
+	args := m.Called(email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) UpdatePassword(_ context.Context, userID int, passwordHash string) error {
+	args := m.Called(userID, passwordHash)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) GetUsersExcept(_ context.Context, excludeUserID int) ([]*store.User, error) {
 	args := m.Called(excludeUserID)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -51,6 +75,43 @@ func (m *MockUserStore) GetUsersExcept(excludeUserID int) ([]*store.User, error)
 	return args.Get(0).([]*store.User), args.Error(1)
 }
 
+func (m *MockUserStore) SearchUsers(_ context.Context, search store.UserSearch) (*store.UserPage, error) {
+	args := m.Called(search)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.UserPage), args.Error(1)
+}
+
+func (m *MockUserStore) SetDiscoverable(_ context.Context, userID int, discoverable bool) error {
+	args := m.Called(userID, discoverable)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) UpdateProfile(_ context.Context, userID int, update store.ProfileUpdate) (*store.User, error) {
+	args := m.Called(userID, update)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) SetAvatar(_ context.Context, userID int, contentType string, data []byte) (*store.User, error) {
+	args := m.Called(userID, contentType, data)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockUserStore) GetAvatar(_ context.Context, userID int) (string, []byte, error) {
+	args := m.Called(userID)
+	if args.Get(1) == nil {
+		return args.String(0), nil, args.Error(2)
+	}
+	return args.String(0), args.Get(1).([]byte), args.Error(2)
+}
+
 func (m *MockUserStore) HashPassword(password string) (string, error) {
 	args := m.Called(password)
 	return args.String(0), args.Error(1)
@@ -61,7 +122,7 @@ func (m *MockUserStore) CheckPassword(hashedPassword, password string) error {
 	return args.Error(0)
 }
 
-func (m *MockUserStore) AuthenticateUser(username, password string) (*store.User, error) {
+func (m *MockUserStore) AuthenticateUser(_ context.Context, username, password string) (*store.User, error) {
 	args := m.Called(username, password)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -69,12 +130,35 @@ func (m *MockUserStore) AuthenticateUser(username, password string) (*store.User
 	return args.Get(0).(*store.User), args.Error(1)
 }
 
+func (m *MockUserStore) ListUsers(_ context.Context, list store.UserList) (*store.UserPage, error) {
+	args := m.Called(list)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.UserPage), args.Error(1)
+}
+
+func (m *MockUserStore) SetRole(_ context.Context, userID int, role string) error {
+	args := m.Called(userID, role)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) SetDisabled(_ context.Context, userID int, disabled bool) error {
+	args := m.Called(userID, disabled)
+	return args.Error(0)
+}
+
+func (m *MockUserStore) DeleteUser(_ context.Context, userID int) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
 // MockMessageStore for testing
 type MockMessageStore struct {
 	mock.Mock
 }
 
-func (m *MockMessageStore) CreateMessage(senderID, receiverID int, content string) (*store.Message, error) {
+func (m *MockMessageStore) CreateMessage(_ context.Context, senderID, receiverID int, content string) (*store.Message, error) {
 	args := m.Called(senderID, receiverID, content)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -82,7 +166,7 @@ func (m *MockMessageStore) CreateMessage(senderID, receiverID int, content strin
 	return args.Get(0).(*store.Message), args.Error(1)
 }
 
-func (m *MockMessageStore) GetMessagesBetweenUsers(userID1, userID2 int) ([]*store.Message, error) {
+func (m *MockMessageStore) GetMessagesBetweenUsers(_ context.Context, userID1, userID2 int) ([]*store.Message, error) {
 	args := m.Called(userID1, userID2)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -90,26 +174,305 @@ func (m *MockMessageStore) GetMessagesBetweenUsers(userID1, userID2 int) ([]*sto
 	return args.Get(0).([]*store.Message), args.Error(1)
 }
 
+func (m *MockMessageStore) GetMessagesPage(_ context.Context, userID1, userID2, beforeID, limit int) ([]*store.Message, error) {
+	args := m.Called(userID1, userID2, beforeID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Message), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversations(_ context.Context, userID int) ([]*store.Conversation, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Conversation), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversation(_ context.Context, userID, otherUserID int) (*store.Conversation, error) {
+	args := m.Called(userID, otherUserID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Conversation), args.Error(1)
+}
+
+func (m *MockMessageStore) GetConversationPartnerIDs(_ context.Context, userID int) ([]int, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]int), args.Error(1)
+}
+
+func (m *MockMessageStore) MarkConversationRead(_ context.Context, readerID, otherUserID int) (int, error) {
+	args := m.Called(readerID, otherUserID)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockMessageStore) DeleteMessage(_ context.Context, messageID int) error {
+	args := m.Called(messageID)
+	return args.Error(0)
+}
+
+// MockSessionStore is a mock implementation of store.SessionStore
+type MockSessionStore struct {
+	mock.Mock
+}
+
+func (m *MockSessionStore) CreateSession(_ context.Context, userID int, ttl time.Duration) (string, *store.Session, error) {
+	args := m.Called(userID, ttl)
+	if args.Get(1) == nil {
+		return args.String(0), nil, args.Error(2)
+	}
+	return args.String(0), args.Get(1).(*store.Session), args.Error(2)
+}
+
+func (m *MockSessionStore) GetSession(_ context.Context, token string) (*store.Session, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Session), args.Error(1)
+}
+
+func (m *MockSessionStore) RevokeSession(_ context.Context, sessionID int) error {
+	return m.Called(sessionID).Error(0)
+}
+
+func (m *MockSessionStore) RevokeOtherSessions(_ context.Context, userID, keepSessionID int) error {
+	return m.Called(userID, keepSessionID).Error(0)
+}
+
+func (m *MockSessionStore) CreatePasswordReset(_ context.Context, userID int, ttl time.Duration) (string, error) {
+	args := m.Called(userID, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockSessionStore) GetPasswordReset(_ context.Context, token string) (int, error) {
+	args := m.Called(token)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockSessionStore) ConsumePasswordReset(_ context.Context, token string) (int, error) {
+	args := m.Called(token)
+	return args.Int(0), args.Error(1)
+}
+
+// MockAuditStore is a mock implementation of store.AuditStore
+type MockAuditStore struct {
+	mock.Mock
+}
+
+func (m *MockAuditStore) RecordEvent(_ context.Context, event *store.AuditEvent) error {
+	return m.Called(event).Error(0)
+}
+
+// MockMFAStore is a mock implementation of store.MFAStore
+type MockMFAStore struct {
+	mock.Mock
+}
+
+func (m *MockMFAStore) GetMFA(_ context.Context, userID int) (*store.MFA, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.MFA), args.Error(1)
+}
+
+func (m *MockMFAStore) SetPendingMFA(_ context.Context, userID int, secret string) error {
+	return m.Called(userID, secret).Error(0)
+}
+
+func (m *MockMFAStore) EnableMFA(_ context.Context, userID int, step int64, recoveryCodes []string) error {
+	return m.Called(userID, step, recoveryCodes).Error(0)
+}
+
+func (m *MockMFAStore) DisableMFA(_ context.Context, userID int) error {
+	return m.Called(userID).Error(0)
+}
+
+func (m *MockMFAStore) UseTOTPStep(_ context.Context, userID int, step int64) (bool, error) {
+	args := m.Called(userID, step)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockMFAStore) UseRecoveryCode(_ context.Context, userID int, code string) (bool, error) {
+	args := m.Called(userID, code)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockMFAStore) CreateMFAChallenge(_ context.Context, userID int, ttl time.Duration) (string, error) {
+	args := m.Called(userID, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockMFAStore) GetMFAChallenge(_ context.Context, token string) (*store.MFAChallenge, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.MFAChallenge), args.Error(1)
+}
+
+func (m *MockMFAStore) FailMFAChallenge(_ context.Context, challengeID int) error {
+	return m.Called(challengeID).Error(0)
+}
+
+func (m *MockMFAStore) ConsumeMFAChallenge(_ context.Context, challengeID int) error {
+	return m.Called(challengeID).Error(0)
+}
+
+// MockIdentityStore is a mock implementation of store.IdentityStore
+type MockIdentityStore struct {
+	mock.Mock
+}
+
+func (m *MockIdentityStore) CreateOIDCState(_ context.Context, state *store.OIDCState, ttl time.Duration) (string, error) {
+	args := m.Called(state, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockIdentityStore) ConsumeOIDCState(_ context.Context, token string) (*store.OIDCState, error) {
+	args := m.Called(token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.OIDCState), args.Error(1)
+}
+
+func (m *MockIdentityStore) GetUserByIdentity(_ context.Context, provider, subject string) (*store.User, error) {
+	args := m.Called(provider, subject)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.User), args.Error(1)
+}
+
+func (m *MockIdentityStore) LinkIdentity(_ context.Context, identity *store.Identity) error {
+	return m.Called(identity).Error(0)
+}
+
+// MockRelationStore implements the RelationStore interface for testing
+type MockRelationStore struct {
+	mock.Mock
+}
+
+func (m *MockRelationStore) AddRelation(_ context.Context, relation store.Relation, userID, targetID int) error {
+	return m.Called(relation, userID, targetID).Error(0)
+}
+
+func (m *MockRelationStore) RemoveRelation(_ context.Context, relation store.Relation, userID, targetID int) error {
+	return m.Called(relation, userID, targetID).Error(0)
+}
+
+func (m *MockRelationStore) GetRelations(_ context.Context, relation store.Relation, userID int) ([]*store.User, error) {
+	args := m.Called(relation, userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.User), args.Error(1)
+}
+
+func (m *MockRelationStore) IsBlockedBetween(_ context.Context, userID, otherUserID int) (bool, error) {
+	args := m.Called(userID, otherUserID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRelationStore) IsMuted(_ context.Context, userID, targetID int) (bool, error) {
+	args := m.Called(userID, targetID)
+	return args.Bool(0), args.Error(1)
+}
+
+// MockReportStore implements the ReportStore interface for testing
+type MockReportStore struct {
+	mock.Mock
+}
+
+func (m *MockReportStore) CreateReport(_ context.Context, messageID, reporterID int, reason string) (*store.Report, error) {
+	args := m.Called(messageID, reporterID, reason)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) GetReport(_ context.Context, reportID int) (*store.Report, error) {
+	args := m.Called(reportID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) ListReports(_ context.Context, status string, afterID, limit int) ([]*store.Report, error) {
+	args := m.Called(status, afterID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*store.Report), args.Error(1)
+}
+
+func (m *MockReportStore) ResolveReport(_ context.Context, reportID, moderatorID int, status, action string) error {
+	return m.Called(reportID, moderatorID, status, action).Error(0)
+}
+
+func (m *MockReportStore) ReopenReport(_ context.Context, reportID int) error {
+	return m.Called(reportID).Error(0)
+}
+
 func createTestApplication() *app.Application {
-	logger := log.New(os.Stdout, "TEST: ", log.LstdFlags)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	// Create mock stores
 	userStore := &MockUserStore{}
 	messageStore := &MockMessageStore{}
+	sessionStore := &MockSessionStore{}
+	mfaStore := &MockMFAStore{}
+	relationStore := &MockRelationStore{}
 
 	// Set up basic mock expectations to avoid panics
 	userStore.On("GetUserByID", mock.AnythingOfType("int")).Return(nil, ErrUserNotFound).Maybe()
 	userStore.On("GetUsersExcept", mock.AnythingOfType("int")).Return([]*store.User{}, nil).Maybe()
 
 	// Create handlers with mocks
-	userHandler := api.NewUserHandler(userStore, logger)
-	webSocketHandler := api.NewWebSocketHandler(messageStore, userStore, logger)
+	loginGuard := api.NewLoginGuard(&MockAuditStore{}, logger)
+	userHandler := api.NewUserHandler(userStore, sessionStore, mfaStore, credentials.DefaultPolicy(), loginGuard, logger)
+	webSocketHandler := api.NewWebSocketHandler(messageStore, userStore, relationStore, logger)
+	messageHandler := api.NewMessageHandler(messageStore, userStore, webSocketHandler, logger)
+	profileHandler := api.NewProfileHandler(userStore, messageStore, webSocketHandler, logger)
+	passwordHandler := api.NewPasswordHandler(userStore, sessionStore, mail.NewLogMailer(logger), credentials.DefaultPolicy(), loginGuard, webSocketHandler, "http://localhost/reset", logger)
+
+	cfg := config.Default()
+	cfg.CORS.AllowedOrigins = []string{"http://example.com"}
+	registry := prometheus.NewRegistry()
+	appMetrics := metrics.New(registry)
+	webSocketHandler.SetMetrics(appMetrics)
+	checker := health.NewChecker(time.Second, logger)
+	checker.Add("websocket_hub", webSocketHandler.Ready)
 
 	return &app.Application{
-		Logger:           logger,
-		DB:               nil, // Not needed for route testing
-		UserHandler:      userHandler,
-		WebSocketHandler: webSocketHandler,
+		Config:            cfg,
+		Logger:            logger,
+		DB:                nil, // Not needed for route testing
+		Registry:          registry,
+		Metrics:           appMetrics,
+		TracerProvider:    noop.NewTracerProvider(),
+		Health:            checker,
+		UserHandler:       userHandler,
+		WebSocketHandler:  webSocketHandler,
+		MessageHandler:    messageHandler,
+		ProfileHandler:    profileHandler,
+		PasswordHandler:   passwordHandler,
+		MFAHandler:        api.NewMFAHandler(userStore, sessionStore, mfaStore, loginGuard, logger),
+		AdminHandler:      api.NewAdminHandler(userStore, sessionStore, &MockAuditStore{}, webSocketHandler, logger),
+		RelationHandler:   api.NewRelationHandler(relationStore, userStore, webSocketHandler, logger),
+		ModerationHandler: api.NewModerationHandler(&MockReportStore{}, messageStore, userStore, sessionStore, &MockAuditStore{}, webSocketHandler, logger),
+		SSOHandler:        api.NewSSOHandler(nil, userStore, sessionStore, &MockIdentityStore{}, mfaStore, credentials.DefaultPolicy(), "http://localhost/login/callback", logger),
+		Authenticator:     api.NewAuthenticator(sessionStore, userStore, logger),
+		RateLimiter:       ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.DefaultLimits(), logger),
 	}
 }
 
@@ -135,6 +498,69 @@ func TestHealthCheckRoute(t *testing.T) {
 	assert.Contains(t, w.Body.String(), `"OK"`)
 }
 
+func TestProbeRoutes(t *testing.T) {
+	app := createTestApplication()
+	router := SetupRoutes(app)
+
+	probe := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := probe("/livez")
+	assert.Equal(t, http.StatusOK, code)
+	code, body := probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"status": "ready"`)
+
+	// Draining takes the server out of rotation but leaves it live
+	require.NoError(t, app.WebSocketHandler.Shutdown(context.Background(), time.Second))
+	code, body = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "draining connections")
+	code, _ = probe("/livez")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestProbeRoutes_SkipAuthAndRateLimit(t *testing.T) {
+	app := createTestApplication()
+	app.RateLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		ratelimit.HTTPDefault: {Requests: 1, Per: time.Hour},
+	}, app.Logger)
+	router := SetupRoutes(app)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, get("/healthcheck"))
+	assert.Equal(t, http.StatusTooManyRequests, get("/healthcheck"))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get("/livez"))
+		assert.Equal(t, http.StatusOK, get("/readyz"))
+	}
+}
+
+func TestMetricsRoute(t *testing.T) {
+	app := createTestApplication()
+	router := SetupRoutes(app)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+
+	// Metrics are only on their own listener
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	SetupMetricsRoutes(app).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `chat_http_requests_total{method="GET",route="/healthcheck",status="200"} 1`)
+}
+
 func TestCORSHeaders(t *testing.T) {
 	app := createTestApplication()
 	router := SetupRoutes(app)
@@ -194,6 +620,102 @@ func TestRouteEndpoints(t *testing.T) {
 			path:           "/user.get.me",
 			expectedStatus: http.StatusBadRequest, // Will fail due to missing user_id, but route exists
 		},
+		{
+			name:           "send message endpoint exists",
+			method:         http.MethodPost,
+			path:           "/message.send",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "message history endpoint exists",
+			method:         http.MethodGet,
+			path:           "/message.history",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "conversation list endpoint exists",
+			method:         http.MethodGet,
+			path:           "/conversation.list",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "conversation read endpoint exists",
+			method:         http.MethodPost,
+			path:           "/conversation.read",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "password change endpoint exists",
+			method:         http.MethodPost,
+			path:           "/user.password.change",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "password reset request endpoint exists",
+			method:         http.MethodPost,
+			path:           "/user.password.reset.request",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "password reset confirm endpoint exists",
+			method:         http.MethodPost,
+			path:           "/user.password.reset.confirm",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "sso providers endpoint exists",
+			method:         http.MethodGet,
+			path:           "/auth.oidc.providers",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "sso callback endpoint exists",
+			method:         http.MethodGet,
+			path:           "/auth.oidc.callback",
+			expectedStatus: http.StatusFound,
+		},
+		{
+			name:           "admin user list requires a session",
+			method:         http.MethodGet,
+			path:           "/admin.user.list",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "admin user disable requires a session",
+			method:         http.MethodPost,
+			path:           "/admin.user.disable",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "admin role change requires a session",
+			method:         http.MethodPost,
+			path:           "/admin.user.role",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "report endpoint exists",
+			method:         http.MethodPost,
+			path:           "/message.report",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "moderation queue requires a session",
+			method:         http.MethodGet,
+			path:           "/moderation.report.list",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "block endpoint exists",
+			method:         http.MethodPost,
+			path:           "/user.block",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "block list endpoint exists",
+			method:         http.MethodGet,
+			path:           "/user.blocks",
+			expectedStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -249,10 +771,9 @@ func TestWebSocketRoute(t *testing.T) {
 
 	router.ServeHTTP(w, req)
 
-	// Should not be 404 (route exists)
+	// Should not be 404 (route exists); without a session it is refused
 	assert.NotEqual(t, http.StatusNotFound, w.Code)
-	// Will likely be 400 or 426 due to missing WebSocket headers
-	assert.True(t, w.Code == http.StatusBadRequest || w.Code == http.StatusUpgradeRequired)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestRouteWithQueryParams(t *testing.T) {
@@ -316,5 +837,41 @@ func TestRouterMiddleware(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	// Should have CORS headers
-	assert.NotEmpty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Origins that are not configured get none
+	req = httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+	req.Header.Set("Origin", "http://evil.test")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+// deadlineSessionStore records whether each session lookup had a deadline.
+type deadlineSessionStore struct {
+	*MockSessionStore
+	deadlines []bool
+}
+
+func (s *deadlineSessionStore) GetSession(ctx context.Context, _ string) (*store.Session, error) {
+	_, ok := ctx.Deadline()
+	s.deadlines = append(s.deadlines, ok)
+	return nil, store.ErrInvalidToken
+}
+
+func TestRequestTimeoutCoversAuthentication(t *testing.T) {
+	app := createTestApplication()
+	sessions := &deadlineSessionStore{MockSessionStore: &MockSessionStore{}}
+	app.Authenticator = api.NewAuthenticator(sessions, &MockUserStore{}, app.Logger)
+	router := SetupRoutes(app)
+
+	for _, path := range []string{"/user.get.me", "/chat/ws"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer expired")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+	}
+	assert.Equal(t, []bool{true, false}, sessions.deadlines, "streaming routes have no deadline")
 }